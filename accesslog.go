@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+)
+
+type accessContextKey struct{}
+
+// What the access log records of a request besides its response
+type accessEntry struct {
+	job   string // Job the request created or asked about
+	route string // Pattern of the handler that answered it
+}
+
+// Log every request once it's answered: method, path, status, duration, and
+// bytes read and written, with the job it concerns when there is one, and
+// count it in the /metrics histograms. WebSocket connections are logged when
+// they close, with status 101 and without the bytes sent over them.
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessEntry{}
+		recorder := &accessRecorder{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		r = r.WithContext(context.WithValue(r.Context(), accessContextKey{}, entry))
+		r.Body = body
+		defer func() {
+			status := recorder.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			duration := time.Since(start)
+			httpMetrics.observe(entry.route, status, duration, body.n, recorder.written)
+			if !config.Logging.Access {
+				return
+			}
+			job := ""
+			if entry.job != "" {
+				job = " job=" + entry.job
+			}
+			log.Printf("%s %s %d %s in=%d out=%d%s", r.Method, r.URL.Path, status,
+				duration.Round(time.Millisecond), body.n, recorder.written, job)
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// Name the job a request concerns in its access log entry
+func noteRequestJob(r *http.Request, id string) {
+	if entry, ok := r.Context().Value(accessContextKey{}).(*accessEntry); ok {
+		entry.job = id
+	}
+}
+
+// Counts what is read of a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Remembers the status and size of a response, and passes on flushing and
+// hijacking for streamed responses and WebSocket upgrades
+type accessRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (a *accessRecorder) WriteHeader(status int) {
+	if a.status == 0 {
+		a.status = status
+	}
+	a.ResponseWriter.WriteHeader(status)
+}
+
+func (a *accessRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.written += int64(n)
+	return n, err
+}
+
+// Keeps sendfile for local files
+func (a *accessRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := io.Copy(a.ResponseWriter, src)
+	a.written += n
+	return n, err
+}
+
+func (a *accessRecorder) Flush() {
+	if f, ok := a.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (a *accessRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := a.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response doesn't support hijacking")
+	}
+	a.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (a *accessRecorder) Unwrap() http.ResponseWriter {
+	return a.ResponseWriter
+}
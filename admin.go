@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Only let requests through that carry the configured admin token as a bearer
+// token. Admin endpoints are disabled when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			notFound(w, r)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			apiError(w, r, http.StatusUnauthorized, ErrUnauthorized, "Unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// GET /admin/queue
+func queueStatusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, queueStatus(r.Context()))
+}
+
+// POST /admin/queue/pause
+func pauseQueueHandler(w http.ResponseWriter, r *http.Request) {
+	setQueuePaused(true)
+	log.Println("Render queue paused")
+	writeJSON(w, http.StatusOK, queueStatus(r.Context()))
+}
+
+// POST /admin/queue/resume
+func resumeQueueHandler(w http.ResponseWriter, r *http.Request) {
+	setQueuePaused(false)
+	log.Println("Render queue resumed")
+	writeJSON(w, http.StatusOK, queueStatus(r.Context()))
+}
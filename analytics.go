@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AnalyticsFile         = "analytics.json" // JSON file with output views and downloads, when not stateless
+	AnalyticsSaveInterval = time.Minute
+	MaxRecentAccesses     = 50  // Accesses kept with their time and referrer, per output
+	MaxReferrers          = 100 // Referring sites counted per output; the rest count as OtherReferrer
+	OtherReferrer         = "other"
+	DefaultAnalyticsTop   = 20
+)
+
+const (
+	AccessView     = "view"     // Shown embedded in a page
+	AccessDownload = "download" // Opened directly, saved, or fetched by an API client
+)
+
+// One time an output was served
+type OutputAccess struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`               // AccessView or AccessDownload
+	Referrer string    `json:"referrer,omitempty"` // Host of the referring page
+}
+
+// How often an output was served, and from where
+type OutputAnalytics struct {
+	Views     int64            `json:"views"`
+	Downloads int64            `json:"downloads"`
+	FirstAt   *time.Time       `json:"first_at,omitempty"`
+	LastAt    *time.Time       `json:"last_at,omitempty"`
+	Referrers map[string]int64 `json:"referrers,omitempty"` // Accesses by referring host
+	Recent    []OutputAccess   `json:"recent,omitempty"`    // Newest first, up to MaxRecentAccesses
+}
+
+// Usage across all outputs, for GET /admin/analytics
+type AnalyticsSummary struct {
+	Views     int64            `json:"views"`
+	Downloads int64            `json:"downloads"`
+	Outputs   int              `json:"outputs"`   // Outputs served at least once
+	Top       []OutputUsage    `json:"top"`       // Most served outputs, most first
+	Referrers map[string]int64 `json:"referrers"` // Accesses by referring host
+}
+
+// Access counts of one output
+type OutputUsage struct {
+	Tenant    string `json:"tenant,omitempty"`
+	Name      string `json:"name"`
+	Views     int64  `json:"views"`
+	Downloads int64  `json:"downloads"`
+}
+
+var (
+	analyticsMu     sync.Mutex
+	outputAnalytics = make(map[string]*OutputAnalytics) // By analyticsKey
+	analyticsDirty  bool
+)
+
+// Key an output's analytics are kept under; output names repeat across
+// tenants for outputs that aren't cached by file hash
+func analyticsKey(tenant, name string) string {
+	if tenant == "" {
+		return name
+	}
+	return tenant + "/" + name
+}
+
+func splitAnalyticsKey(key string) (tenant, name string) {
+	if tenant, name, ok := strings.Cut(key, "/"); ok {
+		return tenant, name
+	}
+	return "", key
+}
+
+// Load analytics from JSON on startup
+func loadAnalytics() error {
+	data, err := os.ReadFile(AnalyticsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	analyticsMu.Lock()
+	defer analyticsMu.Unlock()
+	return json.Unmarshal(data, &outputAnalytics)
+}
+
+// Write analytics to JSON every AnalyticsSaveInterval when they changed,
+// rather than on every access
+func saveAnalyticsPeriodically() {
+	if store != nil {
+		return
+	}
+	for range time.Tick(AnalyticsSaveInterval) {
+		if err := saveAnalytics(); err != nil {
+			log.Printf("Failed to save analytics: %v", err)
+		}
+	}
+}
+
+func saveAnalytics() error {
+	analyticsMu.Lock()
+	if !analyticsDirty {
+		analyticsMu.Unlock()
+		return nil
+	}
+	data, err := json.Marshal(outputAnalytics)
+	analyticsDirty = false
+	analyticsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(AnalyticsFile, data, 0644)
+}
+
+// What a request for an output counts as, or "" when it doesn't count: only
+// successful GETs from the start of the file, so resumed downloads and
+// HEAD checks aren't counted twice
+func outputAccessKind(r *http.Request, status int) string {
+	if r.Method != http.MethodGet || (status != http.StatusOK && status != http.StatusPartialContent && status != http.StatusNotModified) {
+		return ""
+	}
+	if rng := r.Header.Get("Range"); rng != "" && !strings.HasPrefix(rng, "bytes=0-") {
+		return ""
+	}
+	if r.URL.Query().Get("download") != "" {
+		return AccessDownload
+	}
+	switch r.Header.Get("Sec-Fetch-Dest") {
+	case "image", "video":
+		return AccessView
+	case "":
+		// Older browsers only say what they accept
+		if strings.HasPrefix(r.Header.Get("Accept"), "image/") {
+			return AccessView
+		}
+	}
+	return AccessDownload
+}
+
+// Host of the page a request came from; the path and query aren't kept
+func referrerHost(r *http.Request) string {
+	u, err := url.Parse(r.Referer())
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// Count a served output
+func recordOutputAccess(r *http.Request, name string, status int) {
+	kind := outputAccessKind(r, status)
+	if kind == "" {
+		return
+	}
+	key := analyticsKey(tenantOf(r.Context()), name)
+	access := OutputAccess{Time: time.Now().UTC(), Kind: kind, Referrer: referrerHost(r)}
+	if store != nil {
+		if err := store.RecordAccess(key, access); err != nil {
+			log.Printf("Failed to record output access: %v", err)
+		}
+		return
+	}
+
+	analyticsMu.Lock()
+	defer analyticsMu.Unlock()
+	a := outputAnalytics[key]
+	if a == nil {
+		a = &OutputAnalytics{FirstAt: &access.Time}
+		outputAnalytics[key] = a
+	}
+	a.add(access)
+	analyticsDirty = true
+}
+
+func (a *OutputAnalytics) add(access OutputAccess) {
+	if access.Kind == AccessView {
+		a.Views++
+	} else {
+		a.Downloads++
+	}
+	a.LastAt = &access.Time
+	if host := access.Referrer; host != "" {
+		if a.Referrers == nil {
+			a.Referrers = make(map[string]int64)
+		}
+		if _, ok := a.Referrers[host]; !ok && len(a.Referrers) >= MaxReferrers {
+			host = OtherReferrer
+		}
+		a.Referrers[host]++
+	}
+	a.Recent = append([]OutputAccess{access}, a.Recent[:min(len(a.Recent), MaxRecentAccesses-1)]...)
+}
+
+// Analytics of an output; zero when it was never served
+func lookupOutputAnalytics(tenant, name string) OutputAnalytics {
+	key := analyticsKey(tenant, name)
+	if store != nil {
+		a, err := store.LoadAnalytics(key)
+		if err != nil {
+			log.Printf("Failed to load analytics: %v", err)
+		}
+		return a
+	}
+	analyticsMu.Lock()
+	defer analyticsMu.Unlock()
+	if a := outputAnalytics[key]; a != nil {
+		snapshot := *a
+		snapshot.Referrers = make(map[string]int64, len(a.Referrers))
+		for host, n := range a.Referrers {
+			snapshot.Referrers[host] = n
+		}
+		snapshot.Recent = append([]OutputAccess(nil), a.Recent...)
+		return snapshot
+	}
+	return OutputAnalytics{}
+}
+
+// Totals across outputs, with the top most served
+func summarizeAnalytics(top int) (AnalyticsSummary, error) {
+	if store != nil {
+		return store.AnalyticsSummary(top)
+	}
+	summary := AnalyticsSummary{Referrers: make(map[string]int64)}
+	analyticsMu.Lock()
+	for key, a := range outputAnalytics {
+		summary.Views += a.Views
+		summary.Downloads += a.Downloads
+		summary.Outputs++
+		for host, n := range a.Referrers {
+			summary.Referrers[host] += n
+		}
+		tenant, name := splitAnalyticsKey(key)
+		summary.Top = append(summary.Top, OutputUsage{Tenant: tenant, Name: name, Views: a.Views, Downloads: a.Downloads})
+	}
+	analyticsMu.Unlock()
+	sortOutputUsage(summary.Top)
+	if len(summary.Top) > top {
+		summary.Top = summary.Top[:top]
+	}
+	return summary, nil
+}
+
+// Most accesses first, by name when tied
+func sortOutputUsage(usage []OutputUsage) {
+	sort.Slice(usage, func(i, j int) bool {
+		a, b := usage[i].Views+usage[i].Downloads, usage[j].Views+usage[j].Downloads
+		if a != b {
+			return a > b
+		}
+		return usage[i].Name < usage[j].Name
+	})
+}
+
+// Remembers the status a response was written with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+// Keeps sendfile for local files
+func (s *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return io.Copy(s.ResponseWriter, src)
+}
+
+// GET /admin/analytics
+//
+// Views and downloads across all outputs, the ?top= most served (default
+// DefaultAnalyticsTop), and the sites they were served to
+func analyticsHandler(w http.ResponseWriter, r *http.Request) {
+	top := DefaultAnalyticsTop
+	if value := r.URL.Query().Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "top must be a positive number")
+			return
+		}
+		top = n
+	}
+	summary, err := summarizeAnalytics(top)
+	if err != nil {
+		log.Printf("Failed to summarize analytics: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load analytics")
+		return
+	}
+	if summary.Top == nil {
+		summary.Top = []OutputUsage{}
+	}
+	writeJSON(w, http.StatusOK, summary)
+}
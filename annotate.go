@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fogleman/fauxgl"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	MaxAnnotations     = 20 // Most labels plus callouts on one render
+	MaxAnnotationRunes = 80 // Longest label or callout text
+)
+
+// Annotations a client adds over a render, sent as JSON in the annotations
+// form field
+type Annotations struct {
+	Labels    []TextLabel `json:"labels,omitempty"`    // Text placed on the image
+	Callouts  []Callout   `json:"callouts,omitempty"`  // Text pointing at points of the model
+	Axes      bool        `json:"axes,omitempty"`      // Draw the model's X, Y and Z directions in the bottom right corner
+	Timestamp bool        `json:"timestamp,omitempty"` // Print the time of the render in the top right corner
+}
+
+// Text at a fixed place on the image
+type TextLabel struct {
+	Text string  `json:"text"`
+	X    float64 `json:"x"` // Left edge, as a fraction of the image width
+	Y    float64 `json:"y"` // Top edge, as a fraction of the image height
+}
+
+// Text joined by a leader line to a marker on a point of the model, placed
+// in every view the point is in front of the camera
+type Callout struct {
+	Text  string     `json:"text"`
+	Point [3]float64 `json:"point"`           // In the uploaded file's coordinates and units, before mirroring and rotation
+	Color string     `json:"color,omitempty"` // "#rrggbb" of the marker and line; red by default
+}
+
+var axisColors = [3]color.NRGBA{{0xe7, 0x4c, 0x3c, 255}, {0x27, 0xae, 0x60, 255}, {0x29, 0x80, 0xb9, 255}}
+
+var (
+	annotationFont     *opentype.Font
+	annotationFontOnce sync.Once
+	annotationFontErr  error
+)
+
+// Read the annotations form field into the options
+func parseAnnotationOptions(r *http.Request, opts *RenderOptions) error {
+	v := r.FormValue("annotations")
+	if v == "" {
+		return nil
+	}
+	var a Annotations
+	if err := json.Unmarshal([]byte(v), &a); err != nil {
+		return fmt.Errorf("annotations must be a JSON object of labels, callouts, axes, and timestamp")
+	}
+	if len(a.Labels)+len(a.Callouts) > MaxAnnotations {
+		return fmt.Errorf("at most %d labels and callouts", MaxAnnotations)
+	}
+	for _, l := range a.Labels {
+		if err := checkAnnotationText(l.Text); err != nil {
+			return err
+		}
+		if l.X < 0 || l.X > 1 || l.Y < 0 || l.Y > 1 {
+			return fmt.Errorf("label x and y must be between 0 and 1")
+		}
+	}
+	for _, c := range a.Callouts {
+		if err := checkAnnotationText(c.Text); err != nil {
+			return err
+		}
+		if c.Color != "" && !hexColorPattern.MatchString(c.Color) {
+			return fmt.Errorf("callout color must be #rrggbb")
+		}
+	}
+	// An empty spec keeps the cache key of a render without one
+	if len(a.Labels) == 0 && len(a.Callouts) == 0 && !a.Axes && !a.Timestamp {
+		return nil
+	}
+	opts.Annotations = &a
+	return nil
+}
+
+func checkAnnotationText(text string) error {
+	if strings.TrimSpace(text) == "" || strings.ContainsAny(text, "\r\n") {
+		return fmt.Errorf("annotation text must be one nonempty line")
+	}
+	if utf8.RuneCountInString(text) > MaxAnnotationRunes {
+		return fmt.Errorf("annotation text must be at most %d characters", MaxAnnotationRunes)
+	}
+	return nil
+}
+
+// Everything drawn over a scene's finished images, after rendering and
+// post-processing, so it stays sharp and keeps its colors
+type annotationLayer struct {
+	legend    *legend
+	labels    []TextLabel
+	callouts  []placedCallout
+	axes      *[3]fauxgl.Vector // The model's X, Y and Z directions in the scene
+	timestamp string
+}
+
+type placedCallout struct {
+	text  string
+	point fauxgl.Vector // In the scene
+	color color.NRGBA
+}
+
+// Annotations of a scene whose model was moved into place by toScene, or nil
+// when there is nothing to draw
+func newAnnotationLayer(lg *legend, spec *Annotations, toScene fauxgl.Matrix) *annotationLayer {
+	if lg == nil && spec == nil {
+		return nil
+	}
+	layer := &annotationLayer{legend: lg}
+	if spec == nil {
+		return layer
+	}
+	layer.labels = spec.Labels
+	for _, c := range spec.Callouts {
+		placed := placedCallout{text: c.Text, point: toScene.MulPosition(fauxgl.Vector{c.Point[0], c.Point[1], c.Point[2]}), color: axisColors[0]}
+		if c.Color != "" {
+			placed.color = fauxgl.HexColor(c.Color).NRGBA()
+		}
+		layer.callouts = append(layer.callouts, placed)
+	}
+	if spec.Axes {
+		layer.axes = &[3]fauxgl.Vector{}
+		for i, axis := range []fauxgl.Vector{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}} {
+			layer.axes[i] = toScene.MulDirection(axis).Normalize()
+		}
+	}
+	if spec.Timestamp {
+		layer.timestamp = time.Now().UTC().Format("2006-01-02 15:04 UTC")
+	}
+	return layer
+}
+
+func loadAnnotationFont() (*opentype.Font, error) {
+	annotationFontOnce.Do(func() {
+		annotationFont, annotationFontErr = opentype.Parse(goregular.TTF)
+	})
+	return annotationFont, annotationFontErr
+}
+
+// Draw the scene's annotations into a finished view seen through cam
+func (sc *scene) withAnnotations(im image.Image, cam camera) image.Image {
+	if sc.annotations == nil {
+		return im
+	}
+	dst, ok := im.(*image.NRGBA)
+	if !ok {
+		b := im.Bounds()
+		dst = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(dst, dst.Bounds(), im, b.Min, draw.Src)
+	}
+	sc.drawAnnotationStrip(dst, 0, dst.Bounds().Size(), cam)
+	return dst
+}
+
+// Draw the part of the scene's annotations over rows y0 and on of a
+// size.X×size.Y view seen through cam, for images rendered a band at a time
+func (sc *scene) drawAnnotationStrip(strip *image.NRGBA, y0 int, size image.Point, cam camera) {
+	if sc.annotations == nil {
+		return
+	}
+	// The same pixels, addressed in coordinates of the whole view; drawing
+	// outside the strip is clipped away
+	view := &image.NRGBA{Pix: strip.Pix, Stride: strip.Stride, Rect: image.Rect(0, y0, strip.Rect.Dx(), y0+strip.Rect.Dy())}
+	cam.window = nil // Annotations are placed on the whole view
+	near, far := clipPlanes(sc, cam)
+	sc.annotations.draw(view, size, cam, cam.projection(size.X, size.Y, near, far))
+}
+
+func (a *annotationLayer) draw(dst *image.NRGBA, size image.Point, cam camera, projection fauxgl.Matrix) {
+	s := min(size.X, size.Y)
+	margin := max(4, s/32)
+	if a.legend != nil {
+		if panel, err := legendPanel(a.legend, size); err == nil {
+			at := image.Pt(margin, size.Y-margin-panel.Bounds().Dy())
+			draw.Draw(dst, panel.Bounds().Add(at), panel, image.Point{}, draw.Over)
+		}
+	}
+	if a.axes == nil && len(a.labels) == 0 && len(a.callouts) == 0 && a.timestamp == "" {
+		return
+	}
+
+	f, err := loadAnnotationFont()
+	if err != nil {
+		return // Only the bundled font can fail to load
+	}
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: math.Max(10, float64(s)/48), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return
+	}
+	defer face.Close()
+	pad := max(3, s/128)
+	inside := image.Rect(margin, margin, size.X-margin, size.Y-margin)
+
+	if a.axes != nil {
+		length := s / 14
+		drawAxes(dst, face, a.axes, cam, image.Pt(size.X-margin-length, size.Y-margin-length), length)
+	}
+
+	for _, l := range a.labels {
+		at := image.Pt(int(l.X*float64(size.X)), int(l.Y*float64(size.Y)))
+		drawTag(dst, face, l.Text, at, pad, inside)
+	}
+	if a.timestamp != "" {
+		tag := tagSize(face, a.timestamp, pad)
+		drawTag(dst, face, a.timestamp, image.Pt(size.X-margin-tag.X, margin), pad, inside)
+	}
+
+	radius := math.Max(2, float64(s)/160)
+	reach := s / 20
+	for _, c := range a.callouts {
+		p, ok := projectPoint(projection, c.point, size)
+		if !ok || !p.In(image.Rectangle{Max: size}) {
+			continue
+		}
+		// Lead up and to the right, or away from whichever edge is too close
+		tag := tagSize(face, c.text, pad)
+		dx, dy := reach, -reach
+		if p.X+reach+tag.X > size.X-margin {
+			dx = -reach
+		}
+		if p.Y-reach-tag.Y/2 < margin {
+			dy = reach
+		}
+		end := p.Add(image.Pt(dx, dy))
+		at := image.Pt(end.X, end.Y-tag.Y/2)
+		if dx < 0 {
+			at.X -= tag.X
+		}
+		drawLine(dst, p, end, radius/2, c.color)
+		fillCircle(dst, p, radius, c.color)
+		drawTag(dst, face, c.text, at, pad, inside)
+	}
+}
+
+// Pixel a point of the scene lands on, and whether it's in front of the camera
+func projectPoint(projection fauxgl.Matrix, p fauxgl.Vector, size image.Point) (image.Point, bool) {
+	v := projection.MulPositionW(p)
+	if v.W <= 0 {
+		return image.Point{}, false
+	}
+	x := (v.X/v.W + 1) / 2 * float64(size.X)
+	y := (1 - v.Y/v.W) / 2 * float64(size.Y)
+	return image.Pt(int(math.Round(x)), int(math.Round(y))), true
+}
+
+// Size of the panel drawTag draws text in
+func tagSize(face font.Face, text string, pad int) image.Point {
+	metrics := face.Metrics()
+	return image.Pt(font.MeasureString(face, text).Ceil()+2*pad, (metrics.Ascent+metrics.Descent).Ceil()+2*pad)
+}
+
+// Draw text on a translucent white panel with its top left at at, moved as
+// little as needed to stay inside bounds
+func drawTag(dst *image.NRGBA, face font.Face, text string, at image.Point, pad int, bounds image.Rectangle) {
+	size := tagSize(face, text, pad)
+	at.X = max(bounds.Min.X, min(at.X, bounds.Max.X-size.X))
+	at.Y = max(bounds.Min.Y, min(at.Y, bounds.Max.Y-size.Y))
+	r := image.Rectangle{Min: at, Max: at.Add(size)}
+	draw.Draw(dst, r, image.NewUniform(color.NRGBA{255, 255, 255, 200}), image.Point{}, draw.Over)
+	drawer := font.Drawer{Dst: dst, Src: image.NewUniform(color.NRGBA{0x22, 0x22, 0x22, 255}), Face: face}
+	drawer.Dot = fixed.P(at.X+pad, at.Y+pad+face.Metrics().Ascent.Ceil())
+	drawer.DrawString(text)
+}
+
+// Draw the model's axes as seen by cam, each length pixels from center and
+// lettered at its tip, farthest first so nearer axes cross over them
+func drawAxes(dst *image.NRGBA, face font.Face, axes *[3]fauxgl.Vector, cam camera, center image.Point, length int) {
+	forward := cam.center.Sub(cam.eye).Normalize()
+	right := forward.Cross(cam.up).Normalize()
+	up := right.Cross(forward)
+	order := []int{0, 1, 2}
+	sort.Slice(order, func(i, j int) bool { return axes[order[i]].Dot(forward) > axes[order[j]].Dot(forward) })
+
+	halfWidth := math.Max(1, float64(length)/24)
+	ascent := face.Metrics().Ascent.Ceil()
+	for _, i := range order {
+		d := axes[i]
+		x, y := d.Dot(right), -d.Dot(up)
+		tip := center.Add(image.Pt(int(math.Round(x*float64(length))), int(math.Round(y*float64(length)))))
+		drawLine(dst, center, tip, halfWidth, axisColors[i])
+
+		// Letter just past the tip, centered on the axis line
+		letter := string(rune('X' + i))
+		width := font.MeasureString(face, letter).Ceil()
+		at := tip.Add(image.Pt(int(x*float64(ascent))-width/2, int(y*float64(ascent))+ascent/2))
+		drawer := font.Drawer{Dst: dst, Src: image.NewUniform(axisColors[i]), Face: face, Dot: fixed.P(at.X, at.Y)}
+		drawer.DrawString(letter)
+	}
+}
+
+// Draw a line of the given half width from a to b
+func drawLine(dst *image.NRGBA, a, b image.Point, halfWidth float64, c color.NRGBA) {
+	d := b.Sub(a)
+	steps := max(1, int(math.Ceil(math.Hypot(float64(d.X), float64(d.Y))*2)))
+	for i := 0; i <= steps; i++ {
+		t := float64(i) / float64(steps)
+		p := image.Pt(a.X+int(math.Round(t*float64(d.X))), a.Y+int(math.Round(t*float64(d.Y))))
+		fillCircle(dst, p, halfWidth, c)
+	}
+}
+
+func fillCircle(dst *image.NRGBA, center image.Point, radius float64, c color.NRGBA) {
+	r := int(math.Ceil(radius))
+	for y := -r; y <= r; y++ {
+		for x := -r; x <= r; x++ {
+			if float64(x*x+y*y) <= radius*radius+0.25 {
+				dst.SetNRGBA(center.X+x, center.Y+y, c) // Clipped to the bounds
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const MaxJobWait = 60 * time.Second // Upper bound for ?wait= on job polling
+
+// Write a value as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write JSON response: %v", err)
+	}
+}
+
+// Whether the client asked for a JSON response
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+type jobResponse struct {
+	ID         string                     `json:"id"`
+	Status     string                     `json:"status"`
+	Priority   string                     `json:"priority,omitempty"`       // Queue lane: interactive or batch
+	ErrorCode  string                     `json:"error_code,omitempty"`     // Why the job failed, once it has
+	Output     string                     `json:"output,omitempty"`         // Download URL of the primary output once the job is done
+	Outputs    []string                   `json:"outputs,omitempty"`        // Download URLs of every requested format
+	ETA        *float64                   `json:"eta_seconds,omitempty"`    // Estimated seconds until done, while the job is pending
+	Position   int                        `json:"queue_position,omitempty"` // Place in line for a worker, 1 for next, while the job is queued
+	Stats      *ModelStats                `json:"stats,omitempty"`
+	Mesh       string                     `json:"mesh,omitempty"`             // Download URL of the processed mesh, when the options changed it
+	Permalink  string                     `json:"permalink,omitempty"`        // Shareable model page, once done
+	Stripped   []MetadataRemoval          `json:"metadata_removed,omitempty"` // What privacy mode removed from the upload
+	Analytics  map[string]OutputAnalytics `json:"analytics,omitempty"`        // Views and downloads by output file name, once done
+	CIDs       map[string]string          `json:"cids,omitempty"`             // IPFS CIDs of the outputs, mesh, and upload by file name, once done with ipfs storage
+	Parameters jobParameters              `json:"parameters"`
+	CreatedAt  time.Time                  `json:"created_at"`
+	UpdatedAt  time.Time                  `json:"updated_at"`
+}
+
+// Upload response when the same file and options were already rendered
+type existingOutputResponse struct {
+	Status  string `json:"status"` // Always "exists"
+	Output  string `json:"output"`
+	Message string `json:"message"`
+}
+
+// Everything that decides what a job's outputs look like, so a render can be
+// reproduced: submitting the model again with these options on the same
+// renderer gives the same image
+type jobParameters struct {
+	Options      RenderOptions `json:"options"`
+	Units        string        `json:"units,omitempty"`
+	HollowWall   float64       `json:"hollow_wall,omitempty"`
+	Width        int           `json:"width"`                   // Of one view
+	Height       int           `json:"height"`                  // Of one view
+	Renderer     string        `json:"renderer,omitempty"`      // Once rendered
+	Seed         *uint64       `json:"seed,omitempty"`          // Path tracing seed, also when it is the default 0
+	SamplesTaken int           `json:"samples_taken,omitempty"` // Path tracing samples per pixel, once rendered; reproducing needs the same
+}
+
+func newJobParameters(job Job) jobParameters {
+	p := jobParameters{Options: job.Options, Units: job.Analysis.Units, HollowWall: job.Analysis.HollowWall, Width: Width, Height: Height, Renderer: job.Renderer}
+	if job.Options.Size > 0 {
+		p.Width, p.Height = job.Options.Size, job.Options.Size
+	}
+	if job.Options.Quality == QualityRaytraced {
+		seed := job.Options.Seed
+		p.Seed = &seed
+		if job.Stats != nil {
+			p.SamplesTaken = job.Stats.Samples
+		}
+	}
+	return p
+}
+
+func newJobResponse(job Job) jobResponse {
+	resp := jobResponse{ID: job.ID, Status: job.Status, Priority: job.Priority, ErrorCode: job.ErrorCode, Stats: job.Stats, Stripped: job.Stripped, Parameters: newJobParameters(job), CreatedAt: job.CreatedAt, UpdatedAt: job.UpdatedAt}
+	if job.Status == JobDone {
+		resp.Output = outputURL(job.Tenant, job.OutputPath)
+		for _, name := range job.Outputs {
+			resp.Outputs = append(resp.Outputs, outputURL(job.Tenant, name))
+		}
+		if job.MeshFile != "" {
+			resp.Mesh = tenantURL(job.Tenant, "/api/v1/jobs/"+job.ID+"/mesh.stl")
+		}
+		resp.Permalink = modelPermalink(job.Tenant, job.FileHash)
+		resp.CIDs = job.CIDs
+		resp.Analytics = make(map[string]OutputAnalytics, len(job.Outputs))
+		for _, name := range job.Outputs {
+			resp.Analytics[name] = lookupOutputAnalytics(job.Tenant, name)
+		}
+	}
+	resp.Position, _ = queuePosition(job.ID)
+	if eta, ok := jobETA(job.ID); ok {
+		seconds := math.Round(eta.Seconds()*10) / 10
+		resp.ETA = &seconds
+	}
+	return resp
+}
+
+// Reply to a job request for a model that isn't stored yet
+type modelNotStoredResponse struct {
+	Code      string `json:"code"`       // Always ErrModelNotStored
+	Error     string `json:"error"`      // Always "model_not_stored", from before error codes
+	UploadURL string `json:"upload_url"` // Where to upload the file instead
+}
+
+// POST /api/v1/jobs
+//
+// Render a model the server already has, by the SHA-256 of the file in hash,
+// so clients with large files can skip the upload: answers like /upload if
+// the model is stored, or 404 model_not_stored, in which case the client
+// uploads the file to /upload. Takes the same option fields as /upload and
+// always answers in JSON.
+func createJobHandler(w http.ResponseWriter, r *http.Request) {
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+	r.Header.Set("Accept", "application/json")
+	hash := strings.ToLower(r.FormValue("hash"))
+	if !fileHashPattern.MatchString(hash) {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "hash must be a hex SHA-256")
+		return
+	}
+	exists, err := storage.Exists(r.Context(), uploadObject(hash))
+	if err != nil {
+		log.Printf("Failed to look up upload %s: %v", hash, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+		return
+	}
+	if !exists {
+		w.Header().Set(ErrorCodeHeader, ErrModelNotStored)
+		writeJSON(w, http.StatusNotFound, modelNotStoredResponse{Code: ErrModelNotStored, Error: "model_not_stored", UploadURL: tenantURL(tenantOf(r.Context()), "/upload")})
+		return
+	}
+	renderStoredModel(w, r, hash)
+}
+
+// GET /api/v1/jobs/{id}?wait=30s
+//
+// With wait, the request is held until the job's status changes or the
+// timeout elapses, whichever comes first.
+func jobStatusHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	noteRequestJob(r, id)
+	job, changed, ok := getJob(id)
+	if !ok {
+		apiError(w, r, http.StatusNotFound, ErrNotFound, "Job not found")
+		return
+	}
+
+	if v := r.URL.Query().Get("wait"); v != "" && !job.finished() {
+		wait, err := time.ParseDuration(v)
+		if err != nil || wait < 0 {
+			apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid wait duration")
+			return
+		}
+		if wait > MaxJobWait {
+			wait = MaxJobWait
+		}
+
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-changed:
+			job, _, ok = getJob(id)
+			if !ok {
+				apiError(w, r, http.StatusNotFound, ErrNotFound, "Job not found")
+				return
+			}
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, newJobResponse(job))
+}
+
+// GET /api/v1/jobs/{id}/events
+//
+// The job's history: every status change and preview frame event pushed to
+// subscribers, oldest first, each with the time it happened. Lets clients
+// that weren't connected see what happened, not only the final state.
+func jobEventsHandler(w http.ResponseWriter, r *http.Request) {
+	noteRequestJob(r, r.PathValue("id"))
+	job, _, ok := getJob(r.PathValue("id"))
+	if !ok {
+		apiError(w, r, http.StatusNotFound, ErrNotFound, "Job not found")
+		return
+	}
+	events := job.Events
+	if events == nil {
+		events = []jobEvent{}
+	}
+	writeJSON(w, http.StatusOK, events)
+}
+
+// GET /api/v1/jobs/{id}/mesh.stl
+//
+// The processed (e.g. decimated) mesh as binary STL, once the job is done
+func jobMeshHandler(w http.ResponseWriter, r *http.Request) {
+	noteRequestJob(r, r.PathValue("id"))
+	job, _, ok := getJob(r.PathValue("id"))
+	if !ok || job.MeshFile == "" {
+		apiError(w, r, http.StatusNotFound, ErrNotFound, "Mesh not found")
+		return
+	}
+	if job.Status != JobDone {
+		apiError(w, r, http.StatusConflict, ErrJobNotFinished, "Job not finished")
+		return
+	}
+	w.Header().Set("Content-Type", "model/stl")
+	w.Header().Set("Content-Disposition", `attachment; filename="mesh.stl"`)
+	serveOutputFile(w, r.WithContext(withTenant(r.Context(), job.Tenant)), job.MeshFile)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const AssetMaxAge = 365 * 24 * 60 * 60 // Cache-Control max-age of static files; their names change with their content
+
+// Scripts, styles, and icons of the pages, built into the binary
+//
+//go:embed static
+var staticFiles embed.FS
+
+// A static file, served under a name that includes a digest of its content
+type asset struct {
+	data        []byte
+	contentType string
+	digest      string
+}
+
+var (
+	assets     = make(map[string]asset)  // By fingerprinted name, e.g. "style.3f2a9c01d4.css"
+	assetNames = make(map[string]string) // Fingerprinted name by file name
+)
+
+// Functions the page templates can use. asset gives the URL of a static file
+// by its name in static/, e.g. {{asset "style.css"}}.
+var templateFuncs = template.FuncMap{
+	"asset": assetURL,
+}
+
+// Fingerprint the embedded static files: each is served as
+// <name>.<digest>.<ext>, so browsers can keep it for good and pick up a
+// changed file by its new URL
+func loadAssets() error {
+	return fs.WalkDir(staticFiles, "static", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := staticFiles.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		name := strings.TrimPrefix(p, "static/")
+		sum := sha256.Sum256(data)
+		digest := hex.EncodeToString(sum[:5])
+		ext := path.Ext(name)
+		fingerprinted := strings.TrimSuffix(name, ext) + "." + digest + ext
+		contentType := mime.TypeByExtension(ext)
+		if contentType == "" {
+			contentType = http.DetectContentType(data)
+		}
+		assets[fingerprinted] = asset{data: data, contentType: contentType, digest: digest}
+		assetNames[name] = fingerprinted
+		return nil
+	})
+}
+
+// URL of a static file by its name in static/
+func assetURL(name string) (string, error) {
+	fingerprinted, ok := assetNames[name]
+	if !ok {
+		return "", fmt.Errorf("no static file %q", name)
+	}
+	return "/static/" + fingerprinted, nil
+}
+
+// Parse a page template with templateFuncs
+func parseTemplate(file string) (*template.Template, error) {
+	return template.New(filepath.Base(file)).Funcs(templateFuncs).ParseFiles(file)
+}
+
+// GET /static/{file}, a static file by its fingerprinted name
+func staticHandler(w http.ResponseWriter, r *http.Request) {
+	a, ok := assets[r.PathValue("file")]
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", a.contentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", AssetMaxAge))
+	w.Header().Set("ETag", `"`+a.digest+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(a.data))
+}
+
+// GET /favicon.ico, for browsers that ask for it without reading the page's
+// icon link
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	u, err := assetURL("favicon.svg")
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	http.Redirect(w, r, u, http.StatusFound)
+}
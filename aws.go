@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const awsUnsignedPayload = "UNSIGNED-PAYLOAD" // Payload hash S3 accepts over HTTPS instead of hashing uploads first
+
+// AWS credentials from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, and
+// AWS_SESSION_TOKEN for temporary ones, for one region
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	region       string
+}
+
+// Credentials from the environment; the region is AWS_REGION when empty
+func newAWSCredentials(region string) (awsCredentials, error) {
+	c := awsCredentials{
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		region:       region,
+	}
+	if c.region == "" {
+		c.region = os.Getenv("AWS_REGION")
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return c, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	if c.region == "" {
+		return c, errors.New("needs a region or AWS_REGION")
+	}
+	return c, nil
+}
+
+// Sign a request for service with Signature Version 4. payloadHash is the hex
+// SHA-256 of the body, or awsUnsignedPayload for S3. Query parameters aren't
+// canonicalized; none of the requests made here have any.
+func (c awsCredentials) sign(req *http.Request, service, payloadHash string) {
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	day := stamp[:8]
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	names := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		value := req.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	canonical := strings.Join([]string{req.Method, uri, req.URL.RawQuery, headers.String(), signedHeaders, payloadHash}, "\n")
+
+	scope := day + "/" + c.region + "/" + service + "/aws4_request"
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(digest[:])
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{day, c.region, service, "aws4_request"} {
+		key = awsHMAC(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, hex.EncodeToString(awsHMAC(key, toSign))))
+}
+
+func awsHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Percent-encode an object key as Signature Version 4 expects: everything
+// but unreserved characters and slashes
+func awsEscapePath(key string) string {
+	var b strings.Builder
+	for _, c := range []byte(key) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// An S3 bucket over the REST API, for reading and writing single objects
+type s3Bucket struct {
+	name   string
+	creds  awsCredentials
+	client *http.Client
+}
+
+func (b *s3Bucket) objectURL(key string) string {
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", b.name, b.creds.region, awsEscapePath(key))
+}
+
+// Open an object for reading; fails with os.ErrNotExist if missing
+func (b *s3Bucket) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	b.creds.sign(req, "s3", awsUnsignedPayload)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("s3 download of %s: %s", key, resp.Status)
+}
+
+// Store a local file as an object. The local file is consumed.
+func (b *s3Bucket) Publish(ctx context.Context, localPath, key string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, b.objectURL(key), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	b.creds.sign(req, "s3", awsUnsignedPayload)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 upload of %s: %s", key, resp.Status)
+	}
+	file.Close()
+	return os.Remove(localPath)
+}
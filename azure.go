@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const azureAPIVersion = "2021-08-06" // x-ms-version sent with every Blob request
+
+// Azure Blob Storage over the REST API. Authenticates with the account key in
+// AZURE_STORAGE_KEY, a SAS token in AZURE_STORAGE_SAS_TOKEN, or otherwise the
+// managed identity of the VM or container.
+type azureStorage struct {
+	account   string
+	container string
+	prefix    string
+	key       []byte // Shared Key credential, decoded
+	sas       string // SAS query string, without the leading "?"
+	client    *http.Client
+
+	mu       sync.Mutex
+	identity string // Managed identity bearer token
+	expires  time.Time
+}
+
+func newAzureStorage(cfg StorageConfig) (*azureStorage, error) {
+	s := &azureStorage{account: cfg.Account, container: cfg.Container, prefix: cfg.Prefix, client: &http.Client{}}
+	if s.account == "" {
+		s.account = os.Getenv("AZURE_STORAGE_ACCOUNT")
+	}
+	if s.account == "" || s.container == "" {
+		return nil, fmt.Errorf("azure storage needs an account and a container")
+	}
+	if key := os.Getenv("AZURE_STORAGE_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AZURE_STORAGE_KEY: %w", err)
+		}
+		s.key = decoded
+	}
+	s.sas = strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+	return s, nil
+}
+
+func (s *azureStorage) blobURL(name string) string {
+	u := fmt.Sprintf("https://%s.blob.core.windows.net/%s/%s", s.account, url.PathEscape(s.container), escapeBlobName(prefixedName(s.prefix, name)))
+	if s.sas != "" && s.key == nil {
+		u += "?" + s.sas
+	}
+	return u
+}
+
+// Escape each path segment, keeping the slashes of virtual directories
+func escapeBlobName(name string) string {
+	segments := strings.Split(name, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (s *azureStorage) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	switch {
+	case s.key != nil:
+		req.Header.Set("Authorization", "SharedKey "+s.account+":"+s.sign(req))
+	case s.sas != "":
+		// Authorized by the query string
+	default:
+		token, err := s.identityToken(req.Context())
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return s.client.Do(req)
+}
+
+// Shared Key signature over the canonicalized request
+func (s *azureStorage) sign(req *http.Request) string {
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	var msHeaders []string
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(req.Header.Get(name)))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	resource := "/" + s.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	var params []string
+	for name, values := range query {
+		sort.Strings(values)
+		params = append(params, strings.ToLower(name)+":"+strings.Join(values, ","))
+	}
+	sort.Strings(params)
+	for _, p := range params {
+		resource += "\n" + p
+	}
+
+	toSign := strings.Join([]string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		length,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, superseded by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		resource,
+	}, "\n")
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(toSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Bearer token from the instance metadata service, cached until shortly
+// before it expires
+func (s *azureStorage) identityToken(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.identity != "" && time.Until(s.expires) > time.Minute {
+		return s.identity, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource="+url.QueryEscape("https://storage.azure.com/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to get Azure managed identity token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get Azure managed identity token: %s", resp.Status)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   string `json:"expires_in"` // Seconds, as a string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	seconds, _ := strconv.Atoi(token.ExpiresIn)
+	s.identity = token.AccessToken
+	s.expires = time.Now().Add(time.Duration(seconds) * time.Second)
+	return s.identity, nil
+}
+
+func (s *azureStorage) Publish(ctx context.Context, localPath, name string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.blobURL(name), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("azure upload of %s: %s", name, resp.Status)
+	}
+	file.Close()
+	return os.Remove(localPath)
+}
+
+func (s *azureStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.blobURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("azure download of %s: %s", name, resp.Status)
+}
+
+func (s *azureStorage) OpenAt(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	if offset == 0 {
+		return s.Open(ctx, name)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.blobURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("azure ranged download of %s: %s", name, resp.Status)
+}
+
+func (s *azureStorage) Stat(ctx context.Context, name string) (StoredFileInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.blobURL(name), nil)
+	if err != nil {
+		return StoredFileInfo{}, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return StoredFileInfo{}, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return StoredFileInfo{}, os.ErrNotExist
+	default:
+		return StoredFileInfo{}, fmt.Errorf("azure lookup of %s: %s", name, resp.Status)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return StoredFileInfo{Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *azureStorage) Exists(ctx context.Context, name string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.blobURL(name), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("azure lookup of %s: %s", name, resp.Status)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// A backdrop image rendered models are composited over
+type backdrop struct {
+	digest string // Content hash, copied into render options so the cache key changes with the image
+	image  image.Image
+}
+
+var (
+	backdropsByPath   = make(map[string]*backdrop) // Presets' backdrops, loaded on startup
+	backdropsByDigest = make(map[string]*backdrop)
+	backdropMu        sync.Mutex
+	scaledBackdrops   = make(map[backdropSize]*image.NRGBA) // Backdrops resized to each full view size used so far
+)
+
+type backdropSize struct {
+	digest string
+	size   image.Point
+}
+
+// Load the backdrop of every preset that has one. Transparent parts of a
+// backdrop show white, like the plain background.
+func loadBackdrops() error {
+	for _, p := range config.Presets {
+		if p.Backdrop == "" || backdropsByPath[p.Backdrop] != nil {
+			continue
+		}
+		data, err := os.ReadFile(p.Backdrop)
+		if err != nil {
+			return fmt.Errorf("preset %q: %w", p.Name, err)
+		}
+		im, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("preset %q: backdrop must be a PNG or JPEG: %w", p.Name, err)
+		}
+		b := im.Bounds()
+		flat := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(flat, flat.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), im, b.Min, draw.Over)
+
+		sum := sha256.Sum256(data)
+		bd := &backdrop{digest: hex.EncodeToString(sum[:8]), image: flat}
+		backdropsByPath[p.Backdrop] = bd
+		backdropsByDigest[bd.digest] = bd
+	}
+	return nil
+}
+
+// Digest of a preset's backdrop, or "" when it has none
+func presetBackdrop(p FilterPreset) string {
+	if bd := backdropsByPath[p.Backdrop]; bd != nil {
+		return bd.digest
+	}
+	return ""
+}
+
+// Backdrop a job's options ask for, or nil for the plain background
+func findBackdrop(digest string) (image.Image, error) {
+	if digest == "" {
+		return nil, nil
+	}
+	bd := backdropsByDigest[digest]
+	if bd == nil {
+		return nil, fmt.Errorf("backdrop %s is no longer configured", digest)
+	}
+	return bd.image, nil
+}
+
+// Put the scene's backdrop behind the model: every pixel nothing was drawn
+// on, still the cleared white with nothing in the depth buffer, takes the
+// backdrop's color. The backdrop covers the whole view, scaled to fill it
+// and cropped evenly; a camera window gets its part of it.
+func (sc *scene) applyBackdrop(dst *image.NRGBA, depth []float64, cam camera) {
+	b := dst.Bounds()
+	w, h := b.Dx(), b.Dy()
+	layer := sc.backdropLayer(cam, w, h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			if depth[y*w+x] != math.MaxFloat64 {
+				continue
+			}
+			i := dst.PixOffset(b.Min.X+x, b.Min.Y+y)
+			p := dst.Pix[i : i+4 : i+4]
+			if p[0] != 0xff || p[1] != 0xff || p[2] != 0xff {
+				continue // An overlay, drawn without depth
+			}
+			j := layer.PixOffset(x, y)
+			copy(p, layer.Pix[j:j+4])
+		}
+	}
+}
+
+// The backdrop as it lies behind a w×h view through cam's window
+func (sc *scene) backdropLayer(cam camera, w, h int) *image.NRGBA {
+	if cam.window == nil {
+		return scaledBackdrop(sc.backdropDigest, sc.backdrop, image.Pt(w, h))
+	}
+	win := cam.window
+	fullW, fullH := float64(w)/(win.right-win.left), float64(h)/(win.bottom-win.top)
+	bb := sc.backdrop.Bounds()
+	s := math.Max(fullW/float64(bb.Dx()), fullH/float64(bb.Dy()))
+	ox := (fullW-float64(bb.Dx())*s)/2 - win.left*fullW
+	oy := (fullH-float64(bb.Dy())*s)/2 - win.top*fullH
+	layer := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(layer, layer.Bounds(), image.White, image.Point{}, draw.Src)
+	toLayer := f64.Aff3{
+		s, 0, ox - float64(bb.Min.X)*s,
+		0, s, oy - float64(bb.Min.Y)*s,
+	}
+	draw.CatmullRom.Transform(layer, toLayer, sc.backdrop, bb, draw.Src, nil)
+	return layer
+}
+
+// A backdrop scaled to fill a whole view, resized once per size
+func scaledBackdrop(digest string, im image.Image, size image.Point) *image.NRGBA {
+	key := backdropSize{digest, size}
+	backdropMu.Lock()
+	defer backdropMu.Unlock()
+	if layer, ok := scaledBackdrops[key]; ok {
+		return layer
+	}
+	bb := im.Bounds()
+	s := math.Max(float64(size.X)/float64(bb.Dx()), float64(size.Y)/float64(bb.Dy()))
+	// Part of the backdrop that shows, centered
+	cw, ch := int(math.Round(float64(size.X)/s)), int(math.Round(float64(size.Y)/s))
+	crop := image.Rect(0, 0, cw, ch).Add(bb.Min).Add(image.Pt((bb.Dx()-cw)/2, (bb.Dy()-ch)/2))
+	layer := image.NewNRGBA(image.Rectangle{Max: size})
+	draw.CatmullRom.Scale(layer, layer.Bounds(), im, crop, draw.Src, nil)
+	scaledBackdrops[key] = layer
+	return layer
+}
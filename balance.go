@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/fogleman/fauxgl"
+)
+
+// Fraction of the model height within which vertices count as resting on the
+// build plate
+const baseTolerance = 1e-3
+
+// Support margins smaller than this fraction of the base size are reported as
+// marginal rather than stable
+const marginalMargin = 0.05
+
+// Whether a model stands on its base without tipping over
+type Stability struct {
+	Verdict string  `json:"verdict"` // "stable", "marginal", or "unstable"
+	Margin  float64 `json:"margin"`  // Distance from the center of mass to the edge of the support polygon, in model units; negative outside
+}
+
+// Center of mass of a closed mesh of uniform density, found by summing signed
+// tetrahedra from the origin to each face. Returns false for open or flat
+// meshes that enclose no volume.
+func centerOfMass(mesh *fauxgl.Mesh) (fauxgl.Vector, bool) {
+	var volume float64
+	var moment fauxgl.Vector
+	for _, t := range mesh.Triangles {
+		a, b, c := t.V1.Position, t.V2.Position, t.V3.Position
+		v := a.Dot(b.Cross(c)) / 6
+		volume += v
+		moment = moment.Add(a.Add(b).Add(c).MulScalar(v / 4))
+	}
+
+	size := mesh.BoundingBox().Size()
+	if math.Abs(volume) <= 1e-9*size.X*size.Y*size.Z {
+		return fauxgl.Vector{}, false
+	}
+	return moment.DivScalar(volume), true
+}
+
+// Check whether the center of mass projects inside the convex hull of the
+// points the model rests on, with the model standing on its lowest Z
+func analyzeStability(mesh *fauxgl.Mesh, com fauxgl.Vector) Stability {
+	box := mesh.BoundingBox()
+	limit := box.Min.Z + baseTolerance*(box.Max.Z-box.Min.Z)
+
+	var base []fauxgl.Vector
+	for _, t := range mesh.Triangles {
+		for _, v := range []fauxgl.Vector{t.V1.Position, t.V2.Position, t.V3.Position} {
+			if v.Z <= limit {
+				base = append(base, fauxgl.Vector{v.X, v.Y, 0})
+			}
+		}
+	}
+
+	hull := convexHull2D(base)
+	if len(hull) < 3 {
+		// Resting on a point or an edge
+		return Stability{Verdict: "unstable"}
+	}
+
+	margin := hullMargin(hull, fauxgl.Vector{com.X, com.Y, 0})
+	baseSize := math.Max(box.Max.X-box.Min.X, box.Max.Y-box.Min.Y)
+	s := Stability{Verdict: "stable", Margin: margin}
+	switch {
+	case margin <= 0:
+		s.Verdict = "unstable"
+	case margin < marginalMargin*baseSize:
+		s.Verdict = "marginal"
+	}
+	return s
+}
+
+// Convex hull of points in the XY plane, counterclockwise (monotone chain)
+func convexHull2D(points []fauxgl.Vector) []fauxgl.Vector {
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].X != points[j].X {
+			return points[i].X < points[j].X
+		}
+		return points[i].Y < points[j].Y
+	})
+	cross := func(o, a, b fauxgl.Vector) float64 {
+		return (a.X-o.X)*(b.Y-o.Y) - (a.Y-o.Y)*(b.X-o.X)
+	}
+
+	var hull []fauxgl.Vector
+	for _, p := range points {
+		for len(hull) >= 2 && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	lower := len(hull) + 1
+	for i := len(points) - 2; i >= 0; i-- {
+		p := points[i]
+		for len(hull) >= lower && cross(hull[len(hull)-2], hull[len(hull)-1], p) <= 0 {
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, p)
+	}
+	if len(hull) > 1 {
+		hull = hull[:len(hull)-1] // Last point repeats the first
+	}
+	return hull
+}
+
+// Signed distance from a point to the boundary of a counterclockwise convex
+// polygon: positive inside, negative outside
+func hullMargin(hull []fauxgl.Vector, p fauxgl.Vector) float64 {
+	margin := math.Inf(1)
+	outside := false
+	for i := range hull {
+		a, b := hull[i], hull[(i+1)%len(hull)]
+		edge := b.Sub(a)
+		d := (edge.X*(p.Y-a.Y) - edge.Y*(p.X-a.X)) / edge.Length()
+		if d < 0 {
+			outside = true
+		}
+		margin = math.Min(margin, math.Abs(segmentDistance(a, b, p)))
+	}
+	if outside {
+		return -margin
+	}
+	return margin
+}
+
+// Distance from p to the segment ab
+func segmentDistance(a, b, p fauxgl.Vector) float64 {
+	ab := b.Sub(a)
+	t := 0.0
+	if l2 := ab.Dot(ab); l2 > 0 {
+		t = math.Max(0, math.Min(1, p.Sub(a).Dot(ab)/l2))
+	}
+	return p.Sub(a.Add(ab.MulScalar(t))).Length()
+}
+
+// Small sphere marking the center of mass, sized for the bi-unit cube
+func centerOfMassMarker(center fauxgl.Vector) *fauxgl.Mesh {
+	marker := fauxgl.NewSphere(2)
+	marker.Transform(fauxgl.Scale(fauxgl.Vector{0.04, 0.04, 0.04}).Translate(center))
+	return marker
+}
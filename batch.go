@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	MaxBatchFiles  = 20       // Most files accepted by one batch request
+	MaxBatchUpload = 64 << 20 // Multipart memory limit for batch uploads
+)
+
+// Overall result of a batch
+const (
+	BatchAccepted = "accepted" // Every file was queued or already rendered
+	BatchPartial  = "partial"  // Some files failed, the rest were queued or already rendered
+	BatchFailed   = "failed"   // Every file failed
+)
+
+// What happened to one file of a batch. Files with a job are followed like
+// any other job; their job can still fail on its own, with its error code.
+type batchItem struct {
+	File      string `json:"file"`
+	Status    string `json:"status"`               // "exists", the job's status, or "failed"
+	JobID     string `json:"job_id,omitempty"`     // Job rendering the file, when it has one
+	JobURL    string `json:"job_url,omitempty"`    // Where to poll that job
+	Output    string `json:"output,omitempty"`     // Download URL, when the file was already rendered
+	ErrorCode string `json:"error_code,omitempty"` // Why the file failed, when it did
+	Message   string `json:"message,omitempty"`    // Human-readable reason, in English
+}
+
+type batchResponse struct {
+	Status    string      `json:"status"` // BatchAccepted, BatchPartial, or BatchFailed
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Items     []batchItem `json:"items"` // In the order the files were sent
+}
+
+// POST /api/v1/batches with several file fields and the option fields of
+// /upload, which apply to every file. Each file is scanned, checked against
+// the cache, and queued on its own, so one that fails leaves the others
+// going; the response lists what happened to each. Answers 202 when any file
+// was queued or already rendered, 422 when none was.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+	r.Header.Set("Accept", "application/json")
+	if err := r.ParseMultipartForm(MaxBatchUpload); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Failed to read files")
+		return
+	}
+	opts, err := parseRenderOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	analysis, err := parseAnalysisOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if _, err := parseGroupID(r); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 || len(headers) > MaxBatchFiles {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, fmt.Sprintf("Send between 1 and %d files", MaxBatchFiles))
+		return
+	}
+
+	resp := batchResponse{Items: make([]batchItem, len(headers))}
+	for i, header := range headers {
+		item := submitBatchItem(r, header, opts, analysis)
+		if item.ErrorCode != "" {
+			resp.Failed++
+		} else {
+			resp.Succeeded++
+		}
+		resp.Items[i] = item
+	}
+
+	status := http.StatusAccepted
+	switch {
+	case resp.Succeeded == 0:
+		resp.Status = BatchFailed
+		status = http.StatusUnprocessableEntity
+	case resp.Failed > 0:
+		resp.Status = BatchPartial
+	default:
+		resp.Status = BatchAccepted
+	}
+	writeJSON(w, status, resp)
+}
+
+// Save, scan, and queue one file of a batch, as /upload does for a single one
+func submitBatchItem(r *http.Request, header *multipart.FileHeader, opts RenderOptions, analysis AnalysisOptions) batchItem {
+	item := batchItem{File: header.Filename}
+	fail := func(code, message string) batchItem {
+		item.Status, item.ErrorCode, item.Message = JobFailed, code, message
+		return item
+	}
+	ctx := r.Context()
+
+	conv, err := uploadConverter(r, header.Filename)
+	if err != nil {
+		return fail(ErrInvalidRequest, err.Error())
+	}
+	workDir, err := newJobWorkDir()
+	if err != nil {
+		log.Printf("Failed to create work dir: %v", err)
+		return fail(ErrInternal, "Failed to save file")
+	}
+	keepWorkDir := false
+	defer func() {
+		if !keepWorkDir {
+			os.RemoveAll(workDir)
+		}
+	}()
+	stlPath := filepath.Join(workDir, "input.stl")
+	inputPath := stlPath
+	if conv != nil {
+		inputPath = filepath.Join(workDir, "input."+conv.ext)
+	}
+
+	fileHash, err := saveUploadPart(header, inputPath)
+	if err != nil {
+		log.Printf("Failed to save batch file %s: %v", header.Filename, err)
+		return fail(ErrInternal, "Failed to save file")
+	}
+	switch err := scanFile(ctx, inputPath, fileHash); err {
+	case nil:
+	case errScanFailed:
+		return fail(ErrScanUnavailable, "Failed to scan file")
+	default:
+		return fail(errorCode(err, ErrInternal), "File rejected by virus scan")
+	}
+	if conv != nil {
+		if err := conv.convert(inputPath, stlPath); err != nil {
+			return fail(ErrUnsupportedFormat, "Failed to convert upload: "+err.Error())
+		}
+		os.Remove(inputPath)
+	}
+	fileHash = convertedFileHash(fileHash, conv)
+
+	item, keepWorkDir = queueBatchItem(r, item, workDir, fileHash, opts, analysis)
+	return item
+}
+
+// Answer a batch item from the cache, or from a job queued or already in
+// flight for its model in workDir. Returns whether a new job took workDir
+// over.
+func queueBatchItem(r *http.Request, item batchItem, workDir, fileHash string, opts RenderOptions, analysis AnalysisOptions) (batchItem, bool) {
+	fail := func(code, message string) (batchItem, bool) {
+		item.Status, item.ErrorCode, item.Message = JobFailed, code, message
+		return item, false
+	}
+	tenant := tenantOf(r.Context())
+	cacheKey := outputCacheKey(tenant, fileHash, opts, analysis)
+	if name, ok := lookupOutput(cacheKey); ok {
+		item.Status, item.Output = "exists", outputURL(tenant, filepath.Base(name))
+		return item, false
+	}
+	keepWorkDir := false
+	id, ok := findInFlightJob(cacheKey)
+	if !ok {
+		var coalesced bool
+		var err error
+		id, coalesced, err = queueRender(r.Context(), workDir, fileHash, opts, analysis, false, requestLocale(r))
+		switch {
+		case errors.Is(err, errQueueFull):
+			return fail(ErrQueueFull, "The render queue is full, try again later")
+		case errors.Is(err, errTenantQuota):
+			return fail(ErrTenantQuota, "Too many jobs in progress, try again later")
+		case err != nil:
+			return fail(ErrInternal, "Failed to queue job")
+		}
+		keepWorkDir = !coalesced
+	}
+
+	joinRequestGroup(r, id)
+	job, _, _ := getJob(id)
+	item.Status, item.JobID, item.JobURL = job.Status, id, tenantURL(tenant, "/api/v1/jobs/"+id)
+	return item, keepWorkDir
+}
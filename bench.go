@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	BenchSubcommand = "bench"            // First argument that benchmarks this machine instead of serving
+	CalibrationFile = "calibration.json" // Worker count found by the benchmark
+	MinWorkerGain   = 1.05               // Throughput a worker count must add over the last one to be picked
+)
+
+// A generated mesh the benchmark renders, so results compare across machines
+type referenceMesh struct {
+	name         string
+	rings, sides int // Torus resolution; it has 2*rings*sides triangles
+}
+
+var referenceMeshes = []referenceMesh{
+	{"small", 100, 50},
+	{"medium", 500, 100},
+	{"large", 1000, 500},
+}
+
+var benchSizes = []int{512, 1024, 2048}
+
+// What the benchmark found, read on startup
+type Calibration struct {
+	Workers    int       `json:"workers"` // Concurrent renders with the best throughput
+	MeasuredAt time.Time `json:"measured_at"`
+}
+
+var calibration Calibration
+
+// Load the benchmark results from JSON on startup
+func loadCalibration() error {
+	data, err := os.ReadFile(CalibrationFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, &calibration)
+}
+
+// Number of render workers: configured, else calibrated, else one
+func workerCount() int {
+	if config.Workers > 0 {
+		return config.Workers
+	}
+	if calibration.Workers > 0 {
+		return calibration.Workers
+	}
+	return 1
+}
+
+// Time spent in each phase of one render
+type benchTiming struct {
+	load, raster, finish, encode time.Duration
+}
+
+func (t benchTiming) total() time.Duration {
+	return t.load + t.raster + t.finish + t.encode
+}
+
+func (t benchTiming) add(o benchTiming) benchTiming {
+	return benchTiming{t.load + o.load, t.raster + o.raster, t.finish + o.finish, t.encode + o.encode}
+}
+
+// Entry point of the bench subcommand: render the reference meshes at each
+// size and print how long every phase took, then find how many concurrent
+// renders this machine handles best. Unless -dry-run is given, the timings
+// seed the render history for ETAs and the worker count is saved to
+// CalibrationFile. Returns the exit code.
+func runBench(args []string) int {
+	flags := flag.NewFlagSet(BenchSubcommand, flag.ContinueOnError)
+	runs := flags.Int("runs", 3, "renders of each mesh and size to average")
+	dryRun := flags.Bool("dry-run", false, "print the results without saving them")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *runs < 1 {
+		log.Printf("-runs must be at least 1")
+		return 2
+	}
+
+	if err := loadConfig(); err != nil {
+		log.Printf("Error loading config: %v", err)
+		return 1
+	}
+	if err := loadBrandingFrame(); err != nil {
+		log.Printf("Error loading branding frame: %v", err)
+		return 1
+	}
+	if err := setupRenderer(); err != nil {
+		log.Printf("Error setting up renderer: %v", err)
+		return 1
+	}
+	if !*dryRun {
+		if err := loadRenderHistory(); err != nil {
+			log.Printf("Error loading render history: %v", err)
+		}
+	}
+
+	dir, err := os.MkdirTemp(config.WorkDir, "render-bench-*")
+	if err != nil {
+		log.Printf("Error creating bench dir: %v", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(out, "mesh\ttriangles\tsize\tload\traster\tfinish\tencode\ttotal\t")
+	paths := make([]string, len(referenceMeshes))
+	for i, ref := range referenceMeshes {
+		paths[i] = filepath.Join(dir, ref.name+".stl")
+		mesh := torusMesh(ref.rings, ref.sides)
+		if err := mesh.SaveSTL(paths[i]); err != nil {
+			log.Printf("Error saving reference mesh: %v", err)
+			return 1
+		}
+		for _, size := range benchSizes {
+			var sum benchTiming
+			for run := 0; run < *runs; run++ {
+				timing, err := benchRender(paths[i], size, filepath.Join(dir, "out.png"))
+				if err != nil {
+					log.Printf("Error rendering %s mesh: %v", ref.name, err)
+					return 1
+				}
+				sum = sum.add(timing)
+			}
+			n := time.Duration(*runs)
+			avg := benchTiming{sum.load / n, sum.raster / n, sum.finish / n, sum.encode / n}
+			triangles := 2 * ref.rings * ref.sides
+			fmt.Fprintf(out, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t\n", ref.name, triangles, size,
+				benchDuration(avg.load), benchDuration(avg.raster), benchDuration(avg.finish), benchDuration(avg.encode), benchDuration(avg.total()))
+
+			if !*dryRun {
+				info, _ := os.Stat(paths[i])
+				sample := RenderSample{Triangles: triangles, Views: 1, Pixels: size * size, Seconds: avg.total().Seconds()}
+				if info != nil {
+					sample.FileSize = info.Size()
+				}
+				if err := recordRenderSample(sample); err != nil {
+					log.Printf("Failed to save render history: %v", err)
+				}
+			}
+		}
+	}
+	out.Flush()
+
+	// Render the medium mesh at the standard size with more and more workers
+	fmt.Println()
+	out = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(out, "workers\trenders/s\t")
+	best, bestRate := 1, 0.0
+	for workers := 1; ; workers *= 2 {
+		workers = min(workers, runtime.NumCPU())
+		rate, err := benchThroughput(paths[1], workers, *runs, dir)
+		if err != nil {
+			log.Printf("Error rendering with %d workers: %v", workers, err)
+			return 1
+		}
+		fmt.Fprintf(out, "%d\t%.2f\t\n", workers, rate)
+		if rate > bestRate*MinWorkerGain {
+			best, bestRate = workers, rate
+		}
+		if workers == runtime.NumCPU() {
+			break
+		}
+	}
+	out.Flush()
+	fmt.Printf("\nBest worker count: %d\n", best)
+
+	if *dryRun {
+		return 0
+	}
+	data, err := json.MarshalIndent(Calibration{Workers: best, MeasuredAt: time.Now().UTC()}, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding calibration: %v", err)
+		return 1
+	}
+	if err := os.WriteFile(CalibrationFile, data, 0644); err != nil {
+		log.Printf("Error saving calibration: %v", err)
+		return 1
+	}
+	fmt.Printf("Saved %s and %s\n", CalibrationFile, HistoryFile)
+	return 0
+}
+
+// Render a standard view of an STL at size×size, timing each phase
+func benchRender(path string, size int, outputPath string) (benchTiming, error) {
+	var timing benchTiming
+	started := time.Now()
+	sc, err := loadScene(context.Background(), Job{STLPath: path})
+	if err != nil {
+		return timing, err
+	}
+	timing.load = time.Since(started)
+
+	started = time.Now()
+	context := renderContext(sc, defaultCamera, size, size)
+	timing.raster = time.Since(started)
+
+	started = time.Now()
+	im := applyBrandingFrame(sc.finishView(context, defaultCamera))
+	timing.finish = time.Since(started)
+
+	started = time.Now()
+	if err := saveImage(outputPath, im, "png"); err != nil {
+		return timing, err
+	}
+	timing.encode = time.Since(started)
+	return timing, nil
+}
+
+// Renders per second with this many running at once, each worker rendering
+// runs times
+func benchThroughput(path string, workers, runs int, dir string) (float64, error) {
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	started := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			output := filepath.Join(dir, fmt.Sprintf("worker-%d.png", w))
+			for run := 0; run < runs; run++ {
+				if _, err := benchRender(path, Width, output); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return 0, err
+	}
+	return float64(workers*runs) / time.Since(started).Seconds(), nil
+}
+
+func benchDuration(d time.Duration) string {
+	return fmt.Sprintf("%.3fs", d.Seconds())
+}
+
+// A torus with its hole along Z, about the size of a typical print in mm
+func torusMesh(rings, sides int) *fauxgl.Mesh {
+	const major, minor = 40, 15
+	point := func(i, j int) fauxgl.Vector {
+		u := 2 * math.Pi * float64(i%rings) / float64(rings)
+		v := 2 * math.Pi * float64(j%sides) / float64(sides)
+		r := major + minor*math.Cos(v)
+		return fauxgl.Vector{r * math.Cos(u), r * math.Sin(u), minor * math.Sin(v)}
+	}
+	mesh := fauxgl.NewEmptyMesh()
+	for i := 0; i < rings; i++ {
+		for j := 0; j < sides; j++ {
+			a, b, c, d := point(i, j), point(i+1, j), point(i+1, j+1), point(i, j+1)
+			mesh.Triangles = append(mesh.Triangles,
+				fauxgl.NewTriangleForPoints(a, b, c),
+				fauxgl.NewTriangleForPoints(a, c, d))
+		}
+	}
+	return mesh
+}
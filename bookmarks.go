@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	MaxBookmarks       = 50 // Most camera bookmarks kept per model
+	MaxBookmarkNameLen = 64
+	MaxViewZoom        = 20
+)
+
+// Camera orbiting a point of the model, which is fitted to the bi-unit cube
+type CameraView struct {
+	Azimuth   float64    `json:"azimuth"`   // Degrees around the vertical axis; 45 is the standard thumbnail
+	Elevation float64    `json:"elevation"` // Degrees above the horizon
+	Zoom      float64    `json:"zoom"`      // Magnification over the standard framing
+	Target    [3]float64 `json:"target"`    // Point looked at, in normalized model units
+}
+
+// A named camera view saved for one model
+type CameraBookmark struct {
+	Name    string     `json:"name"`
+	View    CameraView `json:"view"`
+	SavedAt time.Time  `json:"saved_at"`
+}
+
+func (v CameraView) camera() camera {
+	cam := orbitCamera(v.Azimuth, v.Elevation)
+	target := fauxgl.Vector{v.Target[0], v.Target[1], v.Target[2]}
+	cam.eye = cam.eye.DivScalar(v.Zoom).Add(target)
+	cam.center = target
+	return cam
+}
+
+// Read the view_* form fields: azimuth and elevation in degrees, zoom, and
+// target as "x,y,z". Returns nil when none are given.
+func parseCameraView(r *http.Request) (*CameraView, error) {
+	view := CameraView{Azimuth: 45, Elevation: DefaultElevation, Zoom: 1}
+	given := false
+	for _, field := range []struct {
+		name     string
+		value    *float64
+		min, max float64
+	}{
+		{"view_azimuth", &view.Azimuth, -360, 360},
+		{"view_elevation", &view.Elevation, -89, 89},
+		{"view_zoom", &view.Zoom, 0.1, MaxViewZoom},
+	} {
+		v := r.FormValue(field.name)
+		if v == "" {
+			continue
+		}
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil || x < field.min || x > field.max {
+			return nil, fmt.Errorf("%s must be between %g and %g", field.name, field.min, field.max)
+		}
+		*field.value = x
+		given = true
+	}
+	if v := r.FormValue("view_target"); v != "" {
+		parts := strings.Split(v, ",")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("view_target must be x,y,z")
+		}
+		for i, p := range parts {
+			x, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil || math.Abs(x) > 1 {
+				return nil, fmt.Errorf("view_target coordinates must be between -1 and 1")
+			}
+			view.Target[i] = x
+		}
+		given = true
+	}
+	if !given {
+		return nil, nil
+	}
+	return &view, nil
+}
+
+// Bookmark of a model by name
+func (m *modelRecord) bookmark(name string) (CameraBookmark, bool) {
+	for _, b := range m.Bookmarks {
+		if b.Name == name {
+			return b, true
+		}
+	}
+	return CameraBookmark{}, false
+}
+
+// Load a model's record for a bookmark request, answering 404 for models
+// never rendered. Returns nil when the response has been written.
+func bookmarkedModel(w http.ResponseWriter, r *http.Request) *modelRecord {
+	hash := r.PathValue("hash")
+	if !fileHashPattern.MatchString(hash) {
+		notFound(w, r)
+		return nil
+	}
+	record, err := loadModelRecord(r.Context(), hash)
+	if err != nil {
+		log.Printf("Failed to load model %s: %v", hash, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+		return nil
+	}
+	if record == nil {
+		apiError(w, r, http.StatusNotFound, ErrNotFound, "Model not found")
+		return nil
+	}
+	return record
+}
+
+// GET /m/{hash}/bookmarks
+func listBookmarksHandler(w http.ResponseWriter, r *http.Request) {
+	record := bookmarkedModel(w, r)
+	if record == nil {
+		return
+	}
+	bookmarks := record.Bookmarks
+	if bookmarks == nil {
+		bookmarks = []CameraBookmark{}
+	}
+	writeJSON(w, http.StatusOK, bookmarks)
+}
+
+// POST /m/{hash}/bookmarks with a name and view_* fields. Saving under an
+// existing name replaces that bookmark.
+func saveBookmarkHandler(w http.ResponseWriter, r *http.Request) {
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > MaxBookmarkNameLen {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, fmt.Sprintf("name must be 1 to %d characters", MaxBookmarkNameLen))
+		return
+	}
+	view, err := parseCameraView(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if view == nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Give at least one of view_azimuth, view_elevation, view_zoom, view_target")
+		return
+	}
+
+	modelMu.Lock()
+	defer modelMu.Unlock()
+	record := bookmarkedModel(w, r)
+	if record == nil {
+		return
+	}
+	bookmark := CameraBookmark{Name: name, View: *view, SavedAt: time.Now()}
+	replaced := false
+	for i, b := range record.Bookmarks {
+		if b.Name == name {
+			record.Bookmarks[i] = bookmark
+			replaced = true
+		}
+	}
+	if !replaced {
+		if len(record.Bookmarks) >= MaxBookmarks {
+			apiError(w, r, http.StatusConflict, ErrLimitReached, fmt.Sprintf("A model can have at most %d bookmarks", MaxBookmarks))
+			return
+		}
+		record.Bookmarks = append(record.Bookmarks, bookmark)
+	}
+	if err := saveModelRecord(r.Context(), record); err != nil {
+		log.Printf("Failed to save bookmark for %s: %v", record.FileHash, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to save bookmark")
+		return
+	}
+	writeJSON(w, http.StatusOK, bookmark)
+}
+
+// DELETE /m/{hash}/bookmarks/{name}
+func deleteBookmarkHandler(w http.ResponseWriter, r *http.Request) {
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+	modelMu.Lock()
+	defer modelMu.Unlock()
+	record := bookmarkedModel(w, r)
+	if record == nil {
+		return
+	}
+	name := r.PathValue("name")
+	for i, b := range record.Bookmarks {
+		if b.Name == name {
+			record.Bookmarks = append(record.Bookmarks[:i], record.Bookmarks[i+1:]...)
+			if err := saveModelRecord(r.Context(), record); err != nil {
+				log.Printf("Failed to delete bookmark for %s: %v", record.FileHash, err)
+				apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to delete bookmark")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	apiError(w, r, http.StatusNotFound, ErrNotFound, "Bookmark not found")
+}
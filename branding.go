@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// Operator's branding frame, loaded on startup from config.BrandingFrame
+var (
+	brandingFrame image.Image
+	frameMu       sync.Mutex
+	scaledFrames  = make(map[image.Point]image.Image) // Frame resized to each output size used so far
+)
+
+// Load the branding frame, if one is configured
+func loadBrandingFrame() error {
+	if config.BrandingFrame == "" {
+		return nil
+	}
+	file, err := os.Open(config.BrandingFrame)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	im, err := png.Decode(file)
+	if err != nil {
+		return fmt.Errorf("branding frame must be a PNG: %w", err)
+	}
+	brandingFrame = im
+	return nil
+}
+
+// Composite the branding frame over a finished image. The frame is stretched
+// to the image's size; its transparent parts let the render show through.
+func applyBrandingFrame(im image.Image) image.Image {
+	if brandingFrame == nil {
+		return im
+	}
+	b := im.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), im, b.Min, draw.Src)
+	draw.Draw(dst, dst.Bounds(), scaledFrame(b.Size()), image.Point{}, draw.Over)
+	return dst
+}
+
+// Composite the part of the branding frame over rows y0 and on of a
+// size.X×size.Y image, for images rendered a band at a time
+func applyBrandingStrip(strip *image.NRGBA, y0 int, size image.Point) {
+	if brandingFrame == nil {
+		return
+	}
+	fb, sb := brandingFrame.Bounds(), strip.Bounds()
+	sx, sy := float64(size.X)/float64(fb.Dx()), float64(size.Y)/float64(fb.Dy())
+	toStrip := f64.Aff3{
+		sx, 0, float64(sb.Min.X) - float64(fb.Min.X)*sx,
+		0, sy, float64(sb.Min.Y-y0) - float64(fb.Min.Y)*sy,
+	}
+	draw.CatmullRom.Transform(strip, toStrip, brandingFrame, fb, draw.Over, nil)
+}
+
+// The frame at the given size, resized once per size
+func scaledFrame(size image.Point) image.Image {
+	frameMu.Lock()
+	defer frameMu.Unlock()
+	if frame, ok := scaledFrames[size]; ok {
+		return frame
+	}
+	frame := image.NewNRGBA(image.Rectangle{Max: size})
+	draw.CatmullRom.Scale(frame, frame.Bounds(), brandingFrame, brandingFrame.Bounds(), draw.Src, nil)
+	scaledFrames[size] = frame
+	return frame
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"sort"
+
+	"github.com/fogleman/fauxgl"
+	"golang.org/x/image/draw"
+)
+
+const (
+	MaxBuildFrames  = 120 // Most frames of a build animation, all of which are held in memory to encode the GIF
+	BuildGIFSize    = 512 // Width and height of build animation frames, in pixels
+	BuildFrameDelay = 8   // Time each build frame is shown, in hundredths of a second
+	BuildHoldDelay  = 200 // Time the finished model is shown before the animation loops
+)
+
+// Render the model being built up from the bed into an animated GIF, like a
+// print timelapse: each of frames adds an even slice of the model's height,
+// drawing whole triangles once their center is below the top of the slice,
+// so G-code appears move by move and layer by layer. The frames share one
+// palette, taken from the finished model. onFrame, if set, is called with
+// each frame as soon as it's rendered. Stops between frames once ctx is done.
+func renderBuildGIF(ctx context.Context, sc *scene, cam camera, frames int, outputPath string, onFrame func(i int, im image.Image)) error {
+	full := sc.mesh
+	box := full.BoundingBox()
+	triangles := append([]*fauxgl.Triangle(nil), full.Triangles...)
+	centers := make(map[*fauxgl.Triangle]float64, len(triangles))
+	for _, t := range triangles {
+		centers[t] = (t.V1.Position.Z + t.V2.Position.Z + t.V3.Position.Z) / 3
+	}
+	sort.SliceStable(triangles, func(i, j int) bool { return centers[triangles[i]] < centers[triangles[j]] })
+	defer func() { sc.mesh = full }()
+
+	// The finished model is drawn first for the palette, and reused as the
+	// last frame
+	last := buildFrame(sc, cam)
+	pal := buildPalette(last)
+	anim := &gif.GIF{
+		Image: make([]*image.Paletted, frames),
+		Delay: make([]int, frames),
+		Config: image.Config{
+			ColorModel: pal,
+			Width:      BuildGIFSize,
+			Height:     BuildGIFSize,
+		},
+	}
+	shown := 0
+	for i := 0; i < frames; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		im := last
+		if i < frames-1 {
+			top := box.Min.Z + (box.Max.Z-box.Min.Z)*float64(i+1)/float64(frames)
+			n := sort.Search(len(triangles), func(k int) bool { return centers[triangles[k]] > top })
+			// The first frame shows something even when the bottom slice is empty
+			shown = max(shown, n, 1)
+			sc.mesh = fauxgl.NewTriangleMesh(triangles[:shown])
+			im = buildFrame(sc, cam)
+		}
+		paletted := image.NewPaletted(image.Rect(0, 0, BuildGIFSize, BuildGIFSize), pal)
+		draw.FloydSteinberg.Draw(paletted, paletted.Bounds(), im, image.Point{})
+		anim.Image[i], anim.Delay[i] = paletted, BuildFrameDelay
+		if onFrame != nil {
+			onFrame(i, im)
+		}
+	}
+	anim.Delay[frames-1] = BuildHoldDelay
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := gif.EncodeAll(file, anim); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// One frame of a build animation, rendered at full size like a spin frame and
+// scaled down to BuildGIFSize
+func buildFrame(sc *scene, cam camera) image.Image {
+	im := applyBrandingFrame(sc.withAnnotations(renderView(sc, cam, Width, Height), cam))
+	small := image.NewNRGBA(image.Rect(0, 0, BuildGIFSize, BuildGIFSize))
+	draw.CatmullRom.Scale(small, small.Bounds(), im, im.Bounds(), draw.Src, nil)
+	return small
+}
+
+// A GIF palette for an image: white for the background, then the most common
+// colors, counted at 5 bits per channel and averaged within each bucket
+func buildPalette(im image.Image) color.Palette {
+	type bucket struct {
+		r, g, b, n int
+	}
+	buckets := make(map[int]*bucket)
+	bounds := im.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(im.At(x, y)).(color.NRGBA)
+			key := int(c.R>>3)<<10 | int(c.G>>3)<<5 | int(c.B>>3)
+			b, ok := buckets[key]
+			if !ok {
+				b = &bucket{}
+				buckets[key] = b
+			}
+			b.r, b.g, b.b, b.n = b.r+int(c.R), b.g+int(c.G), b.b+int(c.B), b.n+1
+		}
+	}
+	sorted := make([]*bucket, 0, len(buckets))
+	for _, b := range buckets {
+		sorted = append(sorted, b)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].n > sorted[j].n })
+	pal := color.Palette{color.White}
+	for _, b := range sorted {
+		if len(pal) == 256 {
+			break
+		}
+		pal = append(pal, color.NRGBA{uint8(b.r / b.n), uint8(b.g / b.n), uint8(b.b / b.n), 255})
+	}
+	return pal
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/fogleman/fauxgl"
+)
+
+// GET /api/v1/jobs/{id}/bundle.zip
+//
+// Everything a finished job produced in one download: its outputs, the model
+// stats as stats.json, and the mesh as mesh.stl, .obj, .ply, and .3mf. The
+// mesh is the processed one when the options changed it, the upload
+// otherwise. The archive is written straight to the response as it's built.
+func jobBundleHandler(w http.ResponseWriter, r *http.Request) {
+	noteRequestJob(r, r.PathValue("id"))
+	job, _, ok := getJob(r.PathValue("id"))
+	if !ok {
+		apiError(w, r, http.StatusNotFound, ErrNotFound, "Job not found")
+		return
+	}
+	if job.Status != JobDone {
+		apiError(w, r, http.StatusConflict, ErrJobNotFinished, "Job not finished")
+		return
+	}
+
+	// Load the mesh before answering, so failures still get an error status.
+	// A missing upload only leaves the mesh out.
+	ctx := withTenant(r.Context(), job.Tenant)
+	meshObject := uploadObject(job.FileHash)
+	if job.MeshFile != "" {
+		meshObject = outputObject(job.MeshFile)
+	}
+	mesh, err := loadStoredMesh(ctx, meshObject)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Failed to load mesh for bundle of job %s: %v", job.ID, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load mesh")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="bundle.zip"`)
+	archive := zip.NewWriter(w)
+	if err := writeBundle(ctx, archive, job, meshObject, mesh); err != nil {
+		// Too late for an error status; the archive is left without its
+		// directory, which unzip tools report as damaged
+		log.Printf("Failed to write bundle of job %s: %v", job.ID, err)
+		return
+	}
+	if err := archive.Close(); err != nil {
+		log.Printf("Failed to write bundle of job %s: %v", job.ID, err)
+	}
+}
+
+// Add every file of the bundle to the archive
+func writeBundle(ctx context.Context, archive *zip.Writer, job Job, meshObject string, mesh *fauxgl.Mesh) error {
+	modified := job.UpdatedAt
+	for _, name := range job.Outputs {
+		// Images and spin ZIPs are compressed already
+		if err := copyStoredFile(ctx, archive, outputObject(name), name, zip.Store, modified); err != nil {
+			return err
+		}
+	}
+
+	if job.Stats != nil {
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: "stats.json", Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		encoder := json.NewEncoder(entry)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(job.Stats); err != nil {
+			return err
+		}
+	}
+
+	if mesh == nil {
+		return nil
+	}
+	if err := copyStoredFile(ctx, archive, meshObject, "mesh.stl", zip.Deflate, modified); err != nil {
+		return err
+	}
+	for _, format := range []struct {
+		name  string
+		write func(io.Writer, *fauxgl.Mesh) error
+	}{{"mesh.obj", writeOBJ}, {"mesh.ply", writePLY}, {"mesh.3mf", write3MF}} {
+		entry, err := archive.CreateHeader(&zip.FileHeader{Name: format.name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		if err := format.write(entry, mesh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stream a stored file into the archive as name
+func copyStoredFile(ctx context.Context, archive *zip.Writer, object, name string, method uint16, modified time.Time) error {
+	file, err := storage.Open(ctx, object)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
+
+// Load a stored STL, through a temporary local copy
+func loadStoredMesh(ctx context.Context, object string) (*fauxgl.Mesh, error) {
+	src, err := storage.Open(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	tmp, err := os.CreateTemp(config.WorkDir, "bundle-*.stl")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return loadMesh(tmp.Name())
+}
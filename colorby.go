@@ -0,0 +1,233 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/fogleman/fauxgl"
+)
+
+// Color stop of a gradient, t in [0, 1]
+type colorStop struct {
+	t     float64
+	color fauxgl.Color
+}
+
+// Piecewise-linear color gradient
+type gradient []colorStop
+
+func (g gradient) at(t float64) fauxgl.Color {
+	t = math.Max(0, math.Min(1, t))
+	for i := 1; i < len(g); i++ {
+		if t <= g[i].t {
+			span := g[i].t - g[i-1].t
+			if span <= 0 {
+				return g[i].color
+			}
+			return g[i-1].color.Lerp(g[i].color, (t-g[i-1].t)/span)
+		}
+	}
+	return g[len(g)-1].color
+}
+
+// Palettes analysis coloring can use, by name. Viridis and cividis stay
+// ordered in lightness and readable with any common color vision deficiency.
+var palettes = map[string]gradient{
+	// Hypsometric tint: water blue, lowland green, highland brown, snow
+	"topographic": {
+		{0.00, fauxgl.HexColor("#2b5c8a")},
+		{0.15, fauxgl.HexColor("#4f9a5a")},
+		{0.45, fauxgl.HexColor("#c8c46a")},
+		{0.75, fauxgl.HexColor("#8c5a3c")},
+		{1.00, fauxgl.HexColor("#f5f5f5")},
+	},
+	// Low blue, middle white, high red
+	"diverging": {
+		{0.0, fauxgl.HexColor("#2c5aa0")},
+		{0.5, fauxgl.HexColor("#f0f0f0")},
+		{1.0, fauxgl.HexColor("#c0392b")},
+	},
+	"viridis": {
+		{0.000, fauxgl.HexColor("#440154")},
+		{0.125, fauxgl.HexColor("#482878")},
+		{0.250, fauxgl.HexColor("#3e4989")},
+		{0.375, fauxgl.HexColor("#31688e")},
+		{0.500, fauxgl.HexColor("#26828e")},
+		{0.625, fauxgl.HexColor("#1f9e89")},
+		{0.750, fauxgl.HexColor("#35b779")},
+		{0.875, fauxgl.HexColor("#6ece58")},
+		{1.000, fauxgl.HexColor("#fde725")},
+	},
+	"cividis": {
+		{0.000, fauxgl.HexColor("#00224e")},
+		{0.125, fauxgl.HexColor("#123570")},
+		{0.250, fauxgl.HexColor("#3b496c")},
+		{0.375, fauxgl.HexColor("#575d6d")},
+		{0.500, fauxgl.HexColor("#707173")},
+		{0.625, fauxgl.HexColor("#8a8779")},
+		{0.750, fauxgl.HexColor("#a69d75")},
+		{0.875, fauxgl.HexColor("#c4b56c")},
+		{1.000, fauxgl.HexColor("#fee838")},
+	},
+}
+
+// Palette of each color_by mode when the request doesn't pick one
+var defaultPalettes = map[string]string{"height": "topographic", "curvature": "diverging", "layer": "viridis"}
+
+const (
+	DefaultLayerHeight = 0.2  // Band thickness of the layer coloring, in mm, the most common layer height
+	MinLayerHeight     = 0.01 // Thinnest layer_height accepted, in mm
+	MaxLayerHeight     = 10.0 // Thickest layer_height accepted, in mm
+	MaxColoredLayers   = 5000 // Most bands the layer coloring draws; thicker ones are used for taller models
+	LayerShade         = 0.85 // Brightness of every other band, so neighboring layers stand apart
+)
+
+// Color vertices by their Z height, bottom to top. Returns the height.
+func colorByHeight(mesh *fauxgl.Mesh, palette gradient) float64 {
+	box := mesh.BoundingBox()
+	height := box.Max.Z - box.Min.Z
+	for _, t := range mesh.Triangles {
+		for _, v := range []*fauxgl.Vertex{&t.V1, &t.V2, &t.V3} {
+			f := 0.5
+			if height > 0 {
+				f = (v.Position.Z - box.Min.Z) / height
+			}
+			v.Color = palette.at(f)
+		}
+	}
+	return height
+}
+
+// Color each triangle by the print layer it is in, bottom to top in bands of
+// layerHeight from the model's bottom, every other band slightly darker, as
+// a sliced print would be built. Triangles lying on a band's bottom, like
+// G-code ribbons, belong to it, so each ribbon or tube of G-code gets the
+// band of its layer when the layers are layerHeight apart. Returns the
+// number of bands drawn.
+func colorByLayer(mesh *fauxgl.Mesh, palette gradient, layerHeight float64) int {
+	if len(mesh.Triangles) == 0 {
+		return 0
+	}
+	box := mesh.BoundingBox()
+	layerHeight = math.Max(layerHeight, (box.Max.Z-box.Min.Z)/MaxColoredLayers)
+	layers := make([]int, len(mesh.Triangles))
+	count := 1
+	for i, t := range mesh.Triangles {
+		z := (t.V1.Position.Z + t.V2.Position.Z + t.V3.Position.Z) / 3
+		layers[i] = int((z-box.Min.Z)/layerHeight + 1e-3)
+		count = max(count, layers[i]+1)
+	}
+	for i, t := range mesh.Triangles {
+		f := 0.5
+		if count > 1 {
+			f = float64(layers[i]) / float64(count-1)
+		}
+		c := palette.at(f)
+		if layers[i]%2 == 1 {
+			c = fauxgl.Color{c.R * LayerShade, c.G * LayerShade, c.B * LayerShade, c.A}
+		}
+		t.V1.Color, t.V2.Color, t.V3.Color = c, c, c
+	}
+	return count
+}
+
+// Color vertices by estimated mean curvature. Curvature at a vertex is
+// approximated from its neighbors: for a sphere of radius R, a neighbor q of p
+// satisfies (q-p)·n = -|q-p|²/(2R). Values are normalized by the 95th
+// percentile so a few noisy spikes don't wash out the rest of the model;
+// that curvature, at either end of the palette, is returned.
+func colorByCurvature(mesh *fauxgl.Mesh, palette gradient) float64 {
+	// Weld vertices by position; STL stores each triangle's corners separately
+	index := make(map[fauxgl.Vector]int)
+	var normals []fauxgl.Vector
+	neighbors := make(map[int]map[int]bool)
+	var positions []fauxgl.Vector
+	vertexID := func(p fauxgl.Vector) int {
+		if id, ok := index[p]; ok {
+			return id
+		}
+		id := len(positions)
+		index[p] = id
+		positions = append(positions, p)
+		normals = append(normals, fauxgl.Vector{})
+		neighbors[id] = make(map[int]bool)
+		return id
+	}
+
+	for _, t := range mesh.Triangles {
+		ids := [3]int{vertexID(t.V1.Position), vertexID(t.V2.Position), vertexID(t.V3.Position)}
+		n := t.V2.Position.Sub(t.V1.Position).Cross(t.V3.Position.Sub(t.V1.Position)) // Area-weighted
+		for i, id := range ids {
+			normals[id] = normals[id].Add(n)
+			neighbors[id][ids[(i+1)%3]] = true
+			neighbors[id][ids[(i+2)%3]] = true
+		}
+	}
+
+	curvature := make([]float64, len(positions))
+	for id, p := range positions {
+		n := normals[id]
+		if n.Length() == 0 || len(neighbors[id]) == 0 {
+			continue
+		}
+		n = n.Normalize()
+		var sum float64
+		for nb := range neighbors[id] {
+			d := positions[nb].Sub(p)
+			if l2 := d.Dot(d); l2 > 0 {
+				sum += -2 * d.Dot(n) / l2
+			}
+		}
+		curvature[id] = sum / float64(len(neighbors[id]))
+	}
+
+	abs := make([]float64, len(curvature))
+	for i, c := range curvature {
+		abs[i] = math.Abs(c)
+	}
+	sort.Float64s(abs)
+	scale := 1.0
+	if len(abs) > 0 {
+		if p := abs[int(0.95*float64(len(abs)-1))]; p > 0 {
+			scale = p
+		}
+	}
+
+	for _, t := range mesh.Triangles {
+		for _, v := range []*fauxgl.Vertex{&t.V1, &t.V2, &t.V3} {
+			c := curvature[index[v.Position]] / scale
+			v.Color = palette.at(0.5 + 0.5*c)
+		}
+	}
+	return scale
+}
+
+// Phong-style shader that takes the surface color from the interpolated
+// vertex colors
+type vertexColorShader struct {
+	matrix         fauxgl.Matrix
+	lightDirection fauxgl.Vector
+	cameraPosition fauxgl.Vector
+}
+
+func newVertexColorShader(matrix fauxgl.Matrix, lightDirection, cameraPosition fauxgl.Vector) *vertexColorShader {
+	return &vertexColorShader{matrix, lightDirection, cameraPosition}
+}
+
+func (s *vertexColorShader) Vertex(v fauxgl.Vertex) fauxgl.Vertex {
+	v.Output = s.matrix.MulPositionW(v.Position)
+	return v
+}
+
+func (s *vertexColorShader) Fragment(v fauxgl.Vertex) fauxgl.Color {
+	light := fauxgl.Gray(0.2)
+	if diffuse := math.Max(v.Normal.Dot(s.lightDirection), 0); diffuse > 0 {
+		light = light.Add(fauxgl.Gray(diffuse * 0.8))
+		camera := s.cameraPosition.Sub(v.Position).Normalize()
+		reflected := s.lightDirection.Negate().Reflect(v.Normal)
+		if specular := math.Max(camera.Dot(reflected), 0); specular > 0 {
+			light = light.Add(fauxgl.Gray(math.Pow(specular, 100) * 0.3))
+		}
+	}
+	return v.Color.Mul(light).Min(fauxgl.White).Alpha(v.Color.A)
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	MaxComposeModels = 20       // Most files accepted by one composition request
+	MaxComposeUpload = 64 << 20 // Multipart memory limit for composition uploads
+	UnionGridSize    = 64       // Buckets along each side of the index used for inside tests
+)
+
+// Placement of one part in a composed scene, applied in order: scale,
+// rotation about X, then Y, then Z, then translation
+type PartTransform struct {
+	Translate [3]float64 `json:"translate"` // In mm
+	Rotate    [3]float64 `json:"rotate"`    // In degrees
+	Scale     float64    `json:"scale"`     // Uniform; 1 when 0
+}
+
+// Matrix for the transform
+func (t PartTransform) matrix() fauxgl.Matrix {
+	m := fauxgl.Identity()
+	if t.Scale != 0 {
+		m = m.Scale(fauxgl.Vector{t.Scale, t.Scale, t.Scale})
+	}
+	for axis, v := range []fauxgl.Vector{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}} {
+		if t.Rotate[axis] != 0 {
+			m = m.Rotate(v, fauxgl.Radians(t.Rotate[axis]))
+		}
+	}
+	return m.Translate(fauxgl.Vector{t.Translate[0], t.Translate[1], t.Translate[2]})
+}
+
+// POST /api/v1/compose with several file fields, an optional transforms
+// field holding a JSON array with one PartTransform per file, and union=true
+// to merge overlapping parts into one shell. The parts are placed in one
+// scene, in mm, which is stored and rendered like an upload; the job links
+// the combined STL as its mesh once done.
+func composeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, r, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Invalid request method")
+		return
+	}
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+	if err := r.ParseMultipartForm(MaxComposeUpload); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Failed to read files")
+		return
+	}
+
+	opts, err := parseRenderOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	analysis, err := parseAnalysisOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if _, err := parseGroupID(r); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 || len(headers) > MaxComposeModels {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, fmt.Sprintf("Send between 1 and %d files", MaxComposeModels))
+		return
+	}
+	transforms := make([]PartTransform, len(headers))
+	if v := r.FormValue("transforms"); v != "" {
+		var given []PartTransform
+		if err := json.Unmarshal([]byte(v), &given); err != nil {
+			apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "transforms must be a JSON array of {translate, rotate, scale} objects")
+			return
+		}
+		if len(given) > len(headers) {
+			apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "More transforms than files")
+			return
+		}
+		copy(transforms, given)
+	}
+	for _, t := range transforms {
+		if t.Scale < 0 {
+			apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "scale must be positive")
+			return
+		}
+	}
+	union := false
+	if v := r.FormValue("union"); v != "" {
+		if union, err = strconv.ParseBool(v); err != nil {
+			apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "union must be true or false")
+			return
+		}
+	}
+
+	workDir, err := newJobWorkDir()
+	if err != nil {
+		log.Printf("Failed to create work dir: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to save files")
+		return
+	}
+	keepWorkDir := false
+	defer func() {
+		if !keepWorkDir {
+			os.RemoveAll(workDir)
+		}
+	}()
+
+	// Save, scan, and load every part in mm, then place it
+	key := sha256.New()
+	fmt.Fprintf(key, "compose %s %t\n", analysis.Units, union)
+	parts := make([]*fauxgl.Mesh, len(headers))
+	for i, header := range headers {
+		path := filepath.Join(workDir, fmt.Sprintf("part-%d.stl", i))
+		fileHash, err := saveUploadPart(header, path)
+		if err != nil {
+			apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to save file")
+			return
+		}
+		if !scanUpload(w, r, path, fileHash) {
+			return
+		}
+		placement, _ := json.Marshal(transforms[i])
+		fmt.Fprintf(key, "%s %s\n", fileHash, placement)
+
+		mesh, err := loadMesh(path)
+		if err != nil {
+			apiError(w, r, http.StatusBadRequest, ErrUnsupportedFormat, fmt.Sprintf("Failed to read %s", header.Filename))
+			return
+		}
+		os.Remove(path)
+		size := mesh.BoundingBox().Size()
+		units, _ := resolveUnits(analysis.Units, Dimensions{size.X, size.Y, size.Z})
+		mesh.Transform(fauxgl.Scale(fauxgl.Vector{1, 1, 1}.MulScalar(unitScales[units])))
+		mesh.Transform(transforms[i].matrix())
+		parts[i] = mesh
+	}
+
+	fileHash := hex.EncodeToString(key.Sum(nil))
+	analysis.Units = "mm"
+	if respondCached(w, r, outputCacheKey(tenantOf(r.Context()), fileHash, opts, analysis)) {
+		return
+	}
+
+	scene := fauxgl.NewEmptyMesh()
+	if union {
+		scene = unionParts(parts)
+	} else {
+		for _, part := range parts {
+			scene.Add(part)
+		}
+	}
+	if err := scene.SaveSTL(filepath.Join(workDir, "input.stl")); err != nil {
+		log.Printf("Failed to save composed scene: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to compose scene")
+		return
+	}
+	keepWorkDir = submitRender(w, r, workDir, fileHash, opts, analysis, true)
+}
+
+// Merge parts into one shell by dropping every triangle that lies inside
+// another part. Triangles are kept or dropped whole, by their centroid, so
+// seams where parts cross are as ragged as the triangles there are large;
+// fine for previews, and slicers fuse overlapping solids anyway.
+func unionParts(parts []*fauxgl.Mesh) *fauxgl.Mesh {
+	indexes := make([]*solidIndex, len(parts))
+	for i, part := range parts {
+		indexes[i] = newSolidIndex(part)
+	}
+	merged := fauxgl.NewEmptyMesh()
+	for i, part := range parts {
+		for _, t := range part.Triangles {
+			centroid := t.V1.Position.Add(t.V2.Position).Add(t.V3.Position).DivScalar(3)
+			inside := false
+			for j, index := range indexes {
+				if j != i && index.contains(centroid) {
+					inside = true
+					break
+				}
+			}
+			if !inside {
+				merged.Triangles = append(merged.Triangles, t)
+			}
+		}
+	}
+	return merged
+}
+
+// Triangles of a closed mesh bucketed by their footprint on the XY plane,
+// for quick point-in-solid tests
+type solidIndex struct {
+	mesh    *fauxgl.Mesh
+	box     fauxgl.Box
+	cell    fauxgl.Vector // Bucket size along X and Y
+	buckets [][]int
+}
+
+func newSolidIndex(mesh *fauxgl.Mesh) *solidIndex {
+	box := mesh.BoundingBox()
+	size := box.Size()
+	s := &solidIndex{
+		mesh:    mesh,
+		box:     box,
+		cell:    fauxgl.Vector{math.Max(size.X, 1e-9) / UnionGridSize, math.Max(size.Y, 1e-9) / UnionGridSize, 0},
+		buckets: make([][]int, UnionGridSize*UnionGridSize),
+	}
+	for i, t := range mesh.Triangles {
+		x0, y0 := s.bucket(t.V1.Position.Min(t.V2.Position).Min(t.V3.Position))
+		x1, y1 := s.bucket(t.V1.Position.Max(t.V2.Position).Max(t.V3.Position))
+		for x := x0; x <= x1; x++ {
+			for y := y0; y <= y1; y++ {
+				s.buckets[y*UnionGridSize+x] = append(s.buckets[y*UnionGridSize+x], i)
+			}
+		}
+	}
+	return s
+}
+
+func (s *solidIndex) bucket(p fauxgl.Vector) (int, int) {
+	x := int((p.X - s.box.Min.X) / s.cell.X)
+	y := int((p.Y - s.box.Min.Y) / s.cell.Y)
+	return min(max(x, 0), UnionGridSize-1), min(max(y, 0), UnionGridSize-1)
+}
+
+// Whether p is inside the solid, by the parity of surface crossings on a
+// vertical ray up from it
+func (s *solidIndex) contains(p fauxgl.Vector) bool {
+	if p.X < s.box.Min.X || p.X > s.box.Max.X || p.Y < s.box.Min.Y || p.Y > s.box.Max.Y || p.Z < s.box.Min.Z || p.Z > s.box.Max.Z {
+		return false
+	}
+	x, y := s.bucket(p)
+	inside := false
+	for _, i := range s.buckets[y*UnionGridSize+x] {
+		t := s.mesh.Triangles[i]
+		if z, ok := verticalHit(t.V1.Position, t.V2.Position, t.V3.Position, p.X, p.Y); ok && z > p.Z {
+			inside = !inside
+		}
+	}
+	return inside
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+)
+
+const ConfigFile = "config.json" // Optional JSON file with operator settings
+
+// Operator settings loaded from ConfigFile. Every section is optional and
+// falls back to the defaults below.
+type Config struct {
+	AdminToken string `json:"admin_token"` // Bearer token for /admin endpoints; disabled when empty
+	WorkDir    string `json:"work_dir"`    // Base for per-job scratch directories, e.g. a tmpfs mount; system temp dir when empty
+
+	RenderTimeoutSecs int     `json:"render_timeout_secs"` // Fail renders that take longer than this; no limit when 0
+	Renderer          string  `json:"renderer"`            // What draws model views: "cpu" (default) or "gpu"
+	RaytraceSecs      int     `json:"raytrace_secs"`       // Longest a raytraced render keeps adding samples; no limit when 0
+	Workers           int     `json:"workers"`             // Renders run at once; the benchmarked count, or 1, when 0
+	InteractiveShare  float64 `json:"interactive_share"`   // Fraction of workers that only take interactive jobs; none when 0
+
+	QueueCapacity  int    `json:"queue_capacity"`   // Jobs that may wait for a worker
+	QueueFull      string `json:"queue_full"`       // What uploads do when the queue is full: "reject" or "wait"
+	QueueWaitSecs  int    `json:"queue_wait_secs"`  // How long "wait" holds an upload for a free slot before rejecting it
+	MemoryBudgetMB int    `json:"memory_budget_mb"` // Estimated memory renders may use at once; no limit when 0
+	MaxUploadMB    int    `json:"max_upload_mb"`    // Largest request body of /upload and /api/v1/convert; no limit when 0
+
+	Sandbox    SandboxConfig     `json:"sandbox"`
+	Warmup     WarmupConfig      `json:"warmup"`
+	Ingest     IngestConfig      `json:"ingest"`
+	Imports    ImportConfig      `json:"imports"`
+	Origin     OriginConfig      `json:"origin"`
+	RenderURLs RenderURLConfig   `json:"render_urls"`
+	Scanner    ScannerConfig     `json:"scanner"`
+	CORS       CORSConfig        `json:"cors"`
+	Printers   []PrinterProfile  `json:"printers"`    // Build volumes that jobs are checked against
+	PrintHosts []PrintHostConfig `json:"print_hosts"` // OctoPrint and PrusaLink instances whose G-code gets thumbnails
+	Presets    []FilterPreset    `json:"presets"`     // Named post-processing filter sets jobs can ask for
+
+	BrandingFrame string           `json:"branding_frame"` // PNG with transparency composited over every rendered image
+	UI            UIConfig         `json:"ui"`
+	Storage       StorageConfig    `json:"storage"`
+	Encryption    EncryptionConfig `json:"encryption"`
+	Privacy       bool             `json:"privacy"` // Strip identifying metadata from uploads before they are stored
+	Logging       LoggingConfig    `json:"logging"`
+	JobEvents     JobEventsConfig  `json:"job_events"`
+
+	Tenants []TenantConfig `json:"tenants"` // Teams with separate caches and storage; one shared namespace when empty
+
+	Stateless bool           `json:"stateless"` // Keep the queue, jobs, and output index in Redis so instances are interchangeable
+	Redis     RedisConfig    `json:"redis"`
+	JobStore  string         `json:"job_store"` // Where stateless mode keeps jobs and the output index: "redis" (default) or "postgres"
+	Postgres  PostgresConfig `json:"postgres"`
+}
+
+var config = Config{
+	QueueCapacity: 100,
+	RaytraceSecs:  60,
+	QueueFull:     QueueFullReject,
+	QueueWaitSecs: 30,
+	MaxUploadMB:   256,
+	Sandbox: SandboxConfig{
+		MemoryMB: 4096,
+		CPUSecs:  600,
+	},
+	Warmup: WarmupConfig{
+		MaxMB: 256,
+	},
+	Ingest: IngestConfig{
+		MaxMB: 256,
+	},
+	Imports: ImportConfig{
+		MaxMB: 256,
+	},
+	Origin: OriginConfig{
+		WaitSecs:            60,
+		MaxAgeSecs:          365 * 24 * 60 * 60,
+		MaxSize:             1024,
+		MaxRendersPerMinute: 60,
+	},
+	RenderURLs: RenderURLConfig{
+		WaitSecs:   60,
+		MaxAgeSecs: 365 * 24 * 60 * 60,
+	},
+	Scanner: ScannerConfig{
+		Action:        ScanActionReject,
+		QuarantineDir: "quarantine",
+		TimeoutSecs:   30,
+	},
+	CORS: CORSConfig{
+		AllowedMethods: []string{"GET", "POST", "OPTIONS"},
+		AllowedHeaders: []string{"Content-Type", CSRFHeaderName, UploadIDHeader, TenantHeader, TenantTokenHeader},
+		MaxAgeSecs:     600,
+	},
+	UI: UIConfig{
+		Title:         "No thumbnails, no party",
+		Headline:      "thumbnails ❣️",
+		Template:      "templates/index.html",
+		RecentRenders: 8,
+		Colors: ThemeColors{
+			Background: "#ffffff",
+			Text:       "#333333",
+			Accent:     "#888888",
+			Highlight:  "#f0f8ff",
+		},
+	},
+}
+
+// Load operator settings from JSON on startup
+func loadConfig() error {
+	data, err := os.ReadFile(ConfigFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // No config file, keep the defaults
+		}
+		return err
+	}
+	return json.Unmarshal(data, &config)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/fauxgl"
+)
+
+// Mesh formats the conversion API reads and writes
+var meshFormats = map[string]string{
+	"stl": "model/stl",
+	"obj": "model/obj",
+	"ply": "application/x-ply",
+	"3mf": "model/3mf",
+}
+
+// Load a mesh in any supported format, by file extension
+func loadMeshFormat(path, format string) (*fauxgl.Mesh, error) {
+	switch format {
+	case "stl":
+		return loadMesh(path)
+	case "obj":
+		return fauxgl.LoadOBJ(path)
+	case "ply":
+		return fauxgl.LoadPLY(path)
+	case "3mf":
+		return load3MF(path)
+	}
+	return nil, fmt.Errorf("unsupported mesh format %q", format)
+}
+
+// Write a mesh in any supported format
+func saveMeshFormat(path, format string, mesh *fauxgl.Mesh) error {
+	if format == "stl" {
+		return mesh.SaveSTL(path)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch format {
+	case "obj":
+		err = writeOBJ(file, mesh)
+	case "ply":
+		err = writePLY(file, mesh)
+	case "3mf":
+		err = write3MF(file, mesh)
+	default:
+		err = fmt.Errorf("unsupported mesh format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Shared vertex list and faces indexing into it, for formats that store them
+// that way
+func indexMesh(mesh *fauxgl.Mesh) ([]fauxgl.Vector, [][3]int) {
+	index := make(map[fauxgl.Vector]int)
+	var vertices []fauxgl.Vector
+	faces := make([][3]int, len(mesh.Triangles))
+	for i, t := range mesh.Triangles {
+		for j, p := range []fauxgl.Vector{t.V1.Position, t.V2.Position, t.V3.Position} {
+			id, ok := index[p]
+			if !ok {
+				id = len(vertices)
+				index[p] = id
+				vertices = append(vertices, p)
+			}
+			faces[i][j] = id
+		}
+	}
+	return vertices, faces
+}
+
+func writeOBJ(w io.Writer, mesh *fauxgl.Mesh) error {
+	bw := bufio.NewWriter(w)
+	vertices, faces := indexMesh(mesh)
+	for _, v := range vertices {
+		fmt.Fprintf(bw, "v %g %g %g\n", v.X, v.Y, v.Z)
+	}
+	for _, f := range faces {
+		fmt.Fprintf(bw, "f %d %d %d\n", f[0]+1, f[1]+1, f[2]+1)
+	}
+	return bw.Flush()
+}
+
+// Binary little-endian PLY
+func writePLY(w io.Writer, mesh *fauxgl.Mesh) error {
+	bw := bufio.NewWriter(w)
+	vertices, faces := indexMesh(mesh)
+	fmt.Fprintf(bw, "ply\nformat binary_little_endian 1.0\n")
+	fmt.Fprintf(bw, "element vertex %d\nproperty float x\nproperty float y\nproperty float z\n", len(vertices))
+	fmt.Fprintf(bw, "element face %d\nproperty list uchar int vertex_indices\nend_header\n", len(faces))
+	for _, v := range vertices {
+		binary.Write(bw, binary.LittleEndian, [3]float32{float32(v.X), float32(v.Y), float32(v.Z)})
+	}
+	for _, f := range faces {
+		bw.WriteByte(3)
+		binary.Write(bw, binary.LittleEndian, [3]int32{int32(f[0]), int32(f[1]), int32(f[2])})
+	}
+	return bw.Flush()
+}
+
+// Parts of the 3MF core model we read and write
+type threeMFModel struct {
+	XMLName   xml.Name           `xml:"model"`
+	Unit      string             `xml:"unit,attr,omitempty"`
+	Namespace string             `xml:"xmlns,attr,omitempty"`
+	Objects   []threeMFObject    `xml:"resources>object"`
+	Items     []threeMFBuildItem `xml:"build>item"`
+}
+
+type threeMFObject struct {
+	ID        int               `xml:"id,attr"`
+	Type      string            `xml:"type,attr,omitempty"`
+	Vertices  []threeMFVertex   `xml:"mesh>vertices>vertex"`
+	Triangles []threeMFTriangle `xml:"mesh>triangles>triangle"`
+}
+
+type threeMFVertex struct {
+	X float64 `xml:"x,attr"`
+	Y float64 `xml:"y,attr"`
+	Z float64 `xml:"z,attr"`
+}
+
+type threeMFTriangle struct {
+	V1 int `xml:"v1,attr"`
+	V2 int `xml:"v2,attr"`
+	V3 int `xml:"v3,attr"`
+}
+
+type threeMFBuildItem struct {
+	ObjectID  int    `xml:"objectid,attr"`
+	Transform string `xml:"transform,attr,omitempty"`
+}
+
+const threeMFNamespace = "http://schemas.microsoft.com/3dmanufacturing/core/2015/02"
+
+// Load every mesh object of a 3MF package, placed by its build items. Objects
+// built from components of other objects aren't supported.
+func load3MF(path string) (*fauxgl.Mesh, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open 3MF package: %w", err)
+	}
+	defer archive.Close()
+
+	var model threeMFModel
+	found := false
+	for _, f := range archive.File {
+		if !strings.EqualFold(f.Name, "3D/3dmodel.model") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = xml.NewDecoder(rc).Decode(&model)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse 3MF model: %w", err)
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("3MF package has no 3D/3dmodel.model")
+	}
+
+	objects := make(map[int]threeMFObject)
+	for _, o := range model.Objects {
+		objects[o.ID] = o
+	}
+	items := model.Items
+	if len(items) == 0 {
+		for _, o := range model.Objects {
+			items = append(items, threeMFBuildItem{ObjectID: o.ID})
+		}
+	}
+
+	mesh := fauxgl.NewEmptyMesh()
+	for _, item := range items {
+		object, ok := objects[item.ObjectID]
+		if !ok {
+			continue
+		}
+		matrix, err := parse3MFTransform(item.Transform)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range object.Triangles {
+			var points [3]fauxgl.Vector
+			for i, id := range []int{t.V1, t.V2, t.V3} {
+				if id < 0 || id >= len(object.Vertices) {
+					return nil, fmt.Errorf("3MF triangle references missing vertex %d", id)
+				}
+				v := object.Vertices[id]
+				points[i] = matrix.MulPosition(fauxgl.Vector{v.X, v.Y, v.Z})
+			}
+			mesh.Triangles = append(mesh.Triangles, fauxgl.NewTriangleForPoints(points[0], points[1], points[2]))
+		}
+	}
+	return mesh, nil
+}
+
+// A 3MF transform lists the 4×3 matrix row by row for row vectors; fauxgl
+// uses column vectors, so it goes in transposed
+func parse3MFTransform(s string) (fauxgl.Matrix, error) {
+	if strings.TrimSpace(s) == "" {
+		return fauxgl.Identity(), nil
+	}
+	fields := strings.Fields(s)
+	if len(fields) != 12 {
+		return fauxgl.Matrix{}, fmt.Errorf("invalid 3MF transform %q", s)
+	}
+	var m [12]float64
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return fauxgl.Matrix{}, fmt.Errorf("invalid 3MF transform %q", s)
+		}
+		m[i] = v
+	}
+	return fauxgl.Matrix{
+		m[0], m[3], m[6], m[9],
+		m[1], m[4], m[7], m[10],
+		m[2], m[5], m[8], m[11],
+		0, 0, 0, 1,
+	}, nil
+}
+
+// Single-object 3MF package
+func write3MF(w io.Writer, mesh *fauxgl.Mesh) error {
+	vertices, faces := indexMesh(mesh)
+	object := threeMFObject{ID: 1, Type: "model"}
+	for _, v := range vertices {
+		object.Vertices = append(object.Vertices, threeMFVertex{v.X, v.Y, v.Z})
+	}
+	for _, f := range faces {
+		object.Triangles = append(object.Triangles, threeMFTriangle{f[0], f[1], f[2]})
+	}
+	model := threeMFModel{
+		Unit:      "millimeter",
+		Namespace: threeMFNamespace,
+		Objects:   []threeMFObject{object},
+		Items:     []threeMFBuildItem{{ObjectID: 1}},
+	}
+
+	archive := zip.NewWriter(w)
+	parts := []struct{ name, body string }{
+		{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>
+<Default Extension="model" ContentType="application/vnd.ms-package.3dmanufacturing-3dmodel+xml"/>
+</Types>`},
+		{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+<Relationship Target="/3D/3dmodel.model" Id="rel0" Type="http://schemas.microsoft.com/3dmanufacturing/2013/01/3dmodel"/>
+</Relationships>`},
+	}
+	for _, part := range parts {
+		f, err := archive.Create(part.name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, part.body); err != nil {
+			return err
+		}
+	}
+
+	f, err := archive.Create("3D/3dmodel.model")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, xml.Header); err != nil {
+		return err
+	}
+	if err := xml.NewEncoder(f).Encode(model); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// POST /api/v1/convert with a file field and to=stl|obj|ply|3mf. The input
+// format comes from the file name's extension, or an explicit from field.
+// Responds with the converted file.
+func convertHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, r, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Invalid request method")
+		return
+	}
+	if !parseUpload(w, r) {
+		return
+	}
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+
+	to := strings.ToLower(r.FormValue("to"))
+	if _, ok := meshFormats[to]; !ok {
+		apiError(w, r, http.StatusBadRequest, ErrUnsupportedFormat, "to must be one of stl, obj, ply, 3mf")
+		return
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Failed to read file")
+		return
+	}
+	defer file.Close()
+	from := strings.ToLower(r.FormValue("from"))
+	if from == "" {
+		from = strings.TrimPrefix(strings.ToLower(filepath.Ext(header.Filename)), ".")
+	}
+	if _, ok := meshFormats[from]; !ok {
+		apiError(w, r, http.StatusBadRequest, ErrUnsupportedFormat, "Unknown input format; name the file .stl, .obj, .ply, or .3mf, or pass from")
+		return
+	}
+
+	workDir, err := newJobWorkDir()
+	if err != nil {
+		log.Printf("Failed to create work dir: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to save file")
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	inputPath := filepath.Join(workDir, "input."+from)
+	fileHash, err := saveUploadPart(header, inputPath)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to save file")
+		return
+	}
+	if !scanUpload(w, r, inputPath, fileHash) {
+		return
+	}
+
+	mesh, err := loadMeshFormat(inputPath, from)
+	if err != nil || len(mesh.Triangles) == 0 {
+		apiError(w, r, http.StatusBadRequest, ErrUnsupportedFormat, fmt.Sprintf("Failed to read %s file", strings.ToUpper(from)))
+		return
+	}
+	outputPath := filepath.Join(workDir, "output."+to)
+	if err := saveMeshFormat(outputPath, to, mesh); err != nil {
+		log.Printf("Failed to convert %s to %s: %v", from, to, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to convert file")
+		return
+	}
+
+	name := strings.TrimSuffix(filepath.Base(header.Filename), filepath.Ext(header.Filename))
+	if name == "" || strings.ContainsAny(name, "\"\\\r\n") {
+		name = "model"
+	}
+	w.Header().Set("Content-Type", meshFormats[to])
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, to))
+	http.ServeFile(w, r, outputPath)
+}
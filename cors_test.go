@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateCORSRefusesWildcardWithCredentials(t *testing.T) {
+	tests := []struct {
+		cfg     CORSConfig
+		wantErr bool
+	}{
+		{CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, true},
+		{CORSConfig{AllowedOrigins: []string{"https://app.example", "*"}, AllowCredentials: true}, true},
+		{CORSConfig{AllowedOrigins: []string{"*"}}, false},
+		{CORSConfig{AllowedOrigins: []string{"https://app.example"}, AllowCredentials: true}, false},
+		{CORSConfig{}, false},
+	}
+	for _, tt := range tests {
+		if err := validateCORS(tt.cfg); (err != nil) != tt.wantErr {
+			t.Errorf("validateCORS(%+v) = %v, want error %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCORSHeaders(t *testing.T) {
+	saved := config.CORS
+	t.Cleanup(func() { config.CORS = saved })
+	handler := withCORS(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		cfg             CORSConfig
+		wantOrigin      string
+		wantCredentials string
+	}{
+		{CORSConfig{AllowedOrigins: []string{"*"}}, "*", ""},
+		{CORSConfig{AllowedOrigins: []string{"https://app.example"}, AllowCredentials: true}, "https://app.example", "true"},
+		{CORSConfig{AllowedOrigins: []string{"https://other.example"}}, "", ""},
+	}
+	for _, tt := range tests {
+		config.CORS = tt.cfg
+		r := httptest.NewRequest(http.MethodGet, "/upload", nil)
+		r.Header.Set("Origin", "https://app.example")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+			t.Errorf("%+v: Access-Control-Allow-Origin = %q, want %q", tt.cfg, got, tt.wantOrigin)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Credentials"); got != tt.wantCredentials {
+			t.Errorf("%+v: Access-Control-Allow-Credentials = %q, want %q", tt.cfg, got, tt.wantCredentials)
+		}
+	}
+}
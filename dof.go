@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	MaxAperture    = 32 // Largest blur radius, in pixels
+	DOFSampleCount = 64 // Samples gathered per blurred pixel
+	MinBlurRadius  = 0.5
+	goldenAngle    = 2.399963229728653 // Radians between successive disk samples
+)
+
+// Focal blur applied to a rendered view using its depth buffer
+type DepthOfField struct {
+	Focus    float64 `json:"focus,omitempty"` // Distance from the camera kept sharp, in normalized model units; the camera target when 0
+	Aperture float64 `json:"aperture"`        // Blur radius in pixels far behind the focal plane
+}
+
+// Read the aperture and focus form fields into the options
+func parseDOFOptions(r *http.Request, opts *RenderOptions) error {
+	v := r.FormValue("aperture")
+	if v == "" {
+		if r.FormValue("focus") != "" {
+			return fmt.Errorf("focus needs an aperture")
+		}
+		return nil
+	}
+	aperture, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(aperture > 0 && aperture <= MaxAperture) {
+		return fmt.Errorf("aperture must be a blur radius between 0 and %d pixels", MaxAperture)
+	}
+	dof := DepthOfField{Aperture: aperture}
+	if v := r.FormValue("focus"); v != "" {
+		focus, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(focus > 0 && focus <= MaxClipDistance) {
+			return fmt.Errorf("focus must be a distance between 0 and %g", MaxClipDistance)
+		}
+		dof.Focus = focus
+	}
+	opts.DOF = &dof
+	return nil
+}
+
+// Blur a rendered view by how far each pixel is from the focal plane. Each
+// pixel gathers samples from a disk as large as its circle of confusion,
+// skipping nearer samples that are sharper than their distance, so in-focus
+// edges don't bleed into the blurred background behind them.
+func focalBlur(src *image.NRGBA, context *fauxgl.Context, cam camera, near, far float64, dof DepthOfField) *image.NRGBA {
+	focus := dof.Focus
+	if focus == 0 {
+		focus = cam.center.Sub(cam.eye).Length()
+	}
+
+	// Blur radius of every pixel
+	distance := viewDistances(context, near, far)
+	radius := make([]float64, len(distance))
+	for i, d := range distance {
+		radius[i] = dof.Aperture
+		if !math.IsInf(d, 1) {
+			radius[i] = math.Min(dof.Aperture*math.Abs(d-focus)/d, MaxAperture)
+		}
+	}
+
+	// Evenly spread points on the unit disk
+	var offsets [DOFSampleCount][2]float64
+	for k := range offsets {
+		r := math.Sqrt((float64(k) + 0.5) / DOFSampleCount)
+		a := float64(k) * goldenAngle
+		offsets[k] = [2]float64{r * math.Cos(a), r * math.Sin(a)}
+	}
+
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	draw.Draw(dst, b, src, b.Min, draw.Src)
+	width := context.Width
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := (y-b.Min.Y)*width + (x - b.Min.X)
+			r := radius[i]
+			if r < MinBlurRadius {
+				continue
+			}
+			var sum [4]float64
+			used := 0
+			for _, o := range offsets {
+				sx := min(max(x+int(math.Round(o[0]*r)), b.Min.X), b.Max.X-1)
+				sy := min(max(y+int(math.Round(o[1]*r)), b.Min.Y), b.Max.Y-1)
+				j := (sy-b.Min.Y)*width + (sx - b.Min.X)
+				if distance[j] < distance[i] && radius[j] < math.Hypot(o[0], o[1])*r {
+					continue
+				}
+				p := src.Pix[src.PixOffset(sx, sy):]
+				a := float64(p[3])
+				sum[0] += float64(p[0]) * a
+				sum[1] += float64(p[1]) * a
+				sum[2] += float64(p[2]) * a
+				sum[3] += a
+				used++
+			}
+			// Only transparent pixels, or ones hidden by sharp edges all
+			// around, gather nothing; leave them as they are
+			if sum[3] == 0 {
+				continue
+			}
+			p := dst.Pix[dst.PixOffset(x, y):]
+			for c := 0; c < 3; c++ {
+				p[c] = uint8(math.Round(sum[c] / sum[3]))
+			}
+			p[3] = uint8(math.Round(sum[3] / float64(used)))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const (
+	kmsScope         = "https://www.googleapis.com/auth/cloudkms"
+	encryptedMagic   = "RSE1"   // Starts every encrypted object
+	encryptChunkSize = 64 << 10 // Plaintext bytes sealed at a time, so ranged reads only decrypt what they need
+	encryptKeyIDSize = 4
+	encryptNonceSize = 7 // Random per object; the chunk index and a last-chunk flag fill the rest of the nonce
+	encryptTagSize   = 16
+	encryptedHeader  = len(encryptedMagic) + encryptKeyIDSize + encryptNonceSize
+)
+
+// Settings for encrypting stored uploads, meshes, renders, and model records
+// with AES-256-GCM. Encryption is on when a key is set, in the config, in an
+// environment variable, or wrapped with a Cloud KMS key.
+type EncryptionConfig struct {
+	Key        string   `json:"key"`         // Base64 256-bit key
+	KeyEnv     string   `json:"key_env"`     // Environment variable holding the base64 key
+	KMSKey     string   `json:"kms_key"`     // Cloud KMS key that unwraps WrappedKey, as projects/…/cryptoKeys/…
+	WrappedKey string   `json:"wrapped_key"` // Base64 key encrypted with KMSKey
+	OldKeys    []string `json:"old_keys"`    // Base64 keys replaced by Key, still used to read what they encrypted
+}
+
+// Storage that encrypts every object on the way in and decrypts it on the way
+// out. Objects are sealed in chunks, each authenticated together with the
+// object's name, so ranged reads stay cheap and objects can't be swapped or
+// truncated unnoticed. Objects stored before encryption was turned on are
+// read as they are.
+type encryptedStorage struct {
+	Storage
+	current []byte                 // ID of the key new objects are sealed with
+	keys    map[string]cipher.AEAD // By key ID
+}
+
+// Wrap storage with encryption when a key is configured
+func setupEncryption(ctx context.Context, cfg EncryptionConfig) error {
+	key, err := encryptionKey(ctx, cfg)
+	if err != nil || key == nil {
+		return err
+	}
+	s := encryptedStorage{Storage: storage, keys: make(map[string]cipher.AEAD)}
+	s.current, err = s.addKey(key)
+	if err != nil {
+		return err
+	}
+	for _, old := range cfg.OldKeys {
+		key, err := decodeEncryptionKey(old)
+		if err != nil {
+			return fmt.Errorf("old key: %w", err)
+		}
+		if _, err := s.addKey(key); err != nil {
+			return err
+		}
+	}
+	storage = s
+	return nil
+}
+
+// The configured key, or nil if encryption is off
+func encryptionKey(ctx context.Context, cfg EncryptionConfig) ([]byte, error) {
+	switch {
+	case cfg.Key != "":
+		return decodeEncryptionKey(cfg.Key)
+	case cfg.KeyEnv != "":
+		value := os.Getenv(cfg.KeyEnv)
+		if value == "" {
+			return nil, fmt.Errorf("%s is empty", cfg.KeyEnv)
+		}
+		return decodeEncryptionKey(value)
+	case cfg.KMSKey != "":
+		return unwrapKMSKey(ctx, cfg.KMSKey, cfg.WrappedKey)
+	}
+	return nil, nil
+}
+
+func decodeEncryptionKey(value string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes, base64 encoded")
+	}
+	return key, nil
+}
+
+// Decrypt a data key with Cloud KMS
+func unwrapKMSKey(ctx context.Context, kmsKey, wrapped string) ([]byte, error) {
+	if wrapped == "" {
+		return nil, errors.New("kms_key needs a wrapped_key")
+	}
+	body, _ := json.Marshal(map[string]string{"ciphertext": wrapped})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://cloudkms.googleapis.com/v1/"+kmsKey+":decrypt", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	token, err := newGoogleTokenSource(kmsScope).token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kms decrypt: %s", resp.Status)
+	}
+	var result struct {
+		Plaintext string `json:"plaintext"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return decodeEncryptionKey(result.Plaintext)
+}
+
+// Register a key for reading, returning its ID
+func (s encryptedStorage) addKey(key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	id := sum[:encryptKeyIDSize]
+	s.keys[string(id)] = aead
+	return id, nil
+}
+
+// Nonce of one chunk of an object
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+func (s encryptedStorage) Publish(ctx context.Context, localPath, name string) error {
+	in, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.CreateTemp(filepath.Dir(localPath), ".enc-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	err = s.seal(bufio.NewWriter(out), in, name)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	in.Close()
+	os.Remove(localPath)
+	return s.Storage.Publish(ctx, out.Name(), name)
+}
+
+// Write the encrypted form of src to w
+func (s encryptedStorage) seal(w *bufio.Writer, src io.Reader, name string) error {
+	prefix := make([]byte, encryptNonceSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	w.WriteString(encryptedMagic)
+	w.Write(s.current)
+	w.Write(prefix)
+
+	aead := s.keys[string(s.current)]
+	reader := bufio.NewReaderSize(src, encryptChunkSize)
+	chunk := make([]byte, encryptChunkSize)
+	sealed := make([]byte, 0, encryptChunkSize+aead.Overhead())
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// The chunk is the last one if nothing follows it
+		_, peekErr := reader.Peek(1)
+		last := peekErr == io.EOF
+		if peekErr != nil && !last {
+			return peekErr
+		}
+		sealed = aead.Seal(sealed[:0], chunkNonce(prefix, index, last), chunk[:n], []byte(name))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return w.Flush()
+		}
+	}
+}
+
+func (s encryptedStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.OpenAt(ctx, name, 0)
+}
+
+func (s encryptedStorage) OpenAt(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	body, err := s.Storage.OpenAt(ctx, name, 0)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, encryptedHeader)
+	n, err := io.ReadFull(body, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		body.Close()
+		return nil, err
+	}
+	if n < len(header) || string(header[:len(encryptedMagic)]) != encryptedMagic {
+		// Stored before encryption was turned on
+		body.Close()
+		return s.Storage.OpenAt(ctx, name, offset)
+	}
+	keyID := header[len(encryptedMagic) : len(encryptedMagic)+encryptKeyIDSize]
+	aead, ok := s.keys[string(keyID)]
+	if !ok {
+		body.Close()
+		return nil, fmt.Errorf("%s is encrypted with an unknown key", name)
+	}
+
+	// Start at the chunk holding offset, or at the end of the one before, as
+	// the object may end there
+	index, skip := offset/encryptChunkSize, offset%encryptChunkSize
+	if index > 0 && skip == 0 {
+		index, skip = index-1, encryptChunkSize
+	}
+	if index > 0 {
+		body.Close()
+		start := int64(encryptedHeader) + index*int64(encryptChunkSize+aead.Overhead())
+		if body, err = s.Storage.OpenAt(ctx, name, start); err != nil {
+			return nil, err
+		}
+	}
+	return &decryptReader{
+		src:    bufio.NewReaderSize(body, encryptChunkSize+aead.Overhead()),
+		body:   body,
+		aead:   aead,
+		prefix: header[len(encryptedMagic)+encryptKeyIDSize:],
+		name:   []byte(name),
+		index:  uint32(index),
+		skip:   int(skip),
+	}, nil
+}
+
+func (s encryptedStorage) Stat(ctx context.Context, name string) (StoredFileInfo, error) {
+	info, err := s.Storage.Stat(ctx, name)
+	if err != nil {
+		return info, err
+	}
+	body, err := s.Storage.OpenAt(ctx, name, 0)
+	if err != nil {
+		return info, err
+	}
+	defer body.Close()
+	magic := make([]byte, len(encryptedMagic))
+	if _, err := io.ReadFull(body, magic); err != nil || string(magic) != encryptedMagic {
+		return info, nil
+	}
+	// Every chunk but the last is full, and each carries a tag
+	sealed := info.Size - int64(encryptedHeader)
+	chunk := int64(encryptChunkSize + encryptTagSize)
+	chunks := (sealed + chunk - 1) / chunk
+	info.Size = sealed - chunks*encryptTagSize
+	return info, nil
+}
+
+// Plaintext of an encrypted object, one chunk at a time
+type decryptReader struct {
+	src    *bufio.Reader
+	body   io.Closer
+	aead   cipher.AEAD
+	prefix []byte
+	name   []byte
+	index  uint32
+	skip   int    // Bytes of the first chunk before the requested offset
+	buf    []byte // Decrypted bytes not read yet
+	sealed []byte
+	done   bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// Decrypt the next chunk into buf
+func (r *decryptReader) next() error {
+	if r.sealed == nil {
+		r.sealed = make([]byte, encryptChunkSize+r.aead.Overhead())
+	}
+	n, err := io.ReadFull(r.src, r.sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF // Ended before the last chunk
+		}
+		return err
+	}
+	_, peekErr := r.src.Peek(1)
+	last := peekErr == io.EOF
+	if peekErr != nil && !last {
+		return peekErr
+	}
+	plain, err := r.aead.Open(r.sealed[:0], chunkNonce(r.prefix, r.index, last), r.sealed[:n], r.name)
+	if err != nil {
+		return fmt.Errorf("decrypting %s: %w", r.name, err)
+	}
+	r.index++
+	r.done = last
+	if r.skip > len(plain) {
+		return io.ErrUnexpectedEOF
+	}
+	r.buf, r.skip = plain[r.skip:], 0
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.body.Close()
+}
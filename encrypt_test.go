@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Storage that keeps objects in memory
+type memStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: make(map[string][]byte)}
+}
+
+func (s *memStorage) Publish(ctx context.Context, localPath, name string) error {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[name] = data
+	return os.Remove(localPath)
+}
+
+func (s *memStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.OpenAt(ctx, name, 0)
+}
+
+func (s *memStorage) OpenAt(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(data[min(offset, int64(len(data))):])), nil
+}
+
+func (s *memStorage) Stat(ctx context.Context, name string) (StoredFileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[name]
+	if !ok {
+		return StoredFileInfo{}, os.ErrNotExist
+	}
+	return StoredFileInfo{Size: int64(len(data))}, nil
+}
+
+func (s *memStorage) Exists(ctx context.Context, name string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.objects[name]
+	return ok, nil
+}
+
+// Encrypted storage over backend that seals with key and also reads oldKeys
+func newTestEncryptedStorage(t *testing.T, backend Storage, key []byte, oldKeys ...[]byte) encryptedStorage {
+	t.Helper()
+	s := encryptedStorage{Storage: backend, keys: make(map[string]cipher.AEAD)}
+	var err error
+	if s.current, err = s.addKey(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, old := range oldKeys {
+		if _, err := s.addKey(old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Publish data under name through s
+func publishBytes(t *testing.T, s Storage, name string, data []byte) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "object")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish(context.Background(), path, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readObject(s Storage, name string, offset int64) ([]byte, error) {
+	r, err := s.OpenAt(context.Background(), name, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestEncryptedStorageRoundTrip(t *testing.T) {
+	key := randomBytes(t, 32)
+	for _, size := range []int{0, 1, encryptChunkSize - 1, encryptChunkSize, encryptChunkSize + 1, 3*encryptChunkSize + 5} {
+		backend := newMemStorage()
+		s := newTestEncryptedStorage(t, backend, key)
+		data := randomBytes(t, size)
+		publishBytes(t, s, "outputs/object", data)
+
+		if size >= 16 && bytes.Contains(backend.objects["outputs/object"], data[:16]) {
+			t.Errorf("%d bytes: stored object holds the plaintext", size)
+		}
+		info, err := s.Stat(context.Background(), "outputs/object")
+		if err != nil || info.Size != int64(size) {
+			t.Errorf("%d bytes: Stat gave size %d, %v", size, info.Size, err)
+		}
+		for _, offset := range []int64{0, 1, encryptChunkSize - 1, encryptChunkSize, encryptChunkSize + 3, int64(size)} {
+			if offset > int64(size) {
+				continue
+			}
+			got, err := readObject(s, "outputs/object", offset)
+			if err != nil {
+				t.Errorf("%d bytes from %d: %v", size, offset, err)
+			} else if !bytes.Equal(got, data[offset:]) {
+				t.Errorf("%d bytes from %d: read %d bytes that don't match", size, offset, len(got))
+			}
+		}
+	}
+}
+
+func TestEncryptedStorageRejectsTampering(t *testing.T) {
+	key := randomBytes(t, 32)
+	data := randomBytes(t, 3*encryptChunkSize+100)
+	sealedChunk := encryptChunkSize + encryptTagSize
+	tests := []struct {
+		name   string
+		change func(stored []byte) []byte
+		offset int64
+	}{
+		{"flipped byte in a middle chunk", func(b []byte) []byte {
+			b[encryptedHeader+sealedChunk+10] ^= 1
+			return b
+		}, 0},
+		{"flipped byte read from its chunk", func(b []byte) []byte {
+			b[encryptedHeader+2*sealedChunk+10] ^= 1
+			return b
+		}, 2 * encryptChunkSize},
+		{"swapped chunks", func(b []byte) []byte {
+			first := bytes.Clone(b[encryptedHeader : encryptedHeader+sealedChunk])
+			copy(b[encryptedHeader:], b[encryptedHeader+sealedChunk:encryptedHeader+2*sealedChunk])
+			copy(b[encryptedHeader+sealedChunk:], first)
+			return b
+		}, 0},
+		{"last chunk dropped", func(b []byte) []byte {
+			return b[:encryptedHeader+3*sealedChunk]
+		}, 0},
+		{"cut inside the last chunk", func(b []byte) []byte {
+			return b[:len(b)-20]
+		}, 0},
+		{"cut after the header", func(b []byte) []byte {
+			return b[:encryptedHeader]
+		}, 0},
+	}
+	for _, tt := range tests {
+		backend := newMemStorage()
+		s := newTestEncryptedStorage(t, backend, key)
+		publishBytes(t, s, "object", data)
+		backend.objects["object"] = tt.change(backend.objects["object"])
+		if got, err := readObject(s, "object", tt.offset); err == nil {
+			t.Errorf("%s: read %d bytes without an error", tt.name, len(got))
+		}
+	}
+
+	// Objects are bound to their name
+	backend := newMemStorage()
+	s := newTestEncryptedStorage(t, backend, key)
+	publishBytes(t, s, "a", data)
+	backend.objects["b"] = backend.objects["a"]
+	if _, err := readObject(s, "b", 0); err == nil {
+		t.Error("an object moved to another name was read")
+	}
+}
+
+func TestEncryptedStorageKeys(t *testing.T) {
+	oldKey, newKey := randomBytes(t, 32), randomBytes(t, 32)
+	data := randomBytes(t, encryptChunkSize+10)
+	backend := newMemStorage()
+	publishBytes(t, newTestEncryptedStorage(t, backend, oldKey), "old", data)
+	publishBytes(t, backend, "plain", data)
+
+	rotated := newTestEncryptedStorage(t, backend, newKey, oldKey)
+	publishBytes(t, rotated, "new", data)
+	for _, name := range []string{"old", "new", "plain"} {
+		got, err := readObject(rotated, name, 0)
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: read %d bytes, %v", name, len(got), err)
+		}
+	}
+
+	// Without the old key, what it sealed can't be read
+	if _, err := readObject(newTestEncryptedStorage(t, backend, newKey), "old", 0); err == nil {
+		t.Error("an object sealed with a dropped key was read")
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Machine-readable error codes, sent with every API error and failed job so
+// clients can branch on what went wrong instead of on the English message.
+// Codes are never renamed; new ones may be added.
+const (
+	// Request errors
+	ErrInvalidRequest      = "ERR_INVALID_REQUEST"      // A parameter is missing, malformed, or out of range
+	ErrUnsupportedFormat   = "ERR_UNSUPPORTED_FORMAT"   // A file isn't in a format this service reads, or can't be parsed
+	ErrTooLarge            = "ERR_TOO_LARGE"            // The request body is over its size limit
+	ErrChecksumMismatch    = "ERR_CHECKSUM_MISMATCH"    // The upload doesn't match the SHA-256 the client sent
+	ErrUnauthorized        = "ERR_UNAUTHORIZED"         // Missing or wrong admin token
+	ErrInvalidCSRF         = "ERR_INVALID_CSRF"         // Missing or wrong CSRF token, from an origin that isn't trusted
+	ErrInvalidSignature    = "ERR_INVALID_SIGNATURE"    // A render URL's signature is missing, wrong, or expired
+	ErrMethodNotAllowed    = "ERR_METHOD_NOT_ALLOWED"   // The endpoint doesn't take this method
+	ErrUnsupportedProtocol = "ERR_UNSUPPORTED_PROTOCOL" // None of the WebSocket versions offered is spoken here
+	ErrNotFound            = "ERR_NOT_FOUND"            // No such job, model, bookmark, upload, or output
+	ErrModelNotStored      = "ERR_MODEL_NOT_STORED"     // The model must be uploaded before it can be rendered by hash
+	ErrJobNotFinished      = "ERR_JOB_NOT_FINISHED"     // The job's files aren't ready yet
+	ErrLimitReached        = "ERR_LIMIT_REACHED"        // A limit on bookmarks, followed jobs, or renders on demand is reached
+	ErrVirusDetected       = "ERR_VIRUS_DETECTED"       // The upload was flagged by the virus scanner
+	ErrScanUnavailable     = "ERR_SCAN_UNAVAILABLE"     // The virus scanner couldn't be reached; retry later
+	ErrQueueFull           = "ERR_QUEUE_FULL"           // The render queue has no room; retry after Retry-After
+	ErrTenantQuota         = "ERR_TENANT_QUOTA"         // The tenant has too many jobs in progress; retry later
+	ErrStorage             = "ERR_STORAGE"              // Storage couldn't be read
+	ErrInternal            = "ERR_INTERNAL"             // Anything else that went wrong on the server
+
+	// Job failures
+	ErrRenderTimeout    = "ERR_RENDER_TIMEOUT"    // The render took longer than render_timeout_secs
+	ErrRenderFailed     = "ERR_RENDER_FAILED"     // The render failed for another reason
+	ErrInputUnavailable = "ERR_INPUT_UNAVAILABLE" // The upload couldn't be fetched from storage to render
+	ErrJobAbandoned     = "ERR_JOB_ABANDONED"     // The instance rendering the job stopped responding
+)
+
+const ErrorCodeHeader = "X-Error-Code" // Error code of a failed request, for clients that don't ask for JSON
+
+// Error reply for clients that ask for JSON
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"` // Human-readable, in English
+}
+
+// Answer a request with an error: JSON for clients that ask for it, plain
+// text otherwise, and the code in ErrorCodeHeader either way
+func apiError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set(ErrorCodeHeader, code)
+	if wantsJSON(r) {
+		writeJSON(w, status, errorResponse{Code: code, Message: message})
+		return
+	}
+	http.Error(w, message, status)
+}
+
+// Like http.NotFound, with ErrNotFound
+func notFound(w http.ResponseWriter, r *http.Request) {
+	apiError(w, r, http.StatusNotFound, ErrNotFound, "404 page not found")
+}
+
+// Error carrying the code a job that fails with it should report
+type codedError struct {
+	code string
+	err  error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() error {
+	return e.err
+}
+
+func withErrorCode(code string, err error) error {
+	return &codedError{code: code, err: err}
+}
+
+// Code an error carries, or fallback if it carries none
+func errorCode(err error, fallback string) string {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return fallback
+}
+
+// Code a failed render reports
+func renderErrorCode(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrRenderTimeout
+	}
+	return errorCode(err, ErrRenderFailed)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	HistoryFile       = "render_history.json" // JSON file with past render timings, used for ETAs
+	MaxHistorySamples = 1000
+	MinHistoryFit     = 5 // Samples needed before the regression is trusted
+)
+
+// Timing of one finished render
+type RenderSample struct {
+	FileSize  int64   `json:"file_size"`
+	Triangles int     `json:"triangles"`
+	Views     int     `json:"views"`  // Number of rasterized views (stereo pairs and spins render several)
+	Pixels    int     `json:"pixels"` // Total pixels rasterized across all views
+	Seconds   float64 `json:"seconds"`
+}
+
+// Linear model: seconds = coef[0] + coef[1]*(triangles*views) + coef[2]*pixels,
+// fitted on standardized features
+type etaModel struct {
+	coef  [3]float64
+	mean  [3]float64
+	scale [3]float64 // Zero for features that don't vary, which are then ignored
+}
+
+var (
+	historyMu     sync.Mutex
+	renderHistory []RenderSample
+	currentModel  *etaModel // nil until there are enough samples
+)
+
+func (s RenderSample) features() [3]float64 {
+	return [3]float64{1, float64(s.Triangles * s.Views), float64(s.Pixels)}
+}
+
+// Load render history from JSON on startup
+func loadRenderHistory() error {
+	data, err := os.ReadFile(HistoryFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if err := json.Unmarshal(data, &renderHistory); err != nil {
+		return err
+	}
+	currentModel = fitETAModel(renderHistory)
+	return nil
+}
+
+// Record a finished render, refit the model, and save the history
+func recordRenderSample(sample RenderSample) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	renderHistory = append(renderHistory, sample)
+	if len(renderHistory) > MaxHistorySamples {
+		renderHistory = renderHistory[len(renderHistory)-MaxHistorySamples:]
+	}
+	currentModel = fitETAModel(renderHistory)
+
+	data, err := json.Marshal(renderHistory)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(HistoryFile, data, 0644)
+}
+
+// Least-squares fit via the normal equations
+func fitETAModel(samples []RenderSample) *etaModel {
+	if len(samples) < MinHistoryFit {
+		return nil
+	}
+
+	m := &etaModel{}
+	m.scale[0] = 1
+	n := float64(len(samples))
+	for i := 1; i < 3; i++ {
+		var sum, sumSq float64
+		for _, s := range samples {
+			x := s.features()[i]
+			sum += x
+			sumSq += x * x
+		}
+		m.mean[i] = sum / n
+		if variance := sumSq/n - m.mean[i]*m.mean[i]; variance > 1e-12 {
+			m.scale[i] = math.Sqrt(variance)
+		}
+	}
+
+	// Build XᵀX and Xᵀy, leaving constant features out with an identity row
+	var a [3][4]float64
+	for _, s := range samples {
+		x := m.standardize(s.features())
+		for i := 0; i < 3; i++ {
+			for j := 0; j < 3; j++ {
+				a[i][j] += x[i] * x[j]
+			}
+			a[i][3] += x[i] * s.Seconds
+		}
+	}
+	for i := 1; i < 3; i++ {
+		if m.scale[i] == 0 {
+			a[i] = [4]float64{}
+			a[i][i] = 1
+		}
+	}
+
+	coef, ok := solve3(a)
+	if !ok {
+		return nil
+	}
+	m.coef = coef
+	return m
+}
+
+func (m *etaModel) standardize(x [3]float64) [3]float64 {
+	out := [3]float64{1}
+	for i := 1; i < 3; i++ {
+		if m.scale[i] != 0 {
+			out[i] = (x[i] - m.mean[i]) / m.scale[i]
+		}
+	}
+	return out
+}
+
+func (m *etaModel) predict(sample RenderSample) float64 {
+	x := m.standardize(sample.features())
+	return m.coef[0]*x[0] + m.coef[1]*x[1] + m.coef[2]*x[2]
+}
+
+// Gaussian elimination with partial pivoting on an augmented 3x4 matrix
+func solve3(a [3][4]float64) ([3]float64, bool) {
+	for col := 0; col < 3; col++ {
+		pivot := col
+		for row := col + 1; row < 3; row++ {
+			if math.Abs(a[row][col]) > math.Abs(a[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return [3]float64{}, false
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		for row := 0; row < 3; row++ {
+			if row == col {
+				continue
+			}
+			f := a[row][col] / a[col][col]
+			for k := col; k < 4; k++ {
+				a[row][k] -= f * a[col][k]
+			}
+		}
+	}
+	return [3]float64{a[0][3] / a[0][0], a[1][3] / a[1][1], a[2][3] / a[2][2]}, true
+}
+
+// Estimate how long a render will take. Falls back to a flat per-triangle
+// rate until enough history has been collected.
+func estimateRenderTime(sample RenderSample) time.Duration {
+	historyMu.Lock()
+	model := currentModel
+	historyMu.Unlock()
+
+	var seconds float64
+	if model != nil {
+		seconds = model.predict(sample)
+	} else {
+		seconds = 0.5*float64(sample.Views) + 2e-6*float64(sample.Triangles*sample.Views)
+	}
+	if seconds < 0.1 {
+		seconds = 0.1
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Describe the render work for a job from its input file and options. Binary
+// STLs store their triangle count in the header; ASCII files are estimated
+// from their size.
+func renderSampleFor(path string, opts RenderOptions) RenderSample {
+	sample := RenderSample{Views: opts.views()}
+	sample.Pixels = opts.viewPixels() * sample.Views
+
+	file, err := os.Open(path)
+	if err != nil {
+		return sample
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return sample
+	}
+	sample.FileSize = info.Size()
+
+	header := make([]byte, 84)
+	if _, err := file.ReadAt(header, 0); err == nil {
+		count := int64(binary.LittleEndian.Uint32(header[80:]))
+		if 84+50*count == sample.FileSize {
+			sample.Triangles = int(count)
+			return sample
+		}
+	}
+	sample.Triangles = int(sample.FileSize / 250) // Typical size of an ASCII facet block
+	return sample
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket protocol versions this server speaks, newest first. Clients pick
+// one by offering the subprotocol "render.v<N>"; those that offer none get
+// WSDefaultVersion, the shape the protocol had before versioning.
+var wsVersions = []int{1}
+
+const (
+	WSDefaultVersion    = 1
+	wsSubprotocolPrefix = "render.v"
+)
+
+// Machine-readable WebSocket event. Clients decide how to present it; the
+// server sends no markup. Every event carries the protocol version it was
+// written for.
+type wsEvent struct {
+	V     int    `json:"v"`
+	Type  string `json:"type"` // "hello", "status", "queue", "image_start", "image_end", "preview", "tile", "upload_progress", or "group_done"
+	JobID string `json:"job_id,omitempty"`
+
+	// Hello event, sent first to clients that negotiated a version
+	Versions []int `json:"versions,omitempty"` // Every version the server speaks
+
+	// Status events
+	Status    string   `json:"status,omitempty"`
+	Message   string   `json:"message,omitempty"`    // Human-readable status, in the job's language
+	ErrorCode string   `json:"error_code,omitempty"` // Why the job failed, once it has
+	Output    string   `json:"output,omitempty"`     // Download URL of the primary output, once done
+	Outputs   []string `json:"outputs,omitempty"`
+	Mesh      string   `json:"mesh,omitempty"`      // Download URL of the processed mesh, if any
+	Permalink string   `json:"permalink,omitempty"` // Shareable model page, once done
+
+	// Queue events
+	Position int `json:"position,omitempty"` // Place in line for a worker, 1 for next
+
+	// Image push, preview, and tile events
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	Frame       int    `json:"frame,omitempty"` // Spin frame, or tiles done
+	Total       int    `json:"total,omitempty"` // Frames in a spin, tiles in a poster, or bytes in an upload
+
+	// Group events
+	GroupID   string `json:"group_id,omitempty"`
+	Succeeded int    `json:"succeeded,omitempty"` // Jobs that rendered, of Total
+	Failed    int    `json:"failed,omitempty"`    // Jobs that failed, of Total
+
+	// Upload progress events
+	UploadID string `json:"upload_id,omitempty"`
+	Received int64  `json:"received,omitempty"`
+	Done     bool   `json:"done,omitempty"`
+}
+
+// Catalog keys of the human-readable text for each status
+var statusMessageKeys = map[string]string{
+	JobProcessing: "status.processing",
+	JobDone:       "status.done",
+	JobFailed:     "status.failed",
+}
+
+// Status event for a job's current state
+func statusEvent(job *Job) wsEvent {
+	event := wsEvent{Type: "status", JobID: job.ID, Status: job.Status, ErrorCode: job.ErrorCode}
+	if key, ok := statusMessageKeys[job.Status]; ok {
+		event.Message = translate(job.Lang, key)
+	}
+	if job.Status == JobDone {
+		event.Output = outputURL(job.Tenant, job.OutputPath)
+		for _, name := range job.Outputs {
+			event.Outputs = append(event.Outputs, outputURL(job.Tenant, name))
+		}
+		if job.MeshFile != "" {
+			event.Mesh = tenantURL(job.Tenant, "/api/v1/jobs/"+job.ID+"/mesh.stl")
+		}
+		event.Permalink = modelPermalink(job.Tenant, job.FileHash)
+	}
+	return event
+}
+
+// Encode an event as a WebSocket text message for a protocol version,
+// usually wsVersion of the connection it is sent on
+func encodeEvent(version int, event wsEvent) []byte {
+	event.V = version
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", event.Type, err)
+	}
+	return data
+}
+
+// Protocol version a connection negotiated, or WSDefaultVersion if it
+// offered none
+func wsVersion(conn *websocket.Conn) int {
+	if v, err := strconv.Atoi(strings.TrimPrefix(conn.Subprotocol(), wsSubprotocolPrefix)); err == nil {
+		return v
+	}
+	return WSDefaultVersion
+}
+
+// An event encoded ahead of time for WSDefaultVersion, such as a job's
+// latest status, as sent to a connection speaking version
+func reencodeEvent(version int, message string) []byte {
+	if version == WSDefaultVersion {
+		return []byte(message)
+	}
+	var event wsEvent
+	if err := json.Unmarshal([]byte(message), &event); err != nil {
+		return []byte(message)
+	}
+	return encodeEvent(version, event)
+}
+
+// Subprotocol names for the supported versions, in order of preference
+func wsSubprotocols() []string {
+	var names []string
+	for _, v := range wsVersions {
+		names = append(names, wsSubprotocolPrefix+strconv.Itoa(v))
+	}
+	return names
+}
+
+// Upgrade a request to a WebSocket speaking a version both sides know.
+// Clients offering only versions this server doesn't speak are refused with
+// a 400 instead of being sent messages they may misread; clients that
+// negotiated get a hello event listing the server's versions.
+func upgradeWS(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
+	offered := websocket.Subprotocols(r)
+	known := false
+	versioned := false
+	for _, p := range offered {
+		if strings.HasPrefix(p, wsSubprotocolPrefix) {
+			versioned = true
+		}
+		for _, s := range upgrader.Subprotocols {
+			known = known || p == s
+		}
+	}
+	if versioned && !known {
+		apiError(w, r, http.StatusBadRequest, ErrUnsupportedProtocol, fmt.Sprintf("Unsupported protocol version; this server speaks %s", strings.Join(upgrader.Subprotocols, ", ")))
+		return nil, fmt.Errorf("client offered only unsupported versions %v", offered)
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+	if conn.Subprotocol() != "" {
+		hello := wsEvent{Type: "hello", Versions: wsVersions}
+		if err := conn.WriteMessage(websocket.TextMessage, encodeEvent(wsVersion(conn), hello)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
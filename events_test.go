@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestEncodeEventStampsVersion(t *testing.T) {
+	event := wsEvent{Type: "status", JobID: "job", Status: JobDone, Output: "/output/x.png"}
+	stored := string(encodeEvent(WSDefaultVersion, event))
+	for _, tt := range []struct {
+		name string
+		data []byte
+	}{
+		{"encoded", encodeEvent(WSDefaultVersion+1, event)},
+		{"re-encoded", reencodeEvent(WSDefaultVersion+1, stored)},
+	} {
+		var got wsEvent
+		if err := json.Unmarshal(tt.data, &got); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		want := event
+		want.V = WSDefaultVersion + 1
+		if got.V != want.V || got.Type != want.Type || got.JobID != want.JobID || got.Status != want.Status || got.Output != want.Output {
+			t.Errorf("%s event is %+v, want %+v", tt.name, got, want)
+		}
+	}
+	if got := string(reencodeEvent(WSDefaultVersion, stored)); got != stored {
+		t.Errorf("re-encoding for the default version changed %s to %s", stored, got)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+	"slices"
+)
+
+const (
+	ExposureClip      = 0.005 // Fraction of the model's darkest and brightest pixels allowed to clip
+	ExposureBlack     = 12    // Level the darkest model pixels are mapped to
+	ExposureWhite     = 240   // Level the brightest are mapped to, so the model stays apart from a white background
+	MinExposureRange  = 24    // Narrowest range of levels stretched, so flat colors aren't blown into noise
+	MaxExposureGamma  = 2.5   // Strongest midtone correction either way
+	ExposureMeterSize = 256   // Size of the view metered before a tiled render
+)
+
+// Levels the autoexposure filter maps each channel value to
+type toneCurve [256]uint8
+
+// Meter the model's brightness once per scene, on its first view, so spin
+// frames and stereo pairs share one exposure instead of flickering
+func (sc *scene) meterExposure(im image.Image, depth []float64) {
+	if sc.exposure != nil || !slices.Contains(sc.filters, "autoexposure") {
+		return
+	}
+	src, ok := im.(*image.NRGBA)
+	if !ok {
+		src = image.NewNRGBA(im.Bounds())
+		draw.Draw(src, src.Bounds(), im, im.Bounds().Min, draw.Src)
+	}
+	sc.exposure = exposureCurve(src, depth)
+}
+
+// Curve that stretches the model pixels' brightness, found from their
+// histogram, between ExposureBlack and ExposureWhite and brings their median
+// to mid-gray. Levels above the brightest model pixel rise to white, so the
+// background stays white. Returns the identity when nothing was drawn.
+func exposureCurve(im *image.NRGBA, depth []float64) *toneCurve {
+	var hist [256]int
+	total := 0
+	b := im.Bounds()
+	w := b.Dx()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if depth[(y-b.Min.Y)*w+x-b.Min.X] == math.MaxFloat64 {
+				continue
+			}
+			hist[uint8(math.Round(255*luma(im, x, y)))]++
+			total++
+		}
+	}
+	curve := &toneCurve{}
+	for i := range curve {
+		curve[i] = uint8(i)
+	}
+	if total == 0 {
+		return curve
+	}
+	percentile := func(p float64) int {
+		want, seen := int(p*float64(total)), 0
+		for level, n := range hist {
+			if seen += n; seen > want {
+				return level
+			}
+		}
+		return 255
+	}
+	lo, hi, median := percentile(ExposureClip), percentile(1-ExposureClip), percentile(0.5)
+	hi = min(hi, 254) // Keep 255 for the background
+	if hi-lo < MinExposureRange {
+		lo = max(0, min(lo, hi-MinExposureRange))
+		hi = lo + MinExposureRange
+	}
+
+	// Gamma that takes the stretched median to 0.5
+	m := math.Min(math.Max(float64(median-lo)/float64(hi-lo), 0.01), 0.99)
+	gamma := math.Min(math.Max(math.Log(0.5)/math.Log(m), 1/MaxExposureGamma), MaxExposureGamma)
+	for i := range curve {
+		var v float64
+		switch {
+		case i <= lo:
+			v = ExposureBlack * float64(i) / math.Max(float64(lo), 1)
+		case i >= hi:
+			v = ExposureWhite + (255-ExposureWhite)*float64(i-hi)/math.Max(float64(255-hi), 1)
+		default:
+			t := math.Pow(float64(i-lo)/float64(hi-lo), gamma)
+			v = ExposureBlack + (ExposureWhite-ExposureBlack)*t
+		}
+		curve[i] = uint8(math.Round(math.Min(v, 255)))
+	}
+	return curve
+}
+
+// Map every channel of every pixel through the curve
+func applyToneCurve(im *image.NRGBA, curve *toneCurve) {
+	for i := 0; i < len(im.Pix); i += 4 {
+		im.Pix[i] = curve[im.Pix[i]]
+		im.Pix[i+1] = curve[im.Pix[i+1]]
+		im.Pix[i+2] = curve[im.Pix[i+2]]
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Estimated render time each tenant may take per turn. Tenants take turns
+// within a lane (deficit round robin): a turn adds FairQuantum to the
+// tenant's allowance, and its jobs are taken until their estimates use it
+// up, so a tenant with thousands of jobs queued gets the same share of the
+// workers as one with a few, and cheap jobs aren't held up behind expensive
+// ones.
+const FairQuantum = 10 * time.Second
+
+const MinFairCost = 100 * time.Millisecond // Least a job is charged, so jobs without an estimate still use up turns
+
+// Tenants taking turns and what each may still take this turn
+type fairTurns struct {
+	order     []string // Tenants in turn order; empty name for the default tenant
+	next      int      // Index in order of the tenant whose turn it is
+	allowance map[string]time.Duration
+}
+
+func newFairTurns(tenants ...string) *fairTurns {
+	t := &fairTurns{allowance: make(map[string]time.Duration)}
+	for _, tenant := range tenants {
+		t.join(tenant)
+	}
+	return t
+}
+
+// Tenant whose turn it is
+func (t *fairTurns) current() string {
+	return t.order[t.next]
+}
+
+// Add a tenant at the end of the line; the first one starts its turn
+func (t *fairTurns) join(tenant string) {
+	if slices.Contains(t.order, tenant) {
+		return
+	}
+	t.order = append(t.order, tenant)
+	if len(t.order) == 1 {
+		t.turnTo(0)
+	}
+}
+
+// Remove a tenant with nothing left waiting, forfeiting its allowance
+func (t *fairTurns) leave(tenant string) {
+	i := slices.Index(t.order, tenant)
+	if i < 0 {
+		return
+	}
+	t.order = slices.Delete(t.order, i, i+1)
+	delete(t.allowance, tenant)
+	switch {
+	case len(t.order) == 0:
+		t.next = 0
+	case i < t.next:
+		t.next--
+	case i == t.next:
+		t.turnTo(t.next % len(t.order))
+	}
+}
+
+// Give the turn to the tenant at index i, or the first after it with
+// allowance left once its own turn's is added
+func (t *fairTurns) turnTo(i int) {
+	t.next = i
+	for {
+		tenant := t.order[t.next]
+		t.allowance[tenant] += FairQuantum
+		if t.allowance[tenant] > 0 {
+			return
+		}
+		t.next = (t.next + 1) % len(t.order)
+	}
+}
+
+// Charge a tenant for a job taken from it, passing the turn on once its
+// allowance is used up. Whatever it overspent comes out of its next turn.
+func (t *fairTurns) charge(tenant string, estimate time.Duration) {
+	t.allowance[tenant] -= max(estimate, MinFairCost)
+	if tenant == t.current() && t.allowance[tenant] <= 0 {
+		t.turnTo((t.next + 1) % len(t.order))
+	}
+}
+
+// Charge a tenant for a job taken from the shared queue. Its job was popped
+// from the first line in rotation order that had one, so the tenants before
+// it had nothing waiting: they forfeit their allowance and the turn moves on
+// to it.
+func (t *fairTurns) took(tenant string, estimate time.Duration) {
+	i := slices.Index(t.order, tenant)
+	if i < 0 {
+		return // No longer configured
+	}
+	for t.next != i {
+		t.allowance[t.current()] = 0
+		t.turnTo((t.next + 1) % len(t.order))
+	}
+	t.charge(tenant, estimate)
+}
+
+// Tenants in the order they would be served, starting with the one whose
+// turn it is
+func (t *fairTurns) rotation() []string {
+	return append(slices.Clone(t.order[t.next:]), t.order[:t.next]...)
+}
+
+// A lane of this instance's queue, when not stateless. Each tenant's jobs
+// wait in their own line, taken in fairTurns order.
+type fairQueue struct {
+	slots chan struct{} // One per queued job, bounding the lane to its capacity
+	ready chan struct{} // One per queued job, for workers to wait on
+
+	mu      sync.Mutex
+	waiting map[string][]Job // By tenant, oldest first
+	turns   *fairTurns
+}
+
+func newFairQueue(capacity int) *fairQueue {
+	return &fairQueue{
+		slots:   make(chan struct{}, capacity),
+		ready:   make(chan struct{}, capacity),
+		waiting: make(map[string][]Job),
+		turns:   newFairTurns(),
+	}
+}
+
+// Add a job once it holds one of the lane's slots
+func (q *fairQueue) push(job Job) {
+	q.mu.Lock()
+	q.waiting[job.Tenant] = append(q.waiting[job.Tenant], job)
+	q.turns.join(job.Tenant)
+	q.mu.Unlock()
+	q.ready <- struct{}{}
+}
+
+// Take the next job, once one of the lane's ready signals was received
+func (q *fairQueue) pop() Job {
+	q.mu.Lock()
+	tenant := q.turns.current()
+	job := q.waiting[tenant][0]
+	q.waiting[tenant] = q.waiting[tenant][1:]
+	q.turns.charge(tenant, job.Estimate)
+	if len(q.waiting[tenant]) == 0 {
+		delete(q.waiting, tenant)
+		q.turns.leave(tenant)
+	}
+	q.mu.Unlock()
+	<-q.slots
+	return job
+}
+
+func (q *fairQueue) len() int {
+	return len(q.slots)
+}
+
+// Jobs waiting by tenant
+func (q *fairQueue) depths() map[string]int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	depths := make(map[string]int, len(q.waiting))
+	for tenant, jobs := range q.waiting {
+		depths[tenant] = len(jobs)
+	}
+	return depths
+}
+
+// Every tenant that can have jobs queued: the default one, then the
+// configured ones
+func queueTenants() []string {
+	tenants := []string{""}
+	for _, t := range config.Tenants {
+		tenants = append(tenants, t.Name)
+	}
+	return tenants
+}
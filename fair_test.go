@@ -0,0 +1,67 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFairQueueTurns(t *testing.T) {
+	type queued struct {
+		tenant   string
+		estimate time.Duration
+		count    int
+	}
+	tests := []struct {
+		name   string
+		queued []queued
+		want   string // Tenants of the jobs in the order they're taken, "-" for the default one
+	}{
+		{"one tenant", []queued{{"a", 4 * time.Second, 3}}, "aaa"},
+		{"equal jobs", []queued{{"", 4 * time.Second, 5}, {"b", 4 * time.Second, 2}}, "---bb--"},
+		{"overspending waits out turns", []queued{{"a", 25 * time.Second, 3}, {"b", 5 * time.Second, 6}}, "abbbbabba"},
+		{"cheap jobs go in between", []queued{{"a", 30 * time.Second, 2}, {"b", time.Second, 4}}, "abbbba"},
+		{"unestimated jobs", []queued{{"a", 0, 3}, {"b", 0, 3}, {"c", 0, 1}}, "aaabbbc"},
+		{"three tenants", []queued{{"a", 6 * time.Second, 4}, {"b", 6 * time.Second, 4}, {"c", 12 * time.Second, 2}}, "aabbcaabbc"},
+	}
+	for _, tt := range tests {
+		q := newFairQueue(64)
+		total := 0
+		for _, jobs := range tt.queued {
+			for range jobs.count {
+				q.slots <- struct{}{}
+				q.push(Job{Tenant: jobs.tenant, Estimate: jobs.estimate})
+				total++
+			}
+		}
+		var got strings.Builder
+		for range total {
+			tenant := q.pop().Tenant
+			if tenant == "" {
+				tenant = "-"
+			}
+			got.WriteString(tenant)
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: jobs taken in order %s, want %s", tt.name, got.String(), tt.want)
+		}
+		if q.len() != 0 || len(q.turns.order) != 0 {
+			t.Errorf("%s: %d jobs and tenants %q left", tt.name, q.len(), q.turns.order)
+		}
+	}
+}
+
+func TestFairTurnsTook(t *testing.T) {
+	turns := newFairTurns("a", "b", "c")
+	turns.took("c", time.Second)
+	if got := turns.rotation(); !slices.Equal(got, []string{"c", "a", "b"}) {
+		t.Fatalf("rotation after c took a job is %q, want c first", got)
+	}
+	if turns.allowance["a"] != 0 || turns.allowance["b"] != 0 {
+		t.Errorf("tenants passed over kept allowances %v and %v", turns.allowance["a"], turns.allowance["b"])
+	}
+	if want := FairQuantum - time.Second; turns.allowance["c"] != want {
+		t.Errorf("c has %v left, want %v", turns.allowance["c"], want)
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultSharpen = 0.6 // Unsharp mask strength
+	DefaultGamma   = 2.2
+)
+
+var supportedFilters = map[string]bool{"fxaa": true, "sharpen": true, "gamma": true, "autoexposure": true}
+
+// Named set of post-processing filters, configured by the operator
+type FilterPreset struct {
+	Name     string   `json:"name"`
+	Filters  []string `json:"filters"`            // Applied in order: "fxaa", "sharpen", "gamma"
+	Sharpen  float64  `json:"sharpen,omitempty"`  // Unsharp mask strength, DefaultSharpen when 0
+	Gamma    float64  `json:"gamma,omitempty"`    // Gamma correction exponent, DefaultGamma when 0
+	Backdrop string   `json:"backdrop,omitempty"` // PNG or JPEG the model is composited over instead of white
+}
+
+// Look up a configured filter preset by name
+func findFilterPreset(name string) (FilterPreset, bool) {
+	for _, p := range config.Presets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return FilterPreset{}, false
+}
+
+// Read the filter options: a preset, or a comma-separated filters list with
+// optional sharpen and gamma values. Settings are copied into the options so
+// the cache key changes when a preset does.
+func parseFilterOptions(r *http.Request, opts *RenderOptions) error {
+	var preset FilterPreset
+	if name := r.FormValue("preset"); name != "" {
+		p, ok := findFilterPreset(name)
+		if !ok {
+			return fmt.Errorf("unknown preset %q", name)
+		}
+		preset = p
+	}
+	if v := r.FormValue("filters"); v != "" {
+		preset.Filters = nil
+		for _, f := range strings.Split(v, ",") {
+			preset.Filters = append(preset.Filters, strings.ToLower(strings.TrimSpace(f)))
+		}
+	}
+	for _, field := range []struct {
+		name     string
+		value    *float64
+		min, max float64
+	}{{"sharpen", &preset.Sharpen, 0, 5}, {"gamma", &preset.Gamma, 0.2, 5}} {
+		v := r.FormValue(field.name)
+		if v == "" {
+			continue
+		}
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(x > field.min && x <= field.max) {
+			return fmt.Errorf("%s must be a number between %g and %g", field.name, field.min, field.max)
+		}
+		*field.value = x
+	}
+
+	seen := make(map[string]bool)
+	for _, f := range preset.Filters {
+		if !supportedFilters[f] {
+			return fmt.Errorf("unknown filter %q", f)
+		}
+		if seen[f] {
+			return fmt.Errorf("filter %q listed twice", f)
+		}
+		seen[f] = true
+	}
+	opts.Filters = preset.Filters
+	opts.Backdrop = presetBackdrop(preset)
+	if seen["sharpen"] {
+		opts.Sharpen = preset.Sharpen
+		if opts.Sharpen == 0 {
+			opts.Sharpen = DefaultSharpen
+		}
+	}
+	if seen["gamma"] {
+		opts.Gamma = preset.Gamma
+		if opts.Gamma == 0 {
+			opts.Gamma = DefaultGamma
+		}
+	}
+	return nil
+}
+
+// Post-process a rendered frame with the scene's filters, in order
+func (sc *scene) postProcess(im image.Image) image.Image {
+	if len(sc.filters) == 0 {
+		return im
+	}
+	dst, ok := im.(*image.NRGBA)
+	if !ok {
+		dst = image.NewNRGBA(im.Bounds())
+		draw.Draw(dst, dst.Bounds(), im, im.Bounds().Min, draw.Src)
+	}
+	for _, f := range sc.filters {
+		switch f {
+		case "fxaa":
+			dst = fxaa(dst)
+		case "sharpen":
+			dst = unsharpMask(dst, sc.sharpen)
+		case "gamma":
+			gammaCorrect(dst, sc.gamma)
+		case "autoexposure":
+			if sc.exposure != nil {
+				applyToneCurve(dst, sc.exposure)
+			}
+		}
+	}
+	return dst
+}
+
+// Perceived brightness of a pixel, 0–1
+func luma(im *image.NRGBA, x, y int) float64 {
+	b := im.Bounds()
+	x = min(max(x, b.Min.X), b.Max.X-1)
+	y = min(max(y, b.Min.Y), b.Max.Y-1)
+	i := im.PixOffset(x, y)
+	p := im.Pix[i : i+3 : i+3]
+	return (0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])) / 255
+}
+
+// Simplified FXAA: find pixels on a high-contrast edge and blend them with
+// the neighbor across the edge, more so the more the pixel stands out from
+// its surroundings. Much cheaper than rendering at a higher resolution.
+func fxaa(src *image.NRGBA) *image.NRGBA {
+	const (
+		edgeThreshold    = 0.125  // Minimum contrast, relative to the brightest neighbor
+		edgeThresholdMin = 0.0312 // Ignore contrast below this in dark areas
+	)
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	copy(dst.Pix, src.Pix)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := luma(src, x, y)
+			n, s := luma(src, x, y-1), luma(src, x, y+1)
+			w, e := luma(src, x-1, y), luma(src, x+1, y)
+			lo := math.Min(c, math.Min(math.Min(n, s), math.Min(w, e)))
+			hi := math.Max(c, math.Max(math.Max(n, s), math.Max(w, e)))
+			contrast := hi - lo
+			if contrast < math.Max(edgeThresholdMin, hi*edgeThreshold) {
+				continue
+			}
+
+			// Blend across the edge, toward the side with the larger step
+			var nx, ny int
+			if math.Abs(n+s-2*c) >= math.Abs(w+e-2*c) {
+				ny = 1
+				if math.Abs(n-c) > math.Abs(s-c) {
+					ny = -1
+				}
+			} else {
+				nx = 1
+				if math.Abs(w-c) > math.Abs(e-c) {
+					nx = -1
+				}
+			}
+			t := math.Min(math.Abs((n+s+w+e)/4-c)/contrast, 1)
+			t = t * t * (3 - 2*t) // Smoothstep
+			t *= t * 0.75
+
+			ox := min(max(x+nx, b.Min.X), b.Max.X-1)
+			oy := min(max(y+ny, b.Min.Y), b.Max.Y-1)
+			i, j := src.PixOffset(x, y), src.PixOffset(ox, oy)
+			for k := 0; k < 4; k++ {
+				dst.Pix[i+k] = uint8(math.Round(float64(src.Pix[i+k])*(1-t) + float64(src.Pix[j+k])*t))
+			}
+		}
+	}
+	return dst
+}
+
+// Sharpen by adding back the difference from a 3×3 blurred copy
+func unsharpMask(src *image.NRGBA, amount float64) *image.NRGBA {
+	b := src.Bounds()
+	dst := image.NewNRGBA(b)
+	kernel := [3]float64{1, 2, 1} // Separable Gaussian, weights sum to 16 in 2D
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var blur [3]float64
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					sx := min(max(x+dx, b.Min.X), b.Max.X-1)
+					sy := min(max(y+dy, b.Min.Y), b.Max.Y-1)
+					weight := kernel[dx+1] * kernel[dy+1] / 16
+					j := src.PixOffset(sx, sy)
+					for k := 0; k < 3; k++ {
+						blur[k] += weight * float64(src.Pix[j+k])
+					}
+				}
+			}
+			i := src.PixOffset(x, y)
+			for k := 0; k < 3; k++ {
+				v := float64(src.Pix[i+k])
+				dst.Pix[i+k] = uint8(math.Max(0, math.Min(255, math.Round(v+amount*(v-blur[k])))))
+			}
+			dst.Pix[i+3] = src.Pix[i+3]
+		}
+	}
+	return dst
+}
+
+// Brighten midtones in place by raising each channel to 1/gamma
+func gammaCorrect(im *image.NRGBA, gamma float64) {
+	var table [256]uint8
+	for i := range table {
+		table[i] = uint8(math.Round(255 * math.Pow(float64(i)/255, 1/gamma)))
+	}
+	for i := 0; i < len(im.Pix); i += 4 {
+		im.Pix[i] = table[im.Pix[i]]
+		im.Pix[i+1] = table[im.Pix[i+1]]
+		im.Pix[i+2] = table[im.Pix[i+2]]
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/gif"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hschendel/stl"
+	"golang.org/x/image/webp"
+)
+
+const FsckSubcommand = "fsck" // First argument that checks stored files and the output index instead of serving
+
+// Problems fsck reports
+const (
+	FsckCorrupt  = "corrupt"  // Unreadable: truncated, or fails to decode or decrypt
+	FsckLeftover = "leftover" // Temporary file of a move interrupted by a crash
+	FsckOrphaned = "orphaned" // Processed mesh without any output of its render
+	FsckDangling = "dangling" // Index entry whose output is missing or corrupt
+	FsckMissing  = "missing"  // Output of a finished render the index doesn't know
+	FsckUnknown  = "unknown"  // Not a name this service stores files under
+)
+
+var (
+	uploadNamePattern = regexp.MustCompile(`^input-([0-9a-f]{64})\.stl$`)
+	renderNamePattern = regexp.MustCompile(`^(?:output|mesh)-([0-9a-f]{64}(?:-[0-9a-f]{16})?)`) // Cache key of a render's file
+)
+
+type fsckProblem struct {
+	kind, name, detail string
+	fixed              bool
+}
+
+// What a check found, and what the index should hold
+type fsckState struct {
+	ctx      context.Context
+	repair   bool
+	problems []fsckProblem
+	uploads  int
+	outputs  int
+	modified int                 // Uploads stored converted or stripped, under the hash of what was sent
+	intact   map[string][]string // Readable output names by cache key
+	meshes   map[string]string   // Readable processed mesh object by cache key
+	primary  map[string]string   // Primary output by cache key, from model records
+}
+
+// Check every stored upload and output against its name, and the output index
+// against the outputs. With -repair, the index is rewritten to match, and
+// corrupt outputs, orphaned meshes, and leftover temporary files are removed;
+// outputs are rendered again on demand, so only uploads are never removed.
+func runFsck(args []string) int {
+	flags := flag.NewFlagSet(FsckSubcommand, flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "fix the index and remove corrupt outputs and leftover files")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := loadConfig(); err != nil {
+		log.Printf("Error loading config: %v", err)
+		return 1
+	}
+	if config.Stateless || (config.Storage.Type != "" && config.Storage.Type != StorageLocal) {
+		log.Printf("fsck checks local storage and %s; it can't run in stateless mode or on object storage", HashesFile)
+		return 1
+	}
+	ctx := context.Background()
+	if err := setupEncryption(ctx, config.Encryption); err != nil {
+		log.Printf("Error configuring encryption: %v", err)
+		return 1
+	}
+	if err := loadFileHashes(); err != nil {
+		log.Printf("Error loading file hashes: %v", err)
+		return 1
+	}
+
+	st := &fsckState{ctx: ctx, repair: *repair, intact: make(map[string][]string), meshes: make(map[string]string), primary: make(map[string]string)}
+	roots := []string{""}
+	for _, t := range config.Tenants {
+		roots = append(roots, tenantStoragePrefix(t.Name))
+	}
+	for _, root := range roots {
+		st.checkUploads(root + "uploads")
+		st.checkOutputs(root + "output")
+		st.readModelRecords(root + "models")
+	}
+	st.checkIndex()
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	remaining := 0
+	for _, p := range st.problems {
+		status := "found"
+		if p.fixed {
+			status = "fixed"
+		} else {
+			remaining++
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\n", p.kind, status, p.name, p.detail)
+	}
+	out.Flush()
+	fmt.Printf("Checked %d uploads (%d stored converted or stripped) and %d outputs: %d problems, %d fixed\n",
+		st.uploads, st.modified, st.outputs, len(st.problems), len(st.problems)-remaining)
+	if remaining > 0 {
+		return 1
+	}
+	return 0
+}
+
+func (st *fsckState) report(kind, name, detail string, fixed bool) {
+	st.problems = append(st.problems, fsckProblem{kind, name, detail, fixed})
+}
+
+// Remove a stored file when repairing; returns whether it's gone
+func (st *fsckState) remove(name string) bool {
+	if !st.repair {
+		return false
+	}
+	if err := os.Remove(filepath.FromSlash(name)); err != nil {
+		log.Printf("Failed to remove %s: %v", name, err)
+		return false
+	}
+	return true
+}
+
+// Names of the files in a storage directory; none when it doesn't exist
+func storedFiles(dir string) []string {
+	entries, err := os.ReadDir(filepath.FromSlash(dir))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to list %s: %v", dir, err)
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
+
+// An upload must hash to its name. Uploads converted from point clouds,
+// G-code, or height maps, or stripped of metadata, are stored under the hash
+// of what was sent; those only need to be readable meshes.
+func (st *fsckState) checkUploads(dir string) {
+	for _, file := range storedFiles(dir) {
+		name := path.Join(dir, file)
+		if strings.HasPrefix(file, ".tmp-") {
+			st.report(FsckLeftover, name, "", st.remove(name))
+			continue
+		}
+		m := uploadNamePattern.FindStringSubmatch(file)
+		if m == nil {
+			st.report(FsckUnknown, name, "", false)
+			continue
+		}
+		st.uploads++
+		hash, err := st.hash(name)
+		if err != nil {
+			st.report(FsckCorrupt, name, err.Error(), false)
+			continue
+		}
+		if hash == m[1] {
+			continue
+		}
+		if err := st.decode(name, readSTL); err != nil {
+			st.report(FsckCorrupt, name, "content doesn't match its hash and isn't a readable STL", false)
+			continue
+		}
+		st.modified++
+	}
+}
+
+// SHA-256 of a stored file's contents, decrypted
+func (st *fsckState) hash(name string) (string, error) {
+	file, err := storage.Open(st.ctx, name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Run a decoder over a stored file's contents, decrypted
+func (st *fsckState) decode(name string, decode func(io.Reader) error) error {
+	file, err := storage.Open(st.ctx, name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return decode(file)
+}
+
+// Storage readers can't seek, and the STL reader needs to, to tell ASCII
+// from binary
+func readSTL(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	_, err = stl.ReadAll(bytes.NewReader(data))
+	return err
+}
+
+// Every output must decode. Corrupt ones are removed when repairing, so the
+// next request renders them again.
+func (st *fsckState) checkOutputs(dir string) {
+	for _, file := range storedFiles(dir) {
+		name := path.Join(dir, file)
+		if strings.HasPrefix(file, ".tmp-") {
+			st.report(FsckLeftover, name, "", st.remove(name))
+			continue
+		}
+		if !outputNamePattern.MatchString(file) {
+			st.report(FsckUnknown, name, "", false)
+			continue
+		}
+		st.outputs++
+		if err := st.decode(name, outputDecoders[path.Ext(file)]); err != nil {
+			st.report(FsckCorrupt, name, err.Error(), st.remove(name))
+			continue
+		}
+		m := renderNamePattern.FindStringSubmatch(file)
+		switch {
+		case m == nil: // Social cards, nests, and scenes aren't indexed
+		case strings.HasPrefix(file, "mesh-"):
+			st.meshes[m[1]] = name
+		default:
+			st.intact[m[1]] = append(st.intact[m[1]], file)
+		}
+	}
+}
+
+// Decoders that read an output in full, by extension
+var outputDecoders = map[string]func(io.Reader) error{
+	".png": func(r io.Reader) error {
+		_, err := png.Decode(r)
+		return err
+	},
+	".webp": func(r io.Reader) error {
+		_, err := webp.Decode(r)
+		return err
+	},
+	".stl": readSTL,
+	".zip": readZip,
+	".gif": func(r io.Reader) error {
+		_, err := gif.DecodeAll(r)
+		return err
+	},
+}
+
+// Read every entry of a ZIP, which checks their CRCs
+func readZip(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	for _, f := range archive.File {
+		entry, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+		_, err = io.Copy(io.Discard, entry)
+		entry.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// Model records list each render's outputs primary first, which decides what
+// the index points to when it's rebuilt
+func (st *fsckState) readModelRecords(dir string) {
+	for _, file := range storedFiles(dir) {
+		if path.Ext(file) != ".json" {
+			continue
+		}
+		name := path.Join(dir, file)
+		var record modelRecord
+		err := st.decode(name, func(r io.Reader) error {
+			return json.NewDecoder(r).Decode(&record)
+		})
+		if err != nil {
+			st.report(FsckCorrupt, name, err.Error(), false)
+			continue
+		}
+		for _, render := range record.Renders {
+			if len(render.Outputs) > 0 {
+				st.primary[render.CacheKey] = render.Outputs[0]
+			}
+		}
+	}
+}
+
+// Drop index entries without a readable output, add outputs the index lost,
+// and find processed meshes left without their render
+func (st *fsckState) checkIndex() {
+	changed := false
+	for _, key := range sortedKeys(fileHashes) {
+		name := fileHashes[key]
+		if !slices.Contains(st.intact[key], name) {
+			if st.repair {
+				delete(fileHashes, key)
+				changed = true
+			}
+			st.report(FsckDangling, key, name, st.repair)
+		}
+	}
+
+	for _, key := range sortedKeys(st.intact) {
+		if _, ok := fileHashes[key]; ok {
+			continue
+		}
+		name := primaryOutput(key, st.intact[key], st.primary[key])
+		if st.repair {
+			fileHashes[key] = name
+			changed = true
+		}
+		st.report(FsckMissing, key, name, st.repair)
+	}
+
+	for _, key := range sortedKeys(st.meshes) {
+		if name := st.meshes[key]; len(st.intact[key]) == 0 {
+			st.report(FsckOrphaned, name, "", st.remove(name))
+		}
+	}
+
+	if changed {
+		if err := saveFileHashes(); err != nil {
+			log.Printf("Failed to save file hashes: %v", err)
+		}
+	}
+}
+
+// Output the index should point to for a render: the one its model record
+// lists first, else a spin ZIP, a build GIF, the plain PNG, or WebP, in that
+// order
+func primaryOutput(key string, names []string, recorded string) string {
+	if slices.Contains(names, recorded) {
+		return recorded
+	}
+	rank := func(name string) int {
+		for i, ext := range []string{".zip", ".gif", ".png", ".webp"} {
+			if name == "output-"+key+ext {
+				return i
+			}
+		}
+		return 4 // Extra maps: depth, backlit, picking
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if rank(names[i]) != rank(names[j]) {
+			return rank(names[i]) < rank(names[j])
+		}
+		return names[i] < names[j]
+	})
+	return names[0]
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
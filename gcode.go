@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	MaxGCodeMoves     = 1000000 // Most printing moves drawn as ribbons; larger prints are thinned evenly
+	MaxGCodeTubeMoves = 250000  // Most printing moves drawn as tubes, which take six times the triangles
+	ExtrusionWidth    = 0.45    // Width of the ribbon or tube drawn for each printing move, in mm
+	ExtrusionHeight   = 0.2     // Height of each tube, in mm, hanging below the nozzle
+)
+
+// How printing moves are drawn
+const (
+	ToolpathRibbons = "ribbons" // Flat strips at the nozzle height; the default
+	ToolpathTubes   = "tubes"   // Hexagonal beads, shaded like extruded plastic
+)
+
+// Corners of a tube's cross section, as fractions of the width and height
+// around the bead's center, top first and going around toward the right
+// of the move
+var tubeProfile = func() (p [6][2]float64) {
+	for k := range p {
+		a := math.Pi/2 + float64(k)*math.Pi/3
+		p[k] = [2]float64{math.Cos(a) / 2, math.Sin(a) / 2}
+	}
+	return p
+}()
+
+// G-code formats accepted by the upload form, by file extension
+var gcodeFormats = map[string]bool{"gcode": true, "gco": true, "g": true}
+
+// G-code format of an uploaded file name, or "" for other files
+func gcodeFormat(filename string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	if gcodeFormats[ext] {
+		return ext
+	}
+	return ""
+}
+
+// A printing move, in mm
+type gcodeMove struct {
+	from, to fauxgl.Vector
+}
+
+// Toolpath drawing asked for by an upload's toolpath field
+func parseToolpath(r *http.Request) (string, error) {
+	switch v := r.FormValue("toolpath"); v {
+	case "", ToolpathRibbons:
+		return ToolpathRibbons, nil
+	case ToolpathTubes:
+		return ToolpathTubes, nil
+	default:
+		return "", fmt.Errorf("toolpath must be ribbons or tubes")
+	}
+}
+
+// Turn sliced G-code into a mesh of what it prints, so a print file can be
+// previewed like any other model: each move that extrudes becomes a flat
+// ribbon ExtrusionWidth wide, or with ToolpathTubes a bead of that width.
+// Travel moves are left out, and arcs are drawn as straight moves to their
+// end.
+func convertGCode(path, stlPath, toolpath string) error {
+	moves, err := loadGCodeMoves(path)
+	if err != nil {
+		return err
+	}
+	if len(moves) == 0 {
+		return fmt.Errorf("G-code prints nothing")
+	}
+	limit, draw := MaxGCodeMoves, gcodeRibbon
+	if toolpath == ToolpathTubes {
+		limit, draw = MaxGCodeTubeMoves, gcodeTube
+	}
+	stride := 1
+	if len(moves) > limit {
+		stride = (len(moves) + limit - 1) / limit
+	}
+	mesh := fauxgl.NewEmptyMesh()
+	for i := 0; i < len(moves); i += stride {
+		mesh.Triangles = append(mesh.Triangles, draw(moves[i])...)
+	}
+	return mesh.SaveSTL(stlPath)
+}
+
+// Unit vector to the left of a move, across the bed
+func moveSide(m gcodeMove) fauxgl.Vector {
+	dir := m.to.Sub(m.from)
+	return fauxgl.Vector{-dir.Y, dir.X, 0}.Normalize()
+}
+
+func gcodeRibbon(m gcodeMove) []*fauxgl.Triangle {
+	side := moveSide(m).MulScalar(ExtrusionWidth / 2)
+	a, b := m.from.Sub(side), m.from.Add(side)
+	c, d := m.to.Add(side), m.to.Sub(side)
+	// Wound to face up, toward the usual camera
+	return []*fauxgl.Triangle{fauxgl.NewTriangleForPoints(a, d, c), fauxgl.NewTriangleForPoints(a, c, b)}
+}
+
+// A hexagonal bead from the nozzle down ExtrusionHeight, open at its ends,
+// which touch the moves before and after it along a line
+func gcodeTube(m gcodeMove) []*fauxgl.Triangle {
+	side := moveSide(m).MulScalar(ExtrusionWidth)
+	up := fauxgl.Vector{0, 0, ExtrusionHeight}
+	center := up.MulScalar(-0.5)
+	var from, to [len(tubeProfile)]fauxgl.Vector
+	for k, p := range tubeProfile {
+		offset := center.Add(side.MulScalar(p[0])).Add(up.MulScalar(p[1]))
+		from[k], to[k] = m.from.Add(offset), m.to.Add(offset)
+	}
+	triangles := make([]*fauxgl.Triangle, 0, 2*len(tubeProfile))
+	for k := range tubeProfile {
+		next := (k + 1) % len(tubeProfile)
+		// Wound to face outward
+		triangles = append(triangles,
+			fauxgl.NewTriangleForPoints(from[k], to[next], to[k]),
+			fauxgl.NewTriangleForPoints(from[k], from[next], to[next]))
+	}
+	return triangles
+}
+
+// Read the printing moves of G-code, following absolute and relative
+// positioning (G90/G91, M82/M83), position resets (G92), and inches (G20)
+func loadGCodeMoves(path string) ([]gcodeMove, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var moves []gcodeMove
+	var pos fauxgl.Vector
+	var e float64
+	relative, relativeE, scale := false, false, 1.0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20) // Slicers embed long lines, e.g. thumbnails
+	for line := 1; scanner.Scan(); line++ {
+		code, _, _ := strings.Cut(scanner.Text(), ";")
+		fields := strings.Fields(strings.ToUpper(code))
+		if len(fields) == 0 {
+			continue
+		}
+		// Only moves and position resets have parameters that matter; others,
+		// like M117, take free text
+		params := make(map[byte]float64)
+		if fields[0] == "G0" || fields[0] == "G1" || fields[0] == "G2" || fields[0] == "G3" || fields[0] == "G92" {
+			for _, f := range fields[1:] {
+				if len(f) < 2 {
+					continue
+				}
+				v, err := strconv.ParseFloat(f[1:], 64)
+				if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+					return nil, fmt.Errorf("line %d: invalid parameter %q", line, f)
+				}
+				params[f[0]] = v
+			}
+		}
+		switch fields[0] {
+		case "G20":
+			scale = 25.4
+		case "G21":
+			scale = 1
+		case "G90":
+			relative, relativeE = false, false
+		case "G91":
+			relative, relativeE = true, true
+		case "M82":
+			relativeE = false
+		case "M83":
+			relativeE = true
+		case "G92":
+			for axis, p := range map[byte]*float64{'X': &pos.X, 'Y': &pos.Y, 'Z': &pos.Z} {
+				if v, ok := params[axis]; ok {
+					*p = v * scale
+				}
+			}
+			if v, ok := params['E']; ok {
+				e = v
+			}
+		case "G0", "G1", "G2", "G3":
+			to := pos
+			for axis, p := range map[byte]*float64{'X': &to.X, 'Y': &to.Y, 'Z': &to.Z} {
+				if v, ok := params[axis]; ok {
+					if relative {
+						*p += v * scale
+					} else {
+						*p = v * scale
+					}
+				}
+			}
+			extruded := false
+			if v, ok := params['E']; ok {
+				if relativeE {
+					extruded = v > 0
+					e += v
+				} else {
+					extruded = v > e
+					e = v
+				}
+			}
+			if extruded && (to.X != pos.X || to.Y != pos.Y) {
+				moves = append(moves, gcodeMove{from: pos, to: to})
+			}
+			pos = to
+		}
+	}
+	return moves, scanner.Err()
+}
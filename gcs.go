@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const gcsScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// Google Cloud Storage over the JSON API
+type gcsStorage struct {
+	bucket string
+	prefix string
+	client *http.Client
+	tokens *googleTokenSource
+}
+
+func (s *gcsStorage) do(req *http.Request) (*http.Response, error) {
+	token, err := s.tokens.token(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return s.client.Do(req)
+}
+
+func (s *gcsStorage) objectURL(name string) string {
+	return fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s", url.PathEscape(s.bucket), url.PathEscape(prefixedName(s.prefix, name)))
+}
+
+func (s *gcsStorage) Publish(ctx context.Context, localPath, name string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	u := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		url.PathEscape(s.bucket), url.QueryEscape(prefixedName(s.prefix, name)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("gcs upload of %s: %s", name, resp.Status)
+	}
+	file.Close()
+	return os.Remove(localPath)
+}
+
+func (s *gcsStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(name)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("gcs download of %s: %s", name, resp.Status)
+}
+
+func (s *gcsStorage) OpenAt(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	if offset == 0 {
+		return s.Open(ctx, name)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(name)+"?alt=media", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, os.ErrNotExist
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("gcs ranged download of %s: %s", name, resp.Status)
+}
+
+func (s *gcsStorage) Stat(ctx context.Context, name string) (StoredFileInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(name)+"?fields=size,updated", nil)
+	if err != nil {
+		return StoredFileInfo{}, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return StoredFileInfo{}, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return StoredFileInfo{}, os.ErrNotExist
+	default:
+		return StoredFileInfo{}, fmt.Errorf("gcs lookup of %s: %s", name, resp.Status)
+	}
+	var object struct {
+		Size    int64     `json:"size,string"`
+		Updated time.Time `json:"updated"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return StoredFileInfo{}, fmt.Errorf("gcs lookup of %s: %w", name, err)
+	}
+	return StoredFileInfo{Size: object.Size, ModTime: object.Updated}, nil
+}
+
+func (s *gcsStorage) Exists(ctx context.Context, name string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(name)+"?fields=name", nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("gcs lookup of %s: %s", name, resp.Status)
+}
+
+// OAuth2 access tokens from Application Default Credentials: the key file in
+// GOOGLE_APPLICATION_CREDENTIALS, then gcloud's user credentials, then the
+// metadata server on GCE, GKE, and Cloud Run
+type googleTokenSource struct {
+	scope   string // OAuth2 scope requested for service accounts
+	mu      sync.Mutex
+	current string
+	expires time.Time
+	client  *http.Client
+}
+
+func newGoogleTokenSource(scope string) *googleTokenSource {
+	return &googleTokenSource{scope: scope, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+// Credentials file as written by gcloud or downloaded for a service account
+type googleCredentials struct {
+	Type         string `json:"type"` // service_account or authorized_user
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type googleTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+func (t *googleTokenSource) token(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != "" && time.Until(t.expires) > time.Minute {
+		return t.current, nil
+	}
+
+	resp, err := t.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to get Google access token: %w", err)
+	}
+	t.current = resp.AccessToken
+	t.expires = time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second)
+	return t.current, nil
+}
+
+func (t *googleTokenSource) fetch(ctx context.Context) (*googleTokenResponse, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			candidate := filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+			}
+		}
+	}
+	if path == "" {
+		return t.fromMetadata(ctx)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var creds googleCredentials
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	switch creds.Type {
+	case "service_account":
+		return t.fromServiceAccount(ctx, creds)
+	case "authorized_user":
+		return t.postToken(ctx, "https://oauth2.googleapis.com/token", url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {creds.ClientID},
+			"client_secret": {creds.ClientSecret},
+			"refresh_token": {creds.RefreshToken},
+		})
+	}
+	return nil, fmt.Errorf("%s: unsupported credentials type %q", path, creds.Type)
+}
+
+// Exchange a self-signed JWT for an access token
+func (t *googleTokenSource) fromServiceAccount(ctx context.Context, creds googleCredentials) (*googleTokenResponse, error) {
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return nil, fmt.Errorf("invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("service account key is not RSA")
+	}
+	tokenURI := creds.TokenURI
+	if tokenURI == "" {
+		tokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": t.scope,
+		"aud":   tokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return t.postToken(ctx, tokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)},
+	})
+}
+
+func (t *googleTokenSource) fromMetadata(ctx context.Context) (*googleTokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return t.decodeToken(t.client.Do(req))
+}
+
+func (t *googleTokenSource) postToken(ctx context.Context, tokenURI string, form url.Values) (*googleTokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return t.decodeToken(t.client.Do(req))
+}
+
+func (t *googleTokenSource) decodeToken(resp *http.Response, err error) (*googleTokenResponse, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	var token googleTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, err
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no access token")
+	}
+	return &token, nil
+}
@@ -3,8 +3,18 @@ module go-render-service
 go 1.23.2
 
 require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/lib/pq v1.10.9
+	github.com/redis/go-redis/v9 v9.7.0
+	golang.org/x/image v0.18.0
+	rsc.io/qr v0.2.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/fogleman/fauxgl v0.0.0-20200818143847-27cddc103802 // indirect
 	github.com/fogleman/simplify v0.0.0-20170216171241-d32f302d5046 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/hschendel/stl v1.0.4 // indirect
+	golang.org/x/text v0.16.0 // indirect
 )
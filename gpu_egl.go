@@ -0,0 +1,421 @@
+//go:build linux && cgo && egl
+
+package main
+
+/*
+#cgo LDFLAGS: -lEGL -lOpenGL
+
+#define GL_GLEXT_PROTOTYPES
+#define EGL_EGLEXT_PROTOTYPES
+#include <stdlib.h>
+#include <EGL/egl.h>
+#include <EGL/eglext.h>
+#include <GL/glcorearb.h>
+
+// Same lighting as fauxgl's Phong shader and the vertex color shader
+static const char *vertexSource =
+	"#version 330 core\n"
+	"uniform mat4 matrix;\n"
+	"layout(location = 0) in vec3 position;\n"
+	"layout(location = 1) in vec3 normal;\n"
+	"layout(location = 2) in vec4 color;\n"
+	"out vec3 vPosition;\n"
+	"out vec3 vNormal;\n"
+	"out vec4 vColor;\n"
+	"void main() {\n"
+	"	vPosition = position;\n"
+	"	vNormal = normal;\n"
+	"	vColor = color;\n"
+	"	gl_Position = matrix * vec4(position, 1.0);\n"
+	"}\n";
+
+static const char *fragmentSource =
+	"#version 330 core\n"
+	"uniform vec3 light;\n"
+	"uniform vec3 eye;\n"
+	"uniform vec4 objectColor;\n"
+	"uniform bool vertexColors;\n"
+	"uniform float specularStrength;\n"
+	"uniform float specularPower;\n"
+	"in vec3 vPosition;\n"
+	"in vec3 vNormal;\n"
+	"in vec4 vColor;\n"
+	"out vec4 fragColor;\n"
+	"void main() {\n"
+	"	vec3 n = normalize(vNormal);\n"
+	"	vec4 color = vertexColors ? vColor : objectColor;\n"
+	"	float diffuse = max(dot(n, light), 0.0);\n"
+	"	float shade = 0.2 + 0.8 * diffuse;\n"
+	"	if (diffuse > 0.0) {\n"
+	"		vec3 toEye = normalize(eye - vPosition);\n"
+	"		float specular = max(dot(toEye, reflect(-light, n)), 0.0);\n"
+	"		if (specular > 0.0) shade += specularStrength * pow(specular, specularPower);\n"
+	"	}\n"
+	"	fragColor = vec4(min(color.rgb * shade, vec3(1.0)), color.a);\n"
+	"}\n";
+
+static EGLDisplay display;
+static GLuint program, framebuffer, colorBuffer, depthBuffer;
+static int fbWidth, fbHeight;
+static char message[512];
+
+// Open the first GPU without a window system, falling back to the default
+// display, and make an OpenGL 3.3 context current on this thread
+static const char *gpuInit(void) {
+	display = EGL_NO_DISPLAY;
+	PFNEGLQUERYDEVICESEXTPROC queryDevices = (PFNEGLQUERYDEVICESEXTPROC)eglGetProcAddress("eglQueryDevicesEXT");
+	PFNEGLGETPLATFORMDISPLAYEXTPROC platformDisplay = (PFNEGLGETPLATFORMDISPLAYEXTPROC)eglGetProcAddress("eglGetPlatformDisplayEXT");
+	EGLDeviceEXT device;
+	EGLint devices = 0;
+	if (queryDevices && platformDisplay && queryDevices(1, &device, &devices) && devices > 0) {
+		display = platformDisplay(EGL_PLATFORM_DEVICE_EXT, device, NULL);
+	}
+	if (display == EGL_NO_DISPLAY) {
+		display = eglGetDisplay(EGL_DEFAULT_DISPLAY);
+	}
+	if (display == EGL_NO_DISPLAY || !eglInitialize(display, NULL, NULL)) {
+		return "no EGL display";
+	}
+	if (!eglBindAPI(EGL_OPENGL_API)) {
+		return "EGL has no OpenGL";
+	}
+	EGLint contextAttribs[] = {
+		EGL_CONTEXT_MAJOR_VERSION, 3,
+		EGL_CONTEXT_MINOR_VERSION, 3,
+		EGL_CONTEXT_OPENGL_PROFILE_MASK, EGL_CONTEXT_OPENGL_CORE_PROFILE_BIT,
+		EGL_NONE,
+	};
+	EGLContext context = eglCreateContext(display, EGL_NO_CONFIG_KHR, EGL_NO_CONTEXT, contextAttribs);
+	if (context == EGL_NO_CONTEXT) {
+		return "can't create an OpenGL 3.3 context";
+	}
+	if (!eglMakeCurrent(display, EGL_NO_SURFACE, EGL_NO_SURFACE, context)) {
+		return "can't make the OpenGL context current";
+	}
+
+	const char *sources[] = {vertexSource, fragmentSource};
+	GLenum types[] = {GL_VERTEX_SHADER, GL_FRAGMENT_SHADER};
+	program = glCreateProgram();
+	for (int i = 0; i < 2; i++) {
+		GLuint shader = glCreateShader(types[i]);
+		glShaderSource(shader, 1, &sources[i], NULL);
+		glCompileShader(shader);
+		GLint ok;
+		glGetShaderiv(shader, GL_COMPILE_STATUS, &ok);
+		if (!ok) {
+			glGetShaderInfoLog(shader, sizeof(message), NULL, message);
+			return message;
+		}
+		glAttachShader(program, shader);
+	}
+	glLinkProgram(program);
+	GLint ok;
+	glGetProgramiv(program, GL_LINK_STATUS, &ok);
+	if (!ok) {
+		glGetProgramInfoLog(program, sizeof(message), NULL, message);
+		return message;
+	}
+	glUseProgram(program);
+
+	glGenFramebuffers(1, &framebuffer);
+	glGenRenderbuffers(1, &colorBuffer);
+	glGenRenderbuffers(1, &depthBuffer);
+	glEnable(GL_CULL_FACE);
+	glCullFace(GL_BACK);
+	glFrontFace(GL_CCW);
+	glEnable(GL_DEPTH_TEST);
+	glDepthFunc(GL_LESS);
+	glBlendFuncSeparate(GL_SRC_ALPHA, GL_ONE_MINUS_SRC_ALPHA, GL_ONE, GL_ONE_MINUS_SRC_ALPHA);
+	glPixelStorei(GL_PACK_ALIGNMENT, 1);
+	return NULL;
+}
+
+// Upload a mesh as vertex positions and normals, plus RGBA colors
+static GLuint gpuUpload(const float *positionsNormals, const unsigned char *colors, long vertices) {
+	GLuint vao, buffers[2];
+	glGenVertexArrays(1, &vao);
+	glBindVertexArray(vao);
+	glGenBuffers(2, buffers);
+	glBindBuffer(GL_ARRAY_BUFFER, buffers[0]);
+	glBufferData(GL_ARRAY_BUFFER, vertices * 6 * sizeof(float), positionsNormals, GL_STATIC_DRAW);
+	glVertexAttribPointer(0, 3, GL_FLOAT, GL_FALSE, 6 * sizeof(float), (void *)0);
+	glVertexAttribPointer(1, 3, GL_FLOAT, GL_FALSE, 6 * sizeof(float), (void *)(3 * sizeof(float)));
+	glEnableVertexAttribArray(0);
+	glEnableVertexAttribArray(1);
+	glBindBuffer(GL_ARRAY_BUFFER, buffers[1]);
+	glBufferData(GL_ARRAY_BUFFER, vertices * 4, colors, GL_STATIC_DRAW);
+	glVertexAttribPointer(2, 4, GL_UNSIGNED_BYTE, GL_TRUE, 0, (void *)0);
+	glEnableVertexAttribArray(2);
+	glBindVertexArray(0);
+	// The vertex array keeps the buffers alive until it's deleted
+	glDeleteBuffers(2, buffers);
+	return vao;
+}
+
+static void gpuFree(GLuint vao) {
+	glDeleteVertexArrays(1, &vao);
+}
+
+// Size the framebuffer and clear it to opaque white
+static const char *gpuBegin(int width, int height) {
+	glBindFramebuffer(GL_FRAMEBUFFER, framebuffer);
+	if (width != fbWidth || height != fbHeight) {
+		glBindRenderbuffer(GL_RENDERBUFFER, colorBuffer);
+		glRenderbufferStorage(GL_RENDERBUFFER, GL_RGBA8, width, height);
+		glBindRenderbuffer(GL_RENDERBUFFER, depthBuffer);
+		glRenderbufferStorage(GL_RENDERBUFFER, GL_DEPTH_COMPONENT32F, width, height);
+		glFramebufferRenderbuffer(GL_FRAMEBUFFER, GL_COLOR_ATTACHMENT0, GL_RENDERBUFFER, colorBuffer);
+		glFramebufferRenderbuffer(GL_FRAMEBUFFER, GL_DEPTH_ATTACHMENT, GL_RENDERBUFFER, depthBuffer);
+		if (glCheckFramebufferStatus(GL_FRAMEBUFFER) != GL_FRAMEBUFFER_COMPLETE) {
+			fbWidth = fbHeight = 0;
+			return "framebuffer incomplete; the image may be too large for the GPU";
+		}
+		fbWidth = width;
+		fbHeight = height;
+	}
+	glViewport(0, 0, width, height);
+	glDepthMask(GL_TRUE);
+	glClearColor(1, 1, 1, 1);
+	glClearDepth(1);
+	glClear(GL_COLOR_BUFFER_BIT | GL_DEPTH_BUFFER_BIT);
+	return NULL;
+}
+
+// Draw one uploaded mesh. The matrix is row-major, like fauxgl's.
+static void gpuDraw(GLuint vao, long vertices, const float *matrix, const float *light, const float *eye,
+		const float *color, int vertexColors, float specularStrength, float specularPower, int blend, int writeDepth) {
+	glUniformMatrix4fv(glGetUniformLocation(program, "matrix"), 1, GL_TRUE, matrix);
+	glUniform3fv(glGetUniformLocation(program, "light"), 1, light);
+	glUniform3fv(glGetUniformLocation(program, "eye"), 1, eye);
+	glUniform4fv(glGetUniformLocation(program, "objectColor"), 1, color);
+	glUniform1i(glGetUniformLocation(program, "vertexColors"), vertexColors);
+	glUniform1f(glGetUniformLocation(program, "specularStrength"), specularStrength);
+	glUniform1f(glGetUniformLocation(program, "specularPower"), specularPower);
+	if (blend) {
+		glEnable(GL_BLEND);
+	} else {
+		glDisable(GL_BLEND);
+	}
+	glDepthMask(writeDepth ? GL_TRUE : GL_FALSE);
+	glBindVertexArray(vao);
+	glDrawArrays(GL_TRIANGLES, 0, vertices);
+	glBindVertexArray(0);
+}
+
+static void gpuClearDepth(void) {
+	glDepthMask(GL_TRUE);
+	glClear(GL_DEPTH_BUFFER_BIT);
+}
+
+static void gpuReadDepth(float *depth, int width, int height) {
+	glReadPixels(0, 0, width, height, GL_DEPTH_COMPONENT, GL_FLOAT, depth);
+}
+
+static void gpuReadColor(unsigned char *rgba, int width, int height) {
+	glReadPixels(0, 0, width, height, GL_RGBA, GL_UNSIGNED_BYTE, rgba);
+}
+
+static const char *gpuError(void) {
+	switch (glGetError()) {
+	case GL_NO_ERROR:
+		return NULL;
+	case GL_OUT_OF_MEMORY:
+		return "out of GPU memory";
+	default:
+		return "OpenGL error";
+	}
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"log"
+	"math"
+	"runtime"
+	"unsafe"
+
+	"github.com/fogleman/fauxgl"
+)
+
+// Renders on the GPU through OpenGL in a headless EGL context. The context
+// belongs to one OS thread, so every call runs on a goroutine locked to it.
+// Meshes stay uploaded while consecutive renders draw them, so a spin
+// uploads its model once.
+type gpuRenderer struct {
+	calls  chan func()
+	meshes map[*fauxgl.Mesh]gpuMesh // Only touched on the GL thread
+}
+
+type gpuMesh struct {
+	vao      C.GLuint
+	vertices int
+}
+
+func newGPURenderer() (Renderer, error) {
+	g := &gpuRenderer{calls: make(chan func()), meshes: make(map[*fauxgl.Mesh]gpuMesh)}
+	ready := make(chan error)
+	go g.run(ready)
+	if err := <-ready; err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *gpuRenderer) run(ready chan<- error) {
+	runtime.LockOSThread()
+	if msg := C.gpuInit(); msg != nil {
+		ready <- errors.New(C.GoString(msg))
+		return
+	}
+	ready <- nil
+	for call := range g.calls {
+		call()
+	}
+}
+
+// Falls back to the CPU when the GPU fails, e.g. when it's out of memory
+func (g *gpuRenderer) Render(sc *scene, cam camera, width, height int) *fauxgl.Context {
+	var context *fauxgl.Context
+	done := make(chan error)
+	g.calls <- func() {
+		var err error
+		context, err = g.draw(sc, cam, width, height)
+		done <- err
+	}
+	if err := <-done; err != nil {
+		log.Printf("GPU render failed, rendering on the CPU: %v", err)
+		return cpuRenderer{}.Render(sc, cam, width, height)
+	}
+	return context
+}
+
+// Draw the model, then its overlays the same way the CPU renderer does
+func (g *gpuRenderer) draw(sc *scene, cam camera, width, height int) (*fauxgl.Context, error) {
+	g.keepMeshes(sc)
+	if msg := C.gpuBegin(C.int(width), C.int(height)); msg != nil {
+		return nil, errors.New(C.GoString(msg))
+	}
+
+	near, far := clipPlanes(sc, cam)
+	m := cam.projection(width, height, near, far)
+	matrix := []C.float{
+		C.float(m.X00), C.float(m.X01), C.float(m.X02), C.float(m.X03),
+		C.float(m.X10), C.float(m.X11), C.float(m.X12), C.float(m.X13),
+		C.float(m.X20), C.float(m.X21), C.float(m.X22), C.float(m.X23),
+		C.float(m.X30), C.float(m.X31), C.float(m.X32), C.float(m.X33),
+	}
+	l := fauxgl.Vector{1, 1, 1}.Normalize()
+	light := []C.float{C.float(l.X), C.float(l.Y), C.float(l.Z)}
+	eye := []C.float{C.float(cam.eye.X), C.float(cam.eye.Y), C.float(cam.eye.Z)}
+	drawMesh := func(mesh *fauxgl.Mesh, c fauxgl.Color, vertexColors bool, specular float64, blend, writeDepth bool) error {
+		uploaded, err := g.upload(mesh)
+		if err != nil {
+			return err
+		}
+		color := []C.float{C.float(c.R), C.float(c.G), C.float(c.B), C.float(c.A)}
+		C.gpuDraw(uploaded.vao, C.long(uploaded.vertices), &matrix[0], &light[0], &eye[0], &color[0],
+			cBool(vertexColors), C.float(specular), 100, cBool(blend), cBool(writeDepth))
+		return nil
+	}
+
+	if sc.vertexColors {
+		if err := drawMesh(sc.mesh, fauxgl.White, true, 0.3, false, true); err != nil {
+			return nil, err
+		}
+	} else if err := drawMesh(sc.mesh, sc.modelColor(), false, 1, false, true); err != nil {
+		return nil, err
+	}
+
+	// The model's depth is kept, so depth maps aren't affected by overlays
+	depth := make([]float32, width*height)
+	C.gpuReadDepth((*C.float)(unsafe.Pointer(&depth[0])), C.int(width), C.int(height))
+	for _, o := range sc.overlays {
+		if o.translucent {
+			if err := drawMesh(o.mesh, o.color, false, 1, true, false); err != nil {
+				return nil, err
+			}
+		}
+	}
+	C.gpuClearDepth()
+	for _, o := range sc.overlays {
+		if !o.translucent {
+			if err := drawMesh(o.mesh, o.color, false, 1, false, true); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	context := fauxgl.NewContext(width, height)
+	pix := make([]byte, 4*width*height)
+	C.gpuReadColor((*C.uchar)(unsafe.Pointer(&pix[0])), C.int(width), C.int(height))
+	if msg := C.gpuError(); msg != nil {
+		return nil, errors.New(C.GoString(msg))
+	}
+
+	// OpenGL's rows go bottom up, fauxgl's top down
+	stride := 4 * width
+	for y := 0; y < height; y++ {
+		row := height - 1 - y
+		copy(context.ColorBuffer.Pix[y*context.ColorBuffer.Stride:], pix[row*stride:(row+1)*stride])
+		for x := 0; x < width; x++ {
+			d := float64(depth[row*width+x])
+			if d >= 1 {
+				d = math.MaxFloat64 // Background, like a cleared fauxgl depth buffer
+			}
+			context.DepthBuffer[y*width+x] = d
+		}
+	}
+	return context, nil
+}
+
+// Free uploaded meshes that aren't part of the scene
+func (g *gpuRenderer) keepMeshes(sc *scene) {
+	keep := map[*fauxgl.Mesh]bool{sc.mesh: true}
+	for _, o := range sc.overlays {
+		keep[o.mesh] = true
+	}
+	for mesh, uploaded := range g.meshes {
+		if !keep[mesh] {
+			C.gpuFree(uploaded.vao)
+			delete(g.meshes, mesh)
+		}
+	}
+}
+
+// Upload a mesh unless it already is
+func (g *gpuRenderer) upload(mesh *fauxgl.Mesh) (gpuMesh, error) {
+	if uploaded, ok := g.meshes[mesh]; ok {
+		return uploaded, nil
+	}
+	vertices := 3 * len(mesh.Triangles)
+	if vertices == 0 {
+		return gpuMesh{}, nil
+	}
+	positionsNormals := make([]float32, 0, 6*vertices)
+	colors := make([]byte, 0, 4*vertices)
+	for _, t := range mesh.Triangles {
+		for _, v := range []fauxgl.Vertex{t.V1, t.V2, t.V3} {
+			positionsNormals = append(positionsNormals,
+				float32(v.Position.X), float32(v.Position.Y), float32(v.Position.Z),
+				float32(v.Normal.X), float32(v.Normal.Y), float32(v.Normal.Z))
+			c := v.Color.NRGBA()
+			colors = append(colors, c.R, c.G, c.B, c.A)
+		}
+	}
+	vao := C.gpuUpload((*C.float)(unsafe.Pointer(&positionsNormals[0])), (*C.uchar)(unsafe.Pointer(&colors[0])), C.long(vertices))
+	if msg := C.gpuError(); msg != nil {
+		C.gpuFree(vao)
+		return gpuMesh{}, errors.New(C.GoString(msg))
+	}
+	uploaded := gpuMesh{vao: vao, vertices: vertices}
+	g.meshes[mesh] = uploaded
+	return uploaded, nil
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,9 @@
+//go:build !(linux && cgo && egl)
+
+package main
+
+import "errors"
+
+func newGPURenderer() (Renderer, error) {
+	return nil, errors.New("the GPU renderer needs a Linux build with cgo and -tags egl")
+}
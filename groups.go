@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const GroupRecheckInterval = 5 * time.Second // How often a group socket looks for members that joined since it last did
+
+// Client-chosen group IDs. Anyone with one can see the group's jobs, so
+// they should be as hard to guess as job tokens.
+var groupIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{8,64}$`)
+
+// Group status once every job in it finished
+const (
+	GroupPending = "pending" // Some jobs are still queued or rendering
+	GroupDone    = "done"    // Every job rendered
+	GroupPartial = "partial" // Some jobs failed, the rest rendered
+	GroupFailed  = "failed"  // Every job failed
+)
+
+// Job IDs by tenant and group ID, when not stateless; guarded by mu
+var jobGroups = make(map[string][]string)
+
+// How the jobs of a group are doing
+type groupResponse struct {
+	ID         string        `json:"id"`
+	Status     string        `json:"status"` // GroupPending until every job finished
+	Total      int           `json:"total"`
+	Queued     int           `json:"queued"`
+	Processing int           `json:"processing"`
+	Done       int           `json:"done"`
+	Failed     int           `json:"failed"`
+	Jobs       []jobResponse `json:"jobs"` // In the order they joined
+}
+
+// Group ID a render request asks its job to join; empty when none
+func parseGroupID(r *http.Request) (string, error) {
+	id := r.FormValue("group_id")
+	if id != "" && !groupIDPattern.MatchString(id) {
+		return "", errors.New("group_id must be 8 to 64 letters, digits, dashes, or underscores")
+	}
+	return id, nil
+}
+
+func groupKey(tenant, id string) string {
+	return tenant + "/" + id
+}
+
+// Add the job a request created or joined to the request's group, if any
+func joinRequestGroup(r *http.Request, jobID string) {
+	id, err := parseGroupID(r)
+	if err != nil || id == "" {
+		return
+	}
+	if err := addGroupMember(groupKey(tenantOf(r.Context()), id), jobID); err != nil {
+		log.Printf("Failed to add job ID %s to group %s: %v", jobID, id, err)
+	}
+}
+
+func addGroupMember(key, jobID string) error {
+	if store != nil {
+		ctx := context.Background()
+		name := redisKey("group:" + key)
+		if err := rdb.SAdd(ctx, name, jobID).Err(); err != nil {
+			return err
+		}
+		return rdb.Expire(ctx, name, JobPendingTTL).Err()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Contains(jobGroups[key], jobID) {
+		jobGroups[key] = append(jobGroups[key], jobID)
+	}
+	return nil
+}
+
+func groupMembers(key string) ([]string, error) {
+	if store != nil {
+		members, err := rdb.SMembers(context.Background(), redisKey("group:"+key)).Result()
+		slices.Sort(members) // Sets are unordered; at least keep the order stable
+		return members, err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	return slices.Clone(jobGroups[key]), nil
+}
+
+// Aggregate status of a group, and a channel per unfinished job that closes
+// on its next change. Jobs past their retention are left out; false when the
+// group has none left.
+func groupStatus(tenant, id string) (groupResponse, []<-chan struct{}, bool, error) {
+	members, err := groupMembers(groupKey(tenant, id))
+	if err != nil {
+		return groupResponse{}, nil, false, err
+	}
+	resp := groupResponse{ID: id, Jobs: []jobResponse{}}
+	var changes []<-chan struct{}
+	for _, jobID := range members {
+		job, changed, ok := getJob(jobID)
+		if !ok {
+			continue
+		}
+		resp.Jobs = append(resp.Jobs, newJobResponse(job))
+		switch job.Status {
+		case JobQueued:
+			resp.Queued++
+		case JobProcessing:
+			resp.Processing++
+		case JobDone:
+			resp.Done++
+		case JobFailed:
+			resp.Failed++
+		}
+		if !job.finished() {
+			changes = append(changes, changed)
+		}
+	}
+	resp.Total = len(resp.Jobs)
+	switch {
+	case resp.Done+resp.Failed < resp.Total:
+		resp.Status = GroupPending
+	case resp.Failed == 0:
+		resp.Status = GroupDone
+	case resp.Done == 0:
+		resp.Status = GroupFailed
+	default:
+		resp.Status = GroupPartial
+	}
+	return resp, changes, resp.Total > 0, nil
+}
+
+// Forget groups whose jobs all expired. Called with mu held.
+func expireGroups() {
+	for key, members := range jobGroups {
+		members = slices.DeleteFunc(members, func(id string) bool {
+			_, ok := jobs[id]
+			return !ok
+		})
+		if len(members) == 0 {
+			delete(jobGroups, key)
+		} else {
+			jobGroups[key] = members
+		}
+	}
+}
+
+// GET /api/v1/groups/{id}
+//
+// Aggregate status of the jobs submitted with group_id, each as
+// /api/v1/jobs/{id} shows it
+func groupHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !groupIDPattern.MatchString(id) {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid group ID")
+		return
+	}
+	resp, _, ok, err := groupStatus(tenantOf(r.Context()), id)
+	if err != nil {
+		log.Printf("Failed to load group %s: %v", id, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load group")
+		return
+	}
+	if !ok {
+		apiError(w, r, http.StatusNotFound, ErrNotFound, "Group not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// GET /ws/groups/{id}
+//
+// Sends one group_done event, with the group's aggregate status and counts,
+// once every job in the group has finished, then closes. Jobs that join
+// after that don't reopen it. The socket may be opened before the first job
+// joins.
+func groupWSHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !groupIDPattern.MatchString(id) {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid group ID")
+		return
+	}
+	conn, err := upgradeWS(w, r)
+	if err != nil {
+		log.Println("WebSocket upgrade failed:", err)
+		return
+	}
+	defer conn.Close()
+
+	// Notice the client going away while waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	tenant := tenantOf(r.Context())
+	for {
+		resp, changes, ok, err := groupStatus(tenant, id)
+		if err != nil {
+			log.Printf("Failed to load group %s: %v", id, err)
+		}
+		if err == nil && ok && resp.Status != GroupPending {
+			event := wsEvent{Type: "group_done", GroupID: id, Status: resp.Status, Total: resp.Total, Succeeded: resp.Done, Failed: resp.Failed}
+			conn.WriteMessage(websocket.TextMessage, encodeEvent(wsVersion(conn), event))
+			return
+		}
+		if !waitForChange(ctx, changes, GroupRecheckInterval) {
+			return
+		}
+	}
+}
+
+// Wait until one of the channels closes or the timeout passes; false if ctx
+// ended first
+func waitForChange(ctx context.Context, changes []<-chan struct{}, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	done := make(chan struct{})
+	defer close(done)
+	changed := make(chan struct{}, 1)
+	for _, ch := range changes {
+		go func() {
+			select {
+			case <-ch:
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			case <-done:
+			}
+		}()
+	}
+	select {
+	case <-changed:
+	case <-timer.C:
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
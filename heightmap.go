@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // Register decoders for height map uploads
+	_ "image/png"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	MaxHeightMapPixels = 512  // Height maps are downsampled to at most this many samples along each side
+	MaxHeightMapSize   = 1000 // Largest accepted size, depth, or base, in mm
+	MaxHeightMapImage  = 4096 // Largest accepted image width or height, in pixels, checked before decoding
+
+	// Light lost per mm of lithophane, as a decay rate: each extra mm lets
+	// through about a third as much, roughly white PLA
+	LithophaneAttenuation = 1.2
+)
+
+var (
+	backlightColor  = color.NRGBA{0xff, 0xf0, 0xd6, 0xff} // Warm white
+	backlitBackdrop = color.NRGBA{0x20, 0x20, 0x20, 0xff}
+)
+
+// Image formats accepted as height maps, by file extension
+var heightMapFormats = map[string]string{"png": "png", "jpg": "jpg", "jpeg": "jpg"}
+
+// How a height map becomes a solid: the image is laid flat, Size mm along
+// its longer side, on a Base mm slab; white is Depth mm above the slab and
+// black is level with it, or the other way round with Invert
+type HeightMapSettings struct {
+	Size   float64
+	Depth  float64
+	Base   float64
+	Invert bool
+}
+
+var (
+	defaultHeightMap = HeightMapSettings{Size: 100, Depth: 10, Base: 2}
+	// Photo lithophane: dark areas thick, 0.8 mm to 3 mm
+	defaultLithophane = HeightMapSettings{Size: 100, Depth: 2.2, Base: 0.8, Invert: true}
+)
+
+// Height map format of an uploaded file name, or ""
+func heightMapFormat(filename string) string {
+	return heightMapFormats[strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))]
+}
+
+// Read the height map form fields, in mm
+func parseHeightMapSettings(r *http.Request) (HeightMapSettings, error) {
+	settings := defaultHeightMap
+	if v := r.FormValue("lithophane"); v != "" {
+		lithophane, err := strconv.ParseBool(v)
+		if err != nil {
+			return settings, fmt.Errorf("lithophane must be true or false")
+		}
+		if lithophane {
+			settings = defaultLithophane
+		}
+	}
+	for _, field := range []struct {
+		name     string
+		value    *float64
+		min, max float64
+	}{
+		{"heightmap_size", &settings.Size, 0, MaxHeightMapSize},
+		{"heightmap_depth", &settings.Depth, 0, MaxHeightMapSize},
+		{"heightmap_base", &settings.Base, 0, MaxHeightMapSize},
+	} {
+		v := r.FormValue(field.name)
+		if v == "" {
+			continue
+		}
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(x > field.min && x <= field.max) {
+			return settings, fmt.Errorf("%s must be a length in mm between %g and %g", field.name, field.min, field.max)
+		}
+		*field.value = x
+	}
+	if v := r.FormValue("heightmap_invert"); v != "" {
+		invert, err := strconv.ParseBool(v)
+		if err != nil {
+			return settings, fmt.Errorf("heightmap_invert must be true or false")
+		}
+		settings.Invert = invert
+	}
+	return settings, nil
+}
+
+// Canonical form of the settings, for the file hash
+func (s HeightMapSettings) key() string {
+	return fmt.Sprintf("heightmap:%g:%g:%g:%t", s.Size, s.Depth, s.Base, s.Invert)
+}
+
+// Decode a height map image and write it as a solid STL
+func convertHeightMap(path, stlPath string, settings HeightMapSettings) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// A small file can declare a huge image; look at its size before
+	// decoding allocates it
+	cfg, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return fmt.Errorf("failed to decode height map: %w", err)
+	}
+	if cfg.Width > MaxHeightMapImage || cfg.Height > MaxHeightMapImage {
+		return fmt.Errorf("height map is %d×%d pixels, larger than %d×%d", cfg.Width, cfg.Height, MaxHeightMapImage, MaxHeightMapImage)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	im, _, err := image.Decode(file)
+	if err != nil {
+		return fmt.Errorf("failed to decode height map: %w", err)
+	}
+	grid := heightSamples(im, MaxHeightMapPixels)
+	if grid.w < 2 || grid.h < 2 {
+		return fmt.Errorf("height map must be at least 2×2 pixels")
+	}
+	return heightMapMesh(grid, settings).SaveSTL(stlPath)
+}
+
+// Brightness grid of an image, 0 for black to 1 for white, averaged down to
+// at most maxSide samples along each side
+type heightGrid struct {
+	w, h   int
+	values []float64 // Row by row, top row first
+}
+
+func (g heightGrid) at(x, y int) float64 {
+	return g.values[y*g.w+x]
+}
+
+func heightSamples(im image.Image, maxSide int) heightGrid {
+	b := im.Bounds()
+	step := max(1, (max(b.Dx(), b.Dy())+maxSide-1)/maxSide)
+	g := heightGrid{w: (b.Dx() + step - 1) / step, h: (b.Dy() + step - 1) / step}
+	g.values = make([]float64, g.w*g.h)
+	for y := 0; y < g.h; y++ {
+		for x := 0; x < g.w; x++ {
+			var sum float64
+			n := 0
+			for sy := b.Min.Y + y*step; sy < min(b.Min.Y+(y+1)*step, b.Max.Y); sy++ {
+				for sx := b.Min.X + x*step; sx < min(b.Min.X+(x+1)*step, b.Max.X); sx++ {
+					sum += float64(color.Gray16Model.Convert(im.At(sx, sy)).(color.Gray16).Y) / 0xffff
+					n++
+				}
+			}
+			g.values[y*g.w+x] = sum / float64(n)
+		}
+	}
+	return g
+}
+
+// Watertight solid from a height grid: the relief on top, vertical walls
+// around the edge, and a flat bottom at z = 0. The image's top row faces +Y.
+func heightMapMesh(g heightGrid, settings HeightMapSettings) *fauxgl.Mesh {
+	spacing := settings.Size / float64(max(max(g.w, g.h)-1, 1))
+	top := func(x, y int) fauxgl.Vector {
+		v := g.at(x, y)
+		if settings.Invert {
+			v = 1 - v
+		}
+		return fauxgl.Vector{float64(x) * spacing, float64(g.h-1-y) * spacing, settings.Base + v*settings.Depth}
+	}
+	bottom := func(x, y int) fauxgl.Vector {
+		p := top(x, y)
+		p.Z = 0
+		return p
+	}
+
+	mesh := fauxgl.NewEmptyMesh()
+	add := func(a, b, c fauxgl.Vector) {
+		mesh.Triangles = append(mesh.Triangles, fauxgl.NewTriangleForPoints(a, b, c))
+	}
+
+	// Relief, two triangles per cell, counterclockwise seen from above
+	for y := 0; y+1 < g.h; y++ {
+		for x := 0; x+1 < g.w; x++ {
+			tl, tr, bl, br := top(x, y), top(x+1, y), top(x, y+1), top(x+1, y+1)
+			add(tl, bl, br)
+			add(tl, br, tr)
+		}
+	}
+
+	// Edge of the grid, counterclockwise seen from above, starting at the
+	// bottom-left corner
+	var rim [][2]int
+	for x := 0; x < g.w-1; x++ {
+		rim = append(rim, [2]int{x, g.h - 1})
+	}
+	for y := g.h - 1; y > 0; y-- {
+		rim = append(rim, [2]int{g.w - 1, y})
+	}
+	for x := g.w - 1; x > 0; x-- {
+		rim = append(rim, [2]int{x, 0})
+	}
+	for y := 0; y < g.h-1; y++ {
+		rim = append(rim, [2]int{0, y})
+	}
+
+	// Walls facing outward, and the bottom as a fan facing down
+	center := fauxgl.Vector{float64(g.w-1) * spacing / 2, float64(g.h-1) * spacing / 2, 0}
+	for i, p := range rim {
+		q := rim[(i+1)%len(rim)]
+		t1, t2 := top(p[0], p[1]), top(q[0], q[1])
+		b1, b2 := bottom(p[0], p[1]), bottom(q[0], q[1])
+		add(b1, b2, t2)
+		add(b1, t2, t1)
+		add(center, b2, b1)
+	}
+	return mesh
+}
+
+// Top-down view of the model held up to a warm light, as a printed
+// lithophane looks in a window: the thinnest areas glow and light falls off
+// with thickness. Expects the mesh fitted to the bi-unit cube.
+func backlitImage(sc *scene, width, height int) image.Image {
+	im := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(im, im.Bounds(), image.NewUniform(backlitBackdrop), image.Point{}, draw.Src)
+	box := sc.mesh.BoundingBox()
+	size := box.Size()
+	if size.X <= 0 || size.Y <= 0 {
+		return im
+	}
+
+	// Footprint centered in the image with a margin, +Y up
+	scale := 0.9 * math.Min(float64(width)/size.X, float64(height)/size.Y)
+	ox := (float64(width) - size.X*scale) / 2
+	oy := (float64(height) - size.Y*scale) / 2
+	toPixel := func(v fauxgl.Vector) fauxgl.Vector {
+		return fauxgl.Vector{ox + (v.X-box.Min.X)*scale, oy + (box.Max.Y-v.Y)*scale, v.Z}
+	}
+
+	// Highest surface over each pixel center
+	top := make([]float64, width*height)
+	for i := range top {
+		top[i] = math.Inf(-1)
+	}
+	for _, t := range sc.mesh.Triangles {
+		a, b, c := toPixel(t.V1.Position), toPixel(t.V2.Position), toPixel(t.V3.Position)
+		x0 := max(0, int(math.Floor(min(a.X, b.X, c.X))))
+		x1 := min(width-1, int(math.Ceil(max(a.X, b.X, c.X))))
+		y0 := max(0, int(math.Floor(min(a.Y, b.Y, c.Y))))
+		y1 := min(height-1, int(math.Ceil(max(a.Y, b.Y, c.Y))))
+		for y := y0; y <= y1; y++ {
+			for x := x0; x <= x1; x++ {
+				z, ok := verticalHit(a, b, c, float64(x)+0.5, float64(y)+0.5)
+				if ok && z > top[y*width+x] {
+					top[y*width+x] = z
+				}
+			}
+		}
+	}
+
+	thinnest := math.Inf(1)
+	for _, z := range top {
+		if !math.IsInf(z, -1) {
+			thinnest = math.Min(thinnest, z)
+		}
+	}
+	mmPerUnit := unitScales[sc.stats.Units] / sc.fitScale
+	for i, z := range top {
+		if math.IsInf(z, -1) {
+			continue
+		}
+		light := math.Exp(-LithophaneAttenuation * (z - thinnest) * mmPerUnit)
+		im.SetNRGBA(i%width, i/width, color.NRGBA{
+			uint8(math.Round(float64(backlightColor.R) * light)),
+			uint8(math.Round(float64(backlightColor.G) * light)),
+			uint8(math.Round(float64(backlightColor.B) * light)),
+			0xff,
+		})
+	}
+	return im
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A PNG of a small image whose header claims it is width×height, as a
+// hostile upload would
+func pngClaiming(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// The IHDR chunk follows the 8 byte signature: length, type, then width
+	// and height, with a CRC over type and data after its 13 data bytes
+	binary.BigEndian.PutUint32(data[16:], width)
+	binary.BigEndian.PutUint32(data[20:], height)
+	binary.BigEndian.PutUint32(data[29:], crc32.ChecksumIEEE(data[12:29]))
+	return data
+}
+
+func TestConvertHeightMapRejectsHugeImages(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "huge.png")
+	if err := os.WriteFile(path, pngClaiming(t, 60000, 60000), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stlPath := filepath.Join(dir, "huge.stl")
+	if err := convertHeightMap(path, stlPath, defaultHeightMap); err == nil {
+		t.Fatal("convertHeightMap accepted a 60000×60000 image")
+	}
+	if _, err := os.Stat(stlPath); err == nil {
+		t.Error("convertHeightMap wrote an STL for a rejected image")
+	}
+}
+
+func TestConvertHeightMap(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "map.png")
+	if err := os.WriteFile(path, pngClaiming(t, 4, 4), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	stlPath := filepath.Join(dir, "map.stl")
+	if err := convertHeightMap(path, stlPath, defaultHeightMap); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(stlPath); err != nil || info.Size() == 0 {
+		t.Fatalf("no STL written: %v", err)
+	}
+}
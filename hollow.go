@@ -0,0 +1,230 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	MaxHollowWall  = 50  // Largest accepted hollow_wall, in mm
+	HollowGridSize = 160 // Voxels along the model's longest side
+)
+
+// Material estimate for printing a model hollowed to a fixed wall thickness
+type Hollowing struct {
+	WallMM          float64 `json:"wall_mm"`
+	SolidVolumeMM3  float64 `json:"solid_volume_mm3"`
+	HollowVolumeMM3 float64 `json:"hollow_volume_mm3"`
+	SavingsPercent  float64 `json:"savings_percent"`
+	VoxelSizeMM     float64 `json:"voxel_size_mm"` // Resolution of the estimate
+}
+
+// Estimate the volume left after hollowing a closed mesh to the given wall
+// thickness (mm). The model is voxelized, each inside voxel's distance to the
+// outside is computed, and voxels deeper than the wall count as removed.
+// mmPerUnit converts model units to millimeters. Returns nil for meshes that
+// enclose no volume.
+func estimateHollowing(mesh *fauxgl.Mesh, wallMM, mmPerUnit float64) *Hollowing {
+	solid := math.Abs(mesh.Volume())
+	if solid == 0 {
+		return nil
+	}
+
+	origin, voxel, nx, ny, nz := voxelGrid(mesh, HollowGridSize)
+	inside := voxelize(mesh, origin, voxel, nx, ny, nz)
+
+	// Squared distance, in voxels, from each inside voxel to the nearest outside one
+	dist := make([]float64, len(inside))
+	for i, in := range inside {
+		if in {
+			dist[i] = math.Inf(1)
+		}
+	}
+	distanceTransform(dist, nx, ny, nz)
+
+	// Distances are measured between voxel centers; the surface lies half a voxel out
+	wall := wallMM / mmPerUnit / voxel
+	removed := 0
+	for i, in := range inside {
+		if in && math.Sqrt(dist[i])-0.5 > wall {
+			removed++
+		}
+	}
+
+	unit3 := mmPerUnit * mmPerUnit * mmPerUnit
+	solidMM3 := solid * unit3
+	hollowMM3 := math.Max(0, solidMM3-float64(removed)*voxel*voxel*voxel*unit3)
+	return &Hollowing{
+		WallMM:          wallMM,
+		SolidVolumeMM3:  math.Round(solidMM3*100) / 100,
+		HollowVolumeMM3: math.Round(hollowMM3*100) / 100,
+		SavingsPercent:  math.Round((1-hollowMM3/solidMM3)*1000) / 10,
+		VoxelSizeMM:     math.Round(voxel*mmPerUnit*1000) / 1000,
+	}
+}
+
+// Grid of cubic voxels covering the mesh, with resolution voxels along its
+// longest side and one empty voxel of padding on each side
+func voxelGrid(mesh *fauxgl.Mesh, resolution int) (origin fauxgl.Vector, voxel float64, nx, ny, nz int) {
+	box := mesh.BoundingBox()
+	size := box.Size()
+	voxel = math.Max(size.X, math.Max(size.Y, size.Z)) / float64(resolution)
+	nx = int(math.Ceil(size.X/voxel)) + 2
+	ny = int(math.Ceil(size.Y/voxel)) + 2
+	nz = int(math.Ceil(size.Z/voxel)) + 2
+	origin = box.Min.Sub(fauxgl.Vector{voxel, voxel, voxel})
+	return origin, voxel, nx, ny, nz
+}
+
+// Mark voxels whose centers lie inside the mesh, by counting crossings of a
+// vertical ray through each column of voxel centers
+func voxelize(mesh *fauxgl.Mesh, origin fauxgl.Vector, voxel float64, nx, ny, nz int) []bool {
+	// Nudge the rays off the grid so they don't run exactly through vertices
+	// and edges of axis-aligned models
+	const jitter = 1e-4
+
+	hits := make([][]float64, nx*ny)
+	for _, t := range mesh.Triangles {
+		a, b, c := t.V1.Position, t.V2.Position, t.V3.Position
+		minX := math.Min(a.X, math.Min(b.X, c.X))
+		maxX := math.Max(a.X, math.Max(b.X, c.X))
+		minY := math.Min(a.Y, math.Min(b.Y, c.Y))
+		maxY := math.Max(a.Y, math.Max(b.Y, c.Y))
+
+		x0 := int(math.Max(0, math.Ceil((minX-origin.X)/voxel-0.5-jitter)))
+		x1 := int(math.Min(float64(nx-1), math.Floor((maxX-origin.X)/voxel-0.5-jitter)))
+		y0 := int(math.Max(0, math.Ceil((minY-origin.Y)/voxel-0.5-jitter)))
+		y1 := int(math.Min(float64(ny-1), math.Floor((maxY-origin.Y)/voxel-0.5-jitter)))
+
+		for ix := x0; ix <= x1; ix++ {
+			px := origin.X + (float64(ix)+0.5+jitter)*voxel
+			for iy := y0; iy <= y1; iy++ {
+				py := origin.Y + (float64(iy)+0.5+jitter)*voxel
+				if z, ok := verticalHit(a, b, c, px, py); ok {
+					hits[ix*ny+iy] = append(hits[ix*ny+iy], z)
+				}
+			}
+		}
+	}
+
+	inside := make([]bool, nx*ny*nz)
+	for ix := 0; ix < nx; ix++ {
+		for iy := 0; iy < ny; iy++ {
+			zs := hits[ix*ny+iy]
+			sort.Float64s(zs)
+			for k := 0; k+1 < len(zs); k += 2 {
+				z0 := int(math.Max(0, math.Ceil((zs[k]-origin.Z)/voxel-0.5)))
+				z1 := int(math.Min(float64(nz-1), math.Floor((zs[k+1]-origin.Z)/voxel-0.5)))
+				for iz := z0; iz <= z1; iz++ {
+					inside[(ix*ny+iy)*nz+iz] = true
+				}
+			}
+		}
+	}
+	return inside
+}
+
+// Height at which the vertical line through (x, y) crosses triangle abc
+func verticalHit(a, b, c fauxgl.Vector, x, y float64) (float64, bool) {
+	det := (b.Y-c.Y)*(a.X-c.X) + (c.X-b.X)*(a.Y-c.Y)
+	if det == 0 {
+		return 0, false // Edge-on
+	}
+	l1 := ((b.Y-c.Y)*(x-c.X) + (c.X-b.X)*(y-c.Y)) / det
+	l2 := ((c.Y-a.Y)*(x-c.X) + (a.X-c.X)*(y-c.Y)) / det
+	l3 := 1 - l1 - l2
+	if l1 < 0 || l2 < 0 || l3 < 0 {
+		return 0, false
+	}
+	return l1*a.Z + l2*b.Z + l3*c.Z, true
+}
+
+// Exact squared Euclidean distance transform in place: zeros are the sources,
+// +Inf entries get their squared distance to the nearest zero. Runs the 1D
+// transform of Felzenszwalb and Huttenlocher along each axis in turn.
+func distanceTransform(grid []float64, nx, ny, nz int) {
+	n := nx
+	if ny > n {
+		n = ny
+	}
+	if nz > n {
+		n = nz
+	}
+	f := make([]float64, n)
+	d := make([]float64, n)
+	v := make([]int, n)
+	z := make([]float64, n+1)
+
+	index := func(ix, iy, iz int) int { return (ix*ny+iy)*nz + iz }
+	pass := func(length int, at func(i int) int) {
+		for i := 0; i < length; i++ {
+			f[i] = grid[at(i)]
+		}
+		distanceTransform1D(f[:length], d[:length], v, z)
+		for i := 0; i < length; i++ {
+			grid[at(i)] = d[i]
+		}
+	}
+
+	for ix := 0; ix < nx; ix++ {
+		for iy := 0; iy < ny; iy++ {
+			pass(nz, func(i int) int { return index(ix, iy, i) })
+		}
+	}
+	for ix := 0; ix < nx; ix++ {
+		for iz := 0; iz < nz; iz++ {
+			pass(ny, func(i int) int { return index(ix, i, iz) })
+		}
+	}
+	for iy := 0; iy < ny; iy++ {
+		for iz := 0; iz < nz; iz++ {
+			pass(nx, func(i int) int { return index(i, iy, iz) })
+		}
+	}
+}
+
+// Lower envelope of parabolas rooted at each sample of f
+func distanceTransform1D(f, d []float64, v []int, z []float64) {
+	n := len(f)
+	k := -1
+	for q := 0; q < n; q++ {
+		if math.IsInf(f[q], 1) {
+			continue
+		}
+		var s float64
+		for k >= 0 {
+			p := v[k]
+			s = ((f[q] + float64(q*q)) - (f[p] + float64(p*p))) / float64(2*(q-p))
+			if s > z[k] {
+				break
+			}
+			k--
+		}
+		k++
+		v[k] = q
+		if k == 0 {
+			z[k] = math.Inf(-1)
+		} else {
+			z[k] = s
+		}
+		z[k+1] = math.Inf(1)
+	}
+	if k < 0 {
+		// No sources in this line
+		for q := range d {
+			d[q] = math.Inf(1)
+		}
+		return
+	}
+
+	k = 0
+	for q := 0; q < n; q++ {
+		for z[k+1] < float64(q) {
+			k++
+		}
+		p := v[k]
+		d[q] = float64((q-p)*(q-p)) + f[p]
+	}
+}
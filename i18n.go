@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	LocalesDir    = "locales" // Message catalogs, one <lang>.json per language
+	DefaultLocale = "en"
+)
+
+// Message catalogs by language tag, loaded on startup
+var catalogs = make(map[string]map[string]string)
+
+// Load every catalog in LocalesDir. The default language must be present,
+// since it's the fallback for missing keys.
+func loadCatalogs() error {
+	paths, err := filepath.Glob(filepath.Join(LocalesDir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var catalog map[string]string
+		if err := json.Unmarshal(data, &catalog); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		catalogs[strings.ToLower(strings.TrimSuffix(filepath.Base(path), ".json"))] = catalog
+	}
+	if _, ok := catalogs[DefaultLocale]; !ok {
+		return fmt.Errorf("no %s catalog in %s", DefaultLocale, LocalesDir)
+	}
+	return nil
+}
+
+// Pick the best available language for an Accept-Language header, matching
+// full tags first and then their base language
+func negotiateLocale(header string) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{tag, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+
+	for _, c := range choices {
+		if _, ok := catalogs[c.tag]; ok {
+			return c.tag
+		}
+		base, _, _ := strings.Cut(c.tag, "-")
+		if _, ok := catalogs[base]; ok {
+			return base
+		}
+	}
+	return DefaultLocale
+}
+
+// Language for a request
+func requestLocale(r *http.Request) string {
+	return negotiateLocale(r.Header.Get("Accept-Language"))
+}
+
+// Look up a message, falling back to the default language and then the key
+func translate(lang, key string) string {
+	if msg, ok := catalogs[lang][key]; ok {
+		return msg
+	}
+	if msg, ok := catalogs[DefaultLocale][key]; ok {
+		return msg
+	}
+	return key
+}
+
+// Every message for a language, with fallbacks filled in, for the page template
+func catalogFor(lang string) map[string]string {
+	messages := make(map[string]string)
+	for key, msg := range catalogs[DefaultLocale] {
+		messages[key] = msg
+	}
+	for key, msg := range catalogs[lang] {
+		messages[key] = msg
+	}
+	return messages
+}
+
+// Plain-text upload reply with a download link after the text. The status
+// class lets clients tell outcomes apart without matching translated text.
+func statusLinkMessage(lang, status, key, href, linkKey string) string {
+	return fmt.Sprintf(`<span class="status status-%s">%s <a href='%s'>%s</a></span>`, status,
+		html.EscapeString(translate(lang, key)), html.EscapeString(href), html.EscapeString(translate(lang, linkKey)))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	ThingiverseAPI = "https://api.thingiverse.com"
+	PrintablesAPI  = "https://api.printables.com/graphql/"
+)
+
+// Model pages imports are taken from, by site
+var (
+	thingiversePagePattern = regexp.MustCompile(`^/thing:(\d+)(?:/|$)`)
+	printablesPagePattern  = regexp.MustCompile(`^/(?:[a-z]{2}/)?model/(\d+)(?:[-/]|$)`)
+)
+
+// Importing models from Thingiverse and Printables by page URL
+type ImportConfig struct {
+	ThingiverseToken string `json:"thingiverse_token"` // App token for the Thingiverse API; Thingiverse imports are refused without one
+	MaxMB            int    `json:"max_mb"`            // Largest file downloaded
+}
+
+// A file of a model page, downloaded only once it is to be imported
+type importFile struct {
+	name     string
+	download func(ctx context.Context) (io.ReadCloser, error)
+}
+
+type importResponse struct {
+	batchResponse
+	Site     string `json:"site"`      // "thingiverse" or "printables"
+	Skipped  int    `json:"skipped"`   // Files that aren't models, or past the first MaxBatchFiles
+	GroupID  string `json:"group_id"`  // Group every queued job joined
+	GroupURL string `json:"group_url"` // Where to follow the group
+}
+
+// POST /api/v1/imports with a url field, a Thingiverse thing or a Printables
+// model page, and the option fields of /upload, which apply to every file.
+// The page's STLs, point clouds, and G-code are downloaded and each is
+// handled like a file of /api/v1/batches; the jobs join group_id, or a new
+// group when none is sent. Answers like /api/v1/batches, plus the group.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+	r.Header.Set("Accept", "application/json")
+	if err := r.ParseForm(); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Failed to read form")
+		return
+	}
+	opts, err := parseRenderOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	analysis, err := parseAnalysisOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	groupID, err := parseGroupID(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if groupID == "" {
+		if groupID, err = randomToken(16); err != nil {
+			apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to create group")
+			return
+		}
+		r.Form.Set("group_id", groupID)
+	}
+
+	site, files, err := resolveImport(r.Context(), r.FormValue("url"))
+	var coded *codedError
+	switch {
+	case errors.As(err, &coded) && coded.code == ErrNotFound:
+		apiError(w, r, http.StatusNotFound, coded.code, err.Error())
+		return
+	case errors.As(err, &coded):
+		apiError(w, r, http.StatusBadRequest, coded.code, err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to list files of %s: %v", r.FormValue("url"), err)
+		apiError(w, r, http.StatusBadGateway, ErrInternal, "Failed to list the model's files")
+		return
+	}
+	resp := importResponse{Site: site, GroupID: groupID, GroupURL: tenantURL(tenantOf(r.Context()), "/api/v1/groups/"+groupID)}
+	for _, file := range files {
+		if !importable(file.name) || len(resp.Items) == MaxBatchFiles {
+			resp.Skipped++
+			continue
+		}
+		item := importItem(r, file, opts, analysis)
+		if item.ErrorCode != "" {
+			resp.Failed++
+		} else {
+			resp.Succeeded++
+		}
+		resp.Items = append(resp.Items, item)
+	}
+	if len(resp.Items) == 0 {
+		apiError(w, r, http.StatusUnprocessableEntity, ErrUnsupportedFormat, "The model has no STL, point cloud, or G-code files")
+		return
+	}
+
+	status := http.StatusAccepted
+	switch {
+	case resp.Succeeded == 0:
+		resp.Status = BatchFailed
+		status = http.StatusUnprocessableEntity
+	case resp.Failed > 0:
+		resp.Status = BatchPartial
+	default:
+		resp.Status = BatchAccepted
+	}
+	writeJSON(w, status, resp)
+}
+
+// Whether a file of a model page is a model to render. Images on model pages
+// are photos, not height maps.
+func importable(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".stl") || pointCloudFormat(name) != "" || gcodeFormat(name) != ""
+}
+
+// Download, scan, and queue one file of a model page
+func importItem(r *http.Request, file importFile, opts RenderOptions, analysis AnalysisOptions) batchItem {
+	item := batchItem{File: file.name}
+	fail := func(code, message string) batchItem {
+		item.Status, item.ErrorCode, item.Message = JobFailed, code, message
+		return item
+	}
+	body, err := file.download(r.Context())
+	if err != nil {
+		log.Printf("Failed to download imported file %s: %v", file.name, err)
+		return fail(ErrInternal, "Failed to download file")
+	}
+	defer body.Close()
+	workDir, fileHash, err := readModel(r.Context(), r, file.name, body, config.Imports.MaxMB)
+	if err != nil {
+		return fail(errorCode(err, ErrInternal), err.Error())
+	}
+	item, keepWorkDir := queueBatchItem(r, item, workDir, fileHash, opts, analysis)
+	if !keepWorkDir {
+		os.RemoveAll(workDir)
+	}
+	return item
+}
+
+// The site and files of a model page URL. Errors the client can fix carry a
+// code.
+func resolveImport(ctx context.Context, rawURL string) (string, []importFile, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" && u.Scheme != "http" {
+		return "", nil, withErrorCode(ErrInvalidRequest, errors.New("url must be a Thingiverse or Printables model page"))
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	switch {
+	case host == "thingiverse.com" && thingiversePagePattern.MatchString(u.Path):
+		if config.Imports.ThingiverseToken == "" {
+			return "", nil, withErrorCode(ErrInvalidRequest, errors.New("thingiverse imports aren't set up on this server"))
+		}
+		files, err := thingiverseFiles(ctx, thingiversePagePattern.FindStringSubmatch(u.Path)[1])
+		return "thingiverse", files, err
+	case host == "printables.com" && printablesPagePattern.MatchString(u.Path):
+		files, err := printablesFiles(ctx, printablesPagePattern.FindStringSubmatch(u.Path)[1])
+		return "printables", files, err
+	}
+	return "", nil, withErrorCode(ErrInvalidRequest, errors.New("url must be a Thingiverse or Printables model page"))
+}
+
+// Files of a Thing, through the Thingiverse REST API
+func thingiverseFiles(ctx context.Context, thingID string) ([]importFile, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ThingiverseAPI+"/things/"+thingID+"/files", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.Imports.ThingiverseToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, withErrorCode(ErrNotFound, errors.New("no such Thing on Thingiverse"))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("thingiverse: %s", resp.Status)
+	}
+	var listed []struct {
+		Name        string `json:"name"`
+		DownloadURL string `json:"download_url"` // Needs the token, redirects to DirectURL
+		DirectURL   string `json:"direct_url"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&listed); err != nil {
+		return nil, err
+	}
+	files := make([]importFile, len(listed))
+	for i, f := range listed {
+		files[i] = importFile{name: path.Base(f.Name), download: func(ctx context.Context) (io.ReadCloser, error) {
+			if f.DirectURL != "" {
+				return importDownload(ctx, f.DirectURL, "")
+			}
+			return importDownload(ctx, f.DownloadURL, config.Imports.ThingiverseToken)
+		}}
+	}
+	return files, nil
+}
+
+// STLs of a model, through the GraphQL API the Printables site uses. It needs
+// no key; each download link is asked for as the file is downloaded.
+func printablesFiles(ctx context.Context, modelID string) ([]importFile, error) {
+	var model struct {
+		Model *struct {
+			STLs []struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"stls"`
+		} `json:"model"`
+	}
+	query := `query ModelFiles($id: ID!) { model: print(id: $id) { stls { id name } } }`
+	if err := printablesQuery(ctx, query, map[string]interface{}{"id": modelID}, &model); err != nil {
+		return nil, err
+	}
+	if model.Model == nil {
+		return nil, withErrorCode(ErrNotFound, errors.New("no such model on Printables"))
+	}
+	files := make([]importFile, len(model.Model.STLs))
+	for i, f := range model.Model.STLs {
+		files[i] = importFile{name: path.Base(f.Name), download: func(ctx context.Context) (io.ReadCloser, error) {
+			var link struct {
+				GetDownloadLink struct {
+					OK     bool `json:"ok"`
+					Output *struct {
+						Link string `json:"link"`
+					} `json:"output"`
+				} `json:"getDownloadLink"`
+			}
+			mutation := `mutation GetDownloadLink($id: ID!, $modelId: ID!, $fileType: DownloadFileTypeEnum!, $source: DownloadSourceEnum!) {
+				getDownloadLink(id: $id, printId: $modelId, fileType: $fileType, source: $source) { ok output { link } }
+			}`
+			variables := map[string]interface{}{"id": f.ID, "modelId": modelID, "fileType": "stl", "source": "model_detail"}
+			if err := printablesQuery(ctx, mutation, variables, &link); err != nil {
+				return nil, err
+			}
+			if !link.GetDownloadLink.OK || link.GetDownloadLink.Output == nil {
+				return nil, errors.New("printables gave no download link")
+			}
+			return importDownload(ctx, link.GetDownloadLink.Output.Link, "")
+		}}
+	}
+	return files, nil
+}
+
+// Run a Printables GraphQL query or mutation, decoding its data into out
+func printablesQuery(ctx context.Context, query string, variables map[string]interface{}, out interface{}) error {
+	body, err := json.Marshal(map[string]interface{}{"query": query, "variables": variables})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, PrintablesAPI, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("printables: %s", resp.Status)
+	}
+	var result struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		return fmt.Errorf("printables: %s", result.Errors[0].Message)
+	}
+	return json.Unmarshal(result.Data, out)
+}
+
+// GET a file, with a bearer token if one is given
+func importDownload(ctx context.Context, rawURL, token string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("download answered %s", resp.Status)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where ingested objects are announced
+const (
+	IngestSQS    = "sqs"    // S3 event notifications, delivered to an SQS queue directly or through SNS
+	IngestPubSub = "pubsub" // GCS notifications, delivered to a Pub/Sub subscription
+)
+
+const (
+	IngestBatch       = 10               // Most messages taken at once; their models are rendered side by side
+	IngestRetryPeriod = 10 * time.Second // Wait after failing to read messages
+	pubsubScope       = "https://www.googleapis.com/auth/pubsub"
+)
+
+// Render models as they land in a bucket, with no HTTP client involved: the
+// bucket's notifications of new objects are read from a queue, each new
+// model is rendered, and its outputs are written back beside it, as
+// models/part.png for models/part.stl.
+type IngestConfig struct {
+	Source       string            `json:"source"`       // "sqs" or "pubsub"; no ingestion when empty
+	Queue        string            `json:"queue"`        // SQS queue URL
+	Region       string            `json:"region"`       // AWS region of the queue and buckets; AWS_REGION when empty
+	Subscription string            `json:"subscription"` // Pub/Sub subscription, as projects/<project>/subscriptions/<name>
+	Prefix       string            `json:"prefix"`       // Only objects whose names start with this are rendered
+	Tenant       string            `json:"tenant"`       // Tenant the renders are cached and stored for; the default one when empty
+	Options      map[string]string `json:"options"`      // Render and analysis form fields, as sent to /upload
+	MaxMB        int               `json:"max_mb"`       // Largest model downloaded
+}
+
+// Bucket that ingested models come from and their outputs go back to
+type ingestBucket interface {
+	// Open an object for reading; fails with os.ErrNotExist if missing
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Store a local file as an object. The local file is consumed.
+	Publish(ctx context.Context, localPath, name string) error
+}
+
+// New objects announced by one message, and how to take the message off
+// the queue once they are rendered
+type ingestMessage struct {
+	objects []ingestObject
+	ack     func(ctx context.Context) error
+}
+
+type ingestObject struct {
+	bucket string
+	name   string
+}
+
+type ingestSource interface {
+	// Wait for up to IngestBatch messages; none if nothing arrived for a while
+	receive(ctx context.Context) ([]ingestMessage, error)
+	bucket(name string) ingestBucket
+}
+
+func newIngestSource(cfg IngestConfig) (ingestSource, error) {
+	if cfg.Tenant != "" {
+		if _, ok := findTenant(cfg.Tenant); !ok {
+			return nil, fmt.Errorf("unknown tenant %q", cfg.Tenant)
+		}
+	}
+	switch cfg.Source {
+	case IngestSQS:
+		if cfg.Queue == "" {
+			return nil, errors.New("sqs ingestion needs a queue")
+		}
+		u, err := url.Parse(cfg.Queue)
+		if err != nil || u.Scheme != "https" {
+			return nil, errors.New("queue must be an https SQS queue URL")
+		}
+		creds, err := newAWSCredentials(cfg.Region)
+		if err != nil {
+			return nil, err
+		}
+		return &sqsSource{queue: cfg.Queue, endpoint: "https://" + u.Host + "/", creds: creds, client: &http.Client{}}, nil
+	case IngestPubSub:
+		if !strings.HasPrefix(cfg.Subscription, "projects/") || !strings.Contains(cfg.Subscription, "/subscriptions/") {
+			return nil, errors.New("pubsub ingestion needs a subscription, as projects/<project>/subscriptions/<name>")
+		}
+		return &pubsubSource{subscription: cfg.Subscription, client: &http.Client{}, tokens: newGoogleTokenSource(pubsubScope + " " + gcsScope)}, nil
+	}
+	return nil, fmt.Errorf("unknown ingestion source %q", cfg.Source)
+}
+
+// Render the models announced to src until shutdown. The messages of a batch
+// are handled side by side, each taken off the queue once its models are
+// done, failed or not; one interrupted by shutdown is left for another
+// instance.
+func runIngest(src ingestSource) {
+	ctx := workerCtx
+	for ctx.Err() == nil {
+		messages, err := src.receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Failed to read ingestion messages: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(IngestRetryPeriod):
+			}
+			continue
+		}
+		var wg sync.WaitGroup
+		for _, message := range messages {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for _, object := range message.objects {
+					if !ingestable(object.name) {
+						continue
+					}
+					if err := safeIngestModel(ctx, src.bucket(object.bucket), object.name); err != nil {
+						log.Printf("Failed to ingest %s/%s: %v", object.bucket, object.name, err)
+					}
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				if err := message.ack(context.Background()); err != nil {
+					log.Printf("Failed to acknowledge ingestion message: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// Whether an object is a model to render: an STL or point cloud under the
+// configured prefix. Height maps are left out, since they are images like
+// the outputs written back.
+func ingestable(name string) bool {
+	if !strings.HasPrefix(name, config.Ingest.Prefix) || strings.HasSuffix(name, "/") {
+		return false
+	}
+	return strings.EqualFold(path.Ext(name), ".stl") || pointCloudFormat(name) != ""
+}
+
+// Ingest one model with ingestModel. A panic while reading or converting it
+// fails that object alone, like a panicking handler fails only its request,
+// instead of taking down the service.
+func safeIngestModel(ctx context.Context, bucket ingestBucket, name string) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v\n%s", p, debug.Stack())
+		}
+	}()
+	return ingestModel(ctx, bucket, name)
+}
+
+// Render one model from a bucket, unless it already was, and write its
+// outputs back beside it
+func ingestModel(ctx context.Context, bucket ingestBucket, name string) error {
+	cfg := config.Ingest
+	ctx = withTenant(ctx, cfg.Tenant)
+	r, err := optionsRequest(ctx, cfg.Options)
+	if err != nil {
+		return err
+	}
+	opts, err := parseRenderOptions(r)
+	if err != nil {
+		return err
+	}
+	analysis, err := parseAnalysisOptions(r)
+	if err != nil {
+		return err
+	}
+
+	body, err := bucket.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	workDir, fileHash, err := readModel(ctx, r, path.Base(name), body, cfg.MaxMB)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	cacheKey, err := renderModel(ctx, workDir, fileHash, opts, analysis)
+	if err != nil {
+		return err
+	}
+
+	// Outputs are named after the cache key; beside the model they are named
+	// after it instead, keeping their suffix
+	stem := strings.TrimSuffix(name, path.Ext(name))
+	for _, output := range opts.outputNames(cacheKey) {
+		target := stem + strings.TrimPrefix(output, "output-"+cacheKey)
+		if err := copyOutput(ctx, bucket, output, target); err != nil {
+			return fmt.Errorf("failed to write %s: %w", target, err)
+		}
+	}
+	return nil
+}
+
+// Copy a stored output to a bucket
+func copyOutput(ctx context.Context, bucket ingestBucket, output, target string) error {
+	src, err := storage.Open(ctx, outputObject(output))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dir, err := newJobWorkDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, "output")
+	dst, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return bucket.Publish(ctx, local, target)
+}
+
+// S3 event notifications from an SQS queue, over the SQS JSON protocol
+type sqsSource struct {
+	queue    string
+	endpoint string // Service endpoint of the queue's region
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// S3 event notification, or the SNS notification wrapping one
+type s3Event struct {
+	Message string `json:"Message"` // The S3 event, when delivered through SNS
+	Records []struct {
+		EventName string `json:"eventName"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"` // URL-encoded, with + for spaces
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+func (s *sqsSource) call(ctx context.Context, action string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+	digest := sha256.Sum256(data)
+	s.creds.sign(req, "sqs", hex.EncodeToString(digest[:]))
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sqs %s: %s", action, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (s *sqsSource) receive(ctx context.Context) ([]ingestMessage, error) {
+	var resp struct {
+		Messages []struct {
+			ReceiptHandle string `json:"ReceiptHandle"`
+			Body          string `json:"Body"`
+		} `json:"Messages"`
+	}
+	err := s.call(ctx, "ReceiveMessage", map[string]interface{}{
+		"QueueUrl":            s.queue,
+		"MaxNumberOfMessages": IngestBatch,
+		"WaitTimeSeconds":     20,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	var messages []ingestMessage
+	for _, m := range resp.Messages {
+		receipt := m.ReceiptHandle
+		message := ingestMessage{ack: func(ctx context.Context) error {
+			return s.call(ctx, "DeleteMessage", map[string]string{"QueueUrl": s.queue, "ReceiptHandle": receipt}, nil)
+		}}
+		var event s3Event
+		err := json.Unmarshal([]byte(m.Body), &event)
+		if err == nil && event.Message != "" {
+			wrapped := event.Message
+			event = s3Event{}
+			err = json.Unmarshal([]byte(wrapped), &event)
+		}
+		if err != nil {
+			log.Printf("Ignoring unreadable S3 event: %v", err)
+		}
+		for _, record := range event.Records {
+			key, err := url.QueryUnescape(record.S3.Object.Key)
+			if err != nil || !strings.HasPrefix(record.EventName, "ObjectCreated:") {
+				continue
+			}
+			message.objects = append(message.objects, ingestObject{bucket: record.S3.Bucket.Name, name: key})
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (s *sqsSource) bucket(name string) ingestBucket {
+	return &s3Bucket{name: name, creds: s.creds, client: s.client}
+}
+
+// GCS notifications from a Pub/Sub subscription, over the REST API
+type pubsubSource struct {
+	subscription string
+	client       *http.Client
+	tokens       *googleTokenSource // For both Pub/Sub and the buckets
+}
+
+func (s *pubsubSource) call(ctx context.Context, method string, body, out interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	u := "https://pubsub.googleapis.com/v1/" + s.subscription + ":" + method
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	token, err := s.tokens.token(ctx)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pubsub %s: %s", method, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (s *pubsubSource) receive(ctx context.Context) ([]ingestMessage, error) {
+	var resp struct {
+		ReceivedMessages []struct {
+			AckID   string `json:"ackId"`
+			Message struct {
+				Attributes map[string]string `json:"attributes"` // eventType, bucketId, and objectId
+			} `json:"message"`
+		} `json:"receivedMessages"`
+	}
+	if err := s.call(ctx, "pull", map[string]int{"maxMessages": IngestBatch}, &resp); err != nil {
+		return nil, err
+	}
+	var messages []ingestMessage
+	for _, m := range resp.ReceivedMessages {
+		ackID := m.AckID
+		message := ingestMessage{ack: func(ctx context.Context) error {
+			return s.call(ctx, "acknowledge", map[string][]string{"ackIds": {ackID}}, nil)
+		}}
+		if attrs := m.Message.Attributes; attrs["eventType"] == "OBJECT_FINALIZE" {
+			message.objects = []ingestObject{{bucket: attrs["bucketId"], name: attrs["objectId"]}}
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func (s *pubsubSource) bucket(name string) ingestBucket {
+	return &gcsStorage{bucket: name, client: s.client, tokens: s.tokens}
+}
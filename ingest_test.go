@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Bucket whose reads panic, standing in for a converter or parser that does
+type panickingBucket struct{}
+
+func (panickingBucket) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	panic("malformed model")
+}
+
+func (panickingBucket) Publish(ctx context.Context, localPath, name string) error {
+	return nil
+}
+
+func TestSafeIngestModelRecoversFromPanics(t *testing.T) {
+	err := safeIngestModel(context.Background(), panickingBucket{}, "models/part.stl")
+	if err == nil || !strings.Contains(err.Error(), "malformed model") {
+		t.Fatalf("got error %v, want the panic as an error", err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// Turns an upload that isn't an STL into one, after it has been saved and
+// scanned
+type inputConverter struct {
+	ext     string                           // Extension the upload is saved with before conversion
+	key     string                           // Settings that change the resulting mesh; folded into the file hash
+	convert func(path, stlPath string) error // Read the upload at path, write the mesh to stlPath
+}
+
+// Converter for an uploaded file, by its name and the request's settings, or
+// nil for STL files
+func uploadConverter(r *http.Request, filename string) (*inputConverter, error) {
+	if format := pointCloudFormat(filename); format != "" {
+		return &inputConverter{ext: format, convert: func(path, stlPath string) error {
+			return convertPointCloud(path, format, stlPath)
+		}}, nil
+	}
+	if format := gcodeFormat(filename); format != "" {
+		toolpath, err := parseToolpath(r)
+		if err != nil {
+			return nil, err
+		}
+		conv := &inputConverter{ext: format, convert: func(path, stlPath string) error {
+			return convertGCode(path, stlPath, toolpath)
+		}}
+		// Ribbons keep the upload's own hash, as before tubes existed
+		if toolpath != ToolpathRibbons {
+			conv.key = "gcode:" + toolpath
+		}
+		return conv, nil
+	}
+	if format := heightMapFormat(filename); format != "" {
+		settings, err := parseHeightMapSettings(r)
+		if err != nil {
+			return nil, err
+		}
+		return &inputConverter{ext: format, key: settings.key(), convert: func(path, stlPath string) error {
+			return convertHeightMap(path, stlPath, settings)
+		}}, nil
+	}
+	return nil, nil
+}
+
+// Hash a converted model is filed under: the upload's hash when conversion
+// has no settings, otherwise one that also covers them, so the same file
+// converted differently is cached and stored separately
+func convertedFileHash(fileHash string, conv *inputConverter) string {
+	if conv == nil || conv.key == "" {
+		return fileHash
+	}
+	sum := sha256.Sum256([]byte(fileHash + "|" + conv.key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const DefaultIPFSAPI = "http://127.0.0.1:5001" // Kubo's RPC API on its default port
+
+// An IPFS node through the Kubo RPC API. Every file is added and pinned, and
+// linked into the node's mutable file system (MFS) under its name, so it can
+// still be found by name; the name then leads to its CID. Credentials in the
+// API URL are sent as basic auth.
+type ipfsStorage struct {
+	api    *url.URL
+	prefix string
+	client *http.Client
+}
+
+func newIPFSStorage(cfg StorageConfig) (*ipfsStorage, error) {
+	api := cfg.API
+	if api == "" {
+		api = DefaultIPFSAPI
+	}
+	u, err := url.Parse(strings.TrimSuffix(api, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("ipfs storage api must be an http or https URL")
+	}
+	return &ipfsStorage{api: u, prefix: cfg.Prefix, client: &http.Client{}}, nil
+}
+
+// MFS path of a stored file
+func (s *ipfsStorage) mfsPath(name string) string {
+	return "/" + prefixedName(s.prefix, name)
+}
+
+// Call an RPC command with arguments and options. A non-nil body is sent as
+// the multipart file most commands that take data expect. The response body
+// is the caller's to close.
+func (s *ipfsStorage) call(ctx context.Context, command string, args []string, options url.Values, body io.Reader) (*http.Response, error) {
+	query := url.Values{}
+	for k, v := range options {
+		query[k] = v
+	}
+	query["arg"] = args
+	u := *s.api
+	u.User = nil
+	u.Path += "/api/v0/" + command
+	u.RawQuery = query.Encode()
+
+	contentType := ""
+	if body != nil {
+		pr, pw := io.Pipe()
+		form := multipart.NewWriter(pw)
+		go func() {
+			part, err := form.CreateFormFile("file", "file")
+			if err == nil {
+				_, err = io.Copy(part, body)
+			}
+			if err == nil {
+				err = form.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		body, contentType = pr, form.FormDataContentType()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if user := s.api.User; user != nil {
+		pass, _ := user.Password()
+		req.SetBasicAuth(user.Username(), pass)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	// Kubo answers failed commands with 500 and a JSON message
+	var failure struct {
+		Message string `json:"Message"`
+	}
+	if json.NewDecoder(resp.Body).Decode(&failure) == nil && failure.Message != "" {
+		if strings.Contains(failure.Message, "does not exist") {
+			return nil, os.ErrNotExist
+		}
+		return nil, fmt.Errorf("ipfs %s: %s", command, failure.Message)
+	}
+	return nil, fmt.Errorf("ipfs %s: %s", command, resp.Status)
+}
+
+// Call an RPC command and decode its JSON answer into out, if not nil
+func (s *ipfsStorage) callJSON(ctx context.Context, command string, args []string, options url.Values, body io.Reader, out interface{}) error {
+	resp, err := s.call(ctx, command, args, options, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type ipfsStat struct {
+	Hash string `json:"Hash"` // CID
+	Size int64  `json:"Size"`
+	Type string `json:"Type"`
+}
+
+func (s *ipfsStorage) stat(ctx context.Context, name string) (ipfsStat, error) {
+	var stat ipfsStat
+	err := s.callJSON(ctx, "files/stat", []string{s.mfsPath(name)}, nil, nil, &stat)
+	return stat, err
+}
+
+// CID of a stored file
+func (s *ipfsStorage) cid(ctx context.Context, name string) (string, error) {
+	stat, err := s.stat(ctx, name)
+	return stat.Hash, err
+}
+
+// Add and pin the file, then point its name at it. A file it replaces is
+// unpinned; the node keeps it while any other name still links to it.
+func (s *ipfsStorage) Publish(ctx context.Context, localPath, name string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var added struct {
+		Hash string `json:"Hash"`
+	}
+	options := url.Values{"pin": {"true"}, "cid-version": {"1"}, "quieter": {"true"}}
+	if err := s.callJSON(ctx, "add", nil, options, file, &added); err != nil {
+		return fmt.Errorf("ipfs add of %s: %w", name, err)
+	}
+	file.Close()
+
+	target := s.mfsPath(name)
+	old, err := s.stat(ctx, name)
+	switch {
+	case err == nil && old.Hash == added.Hash:
+		return os.Remove(localPath)
+	case err == nil:
+		if err := s.callJSON(ctx, "files/rm", []string{target}, url.Values{"force": {"true"}}, nil, nil); err != nil {
+			return err
+		}
+		if err := s.callJSON(ctx, "pin/rm", []string{old.Hash}, nil, nil, nil); err != nil {
+			log.Printf("Failed to unpin %s, replaced as %s: %v", old.Hash, name, err)
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	if err := s.callJSON(ctx, "files/mkdir", []string{path.Dir(target)}, url.Values{"parents": {"true"}}, nil, nil); err != nil {
+		return err
+	}
+	if err := s.callJSON(ctx, "files/cp", []string{"/ipfs/" + added.Hash, target}, nil, nil, nil); err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+func (s *ipfsStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.OpenAt(ctx, name, 0)
+}
+
+func (s *ipfsStorage) OpenAt(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	var options url.Values
+	if offset > 0 {
+		options = url.Values{"offset": {strconv.FormatInt(offset, 10)}}
+	}
+	resp, err := s.call(ctx, "files/read", []string{s.mfsPath(name)}, options, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Files carry no modification time; content addressing leaves nothing to
+// revalidate by date
+func (s *ipfsStorage) Stat(ctx context.Context, name string) (StoredFileInfo, error) {
+	stat, err := s.stat(ctx, name)
+	if err != nil {
+		return StoredFileInfo{}, err
+	}
+	return StoredFileInfo{Size: stat.Size}, nil
+}
+
+func (s *ipfsStorage) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := s.stat(ctx, name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CID of a stored file when storage is IPFS, under the tenant's prefix; ""
+// otherwise. With encryption on, it is the CID of the encrypted file.
+func storedCID(ctx context.Context, name string) (string, error) {
+	s := storage
+	if t, ok := s.(tenantStorage); ok {
+		name, s = t.name(ctx, name), t.Storage
+	}
+	if e, ok := s.(encryptedStorage); ok {
+		s = e.Storage
+	}
+	ipfs, ok := s.(*ipfsStorage)
+	if !ok {
+		return "", nil
+	}
+	return ipfs.cid(ctx, name)
+}
+
+// CIDs of a published job's outputs, processed mesh, and upload, by file
+// name; nil unless storage is IPFS
+func jobCIDs(ctx context.Context, job Job) map[string]string {
+	var cids map[string]string
+	names := append(append([]string(nil), job.Outputs...), job.MeshFile)
+	objects := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		if name != "" {
+			objects = append(objects, outputObject(name))
+		}
+	}
+	for _, object := range append(objects, uploadObject(job.FileHash)) {
+		cid, err := storedCID(ctx, object)
+		if err != nil {
+			log.Printf("Failed to look up CID of %s: %v", object, err)
+			continue
+		}
+		if cid == "" {
+			return nil
+		}
+		if cids == nil {
+			cids = make(map[string]string)
+		}
+		cids[path.Base(object)] = cid
+	}
+	return cids
+}
+
+// Attach the CIDs of a job's published files
+func setJobCIDs(id string, cids map[string]string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if job, ok := jobs[id]; ok {
+		job.CIDs = cids
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Brokers job lifecycle events can go to
+const (
+	BrokerNATS  = "nats"  // A NATS server, over its client protocol
+	BrokerKafka = "kafka" // A Kafka cluster, through a Confluent REST Proxy
+)
+
+// Job lifecycle event types
+const (
+	JobCreatedEvent   = "job.created"
+	JobCompletedEvent = "job.completed"
+	JobFailedEvent    = "job.failed"
+)
+
+const (
+	JobEventBuffer   = 1000             // Events waiting to be sent before new ones are dropped
+	BrokerRetryDelay = 5 * time.Second  // Wait after the broker couldn't take an event
+	BrokerTimeout    = 10 * time.Second // Longest wait for the broker to connect or take an event
+)
+
+// Publish job lifecycle events to a message broker, so catalog and billing
+// systems can follow jobs without polling the API
+type JobEventsConfig struct {
+	Broker  string `json:"broker"`  // "nats" or "kafka"; no events when empty
+	Address string `json:"address"` // NATS server as nats://[user:pass@]host:port, or the Kafka REST Proxy URL
+	Topic   string `json:"topic"`   // NATS subject or Kafka topic
+}
+
+// A job being created, completing, or failing, as published to the broker
+type jobLifecycleEvent struct {
+	Type       string    `json:"type"` // JobCreatedEvent, JobCompletedEvent, or JobFailedEvent
+	JobID      string    `json:"job_id"`
+	Tenant     string    `json:"tenant,omitempty"`
+	FileHash   string    `json:"file_hash"`
+	Priority   string    `json:"priority"`
+	Outputs    []string  `json:"outputs,omitempty"`     // Download URLs, once completed
+	ErrorCode  string    `json:"error_code,omitempty"`  // Why the job failed, once it has
+	RenderSecs float64   `json:"render_secs,omitempty"` // Time from starting the render to finishing, once finished
+	Time       time.Time `json:"time"`
+}
+
+type eventPublisher interface {
+	publish(topic, key string, data []byte) error
+}
+
+// Events waiting to be sent; nil when there is no broker
+var jobEventQueue chan jobLifecycleEvent
+
+// Connect to the configured broker and start sending job events to it
+func setupJobEvents(cfg JobEventsConfig) error {
+	if cfg.Broker == "" {
+		return nil
+	}
+	if cfg.Topic == "" {
+		return errors.New("job_events needs a topic")
+	}
+	var publisher eventPublisher
+	switch cfg.Broker {
+	case BrokerNATS:
+		u, err := url.Parse(cfg.Address)
+		if err != nil || u.Scheme != "nats" || u.Host == "" {
+			return errors.New("job_events address must be a nats:// URL")
+		}
+		publisher = &natsPublisher{url: u}
+	case BrokerKafka:
+		u, err := url.Parse(cfg.Address)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("job_events address must be the http or https URL of a Kafka REST Proxy")
+		}
+		publisher = &kafkaRESTPublisher{baseURL: strings.TrimSuffix(cfg.Address, "/"), client: &http.Client{Timeout: BrokerTimeout}}
+	default:
+		return fmt.Errorf("unknown job_events broker %q", cfg.Broker)
+	}
+	jobEventQueue = make(chan jobLifecycleEvent, JobEventBuffer)
+	go sendJobEvents(publisher, cfg.Topic)
+	return nil
+}
+
+// Queue a lifecycle event for a job. Renders never wait on the broker: with
+// JobEventBuffer events already waiting, the event is dropped.
+func publishJobEvent(eventType string, job Job) {
+	if jobEventQueue == nil {
+		return
+	}
+	event := jobLifecycleEvent{Type: eventType, JobID: job.ID, Tenant: job.Tenant, FileHash: job.FileHash, Priority: job.Priority, ErrorCode: job.ErrorCode, Time: time.Now().UTC()}
+	if eventType == JobCompletedEvent {
+		for _, name := range job.Outputs {
+			event.Outputs = append(event.Outputs, outputURL(job.Tenant, name))
+		}
+	}
+	if eventType != JobCreatedEvent && !job.StartedAt.IsZero() {
+		event.RenderSecs = job.UpdatedAt.Sub(job.StartedAt).Seconds()
+	}
+	select {
+	case jobEventQueue <- event:
+	default:
+		log.Printf("Dropped %s event of job ID %s: too many events waiting for the broker", eventType, job.ID)
+	}
+}
+
+// Send queued events in order, retrying each until the broker takes it
+func sendJobEvents(publisher eventPublisher, topic string) {
+	for event := range jobEventQueue {
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Failed to encode %s event: %v", event.Type, err)
+			continue
+		}
+		for {
+			err := publisher.publish(topic, event.JobID, data)
+			if err == nil {
+				break
+			}
+			log.Printf("Failed to publish %s event of job ID %s: %v", event.Type, event.JobID, err)
+			time.Sleep(BrokerRetryDelay)
+		}
+	}
+}
+
+// A NATS connection, made on first use and again after it fails
+type natsPublisher struct {
+	url  *url.URL
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (p *natsPublisher) publish(subject, _ string, data []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(BrokerTimeout))
+	if _, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\n", subject, len(data), data); err != nil {
+		p.conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Dial the server and introduce ourselves. Called with mu held.
+func (p *natsPublisher) connect() error {
+	host := p.url.Host
+	if p.url.Port() == "" {
+		host = net.JoinHostPort(host, "4222")
+	}
+	conn, err := net.DialTimeout("tcp", host, BrokerTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(BrokerTimeout))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	info, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting from NATS server: %q", strings.TrimSpace(line))
+	}
+	var server struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if json.Unmarshal([]byte(info), &server) == nil && server.TLSRequired {
+		conn.Close()
+		return errors.New("NATS server requires TLS, which isn't supported")
+	}
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "go-render-service", "lang": "go"}
+	if user := p.url.User; user != nil {
+		if pass, ok := user.Password(); ok {
+			options["user"], options["pass"] = user.Username(), pass
+		} else {
+			options["auth_token"] = user.Username()
+		}
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", connect); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	p.conn = conn
+	go p.serve(conn, r)
+	return nil
+}
+
+// Answer the server's pings, which it drops connections without, and log
+// its errors, until the connection fails
+func (p *natsPublisher) serve(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			p.mu.Lock()
+			if p.conn == conn {
+				conn.Close()
+				p.conn = nil
+			}
+			p.mu.Unlock()
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			p.mu.Lock()
+			conn.SetWriteDeadline(time.Now().Add(BrokerTimeout))
+			conn.Write([]byte("PONG\r\n"))
+			p.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("NATS server: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+// Kafka through the v2 API of a Confluent REST Proxy. Events are keyed by job
+// ID, so each job's events stay in order on one partition.
+type kafkaRESTPublisher struct {
+	baseURL string
+	client  *http.Client
+}
+
+func (p *kafkaRESTPublisher) publish(topic, key string, data []byte) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"records": []map[string]interface{}{{"key": key, "value": json.RawMessage(data)}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.baseURL+"/topics/"+url.PathEscape(topic), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("kafka rest proxy: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	JobRetention = time.Hour // How long finished jobs stay queryable
+	MaxJobEvents = 1000      // Longest event history kept per job; enough for a full spin's previews
+)
+
+// Job statuses
+const (
+	JobQueued     = "queued"
+	JobProcessing = "processing"
+	JobDone       = "done"
+	JobFailed     = "failed"
+)
+
+// A render job. The ID is an opaque random token handed to the client; the
+// paths never leave the server.
+type Job struct {
+	ID         string
+	STLPath    string
+	OutputPath string   // Primary output file name
+	Outputs    []string // All output file names, primary first
+	MeshFile   string   // Processed mesh file name, when the options change the mesh
+	FileHash   string   // SHA-256 of the uploaded file
+	CacheKey   string   // File hash, plus an options digest for non-default renders
+	Options    RenderOptions
+	Analysis   AnalysisOptions
+	Lang       string            // Language for status messages, negotiated on upload
+	Tenant     string            // Tenant the job was submitted for; empty for the default one
+	WorkDir    string            // Scratch directory owned by this job, removed when it finishes
+	Sample     RenderSample      // Size of the render work, for ETAs and timing history
+	Estimate   time.Duration     // Predicted render time
+	Stripped   []MetadataRemoval // Metadata removed from the upload in privacy mode
+	Renderer   string            // Renderer that drew the outputs, once rendered
+	Priority   string            // Queue lane: PriorityInteractive or PriorityBatch
+	CIDs       map[string]string // IPFS CIDs of the published files by file name, with ipfs storage
+	CreatedAt  time.Time
+
+	// Progress, guarded by mu
+	Status    string
+	ErrorCode string      // Why the job failed, once it has
+	Message   string      // Last status event pushed to the client, as JSON
+	Stats     *ModelStats // Model measurements, once rendered
+	StartedAt time.Time
+	UpdatedAt time.Time
+	Events    []jobEvent    // Everything pushed to subscribers, oldest first
+	changed   chan struct{} // Closed and replaced on every status change
+}
+
+// One entry of a job's history: an event as pushed over the WebSocket, and
+// when
+type jobEvent struct {
+	Time time.Time `json:"time"`
+	wsEvent
+}
+
+// Add an event to a job's history. Called with mu held; in stateless mode the
+// history is saved and shared with the job's next status change.
+func appendJobEvent(job *Job, event wsEvent) {
+	if len(job.Events) >= MaxJobEvents {
+		return
+	}
+	event.V = WSDefaultVersion
+	job.Events = append(job.Events, jobEvent{Time: time.Now(), wsEvent: event})
+}
+
+func (j *Job) finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+// Assign a token to a new job and add it to the registry as queued. If an
+// identical render is already in flight, nothing is registered and the
+// existing job's ID is returned instead, with coalesced set.
+func registerJob(job *Job) (id string, coalesced bool, err error) {
+	token, err := randomToken(16)
+	if err != nil {
+		return "", false, err
+	}
+
+	job.ID = token
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+	job.Status = JobQueued
+	appendJobEvent(job, statusEvent(job))
+	if store != nil {
+		return registerSharedJob(job)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if existing, ok := inFlightJobs[job.CacheKey]; ok {
+		return existing, true, nil
+	}
+
+	job.changed = make(chan struct{})
+	jobs[job.ID] = job
+	inFlightJobs[job.CacheKey] = job.ID
+	return job.ID, false, nil
+}
+
+// Look up a job. Returns a snapshot and a channel that is closed on the next
+// status change.
+func getJob(id string) (Job, <-chan struct{}, bool) {
+	loadSharedJob(id)
+	mu.Lock()
+	defer mu.Unlock()
+
+	job, ok := jobs[id]
+	if !ok {
+		return Job{}, nil, false
+	}
+	return *job, job.changed, true
+}
+
+// Attach a WebSocket to a registered job, replaying the latest status message
+// so clients that connect (or reconnect) late don't miss the result. The
+// replay is written without holding mu, so a slow client holds up no one
+// else; if the job changed meanwhile, its newer state is replayed too.
+func subscribeJob(ctx context.Context, id string, conn *websocket.Conn) bool {
+	loadSharedJob(id)
+	pushed := false
+	for {
+		mu.Lock()
+		job, ok := jobs[id]
+		if !ok {
+			mu.Unlock()
+			return false
+		}
+		status, output, tenant, message, changed := job.Status, job.OutputPath, job.Tenant, job.Message, job.changed
+		pushImage := imagePushConns[conn]
+		mu.Unlock()
+
+		// Finished before the client connected: push the image ahead of the replayed message
+		if status == JobDone && pushImage && !pushed && pushableOutput(output) {
+			if err := writeImagePush(withTenant(ctx, tenant), conn, id, outputObject(output)); err != nil {
+				log.Printf("Failed to push image to job ID %s: %v\n", id, err)
+				return false
+			}
+			pushed = true
+		}
+		if message != "" {
+			if err := conn.WriteMessage(websocket.TextMessage, reencodeEvent(wsVersion(conn), message)); err != nil {
+				log.Printf("Failed to replay status to job ID %s: %v\n", id, err)
+				return false
+			}
+		}
+
+		mu.Lock()
+		if job, ok := jobs[id]; ok && job.changed == changed {
+			jobConnections[id] = append(jobConnections[id], conn)
+			mu.Unlock()
+			return true
+		}
+		mu.Unlock()
+	}
+}
+
+// Detach a WebSocket from a job
+func removeConnection(id string, conn *websocket.Conn) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	delete(imagePushConns, conn)
+	delete(previewConns, conn)
+	conns := jobConnections[id]
+	for i, c := range conns {
+		if c == conn {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(jobConnections, id)
+	} else {
+		jobConnections[id] = conns
+	}
+}
+
+// Find a queued or running job that will produce the given cache key
+func findInFlightJob(cacheKey string) (string, bool) {
+	if store != nil {
+		id, err := store.FindCacheKey(cacheKey)
+		if err != nil {
+			log.Printf("Failed to look up in-flight job: %v", err)
+		}
+		return id, id != ""
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	id, ok := inFlightJobs[cacheKey]
+	return id, ok
+}
+
+// Record a status change and make it visible to pollers and subscribers,
+// on every instance in stateless mode
+func updateJob(id, status string) {
+	mu.Lock()
+	job, ok := jobs[id]
+	if !ok {
+		mu.Unlock()
+		return
+	}
+	job.Status = status
+	job.UpdatedAt = time.Now()
+	if status == JobProcessing {
+		job.StartedAt = job.UpdatedAt
+	}
+	event := statusEvent(job)
+	job.Message = string(encodeEvent(WSDefaultVersion, event))
+	appendJobEvent(job, event)
+	snapshot := *job
+	mu.Unlock()
+
+	switch status {
+	case JobDone:
+		publishJobEvent(JobCompletedEvent, snapshot)
+	case JobFailed:
+		publishJobEvent(JobFailedEvent, snapshot)
+	}
+	if store != nil {
+		publishJobUpdate(snapshot)
+		return
+	}
+	applyJobUpdate(snapshot)
+}
+
+// Mark a job failed, with the error code clients are told
+func failJob(id, code string) {
+	mu.Lock()
+	if job, ok := jobs[id]; ok {
+		job.ErrorCode = code
+	}
+	mu.Unlock()
+	updateJob(id, JobFailed)
+}
+
+// Take over a job's latest state, wake up pollers, and push the status event
+// to the client. Finished images go out first so clients have the bytes when
+// the done event arrives. The job is marked done before the image is pushed,
+// to the subscribers it had then; later ones see it done and get the image
+// from subscribeJob.
+func applyJobUpdate(update Job) {
+	mu.Lock()
+	job, ok := jobs[update.ID]
+	if ok {
+		close(job.changed)
+	} else {
+		job = &Job{}
+		jobs[update.ID] = job
+	}
+	*job = update
+	job.changed = make(chan struct{})
+	if job.finished() && inFlightJobs[job.CacheKey] == job.ID {
+		delete(inFlightJobs, job.CacheKey)
+	}
+	var pushTo []*websocket.Conn
+	if update.Status == JobDone && pushableOutput(update.OutputPath) {
+		pushTo = imagePushSubscribers(update.ID)
+	}
+	mu.Unlock()
+
+	pushJobImage(pushTo, update.ID, update.Tenant, outputObject(update.OutputPath))
+	if update.Message != "" {
+		notifyClient(update.ID, update.Message)
+	}
+}
+
+// Estimated time until a job finishes: the remaining work of every job ahead
+// of it in the queue, shared among the workers that may take it, plus its
+// own. Interactive jobs are taken first, and tenants take turns.
+func jobETA(id string) (time.Duration, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	job, ok := jobs[id]
+	if !ok || job.finished() {
+		return 0, false
+	}
+
+	remaining := func(j *Job) time.Duration {
+		if j.Status == JobProcessing {
+			if left := j.Estimate - time.Since(j.StartedAt); left > 0 {
+				return left
+			}
+			return 0
+		}
+		return j.Estimate
+	}
+
+	places := queuePlaces()
+	var ahead time.Duration
+	for _, other := range jobs {
+		if other == job || other.finished() {
+			continue
+		}
+		if other.Status == JobProcessing || (job.Status == JobQueued && takenBefore(other, job, places)) {
+			ahead += remaining(other)
+		}
+	}
+	if job.Status == JobProcessing {
+		ahead = 0 // Already has a worker of its own
+	}
+	workers := workerCount()
+	if job.Priority != PriorityInteractive {
+		workers -= reservedWorkers()
+	}
+	return remaining(job) + ahead/time.Duration(workers), true
+}
+
+// Place of a queued job in line for a worker, 1 for the next one taken
+func queuePosition(id string) (int, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	job, ok := jobs[id]
+	if !ok || job.Status != JobQueued {
+		return 0, false
+	}
+	places := queuePlaces()
+	position := 1
+	for _, other := range jobs {
+		if other != job && other.Status == JobQueued && takenBefore(other, job, places) {
+			position++
+		}
+	}
+	return position, true
+}
+
+// Whether a queued job is taken before another: interactive ones first, then
+// in order within a tenant. Tenants take turns, which is counted as one job
+// each, so another tenant's job is ahead when fewer of its tenant's jobs are.
+func takenBefore(a, b *Job, places map[*Job]int) bool {
+	if (a.Priority == PriorityInteractive) != (b.Priority == PriorityInteractive) {
+		return a.Priority == PriorityInteractive
+	}
+	if a.Tenant != b.Tenant && places[a] != places[b] {
+		return places[a] < places[b]
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+// How many jobs of the same tenant and lane are ahead of each queued job.
+// Called with mu held.
+func queuePlaces() map[*Job]int {
+	var queued []*Job
+	for _, job := range jobs {
+		if job.Status == JobQueued {
+			queued = append(queued, job)
+		}
+	}
+	slices.SortFunc(queued, func(a, b *Job) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	places := make(map[*Job]int, len(queued))
+	ahead := make(map[string]int)
+	for _, job := range queued {
+		line := job.Tenant + "/" + job.Priority
+		places[job] = ahead[line]
+		ahead[line]++
+	}
+	return places
+}
+
+// Periodically remove finished jobs past their retention
+func expireJobs() {
+	for range time.Tick(time.Minute) {
+		mu.Lock()
+		for id, job := range jobs {
+			if job.finished() && time.Since(job.UpdatedAt) > JobRetention {
+				delete(jobs, id)
+			}
+		}
+		expireGroups()
+		mu.Unlock()
+	}
+}
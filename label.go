@@ -0,0 +1,546 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/fogleman/fauxgl"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/sfnt"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	MaxLabelRunes    = 64  // Longest accepted label text, including line breaks
+	MaxLabelLines    = 4   // Most lines of text on one label
+	MaxLabelSize     = 500 // Largest accepted letter height, depth, or base, in mm
+	LabelCurveSteps  = 6   // Straight segments each curve in a glyph outline is split into
+	LabelLineSpacing = 1.6 // Distance between baselines, relative to the letter height
+)
+
+// Fonts labels can be set in, by name
+var labelFonts = map[string][]byte{
+	"regular": goregular.TTF,
+	"bold":    gobold.TTF,
+	"italic":  goitalic.TTF,
+	"mono":    gomono.TTF,
+}
+
+// Text extruded into a solid: letters Height mm tall (capitals, from the
+// baseline) and Depth mm deep, standing on a plate Base mm thick with a
+// margin around the text, or free-standing when Base is 0
+type LabelSettings struct {
+	Text   string
+	Font   string
+	Height float64
+	Depth  float64
+	Base   float64
+}
+
+var defaultLabel = LabelSettings{Font: "regular", Height: 10, Depth: 2}
+
+// Read the label form fields
+func parseLabelSettings(r *http.Request) (LabelSettings, error) {
+	settings := defaultLabel
+	settings.Text = strings.TrimSpace(strings.ReplaceAll(r.FormValue("text"), "\r\n", "\n"))
+	if settings.Text == "" {
+		return settings, fmt.Errorf("text is required")
+	}
+	if utf8.RuneCountInString(settings.Text) > MaxLabelRunes {
+		return settings, fmt.Errorf("text must be at most %d characters", MaxLabelRunes)
+	}
+	if strings.Count(settings.Text, "\n") >= MaxLabelLines {
+		return settings, fmt.Errorf("text must be at most %d lines", MaxLabelLines)
+	}
+	if v := r.FormValue("font"); v != "" {
+		if _, ok := labelFonts[v]; !ok {
+			return settings, fmt.Errorf("font must be regular, bold, italic, or mono")
+		}
+		settings.Font = v
+	}
+	for _, field := range []struct {
+		name     string
+		value    *float64
+		min, max float64
+	}{
+		{"height", &settings.Height, 1, MaxLabelSize},
+		{"depth", &settings.Depth, 0.1, MaxLabelSize},
+		{"base", &settings.Base, 0, MaxLabelSize},
+	} {
+		v := r.FormValue(field.name)
+		if v == "" {
+			continue
+		}
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(x >= field.min && x <= field.max) {
+			return settings, fmt.Errorf("%s must be a length in mm between %g and %g", field.name, field.min, field.max)
+		}
+		*field.value = x
+	}
+	return settings, nil
+}
+
+// Hash the generated model is filed under, as if it had been uploaded
+func (s LabelSettings) hash() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("label:%s:%g:%g:%g:%q", s.Font, s.Height, s.Depth, s.Base, s.Text)))
+	return hex.EncodeToString(sum[:])
+}
+
+// POST /api/v1/labels with text and optional font, height, depth, and base
+// fields, plus the usual render options. The text is extruded into a mesh
+// that is stored and rendered like an upload; the job links the STL as its
+// mesh once done.
+func labelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, r, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Invalid request method")
+		return
+	}
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+
+	settings, err := parseLabelSettings(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	opts, err := parseRenderOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	analysis, err := parseAnalysisOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if _, err := parseGroupID(r); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	analysis.Units = "mm"
+
+	fileHash := settings.hash()
+	if respondCached(w, r, outputCacheKey(tenantOf(r.Context()), fileHash, opts, analysis)) {
+		return
+	}
+
+	mesh, err := labelMesh(settings)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Failed to build label: "+err.Error())
+		return
+	}
+	workDir, err := newJobWorkDir()
+	if err != nil {
+		log.Printf("Failed to create work dir: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to build label")
+		return
+	}
+	if err := mesh.SaveSTL(filepath.Join(workDir, "input.stl")); err != nil {
+		log.Printf("Failed to save label: %v", err)
+		os.RemoveAll(workDir)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to build label")
+		return
+	}
+	if !submitRender(w, r, workDir, fileHash, opts, analysis, true) {
+		os.RemoveAll(workDir)
+	}
+}
+
+// Extrude the label text, in mm with the first baseline along the x axis
+func labelMesh(settings LabelSettings) (*fauxgl.Mesh, error) {
+	f, err := sfnt.Parse(labelFonts[settings.Font])
+	if err != nil {
+		return nil, err
+	}
+	var buf sfnt.Buffer
+	ppem := fixed.Int26_6(f.UnitsPerEm()) << 6 // Outlines in font units
+	metrics, err := f.Metrics(&buf, ppem, font.HintingNone)
+	if err != nil {
+		return nil, err
+	}
+	capHeight := float64(metrics.CapHeight) / 64
+	if capHeight <= 0 {
+		capHeight = float64(metrics.Ascent) / 64
+	}
+	scale := settings.Height / capHeight
+
+	// Outlines of every line, centered on the widest
+	var lines [][]labelContour
+	var widths []float64
+	for _, text := range strings.Split(settings.Text, "\n") {
+		contours, width, err := textContours(f, &buf, ppem, text)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, contours)
+		widths = append(widths, width)
+	}
+	maxWidth := 0.0
+	for _, w := range widths {
+		maxWidth = math.Max(maxWidth, w)
+	}
+	var contours []labelContour
+	for i, line := range lines {
+		dx := (maxWidth - widths[i]) / 2
+		dy := -float64(i) * LabelLineSpacing * capHeight
+		for _, c := range line {
+			for j := range c {
+				c[j] = labelPoint{(c[j].x + dx) * scale, (c[j].y + dy) * scale}
+			}
+			contours = append(contours, c)
+		}
+	}
+	if len(contours) == 0 {
+		return nil, fmt.Errorf("text has no visible characters")
+	}
+
+	mesh := fauxgl.NewEmptyMesh()
+	top := settings.Base + settings.Depth
+	for _, shape := range labelShapes(contours) {
+		extrude(mesh, shape, 0, top)
+	}
+	if settings.Base > 0 {
+		// Letters reach down into the plate so slicers fuse them with it
+		lo, hi := contourBounds(contours)
+		margin := settings.Height / 2
+		plate := labelContour{{lo.x - margin, lo.y - margin}, {hi.x + margin, lo.y - margin}, {hi.x + margin, hi.y + margin}, {lo.x - margin, hi.y + margin}}
+		extrude(mesh, []labelContour{plate}, 0, settings.Base)
+	}
+	return mesh, nil
+}
+
+type labelPoint struct{ x, y float64 }
+
+// Closed outline, without repeating the first point at the end
+type labelContour []labelPoint
+
+// Outlines of one line of text in font units, y up from the baseline, and
+// the line's advance width
+func textContours(f *sfnt.Font, buf *sfnt.Buffer, ppem fixed.Int26_6, text string) ([]labelContour, float64, error) {
+	var contours []labelContour
+	var x fixed.Int26_6
+	prev := sfnt.GlyphIndex(0)
+	for _, r := range text {
+		glyph, err := f.GlyphIndex(buf, r)
+		if err != nil {
+			return nil, 0, err
+		}
+		if glyph == 0 {
+			return nil, 0, fmt.Errorf("font has no glyph for %q", r)
+		}
+		if prev != 0 {
+			if kern, err := f.Kern(buf, prev, glyph, ppem, font.HintingNone); err == nil {
+				x += kern
+			}
+		}
+		segments, err := f.LoadGlyph(buf, glyph, ppem, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		contours = append(contours, flattenGlyph(segments, float64(x)/64)...)
+		advance, err := f.GlyphAdvance(buf, glyph, ppem, font.HintingNone)
+		if err != nil {
+			return nil, 0, err
+		}
+		x += advance
+		prev = glyph
+	}
+	return contours, float64(x) / 64, nil
+}
+
+// Turn a glyph's outline segments into polygons, splitting curves into
+// LabelCurveSteps lines each. sfnt's y axis points down; it is flipped here.
+func flattenGlyph(segments sfnt.Segments, dx float64) []labelContour {
+	point := func(p fixed.Point26_6) labelPoint {
+		return labelPoint{float64(p.X)/64 + dx, -float64(p.Y) / 64}
+	}
+	var contours []labelContour
+	var c labelContour
+	flush := func() {
+		// Drop the closing point and repeated points
+		var clean labelContour
+		for _, p := range c {
+			if len(clean) == 0 || p != clean[len(clean)-1] {
+				clean = append(clean, p)
+			}
+		}
+		for len(clean) > 1 && clean[0] == clean[len(clean)-1] {
+			clean = clean[:len(clean)-1]
+		}
+		if len(clean) >= 3 {
+			contours = append(contours, clean)
+		}
+		c = nil
+	}
+	for _, s := range segments {
+		switch s.Op {
+		case sfnt.SegmentOpMoveTo:
+			flush()
+			c = append(c, point(s.Args[0]))
+		case sfnt.SegmentOpLineTo:
+			c = append(c, point(s.Args[0]))
+		case sfnt.SegmentOpQuadTo:
+			p0, p1, p2 := c[len(c)-1], point(s.Args[0]), point(s.Args[1])
+			for i := 1; i <= LabelCurveSteps; i++ {
+				t := float64(i) / LabelCurveSteps
+				a, b, d := (1-t)*(1-t), 2*(1-t)*t, t*t
+				c = append(c, labelPoint{a*p0.x + b*p1.x + d*p2.x, a*p0.y + b*p1.y + d*p2.y})
+			}
+		case sfnt.SegmentOpCubeTo:
+			p0, p1, p2, p3 := c[len(c)-1], point(s.Args[0]), point(s.Args[1]), point(s.Args[2])
+			for i := 1; i <= LabelCurveSteps; i++ {
+				t := float64(i) / LabelCurveSteps
+				u := 1 - t
+				a, b, d, e := u*u*u, 3*u*u*t, 3*u*t*t, t*t*t
+				c = append(c, labelPoint{a*p0.x + b*p1.x + d*p2.x + e*p3.x, a*p0.y + b*p1.y + d*p2.y + e*p3.y})
+			}
+		}
+	}
+	flush()
+	return contours
+}
+
+// Twice the signed area, positive for counterclockwise contours
+func (c labelContour) area2() float64 {
+	var sum float64
+	for i, p := range c {
+		q := c[(i+1)%len(c)]
+		sum += p.x*q.y - q.x*p.y
+	}
+	return sum
+}
+
+// Even-odd test of whether p lies inside the contour
+func (c labelContour) contains(p labelPoint) bool {
+	inside := false
+	for i, a := range c {
+		b := c[(i+1)%len(c)]
+		if (a.y > p.y) != (b.y > p.y) && p.x < a.x+(p.y-a.y)*(b.x-a.x)/(b.y-a.y) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Group contours into solid shapes: an outline counterclockwise, followed by
+// the holes directly inside it, clockwise. Nesting decides which is which,
+// so fonts of either winding convention work.
+func labelShapes(contours []labelContour) [][]labelContour {
+	depth := make([]int, len(contours))
+	parent := make([]int, len(contours))
+	for i, c := range contours {
+		parent[i] = -1
+		for j, other := range contours {
+			if i != j && other.contains(c[0]) {
+				depth[i]++
+				// The innermost container is the smallest one
+				if parent[i] < 0 || math.Abs(other.area2()) < math.Abs(contours[parent[i]].area2()) {
+					parent[i] = j
+				}
+			}
+		}
+	}
+	var shapes [][]labelContour
+	index := make(map[int]int) // Shape of each outline
+	for i, c := range contours {
+		if depth[i]%2 == 0 {
+			if c.area2() < 0 {
+				c.reverse()
+			}
+			index[i] = len(shapes)
+			shapes = append(shapes, []labelContour{c})
+		}
+	}
+	for i, c := range contours {
+		if depth[i]%2 == 1 {
+			if c.area2() > 0 {
+				c.reverse()
+			}
+			if s, ok := index[parent[i]]; ok {
+				shapes[s] = append(shapes[s], c)
+			}
+		}
+	}
+	return shapes
+}
+
+func (c labelContour) reverse() {
+	for i, j := 0, len(c)-1; i < j; i, j = i+1, j-1 {
+		c[i], c[j] = c[j], c[i]
+	}
+}
+
+func contourBounds(contours []labelContour) (labelPoint, labelPoint) {
+	lo := labelPoint{math.Inf(1), math.Inf(1)}
+	hi := labelPoint{math.Inf(-1), math.Inf(-1)}
+	for _, c := range contours {
+		for _, p := range c {
+			lo = labelPoint{math.Min(lo.x, p.x), math.Min(lo.y, p.y)}
+			hi = labelPoint{math.Max(hi.x, p.x), math.Max(hi.y, p.y)}
+		}
+	}
+	return lo, hi
+}
+
+// Add a prism between z0 and z1 over a shape (outline first, then holes),
+// with caps triangulated by ear clipping and walls along every contour
+func extrude(mesh *fauxgl.Mesh, shape []labelContour, z0, z1 float64) {
+	at := func(p labelPoint, z float64) fauxgl.Vector { return fauxgl.Vector{p.x, p.y, z} }
+	add := func(a, b, c fauxgl.Vector) {
+		mesh.Triangles = append(mesh.Triangles, fauxgl.NewTriangleForPoints(a, b, c))
+	}
+	for _, t := range triangulate(bridgeHoles(shape)) {
+		add(at(t[0], z1), at(t[1], z1), at(t[2], z1))
+		add(at(t[0], z0), at(t[2], z0), at(t[1], z0))
+	}
+	// Outlines run counterclockwise and holes clockwise, so the solid is
+	// always on the left and walls face right
+	for _, c := range shape {
+		for i, p := range c {
+			q := c[(i+1)%len(c)]
+			add(at(p, z0), at(q, z0), at(q, z1))
+			add(at(p, z0), at(q, z1), at(p, z1))
+		}
+	}
+}
+
+// Merge holes into the outline through zero-width cuts, giving one polygon
+// that ear clipping can handle. Holes are cut in from their rightmost point
+// to the nearest outline point the cut doesn't cross any edge to.
+func bridgeHoles(shape []labelContour) labelContour {
+	poly := append(labelContour(nil), shape[0]...)
+	holes := append([]labelContour(nil), shape[1:]...)
+	rightmost := func(c labelContour) int {
+		best := 0
+		for i, p := range c {
+			if p.x > c[best].x {
+				best = i
+			}
+		}
+		return best
+	}
+	// Rightmost holes first, so each cut can reach the holes already merged
+	for len(holes) > 0 {
+		next := 0
+		for i, h := range holes {
+			if h[rightmost(h)].x > holes[next][rightmost(holes[next])].x {
+				next = i
+			}
+		}
+		hole := holes[next]
+		holes = append(holes[:next], holes[next+1:]...)
+
+		m := rightmost(hole)
+		from := hole[m]
+		best, bestDist := -1, math.Inf(1)
+		for i, p := range poly {
+			d := (p.x-from.x)*(p.x-from.x) + (p.y-from.y)*(p.y-from.y)
+			if d >= bestDist || !cutIsClear(from, p, poly, hole, holes) {
+				continue
+			}
+			best, bestDist = i, d
+		}
+		if best < 0 {
+			continue // Hole can't be reached; leave it closed over
+		}
+		// poly[..best], hole from m around to m, back to poly[best..]
+		merged := append(labelContour(nil), poly[:best+1]...)
+		for k := 0; k <= len(hole); k++ {
+			merged = append(merged, hole[(m+k)%len(hole)])
+		}
+		merged = append(merged, poly[best:]...)
+		poly = merged
+	}
+	return poly
+}
+
+// Whether the segment ab crosses none of the edges of the given contours
+func cutIsClear(a, b labelPoint, poly, hole labelContour, others []labelContour) bool {
+	contours := append([]labelContour{poly, hole}, others...)
+	for _, c := range contours {
+		for i, p := range c {
+			q := c[(i+1)%len(c)]
+			if segmentsCross(a, b, p, q) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Whether segments ab and cd cross at a point other than a shared endpoint
+func segmentsCross(a, b, c, d labelPoint) bool {
+	if a == c || a == d || b == c || b == d {
+		return false
+	}
+	d1, d2 := orient(c, d, a), orient(c, d, b)
+	d3, d4 := orient(a, b, c), orient(a, b, d)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) && ((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
+
+// Twice the signed area of triangle abc, positive when counterclockwise
+func orient(a, b, c labelPoint) float64 {
+	return (b.x-a.x)*(c.y-a.y) - (b.y-a.y)*(c.x-a.x)
+}
+
+// Ear-clip a counterclockwise simple polygon, which may touch itself along
+// hole cuts, into counterclockwise triangles
+func triangulate(poly labelContour) [][3]labelPoint {
+	idx := make([]int, len(poly))
+	for i := range idx {
+		idx[i] = i
+	}
+	var tris [][3]labelPoint
+	for len(idx) > 3 {
+		n := len(idx)
+		clipped := false
+		for i := 0; i < n; i++ {
+			a, b, c := poly[idx[(i+n-1)%n]], poly[idx[i]], poly[idx[(i+1)%n]]
+			if orient(a, b, c) <= 0 || !isEar(a, b, c, poly, idx) {
+				continue
+			}
+			tris = append(tris, [3]labelPoint{a, b, c})
+			idx = append(idx[:i], idx[i+1:]...)
+			clipped = true
+			break
+		}
+		if !clipped {
+			// Only slivers left, e.g. from rounding along a cut; drop one
+			// collinear or reflex corner and carry on
+			idx = idx[1:]
+		}
+	}
+	if len(idx) == 3 && orient(poly[idx[0]], poly[idx[1]], poly[idx[2]]) > 0 {
+		tris = append(tris, [3]labelPoint{poly[idx[0]], poly[idx[1]], poly[idx[2]]})
+	}
+	return tris
+}
+
+// Whether no remaining corner lies inside triangle abc
+func isEar(a, b, c labelPoint, poly labelContour, idx []int) bool {
+	for _, i := range idx {
+		p := poly[i]
+		if p == a || p == b || p == c {
+			continue
+		}
+		if orient(a, b, p) >= 0 && orient(b, c, p) >= 0 && orient(c, a, p) >= 0 {
+			return false
+		}
+	}
+	return true
+}
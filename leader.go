@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	LeaderLockTTL     = 30 * time.Second // Leadership lapses this long after the leader stops renewing it
+	MaintenancePeriod = time.Minute      // How often the leader sweeps shared state
+	StuckJobAge       = time.Hour        // Jobs processing without an update for this long lost their instance
+)
+
+// Old queued jobs that were on no line of the shared queue at the last sweep.
+// Only the maintenance goroutine uses it.
+var unqueuedJobs = make(map[string]bool)
+
+// Renew the lock only while this instance still holds it
+var renewLeaderScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+
+// Run shared maintenance on exactly one instance. In stateless mode every
+// instance competes for a Redis lock and the holder runs the sweeps, renewing
+// the lock as it goes; if it dies, another instance takes over within
+// LeaderLockTTL. Without stateless mode there is nothing shared to maintain.
+func runMaintenance() {
+	if store == nil {
+		return
+	}
+	instance, err := randomToken(8)
+	if err != nil {
+		log.Printf("Failed to create instance ID: %v", err)
+		return
+	}
+
+	ctx := context.Background()
+	key := redisKey("leader")
+	for {
+		ok, err := rdb.SetNX(ctx, key, instance, LeaderLockTTL).Result()
+		if err != nil {
+			log.Printf("Failed to acquire maintenance lock: %v", err)
+		}
+		if ok {
+			log.Println("Acquired maintenance lock, running shared maintenance")
+			lead(ctx, key, instance)
+			log.Println("Lost maintenance lock")
+		}
+		time.Sleep(LeaderLockTTL / 3)
+	}
+}
+
+// Renew the lock and run the sweeps until the lock is lost
+func lead(ctx context.Context, key, instance string) {
+	renew := time.NewTicker(LeaderLockTTL / 3)
+	defer renew.Stop()
+	sweep := time.NewTicker(MaintenancePeriod)
+	defer sweep.Stop()
+
+	failStuckJobs()
+	for {
+		select {
+		case <-renew.C:
+			renewed, err := renewLeaderScript.Run(ctx, rdb, []string{key}, instance, LeaderLockTTL.Milliseconds()).Int()
+			if err != nil {
+				log.Printf("Failed to renew maintenance lock: %v", err)
+			}
+			if renewed == 0 {
+				return
+			}
+		case <-sweep.C:
+			failStuckJobs()
+		}
+	}
+}
+
+// Fail jobs whose instance died mid-render so their subscribers find out and
+// the cache key is free for a new upload. That includes queued jobs that are
+// on no line of the queue, taken by an instance that died before marking
+// them processing; as one could be between the two, a job must be missing
+// on two sweeps in a row.
+func failStuckJobs() {
+	stuck, err := store.StaleJobs(time.Now().Add(-StuckJobAge))
+	if err != nil {
+		log.Printf("Failed to look for stuck jobs: %v", err)
+		return
+	}
+	queued, err := redisQueuedJobIDs(context.Background())
+	if err != nil {
+		log.Printf("Failed to read the queue: %v", err)
+		return
+	}
+	unqueued := make(map[string]bool)
+	for _, id := range stuck {
+		job, err := store.LoadJob(id)
+		if err != nil || job == nil {
+			continue
+		}
+		if job.Status == JobQueued {
+			if queued[id] {
+				continue
+			}
+			if !unqueuedJobs[id] {
+				unqueued[id] = true
+				continue
+			}
+		}
+		log.Printf("Failing stuck job ID %s\n", id)
+		loadSharedJob(id)
+		failJob(id, ErrJobAbandoned)
+	}
+	unqueuedJobs = unqueued
+}
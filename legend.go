@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Color scale drawn into analysis renders, so the colors can be read as
+// values. Labels are numbers and units only, since outputs are shared across
+// languages.
+type legend struct {
+	palette           gradient
+	low, middle, high string
+
+	mu     sync.Mutex
+	panels map[image.Point]*image.NRGBA // Drawn for each image size used so far
+}
+
+// Legend of a height coloring spanning height model units
+func heightLegend(palette gradient, height float64, units string) *legend {
+	return &legend{palette: palette, low: "0 " + units, high: formatLegendValue(height) + " " + units}
+}
+
+// Legend of a curvature coloring whose ends are ±curvature per model unit
+func curvatureLegend(palette gradient, curvature float64, units string) *legend {
+	value := formatLegendValue(curvature) + "/" + units
+	return &legend{palette: palette, low: "−" + value, middle: "0", high: "+" + value}
+}
+
+// Legend of a layer coloring of layers bands
+func layerLegend(palette gradient, layers int) *legend {
+	return &legend{palette: palette, low: "1", high: fmt.Sprint(layers)}
+}
+
+func formatLegendValue(v float64) string {
+	if v >= 100 {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.3g", v)
+}
+
+// The legend drawn for an image of the given size: a translucent white panel
+// with the palette as a bar and the labels under it. Drawn once per size.
+func legendPanel(lg *legend, size image.Point) (*image.NRGBA, error) {
+	f, err := loadAnnotationFont()
+	if err != nil {
+		return nil, err
+	}
+	lg.mu.Lock()
+	defer lg.mu.Unlock()
+	if panel, ok := lg.panels[size]; ok {
+		return panel, nil
+	}
+
+	s := min(size.X, size.Y)
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: math.Max(10, float64(s)/56), DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+	pad := max(3, s/128)
+	barW, barH := max(60, size.X*7/20), max(6, s/48)
+	metrics := face.Metrics()
+	textH := (metrics.Ascent + metrics.Descent).Ceil()
+	panel := image.NewNRGBA(image.Rect(0, 0, barW+2*pad, pad+barH+pad/2+textH+pad))
+	draw.Draw(panel, panel.Bounds(), image.NewUniform(color.NRGBA{255, 255, 255, 200}), image.Point{}, draw.Src)
+
+	for x := 0; x < barW; x++ {
+		c := image.NewUniform(lg.palette.at(float64(x) / float64(barW-1)).NRGBA())
+		draw.Draw(panel, image.Rect(pad+x, pad, pad+x+1, pad+barH), c, image.Point{}, draw.Src)
+	}
+
+	baseline := pad + barH + pad/2 + metrics.Ascent.Ceil()
+	drawer := font.Drawer{Dst: panel, Src: image.NewUniform(color.NRGBA{0x22, 0x22, 0x22, 255}), Face: face}
+	for _, label := range []struct {
+		text  string
+		align float64 // 0 left, 0.5 centered, 1 right, along the bar
+	}{{lg.low, 0}, {lg.middle, 0.5}, {lg.high, 1}} {
+		if label.text == "" {
+			continue
+		}
+		width := font.MeasureString(face, label.text).Ceil()
+		x := pad + int(label.align*float64(barW-width))
+		drawer.Dot = fixed.P(x, baseline)
+		drawer.DrawString(label.text)
+	}
+	if lg.panels == nil {
+		lg.panels = make(map[image.Point]*image.NRGBA)
+	}
+	lg.panels[size] = panel
+	return panel, nil
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where logs go
+const (
+	LogSinkStderr = "stderr" // Text, one key=value line per entry
+	LogSinkFile   = "file"   // Text to a file rotated by size
+	LogSinkSyslog = "syslog"
+	LogSinkJSON   = "json" // One JSON object per line on stdout
+)
+
+// Components log levels can be set for
+const (
+	LogServer   = "server"   // Requests, storage, and everything not below
+	LogQueue    = "queue"    // Jobs, the queue, and shared state
+	LogRenderer = "renderer" // Rendering, the sandbox, and the GPU
+)
+
+const (
+	DefaultLogMaxSizeMB = 100
+	DefaultLogMaxFiles  = 5
+)
+
+// Operator settings for logging. Without any, logs stay plain lines on
+// stderr, as the standard log package writes them.
+type LoggingConfig struct {
+	Sink          string            `json:"sink"`           // stderr (default), file, syslog, or json
+	File          string            `json:"file"`           // Log file, with the file sink
+	MaxSizeMB     int               `json:"max_size_mb"`    // Size the log file is rotated at; DefaultLogMaxSizeMB when 0
+	MaxFiles      int               `json:"max_files"`      // Rotated files kept next to it; DefaultLogMaxFiles when 0
+	SyslogAddress string            `json:"syslog_address"` // "udp://host:514", "tcp://host:514", or empty for the local syslog daemon
+	Level         string            `json:"level"`          // Lowest level logged: debug, info (default), warn, or error
+	Levels        map[string]string `json:"levels"`         // Lowest level by component: server, queue, renderer
+	Access        bool              `json:"access"`         // Log every request with its status, duration, sizes, and job
+}
+
+// Source files logging for the queue and renderer components; the rest log
+// for the server
+var logComponents = map[string]string{
+	"queue.go": LogQueue, "jobs.go": LogQueue, "events.go": LogQueue, "eta.go": LogQueue, "progress.go": LogQueue,
+	"leader.go": LogQueue, "warmup.go": LogQueue, "stateless.go": LogQueue, "redis.go": LogQueue, "postgres.go": LogQueue,
+	"admin.go": LogQueue, "balance.go": LogQueue, "ingest.go": LogQueue, "printhosts.go": LogQueue, "jobevents.go": LogQueue,
+
+	"render.go": LogRenderer, "renderer.go": LogRenderer, "gpu_egl.go": LogRenderer, "raytrace.go": LogRenderer,
+	"poster.go": LogRenderer, "spin.go": LogRenderer, "sandbox.go": LogRenderer, "sandbox_linux.go": LogRenderer,
+}
+
+// Levels of log lines, by what they contain, first match wins: connection
+// chatter is debug, failures are errors, skipped work is a warning
+var logLevelRules = []struct {
+	prefix, contains string
+	level            slog.Level
+}{
+	{contains: "WebSocket connection ", level: slog.LevelDebug},
+	{prefix: "Failed", level: slog.LevelError},
+	{prefix: "Error", level: slog.LevelError},
+	{contains: " failed", level: slog.LevelError},
+	{contains: " error", level: slog.LevelError},
+	{prefix: "Ignoring", level: slog.LevelWarn},
+	{prefix: "Failing", level: slog.LevelWarn},
+	{prefix: "Lost", level: slog.LevelWarn},
+	{contains: " flagged ", level: slog.LevelWarn},
+}
+
+var logLevelNames = map[string]slog.Level{
+	"debug": slog.LevelDebug,
+	"info":  slog.LevelInfo,
+	"warn":  slog.LevelWarn,
+	"error": slog.LevelError,
+}
+
+// Route the standard logger through the configured sink. Every log line
+// becomes a structured entry with its level, component, and source line;
+// entries below their component's level are dropped.
+func setupLogging(cfg LoggingConfig) error {
+	if cfg.Sink == "" && cfg.Level == "" && len(cfg.Levels) == 0 {
+		return nil
+	}
+	bridge := &logBridge{minimum: slog.LevelInfo, levels: make(map[string]slog.Level)}
+	if cfg.Level != "" {
+		level, ok := logLevelNames[cfg.Level]
+		if !ok {
+			return fmt.Errorf("unknown log level %q", cfg.Level)
+		}
+		bridge.minimum = level
+	}
+	for component, name := range cfg.Levels {
+		if component != LogServer && component != LogQueue && component != LogRenderer {
+			return fmt.Errorf("unknown log component %q", component)
+		}
+		level, ok := logLevelNames[name]
+		if !ok {
+			return fmt.Errorf("unknown log level %q for %s", name, component)
+		}
+		bridge.levels[component] = level
+	}
+
+	// Levels are applied by the bridge, so handlers take everything
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch cfg.Sink {
+	case "", LogSinkStderr:
+		bridge.handler = slog.NewTextHandler(os.Stderr, opts)
+	case LogSinkJSON:
+		bridge.handler = slog.NewJSONHandler(os.Stdout, opts)
+	case LogSinkFile:
+		if cfg.File == "" {
+			return fmt.Errorf("the file log sink needs a file")
+		}
+		file, err := newRotatingFile(cfg.File, cfg.MaxSizeMB, cfg.MaxFiles)
+		if err != nil {
+			return err
+		}
+		bridge.handler = slog.NewTextHandler(file, opts)
+	case LogSinkSyslog:
+		handler, err := newSyslogHandler(cfg.SyslogAddress)
+		if err != nil {
+			return fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		bridge.handler = handler
+	default:
+		return fmt.Errorf("unknown log sink %q", cfg.Sink)
+	}
+
+	log.SetFlags(log.Lshortfile)
+	log.SetPrefix("")
+	log.SetOutput(bridge)
+	return nil
+}
+
+// Takes lines from the standard logger, written with log.Lshortfile, and
+// hands them on as structured entries
+type logBridge struct {
+	handler slog.Handler
+	minimum slog.Level            // For components without their own
+	levels  map[string]slog.Level // By component
+}
+
+func (b *logBridge) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	source, message, ok := strings.Cut(line, ": ")
+	if !ok {
+		source, message = "", line
+	}
+	file, _, _ := strings.Cut(source, ":")
+	component := logComponents[file]
+	if component == "" {
+		component = LogServer
+	}
+	level := logLevel(message)
+	minimum, ok := b.levels[component]
+	if !ok {
+		minimum = b.minimum
+	}
+	if level < minimum {
+		return len(p), nil
+	}
+
+	record := slog.NewRecord(time.Now(), level, message, 0)
+	record.AddAttrs(slog.String("component", component), slog.String("source", source))
+	if err := b.handler.Handle(context.Background(), record); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func logLevel(message string) slog.Level {
+	for _, rule := range logLevelRules {
+		if rule.prefix != "" && strings.HasPrefix(message, rule.prefix) ||
+			rule.contains != "" && strings.Contains(message, rule.contains) {
+			return rule.level
+		}
+	}
+	return slog.LevelInfo
+}
+
+// Log file that is renamed to name.1 once it reaches its size limit, shifting
+// older ones up to name.<maxFiles> and dropping the oldest
+type rotatingFile struct {
+	mu       sync.Mutex
+	name     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func newRotatingFile(name string, maxSizeMB, maxFiles int) (*rotatingFile, error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = DefaultLogMaxSizeMB
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultLogMaxFiles
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	f := &rotatingFile{name: name, maxSize: int64(maxSizeMB) << 20, maxFiles: maxFiles}
+	return f, f.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the full file rather than losing entries
+			fmt.Fprintf(os.Stderr, "Failed to rotate log file: %v\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.name, i), fmt.Sprintf("%s.%d", f.name, i+1))
+	}
+	if err := os.Rename(f.name, f.name+".1"); err != nil {
+		return errors.Join(err, f.open())
+	}
+	return f.open()
+}
+
+// Formats entries as text for a sink that keeps its own time and severity
+type lineHandler struct {
+	mu    *sync.Mutex
+	buf   *bytes.Buffer
+	inner slog.Handler
+	write func(level slog.Level, line string) error
+}
+
+func newLineHandler(write func(level slog.Level, line string) error) *lineHandler {
+	buf := &bytes.Buffer{}
+	inner := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return &lineHandler{mu: &sync.Mutex{}, buf: buf, inner: inner, write: write}
+}
+
+func (h *lineHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return true
+}
+
+func (h *lineHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.inner.Handle(ctx, r); err != nil {
+		return err
+	}
+	return h.write(r.Level, strings.TrimSuffix(h.buf.String(), "\n"))
+}
+
+func (h *lineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &lineHandler{mu: h.mu, buf: h.buf, inner: h.inner.WithAttrs(attrs), write: h.write}
+}
+
+func (h *lineHandler) WithGroup(name string) slog.Handler {
+	return &lineHandler{mu: h.mu, buf: h.buf, inner: h.inner.WithGroup(name), write: h.write}
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+)
+
+func newSyslogHandler(address string) (slog.Handler, error) {
+	return nil, fmt.Errorf("syslog isn't available on this platform")
+}
@@ -0,0 +1,31 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"log/slog"
+	"log/syslog"
+	"strings"
+)
+
+// Handler sending entries to syslog at their level's severity. Syslog keeps
+// the time, so entries carry only their message and attributes.
+func newSyslogHandler(address string) (slog.Handler, error) {
+	network, raddr, _ := strings.Cut(address, "://")
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, "go-render-service")
+	if err != nil {
+		return nil, err
+	}
+	return newLineHandler(func(level slog.Level, line string) error {
+		switch {
+		case level >= slog.LevelError:
+			return writer.Err(line)
+		case level >= slog.LevelWarn:
+			return writer.Warning(line)
+		case level >= slog.LevelInfo:
+			return writer.Info(line)
+		default:
+			return writer.Debug(line)
+		}
+	}), nil
+}
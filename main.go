@@ -1,25 +1,26 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
-	"github.com/hschendel/stl"
-	"github.com/fogleman/fauxgl"
 )
 
 const (
@@ -27,39 +28,207 @@ const (
 	Height     = 1024
 	FOV        = 30
 	HashesFile = "file_hashes.json" // JSON file to store processed file hashes
+
+	UploadMemory = 32 << 20 // Multipart memory limit for single uploads; the rest goes to temporary files
 )
 
 var (
-	queue          = make(chan Job, 100)              // Channel to queue jobs for STL processing
-	upgrader       = websocket.Upgrader{}
-	tmpl           = template.Must(template.ParseFiles("templates/index.html"))
-	mu             sync.Mutex
-	jobConnections = make(map[int64]*websocket.Conn)   // Track WebSocket connections by Job ID
-	fileHashes     = make(map[string]string)           // Track file hashes and their output paths
+	queue            *fairQueue // Queue of jobs for STL processing, sized by config.QueueCapacity
+	interactiveQueue *fairQueue // Like queue, for interactive jobs, which are taken first
+	upgrader         = websocket.Upgrader{CheckOrigin: checkWSOrigin, Subprotocols: wsSubprotocols()}
+	tmpl             *template.Template // Index page, loaded on startup from config.UI.Template
+	mu               sync.Mutex
+	jobConnections   = make(map[string][]*websocket.Conn) // Track WebSocket connections by Job ID; coalesced uploads share a job
+	inFlightJobs     = make(map[string]string)            // Cache key -> ID of the queued or running job producing it
+	jobs             = make(map[string]*Job)              // Jobs registered by uploads, until they finish processing
+	fileHashes       = make(map[string]string)            // Track file hashes and their output paths
+	scanner          Scanner                              // Optional virus scanner run on uploads
 )
 
-type Job struct {
-	ID         int64
-	STLPath    string
-	OutputPath string
-}
-
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case RenderSubcommand:
+			os.Exit(runRenderSubprocess())
+		case BenchSubcommand:
+			os.Exit(runBench(os.Args[2:]))
+		case FsckSubcommand:
+			os.Exit(runFsck(os.Args[2:]))
+		case MigrateSubcommand:
+			os.Exit(runMigrate(os.Args[2:]))
+		}
+	}
+
+	if err := loadConfig(); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+	if err := setupLogging(config.Logging); err != nil {
+		log.Fatalf("Error configuring logging: %v", err)
+	}
+	if err := setupJobEvents(config.JobEvents); err != nil {
+		log.Fatalf("Error configuring job events: %v", err)
+	}
+	if config.QueueCapacity < 1 {
+		log.Fatalf("queue_capacity must be at least 1")
+	}
+	if config.QueueFull != QueueFullReject && config.QueueFull != QueueFullWait {
+		log.Fatalf("queue_full must be %q or %q", QueueFullReject, QueueFullWait)
+	}
+	queue = newFairQueue(config.QueueCapacity)
+	interactiveQueue = newFairQueue(config.QueueCapacity)
+	if config.Sandbox.Enabled && (runtime.GOOS != "linux" || (runtime.GOARCH != "amd64" && runtime.GOARCH != "arm64")) {
+		log.Fatalf("sandbox needs Linux on amd64 or arm64")
+	}
+
+	if err := setupRenderer(); err != nil {
+		log.Fatalf("Error setting up renderer: %v", err)
+	}
+
+	var err error
+	if scanner, err = newScanner(config.Scanner); err != nil {
+		log.Fatalf("Error configuring scanner: %v", err)
+	}
+	if storage, err = newStorage(config.Storage); err != nil {
+		log.Fatalf("Error configuring storage: %v", err)
+	}
+	if err := setupEncryption(context.Background(), config.Encryption); err != nil {
+		log.Fatalf("Error configuring encryption: %v", err)
+	}
+	if err := validateTenants(); err != nil {
+		log.Fatalf("Error configuring tenants: %v", err)
+	}
+	if len(config.Tenants) > 0 {
+		storage = tenantStorage{storage}
+	}
+	if err := validateCORS(config.CORS); err != nil {
+		log.Fatalf("Error configuring CORS: %v", err)
+	}
+	if config.Stateless {
+		if err := setupStateless(); err != nil {
+			log.Fatalf("Error configuring stateless mode: %v", err)
+		}
+	}
+	if err := loadCatalogs(); err != nil {
+		log.Fatalf("Error loading message catalogs: %v", err)
+	}
+	if store != nil {
+		migrateLegacyHashes()
+	}
+	if err := loadAssets(); err != nil {
+		log.Fatalf("Error loading static files: %v", err)
+	}
+	if tmpl, err = parseTemplate(config.UI.Template); err != nil {
+		log.Fatalf("Error loading template: %v", err)
+	}
+	if modelTmpl, err = parseTemplate(ModelTemplate); err != nil {
+		log.Fatalf("Error loading template: %v", err)
+	}
+	if err := loadBrandingFrame(); err != nil {
+		log.Fatalf("Error loading branding frame: %v", err)
+	}
+	if err := loadBackdrops(); err != nil {
+		log.Fatalf("Error loading backdrops: %v", err)
+	}
+
 	// Load file hashes from JSON on startup
 	if err := loadFileHashes(); err != nil {
 		log.Printf("Error loading file hashes: %v", err)
 	}
+	if err := loadRenderHistory(); err != nil {
+		log.Printf("Error loading render history: %v", err)
+	}
+	if err := loadCalibration(); err != nil {
+		log.Printf("Error loading calibration: %v", err)
+	}
+	if err := loadAnalytics(); err != nil {
+		log.Printf("Error loading analytics: %v", err)
+	}
+
+	for _, dir := range []string{"uploads", "output", "models"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Fatalf("Error creating %s directory: %v", dir, err)
+		}
+		if config.Storage.Type != "" && config.Storage.Type != StorageLocal {
+			continue
+		}
+		// Tenants' files go under their prefix
+		for _, t := range config.Tenants {
+			if err := os.MkdirAll(filepath.Join(filepath.FromSlash(tenantStoragePrefix(t.Name)), dir), 0755); err != nil {
+				log.Fatalf("Error creating %s directory: %v", dir, err)
+			}
+		}
+	}
+	cleanStaleWorkDirs()
 
 	http.HandleFunc("/", indexHandler)
-	http.HandleFunc("/upload", uploadHandler)
-	http.HandleFunc("/ws", wsHandler)
-	go processQueue()
+	http.HandleFunc("GET /static/{file}", staticHandler)
+	http.HandleFunc("GET /favicon.ico", faviconHandler)
+	http.HandleFunc("/upload", withCORS(uploadHandler))
+	http.HandleFunc("/ws", withCORS(wsHandler))
+	http.HandleFunc("GET /ws/uploads/{id}", withCORS(uploadProgressWSHandler))
+	http.HandleFunc("GET /api/v1/uploads/{id}", withCORS(uploadProgressHandler))
+	http.HandleFunc("GET /m/{hash}", modelPageHandler)
+	http.HandleFunc("POST /m/{hash}/render", withCORS(modelRenderHandler))
+	http.HandleFunc("GET /m/{hash}/bookmarks", withCORS(listBookmarksHandler))
+	http.HandleFunc("POST /m/{hash}/bookmarks", withCORS(saveBookmarkHandler))
+	http.HandleFunc("DELETE /m/{hash}/bookmarks/{name}", withCORS(deleteBookmarkHandler))
+	http.HandleFunc("GET /og/{file}", ogImageHandler)
+	http.HandleFunc("GET /render/{file}", renderURLHandler)
+	http.HandleFunc("POST /api/v1/jobs", withCORS(createJobHandler))
+	http.HandleFunc("POST /api/v1/batches", withCORS(batchHandler))
+	http.HandleFunc("POST /api/v1/imports", withCORS(importHandler))
+	http.HandleFunc("GET /api/v1/groups/{id}", withCORS(groupHandler))
+	http.HandleFunc("GET /ws/groups/{id}", withCORS(groupWSHandler))
+	http.HandleFunc("GET /ws/jobs", withCORS(jobsWSHandler))
+	http.HandleFunc("GET /api/v1/jobs/{id}", withCORS(jobStatusHandler))
+	http.HandleFunc("GET /api/v1/jobs/{id}/events", withCORS(jobEventsHandler))
+	http.HandleFunc("GET /api/v1/jobs/{id}/mesh.stl", withCORS(jobMeshHandler))
+	http.HandleFunc("GET /api/v1/jobs/{id}/bundle.zip", withCORS(jobBundleHandler))
+	http.HandleFunc("GET /api/v1/models/{hash}", withCORS(modelHandler))
+	http.HandleFunc("GET /api/v1/models/{hash}/renders", withCORS(modelRendersHandler))
+	http.HandleFunc("/api/v1/nest", withCORS(nestHandler))
+	http.HandleFunc("/api/v1/convert", withCORS(convertHandler))
+	http.HandleFunc("/api/v1/labels", withCORS(labelHandler))
+	http.HandleFunc("/api/v1/compose", withCORS(composeHandler))
+	http.HandleFunc("/api/v1/scenes", withCORS(sceneHandler))
+	http.HandleFunc("GET /admin/queue", requireAdmin(queueStatusHandler))
+	http.HandleFunc("POST /admin/queue/pause", requireAdmin(pauseQueueHandler))
+	http.HandleFunc("POST /admin/queue/resume", requireAdmin(resumeQueueHandler))
+	http.HandleFunc("GET /admin/analytics", requireAdmin(analyticsHandler))
+	http.HandleFunc("GET /metrics", requireAdmin(metricsHandler))
+	for i := 0; i < workerCount(); i++ {
+		go processQueue(i < reservedWorkers())
+	}
+	go expireJobs()
+	go warmCache()
+	if config.Ingest.Source != "" {
+		src, err := newIngestSource(config.Ingest)
+		if err != nil {
+			log.Fatalf("Error setting up ingestion: %v", err)
+		}
+		go runIngest(src)
+	}
+	for _, cfg := range config.PrintHosts {
+		host, err := newPrintHost(cfg)
+		if err != nil {
+			log.Fatalf("Error setting up print host %s: %v", cfg.URL, err)
+		}
+		go watchPrintHost(host, cfg)
+	}
+	go runMaintenance()
+	go saveAnalyticsPeriodically()
 
-	// Static file server for PNG output and other static assets
-	http.Handle("/output/", http.StripPrefix("/output/", http.FileServer(http.Dir("output"))))
+	// Rendered PNG output, restricted to hash-named files
+	http.HandleFunc("/output/", outputHandler)
 
-	log.Println("Server started at http://localhost:8080")
-	log.Fatal(http.ListenAndServe("0.0.0.0:8080", nil))
+	server := &http.Server{Addr: "0.0.0.0:8080", Handler: withAccessLog(withTenants(withRoutePattern(http.DefaultServeMux)))}
+	go func() {
+		log.Println("Server started at http://localhost:8080")
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	drainOnSignal(server)
 }
 
 // Helper Functions
@@ -85,25 +254,165 @@ func saveFileHashes() error {
 	return ioutil.WriteFile(HashesFile, data, 0644)
 }
 
+// Output name recorded for a cache key by a finished render
+func lookupOutput(cacheKey string) (string, bool) {
+	if store != nil {
+		name, ok, err := store.LookupOutput(cacheKey)
+		if err != nil {
+			log.Printf("Failed to look up output: %v", err)
+		}
+		return name, ok
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	name, ok := fileHashes[cacheKey]
+	return name, ok
+}
+
+// Remember the output of a finished render
+func recordOutput(cacheKey, name string) {
+	if store != nil {
+		if err := store.RecordOutput(cacheKey, name); err != nil {
+			log.Printf("Failed to record output: %v", err)
+		}
+		return
+	}
+	mu.Lock()
+	fileHashes[cacheKey] = name
+	saveFileHashes()
+	mu.Unlock()
+}
+
 // Template handler
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	if err := tmpl.Execute(w, nil); err != nil {
-		http.Error(w, "Could not load template", http.StatusInternalServerError)
+	csrfToken, err := ensureCSRFToken(w, r)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Could not create session")
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+	if err := tmpl.Execute(w, newPageData(csrfToken, requestLocale(r), tenantOf(r.Context()))); err != nil {
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Could not load template")
 		log.Printf("Template execution error: %v", err)
 	}
 }
 
+// Returned by scanFile when an upload may not be used
+var (
+	errScanFailed  = withErrorCode(ErrScanUnavailable, errors.New("failed to scan file"))
+	errScanFlagged = withErrorCode(ErrVirusDetected, errors.New("file rejected by virus scan"))
+)
+
+// Scan a saved upload with the configured scanner, if any. Flagged files are
+// removed or quarantined.
+func scanFile(ctx context.Context, path, fileHash string) error {
+	if scanner == nil {
+		return nil
+	}
+	result, err := scanner.Scan(ctx, path)
+	if err != nil {
+		log.Printf("Failed to scan %s: %v", path, err)
+		return errScanFailed
+	}
+	if result.Infected {
+		log.Printf("Upload %s flagged by scanner (%s), action: %s", fileHash, result.Signature, config.Scanner.Action)
+		if err := handleFlaggedUpload(path, fmt.Sprintf("input-%s.stl", fileHash), config.Scanner); err != nil {
+			log.Printf("Failed to %s flagged upload %s: %v", config.Scanner.Action, path, err)
+		}
+		return errScanFlagged
+	}
+	return nil
+}
+
+// Scan a saved upload, answering the request with an error if it may not be
+// used; returns whether it may
+func scanUpload(w http.ResponseWriter, r *http.Request, path, fileHash string) bool {
+	switch scanFile(r.Context(), path, fileHash) {
+	case nil:
+		return true
+	case errScanFailed:
+		apiError(w, r, http.StatusServiceUnavailable, ErrScanUnavailable, "Failed to scan file")
+	default:
+		apiError(w, r, http.StatusUnprocessableEntity, ErrVirusDetected, "File rejected by virus scan")
+	}
+	return false
+}
+
+// Copy one file from a multipart upload to disk, returning its SHA-256
+func saveUploadPart(header *multipart.FileHeader, path string) (string, error) {
+	src, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer dst.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dst, hash), src); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), dst.Close()
+}
+
+// Read a multipart upload of at most config.MaxUploadMB. Answers 413 when it
+// is larger and 400 when it can't be read, and reports whether it was read.
+func parseUpload(w http.ResponseWriter, r *http.Request) bool {
+	if config.MaxUploadMB > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(config.MaxUploadMB)<<20)
+	}
+	if err := r.ParseMultipartForm(UploadMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			apiError(w, r, http.StatusRequestEntityTooLarge, ErrTooLarge, fmt.Sprintf("Uploads must be at most %d MB", config.MaxUploadMB))
+			return false
+		}
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Failed to read the upload")
+		return false
+	}
+	return true
+}
+
 // Check if a file already exists based on its hash
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		apiError(w, r, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Invalid request method")
+		return
+	}
+	defer trackUploadProgress(r)()
+	if !parseUpload(w, r) {
+		return
+	}
+
+	// Browsers on explicitly allowed CORS origins are trusted; everyone else needs the CSRF token
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+
+	opts, err := parseRenderOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	analysis, err := parseAnalysisOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if _, err := parseGroupID(r); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
 		return
 	}
 
 	// Parse uploaded file
-	file, _, err := r.FormFile("file")
+	file, header, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Failed to read file")
 		return
 	}
 	defer file.Close()
@@ -111,79 +420,224 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	// Calculate the SHA-256 hash of the file content
 	hash := sha256.New()
 	if _, err := io.Copy(hash, file); err != nil {
-		http.Error(w, "Failed to calculate file hash", http.StatusInternalServerError)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to calculate file hash")
 		return
 	}
 	fileHash := hex.EncodeToString(hash.Sum(nil))
 
-	// Check if this file hash already exists
-	mu.Lock()
-	outputFileName, exists := fileHashes[fileHash]
-	mu.Unlock()
+	// Reject truncated or corrupted uploads when the client told us what to expect
+	expectedHash := r.Header.Get("X-Content-SHA256")
+	if expectedHash == "" {
+		expectedHash = r.FormValue("sha256")
+	}
+	if expectedHash != "" && !strings.EqualFold(strings.TrimSpace(expectedHash), fileHash) {
+		apiError(w, r, http.StatusBadRequest, ErrChecksumMismatch, "Checksum mismatch")
+		return
+	}
 
-	if exists {
-		// File has already been processed, no need to reprocess
-		downloadLink := fmt.Sprintf("/output/%s", filepath.Base(outputFileName))
-		fmt.Fprintf(w, "This file has already been processed. <a href='%s'>Download the existing output here</a>", downloadLink)
+	// Point clouds and height maps are turned into a mesh once scanned
+	conv, err := uploadConverter(r, header.Filename)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	fileHash = convertedFileHash(fileHash, conv)
+
+	cacheKey := outputCacheKey(tenantOf(r.Context()), fileHash, opts, analysis)
+	if respondCached(w, r, cacheKey) {
+		return
+	}
+
+	// Save the file into the job's own scratch directory; it only moves to
+	// uploads/ once the render succeeds
+	workDir, err := newJobWorkDir()
+	if err != nil {
+		log.Printf("Failed to create work dir: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to save file")
 		return
 	}
+	keepWorkDir := false
+	defer func() {
+		if !keepWorkDir {
+			os.RemoveAll(workDir)
+		}
+	}()
+	stlPath := filepath.Join(workDir, "input.stl")
 
-	// Save the file to a unique path in the uploads folder
-	stlPath := filepath.Join("uploads", fmt.Sprintf("input-%s.stl", fileHash))
-	outputFileName = fmt.Sprintf("output-%s.png", fileHash)
+	inputPath := stlPath
+	if conv != nil {
+		inputPath = filepath.Join(workDir, "input."+conv.ext)
+	}
 
 	// Save the uploaded file
 	file.Seek(0, io.SeekStart)
 	fileBytes, err := ioutil.ReadAll(file)
 	if err != nil {
-		http.Error(w, "Failed to read file content", http.StatusInternalServerError)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to read file content")
 		return
 	}
-	err = ioutil.WriteFile(stlPath, fileBytes, 0644)
+	err = ioutil.WriteFile(inputPath, fileBytes, 0644)
 	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to save file")
 		return
 	}
 
-	// Delay job queuing until the WebSocket connection is established
-	fmt.Fprintf(w, "%d|%s|%s", time.Now().Unix(), stlPath, outputFileName) // Send job details to client
+	// Scan the upload before it can be queued
+	if !scanUpload(w, r, inputPath, fileHash) {
+		return
+	}
+	if conv != nil {
+		if err := conv.convert(inputPath, stlPath); err != nil {
+			apiError(w, r, http.StatusBadRequest, ErrUnsupportedFormat, "Failed to convert upload: "+err.Error())
+			return
+		}
+		os.Remove(inputPath)
+	}
+
+	keepWorkDir = submitRender(w, r, workDir, fileHash, opts, analysis, false)
 }
 
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// Answer a render request that needs no new job: the file was already
+// rendered with the same options, or the same render is queued or running.
+// Returns false if a job has to be created.
+func respondCached(w http.ResponseWriter, r *http.Request, cacheKey string) bool {
+	if outputFileName, exists := lookupOutput(cacheKey); exists {
+		// File has already been processed, no need to reprocess
+		downloadLink := outputURL(tenantOf(r.Context()), filepath.Base(outputFileName))
+		if wantsJSON(r) {
+			writeJSON(w, http.StatusOK, existingOutputResponse{Status: "exists", Output: downloadLink, Message: translate(requestLocale(r), "upload.exists")})
+			return true
+		}
+		fmt.Fprint(w, statusLinkMessage(requestLocale(r), "exists", "upload.exists", downloadLink, "upload.download_existing"))
+		return true
+	}
+
+	// Same render already queued or running: follow that job instead of enqueuing a duplicate
+	if id, ok := findInFlightJob(cacheKey); ok {
+		writeJobCreated(w, r, id)
+		return true
+	}
+	return false
+}
+
+// Register a render of the scanned model at input.stl in workDir and queue it
+// right away; clients follow progress over the WebSocket or by polling the job
+// API. offerMesh keeps the mesh for download even when the options leave it
+// unchanged, for generated models. Returns whether the queued job took over
+// the work dir.
+func submitRender(w http.ResponseWriter, r *http.Request, workDir, fileHash string, opts RenderOptions, analysis AnalysisOptions, offerMesh bool) bool {
+	priority, err := requestPriority(r)
 	if err != nil {
-		log.Println("WebSocket upgrade failed:", err)
-		return
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return false
 	}
-	defer conn.Close()
+	id, coalesced, err := queueRender(withPriority(r.Context(), priority), workDir, fileHash, opts, analysis, offerMesh, requestLocale(r))
+	if errors.Is(err, errQueueFull) {
+		respondQueueFull(w, r)
+		return false
+	}
+	if errors.Is(err, errTenantQuota) {
+		apiError(w, r, http.StatusTooManyRequests, ErrTenantQuota, "Too many jobs in progress, try again later")
+		return false
+	}
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to queue job")
+		return false
+	}
+
+	writeJobCreated(w, r, id)
+	return !coalesced
+}
 
-	// Read the job ID and paths from the WebSocket message
-	_, jobDetailsBytes, err := conn.ReadMessage()
+// Register and queue a render of input.stl in workDir for the context's
+// tenant. Returns the job ID and whether an identical job already in flight
+// was reused instead, in which case workDir is left to the caller.
+func queueRender(ctx context.Context, workDir, fileHash string, opts RenderOptions, analysis AnalysisOptions, offerMesh bool, lang string) (string, bool, error) {
+	tenant := tenantOf(ctx)
+	if err := checkTenantQuota(tenant); err != nil {
+		return "", false, err
+	}
+	stlPath := filepath.Join(workDir, "input.stl")
+	cacheKey := outputCacheKey(tenant, fileHash, opts, analysis)
+	outputNames := opts.outputNames(cacheKey)
+	job := &Job{STLPath: stlPath, OutputPath: outputNames[0], Outputs: outputNames, FileHash: fileHash, CacheKey: cacheKey, Options: opts, Analysis: analysis, Lang: lang, Tenant: tenant, WorkDir: workDir, Priority: priorityOf(ctx)}
+	if offerMesh || opts.processesMesh() {
+		job.MeshFile = meshName(cacheKey)
+	}
+	if config.Privacy {
+		removed, err := stripSTLMetadata(stlPath)
+		if err != nil {
+			return "", false, fmt.Errorf("failed to strip metadata: %w", err)
+		}
+		job.Stripped = removed
+	}
+	job.Sample = renderSampleFor(stlPath, opts)
+	job.Estimate = estimateRenderTime(job.Sample)
+	id, coalesced, err := registerJob(job)
 	if err != nil {
-		log.Println("Failed to read job details:", err)
+		return "", false, err
+	}
+	if !coalesced {
+		if err := enqueueJob(ctx, *job); err != nil {
+			log.Printf("Failed to queue job ID %s: %v\n", id, err)
+			failJob(id, errorCode(err, ErrInternal))
+			return "", false, err
+		}
+		publishJobEvent(JobCreatedEvent, *job)
+	}
+	return id, coalesced, nil
+}
+
+// Respond to an upload with its job. API clients get the job with its ETA;
+// the web UI only needs the token.
+func writeJobCreated(w http.ResponseWriter, r *http.Request, id string) {
+	noteRequestJob(r, id)
+	joinRequestGroup(r, id)
+	if wantsJSON(r) {
+		snapshot, _, _ := getJob(id)
+		writeJSON(w, http.StatusAccepted, newJobResponse(snapshot))
 		return
 	}
-	details := string(jobDetailsBytes)
-	parts := strings.Split(details, "|")
+	fmt.Fprint(w, id) // Only the opaque job token goes to the client
+}
 
-	// Ensure the message has at least 3 parts (jobID, stlPath, outputPath)
-	if len(parts) < 3 {
-		log.Println("Received invalid job details format:", details)
+func wsHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWS(w, r)
+	if err != nil {
+		log.Println("WebSocket upgrade failed:", err)
 		return
 	}
+	defer conn.Close()
 
-	jobID, _ := strconv.ParseInt(parts[0], 10, 64)
-	stlPath, outputPath := parts[1], parts[2]
+	// Read the job token from the WebSocket message
+	_, tokenBytes, err := conn.ReadMessage()
+	if err != nil {
+		log.Println("Failed to read job token:", err)
+		return
+	}
+	jobID := strings.TrimSpace(string(tokenBytes))
+	noteRequestJob(r, jobID)
 
-	// Register the WebSocket connection for the job ID
+	// Clients connecting with ?push_image=1 get the finished image over the socket
+	// and ?previews=1 get low-resolution frames while a spin renders
+	query := r.URL.Query()
 	mu.Lock()
-	jobConnections[jobID] = conn
+	if query.Get("push_image") == "1" {
+		imagePushConns[conn] = true
+	}
+	if query.Get("previews") == "1" {
+		previewConns[conn] = true
+	}
 	mu.Unlock()
 
-	log.Printf("WebSocket connection established for job ID: %d\n", jobID)
+	// Only jobs registered by the upload handler can be subscribed to
+	if !subscribeJob(r.Context(), jobID, conn) {
+		log.Println("Received unknown job token:", jobID)
+		removeConnection(jobID, conn)
+		return
+	}
 
-	// Queue the job for processing
-	queue <- Job{ID: jobID, STLPath: stlPath, OutputPath: outputPath}
+	log.Printf("WebSocket connection established for job ID: %s\n", jobID)
 
 	// Keep connection open until manually closed
 	for {
@@ -194,108 +648,114 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// If connection closes, log and remove from connections
-	mu.Lock()
-	delete(jobConnections, jobID)
-	mu.Unlock()
-	log.Printf("WebSocket connection closed for job ID: %d\n", jobID)
+	removeConnection(jobID, conn)
+	log.Printf("WebSocket connection closed for job ID: %s\n", jobID)
 }
 
+// Render jobs from the queue; interactiveOnly workers leave batch jobs to the
+// others
+func processQueue(interactiveOnly bool) {
+	for {
+		waitWhilePaused()
+		job, ok := dequeueJob(workerCtx, interactiveOnly)
+		if !ok {
+			if workerCtx.Err() != nil {
+				return
+			}
+			continue
+		}
+		log.Printf("Processing job ID: %s\n", job.ID)
 
-func processQueue() {
-	for job := range queue {
-		log.Printf("Processing job ID: %d\n", job.ID)
-
-		// Short delay to ensure WebSocket connection is established
-		time.Sleep(100 * time.Millisecond)
-		notifyClient(job.ID, "Processing your file...")
+		// Hold the job until other renders leave room for it in the memory
+		// budget. It counts as rendering meanwhile, so shutdown hands it back.
+		release, err := reserveMemory(workerCtx, estimateRenderMemory(job.Sample))
+		if err != nil {
+			finishRendering(job)
+			return // Shutting down; the job was handed back to the queue
+		}
+		updateJob(job.ID, JobProcessing)
 
 		// Render the STL to PNG
-		outputPath, err := renderSTLToPNG(job)
+		ctx, cancel := jobContext()
+		ctx = withTenant(ctx, job.Tenant)
+		started := time.Now()
+		render := renderSTLToPNG
+		if config.Sandbox.Enabled {
+			render = renderSandboxed
+		}
+		stats, err := render(ctx, job)
+		release()
+		finishRendering(job)
+		var outputPath string
+		var cids map[string]string
+		if err == nil {
+			outputPath, err = publishJobFiles(ctx, job)
+		}
+		if err == nil {
+			cids = jobCIDs(ctx, job)
+		}
+		cancel()
+		os.RemoveAll(job.WorkDir)
 		if err != nil {
+			if workerCtx.Err() != nil {
+				return // Shutting down; the job was handed back to the queue
+			}
 			log.Println("Failed to render STL:", err)
-			notifyClient(job.ID, "Failed to render file. Please try again.")
+			failJob(job.ID, renderErrorCode(err))
 			continue
 		}
 
-		// Store the file hash only after successful processing
-		fileHash := strings.TrimPrefix(filepath.Base(job.STLPath), "input-")
-		fileHash = strings.TrimSuffix(fileHash, ".stl")
+		setJobStats(job.ID, stats)
+		setJobCIDs(job.ID, cids)
 
-		mu.Lock()
-		fileHashes[fileHash] = filepath.Base(outputPath)
-		saveFileHashes()
-		mu.Unlock()
+		sample := job.Sample
+		sample.Seconds = time.Since(started).Seconds()
+		if err := recordRenderSample(sample); err != nil {
+			log.Printf("Failed to save render history: %v", err)
+		}
+
+		// Store the file hash only after successful processing
+		recordOutput(job.CacheKey, filepath.Base(outputPath))
+		if err := recordModelRender(withTenant(context.Background(), job.Tenant), job, stats); err != nil {
+			log.Printf("Failed to update model record: %v", err)
+		}
+		addRecentRender(job.Tenant, filepath.Base(outputPath))
 
-		// Send the rendering complete message with download link
-		downloadLink := fmt.Sprintf("/output/%s", filepath.Base(outputPath))
-		notifyClient(job.ID, fmt.Sprintf("Rendering complete! <a href='%s'>Download your image here</a>", downloadLink))
-		log.Printf("Completed job ID: %d\n", job.ID)
+		// Tell subscribers where to download the result
+		updateJob(job.ID, JobDone)
+		log.Printf("Completed job ID: %s\n", job.ID)
 	}
 }
 
+// Context a single render runs under: cancelled on shutdown, and after
+// config.RenderTimeoutSecs if set
+func jobContext() (context.Context, context.CancelFunc) {
+	if config.RenderTimeoutSecs > 0 {
+		return context.WithTimeout(workerCtx, time.Duration(config.RenderTimeoutSecs)*time.Second)
+	}
+	return context.WithCancel(workerCtx)
+}
 
-func notifyClient(jobID int64, message string) {
+func notifyClient(jobID string, message string) {
 	mu.Lock()
-	conn, ok := jobConnections[jobID]
+	conns := append([]*websocket.Conn(nil), jobConnections[jobID]...)
 	mu.Unlock()
 
-	if !ok {
-		log.Printf("No WebSocket connection found for job ID: %d\n", jobID)
+	if len(conns) == 0 {
+		log.Printf("No WebSocket connection found for job ID: %s\n", jobID)
 		return
 	}
 
-	err := conn.WriteMessage(websocket.TextMessage, []byte(message))
-	if err != nil {
-		log.Printf("Failed to send message to job ID %d: %v\n", jobID, err)
-
-		// Close the WebSocket connection if it's no longer active
-		conn.Close()
-
-		mu.Lock()
-		delete(jobConnections, jobID)
-		mu.Unlock()
-	} else {
-		log.Printf("Successfully sent message to job ID %d: %s\n", jobID, message)
-	}
-}
-
+	for _, conn := range conns {
+		err := conn.WriteMessage(websocket.TextMessage, reencodeEvent(wsVersion(conn), message))
+		if err != nil {
+			log.Printf("Failed to send message to job ID %s: %v\n", jobID, err)
 
-// Render STL to PNG using fauxgl
-func renderSTLToPNG(job Job) (string, error) {
-	reader, err := stl.ReadFile(job.STLPath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read STL file: %w", err)
-	}
-
-	mesh := fauxgl.NewEmptyMesh()
-	for _, triangle := range reader.Triangles {
-		v1 := fauxgl.Vector{float64(triangle.Vertices[0][0]), float64(triangle.Vertices[0][1]), float64(triangle.Vertices[0][2])}
-		v2 := fauxgl.Vector{float64(triangle.Vertices[1][0]), float64(triangle.Vertices[1][1]), float64(triangle.Vertices[1][2])}
-		v3 := fauxgl.Vector{float64(triangle.Vertices[2][0]), float64(triangle.Vertices[2][1]), float64(triangle.Vertices[2][2])}
-		mesh.Triangles = append(mesh.Triangles, fauxgl.NewTriangleForPoints(v1, v2, v3))
-	}
-	mesh.BiUnitCube()
-
-	context := fauxgl.NewContext(Width, Height)
-	context.ClearColorBufferWith(fauxgl.HexColor("#ffffff"))
-
-	eye := fauxgl.Vector{3, 3, 3}
-	center := fauxgl.Vector{0, 0, 0}
-	up := fauxgl.Vector{0, 0, 1}
-	matrix := fauxgl.LookAt(eye, center, up).Perspective(FOV, float64(Width)/float64(Height), 1, 10)
-	light := fauxgl.Vector{1, 1, 1}.Normalize()
-	shader := fauxgl.NewPhongShader(matrix, light, eye)
-	shader.ObjectColor = fauxgl.Gray(0.75)
-	shader.SpecularPower = 100
-	context.Shader = shader
-	context.DrawMesh(mesh)
-
-	outputPath := filepath.Join("output", job.OutputPath)
-	err = fauxgl.SavePNG(outputPath, context.Image())
-	if err != nil {
-		return "", fmt.Errorf("failed to save PNG file: %w", err)
+			// Close the WebSocket connection if it's no longer active
+			conn.Close()
+			removeConnection(jobID, conn)
+		} else {
+			log.Printf("Successfully sent message to job ID %s: %s\n", jobID, message)
+		}
 	}
-
-	return outputPath, nil
 }
-
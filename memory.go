@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	BytesPerTriangle = 1024 // Mesh with normals plus the copies mesh processing makes, per triangle
+	BytesPerPixel    = 64   // Color and depth buffers plus the encoded image, per pixel of one view
+)
+
+// Memory reserved by renders in progress on this instance, against
+// config.MemoryBudgetMB
+var (
+	memoryMu       sync.Mutex
+	memoryFreed    = sync.NewCond(&memoryMu)
+	memoryReserved int64
+)
+
+// Projected peak memory of a render. Views are rasterized one after another,
+// and larger ones in tiles, so only one tile's buffers count.
+func estimateRenderMemory(sample RenderSample) int64 {
+	pixels := int64(Width * Height)
+	if sample.Views > 0 {
+		pixels = min(int64(sample.Pixels/sample.Views), TileSize*TileSize)
+	}
+	return sample.FileSize + int64(sample.Triangles)*BytesPerTriangle + pixels*BytesPerPixel
+}
+
+// Reserve memory for a render, waiting while the renders in progress and this
+// one together would go over the budget. A render larger than the whole
+// budget still runs, once nothing else does. Returns a function that frees
+// the reservation, or ctx's error if it ends first.
+func reserveMemory(ctx context.Context, bytes int64) (func(), error) {
+	budget := int64(config.MemoryBudgetMB) << 20
+	if budget <= 0 {
+		return func() {}, nil
+	}
+
+	// Wake the wait below when ctx ends
+	stop := context.AfterFunc(ctx, func() {
+		memoryMu.Lock()
+		memoryFreed.Broadcast()
+		memoryMu.Unlock()
+	})
+	defer stop()
+
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+	for memoryReserved > 0 && memoryReserved+bytes > budget {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		memoryFreed.Wait()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	memoryReserved += bytes
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			memoryMu.Lock()
+			memoryReserved -= bytes
+			memoryMu.Unlock()
+			memoryFreed.Broadcast()
+		})
+	}, nil
+}
+
+// Memory currently reserved by renders, in bytes
+func reservedMemory() int64 {
+	memoryMu.Lock()
+	defer memoryMu.Unlock()
+	return memoryReserved
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/fogleman/fauxgl"
+)
+
+// Relative size below which a triangle counts as degenerate: its area is
+// under (DegenerateTolerance × bounding box diagonal)²
+const DegenerateTolerance = 1e-6
+
+const EdgeMarkerRadius = 0.005 // Thickness of highlighted edges, in bi-unit model space
+
+var (
+	issueColor       = fauxgl.HexColor("#e74c3c")
+	nonManifoldColor = fauxgl.HexColor("#d633c4")
+	holeColor        = fauxgl.HexColor("#f39c12")
+)
+
+// Broken triangles, as commonly left behind by bad exports
+type MeshIssues struct {
+	Degenerate int `json:"degenerate"` // Zero-area slivers and collapsed triangles
+	Duplicate  int `json:"duplicate"`  // Same corners as an earlier triangle, in either winding
+	Inverted   int `json:"inverted"`   // Wound against the rest of their connected surface
+
+	NonManifoldEdges int `json:"non_manifold_edges"`     // Edges shared by more than two triangles
+	Holes            int `json:"holes"`                  // Loops of edges with a triangle on one side only
+	HolesFilled      int `json:"holes_filled,omitempty"` // Holes closed by the fill_holes repair before measuring
+}
+
+// Edge between two welded vertices, lower ID first
+type meshEdge struct{ a, b int }
+
+// Triangle using an edge, and whether it runs the edge from a to b
+type edgeUse struct {
+	tri     int
+	forward bool
+}
+
+// Triangles welded by position, with their shared edges
+type meshTopology struct {
+	positions []fauxgl.Vector // By vertex ID
+	faces     [][3]int        // Vertex IDs per triangle; unused for skipped triangles
+	skipped   []bool          // Degenerate or duplicate triangles, left out of the edge graph
+	edges     map[meshEdge][]edgeUse
+}
+
+// Weld the mesh's vertices and index which triangles share each edge.
+// Degenerate and duplicate triangles are counted and left out.
+func buildTopology(mesh *fauxgl.Mesh) (*meshTopology, MeshIssues) {
+	var issues MeshIssues
+	box := mesh.BoundingBox()
+	eps := DegenerateTolerance * box.Max.Sub(box.Min).Length()
+	minArea2 := eps * eps * eps * eps // Squared cross product length
+
+	topo := &meshTopology{
+		faces:   make([][3]int, len(mesh.Triangles)),
+		skipped: make([]bool, len(mesh.Triangles)),
+		edges:   make(map[meshEdge][]edgeUse),
+	}
+	index := make(map[fauxgl.Vector]int)
+	vertexID := func(p fauxgl.Vector) int {
+		id, ok := index[p]
+		if !ok {
+			id = len(topo.positions)
+			index[p] = id
+			topo.positions = append(topo.positions, p)
+		}
+		return id
+	}
+
+	seen := make(map[[3]int]bool)
+	for i, t := range mesh.Triangles {
+		face := [3]int{vertexID(t.V1.Position), vertexID(t.V2.Position), vertexID(t.V3.Position)}
+		cross := t.V2.Position.Sub(t.V1.Position).Cross(t.V3.Position.Sub(t.V1.Position))
+		if face[0] == face[1] || face[1] == face[2] || face[0] == face[2] || cross.LengthSquared() <= minArea2 {
+			issues.Degenerate++
+			topo.skipped[i] = true
+			continue
+		}
+
+		key := face
+		if key[0] > key[1] {
+			key[0], key[1] = key[1], key[0]
+		}
+		if key[1] > key[2] {
+			key[1], key[2] = key[2], key[1]
+		}
+		if key[0] > key[1] {
+			key[0], key[1] = key[1], key[0]
+		}
+		if seen[key] {
+			issues.Duplicate++
+			topo.skipped[i] = true
+			continue
+		}
+		seen[key] = true
+
+		topo.faces[i] = face
+		for k := 0; k < 3; k++ {
+			a, b := face[k], face[(k+1)%3]
+			edge := meshEdge{a, b}
+			if a > b {
+				edge = meshEdge{b, a}
+			}
+			topo.edges[edge] = append(topo.edges[edge], edgeUse{tri: i, forward: a < b})
+		}
+	}
+	return topo, issues
+}
+
+// Find triangles wound against their neighbors. Each connected surface is
+// walked from one triangle, flipping the expected winding whenever two
+// neighbors run their shared edge the same way; whichever winding fewer
+// triangles of that surface have is taken to be the inverted one.
+func (topo *meshTopology) invertedTriangles() []bool {
+	neighbors := make([][]edgeUse, len(topo.faces)) // Adjacent triangle, and whether it agrees on the edge
+	for _, uses := range topo.edges {
+		for i := range uses {
+			for j := range uses {
+				if i != j {
+					agree := uses[i].forward != uses[j].forward
+					neighbors[uses[i].tri] = append(neighbors[uses[i].tri], edgeUse{tri: uses[j].tri, forward: agree})
+				}
+			}
+		}
+	}
+
+	inverted := make([]bool, len(topo.faces))
+	flipped := make([]bool, len(topo.faces))
+	visited := make([]bool, len(topo.faces))
+	for start := range topo.faces {
+		if visited[start] || topo.skipped[start] {
+			continue
+		}
+		component := []int{start}
+		visited[start] = true
+		for i := 0; i < len(component); i++ {
+			t := component[i]
+			for _, n := range neighbors[t] {
+				if visited[n.tri] {
+					continue
+				}
+				visited[n.tri] = true
+				flipped[n.tri] = flipped[t] != !n.forward
+				component = append(component, n.tri)
+			}
+		}
+
+		count := 0
+		for _, t := range component {
+			if flipped[t] {
+				count++
+			}
+		}
+		flippedAreInverted := count*2 < len(component)
+		for _, t := range component {
+			inverted[t] = flipped[t] == flippedAreInverted
+		}
+	}
+	return inverted
+}
+
+// Edges shared by more than two triangles, and edges with a triangle on one
+// side only
+func (topo *meshTopology) problemEdges() (nonManifold, boundary []meshEdge) {
+	for edge, uses := range topo.edges {
+		switch {
+		case len(uses) > 2:
+			nonManifold = append(nonManifold, edge)
+		case len(uses) == 1:
+			boundary = append(boundary, edge)
+		}
+	}
+	return nonManifold, boundary
+}
+
+// Number of separate loops the boundary edges form, i.e. holes in the surface
+func countHoles(boundary []meshEdge) int {
+	parent := make(map[int]int)
+	var find func(v int) int
+	find = func(v int) int {
+		p, ok := parent[v]
+		if !ok {
+			parent[v] = v
+			return v
+		}
+		if p == v {
+			return v
+		}
+		root := find(p)
+		parent[v] = root
+		return root
+	}
+	for _, e := range boundary {
+		if a, b := find(e.a), find(e.b); a != b {
+			parent[a] = b
+		}
+	}
+	loops := make(map[int]bool)
+	for _, e := range boundary {
+		loops[find(e.a)] = true
+	}
+	return len(loops)
+}
+
+// Count the mesh's broken triangles and edges, and flag the broken triangles
+func findMeshIssues(mesh *fauxgl.Mesh) (MeshIssues, []bool) {
+	topo, issues := buildTopology(mesh)
+	nonManifold, boundary := topo.problemEdges()
+	issues.NonManifoldEdges = len(nonManifold)
+	issues.Holes = countHoles(boundary)
+	problems := topo.invertedTriangles()
+	for i, bad := range problems {
+		if bad {
+			issues.Inverted++
+		}
+		if topo.skipped[i] {
+			problems[i] = true
+		}
+	}
+	return issues, problems
+}
+
+// Color flagged triangles red, on top of any analysis coloring, or of base
+// without one
+func colorProblemTriangles(mesh *fauxgl.Mesh, problems []bool, vertexColors bool, base fauxgl.Color) {
+	for i, t := range mesh.Triangles {
+		if !vertexColors {
+			t.V1.Color, t.V2.Color, t.V3.Color = base, base, base
+		}
+		if problems[i] {
+			t.V1.Color, t.V2.Color, t.V3.Color = issueColor, issueColor, issueColor
+		}
+	}
+}
+
+// Thin tubes along the mesh's non-manifold edges and hole rims, to draw over
+// the model. Expects the mesh already fitted to the bi-unit cube.
+func edgeMarkers(mesh *fauxgl.Mesh) []overlay {
+	topo, _ := buildTopology(mesh)
+	nonManifold, boundary := topo.problemEdges()
+	var overlays []overlay
+	for _, group := range []struct {
+		edges []meshEdge
+		color fauxgl.Color
+	}{{nonManifold, nonManifoldColor}, {boundary, holeColor}} {
+		if len(group.edges) == 0 {
+			continue
+		}
+		markers := fauxgl.NewEmptyMesh()
+		for _, e := range group.edges {
+			markers.Triangles = append(markers.Triangles, edgeTube(topo.positions[e.a], topo.positions[e.b], EdgeMarkerRadius)...)
+		}
+		overlays = append(overlays, overlay{mesh: markers, color: group.color})
+	}
+	return overlays
+}
+
+// Triangular prism of the given radius from a to b
+func edgeTube(a, b fauxgl.Vector, radius float64) []*fauxgl.Triangle {
+	axis := b.Sub(a).Normalize()
+	u := axis.Perpendicular().Normalize().MulScalar(radius)
+	v := axis.Cross(u)
+	var ring [3]fauxgl.Vector
+	for i := range ring {
+		angle := float64(i) * 2 * math.Pi / 3
+		ring[i] = u.MulScalar(math.Cos(angle)).Add(v.MulScalar(math.Sin(angle)))
+	}
+	var tris []*fauxgl.Triangle
+	for i := range ring {
+		p, q := ring[i], ring[(i+1)%3]
+		tris = append(tris,
+			fauxgl.NewTriangleForPoints(a.Add(p), a.Add(q), b.Add(q)),
+			fauxgl.NewTriangleForPoints(a.Add(p), b.Add(q), b.Add(p)))
+	}
+	return tris
+}
+
+// Close holes of up to maxEdges boundary edges with a fan of triangles around
+// the hole's centroid, wound to match the surrounding surface. Larger holes,
+// and rims that don't form a simple loop, are left open. Returns the number
+// of holes filled.
+func fillHoles(mesh *fauxgl.Mesh, maxEdges int) int {
+	topo, _ := buildTopology(mesh)
+	_, boundary := topo.problemEdges()
+
+	// The fill runs each rim edge opposite to the triangle that owns it
+	next := make(map[int][]int)
+	for _, e := range boundary {
+		from, to := e.b, e.a
+		if !topo.edges[e][0].forward {
+			from, to = e.a, e.b
+		}
+		next[from] = append(next[from], to)
+	}
+
+	// Walk from the lowest vertex IDs so repeated renders fill the same way
+	starts := make([]int, 0, len(next))
+	for v, outs := range next {
+		starts = append(starts, v)
+		sort.Ints(outs)
+	}
+	sort.Ints(starts)
+
+	filled := 0
+	for _, start := range starts {
+		var loop []int
+		closed := false
+		for v := start; len(loop) < maxEdges; {
+			outs := next[v]
+			if len(outs) == 0 {
+				break
+			}
+			loop = append(loop, v)
+			next[v] = outs[1:]
+			v = outs[0]
+			if v == start {
+				closed = true
+				break
+			}
+		}
+		if !closed || len(loop) < 3 {
+			continue
+		}
+
+		var centroid fauxgl.Vector
+		for _, v := range loop {
+			centroid = centroid.Add(topo.positions[v])
+		}
+		centroid = centroid.DivScalar(float64(len(loop)))
+		for i, v := range loop {
+			w := loop[(i+1)%len(loop)]
+			mesh.Triangles = append(mesh.Triangles, fauxgl.NewTriangleForPoints(topo.positions[v], topo.positions[w], centroid))
+		}
+		filled++
+	}
+	return filled
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the histogram buckets, in seconds and in bytes
+var (
+	durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	sizeBuckets     = []float64{100, 1000, 10_000, 100_000, 1_000_000, 10_000_000, 100_000_000}
+)
+
+// Requests answered so far, by route and status, for GET /metrics
+var httpMetrics = newRequestMetrics()
+
+type requestLabels struct {
+	route  string // Pattern of the handler, empty when none matched
+	status int
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	if i, _ := slices.BinarySearch(buckets, v); i < len(buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+type requestHistograms struct {
+	duration, requestSize, responseSize *histogram
+}
+
+type requestMetrics struct {
+	mu      sync.Mutex
+	byLabel map[requestLabels]*requestHistograms
+}
+
+func newRequestMetrics() *requestMetrics {
+	return &requestMetrics{byLabel: make(map[requestLabels]*requestHistograms)}
+}
+
+// Count an answered request
+func (m *requestMetrics) observe(route string, status int, duration time.Duration, in, out int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := requestLabels{route, status}
+	h, ok := m.byLabel[labels]
+	if !ok {
+		h = &requestHistograms{newHistogram(durationBuckets), newHistogram(sizeBuckets), newHistogram(sizeBuckets)}
+		m.byLabel[labels] = h
+	}
+	h.duration.observe(durationBuckets, duration.Seconds())
+	h.requestSize.observe(sizeBuckets, float64(in))
+	h.responseSize.observe(sizeBuckets, float64(out))
+}
+
+// Write the histograms in the Prometheus text format
+func (m *requestMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	labels := slices.SortedFunc(maps.Keys(m.byLabel), func(a, b requestLabels) int {
+		if c := strings.Compare(a.route, b.route); c != 0 {
+			return c
+		}
+		return a.status - b.status
+	})
+	families := []struct {
+		name, help string
+		buckets    []float64
+		pick       func(*requestHistograms) *histogram
+	}{
+		{"http_request_duration_seconds", "Time taken to answer requests.", durationBuckets,
+			func(h *requestHistograms) *histogram { return h.duration }},
+		{"http_request_size_bytes", "Bytes read of request bodies.", sizeBuckets,
+			func(h *requestHistograms) *histogram { return h.requestSize }},
+		{"http_response_size_bytes", "Bytes written of response bodies.", sizeBuckets,
+			func(h *requestHistograms) *histogram { return h.responseSize }},
+	}
+	for _, f := range families {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", f.name, f.help, f.name)
+		for _, l := range labels {
+			h := f.pick(m.byLabel[l])
+			route := l.route
+			if route == "" {
+				route = "none"
+			}
+			common := fmt.Sprintf(`route="%s",status="%d"`, labelEscaper.Replace(route), l.status)
+			var cumulative uint64
+			for i, le := range f.buckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", f.name, common, strconv.FormatFloat(le, 'g', -1, 64), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", f.name, common, h.count)
+			fmt.Fprintf(w, "%s_sum{%s} %s\n", f.name, common, strconv.FormatFloat(h.sum, 'g', -1, 64))
+			fmt.Fprintf(w, "%s_count{%s} %d\n", f.name, common, h.count)
+		}
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Note the pattern of the handler that answered a request, for its metrics.
+// Wraps the mux itself, since the request the mux sets it on is the one it
+// is handed.
+func withRoutePattern(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+		if entry, ok := r.Context().Value(accessContextKey{}).(*accessEntry); ok {
+			entry.route = r.Pattern
+		}
+	})
+}
+
+// GET /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	httpMetrics.write(w)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestMetrics(t *testing.T) {
+	saved := httpMetrics
+	httpMetrics = newRequestMetrics()
+	t.Cleanup(func() { httpMetrics = saved })
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	mux.HandleFunc("POST /upload", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	handler := withAccessLog(withRoutePattern(mux))
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/v1/jobs/a", nil),
+		httptest.NewRequest(http.MethodGet, "/api/v1/jobs/b", nil),
+		httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(strings.Repeat("x", 2000))),
+		httptest.NewRequest(http.MethodGet, "/missing", nil),
+	}
+	for _, r := range requests {
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE http_request_duration_seconds histogram\n",
+		`http_request_duration_seconds_count{route="GET /api/v1/jobs/{id}",status="200"} 2` + "\n",
+		`http_response_size_bytes_bucket{route="GET /api/v1/jobs/{id}",status="200",le="100"} 2` + "\n",
+		`http_response_size_bytes_sum{route="GET /api/v1/jobs/{id}",status="200"} 10` + "\n",
+		`http_request_size_bytes_bucket{route="POST /upload",status="202",le="1000"} 0` + "\n",
+		`http_request_size_bytes_bucket{route="POST /upload",status="202",le="10000"} 1` + "\n",
+		`http_request_size_bytes_bucket{route="POST /upload",status="202",le="+Inf"} 1` + "\n",
+		`http_request_duration_seconds_count{route="none",status="404"} 1` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %q", want)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	MigrateSubcommand = "migrate"   // First argument that imports file_hashes.json into the job store instead of serving
+	MigratedSuffix    = ".migrated" // Added to file_hashes.json once imported, so it's imported only once
+	MigratedJobPrefix = "migrated|" // Hashed with a cache key into the ID of its synthesized job
+)
+
+// What importing the legacy index did
+type migrationResult struct {
+	Imported int // Cache keys added to the job store, each with a synthesized job
+	Skipped  int // Already in the job store, from a render since the upgrade or an earlier import
+}
+
+// Import file_hashes.json into the job store on startup in stateless mode,
+// then rename it, so instances upgraded from local mode keep serving what
+// they already rendered
+func migrateLegacyHashes() {
+	if _, err := os.Stat(HashesFile); err != nil {
+		return
+	}
+	result, err := importFileHashes(context.Background(), false)
+	if err != nil {
+		log.Printf("Failed to import %s, will retry on next start: %v", HashesFile, err)
+		return
+	}
+	if err := os.Rename(HashesFile, HashesFile+MigratedSuffix); err != nil {
+		log.Printf("Failed to rename %s: %v", HashesFile, err)
+	}
+	log.Printf("Imported %d renders from %s into the job store, %d were already there", result.Imported, HashesFile, result.Skipped)
+}
+
+// Import every cache key of file_hashes.json missing from the job store, with
+// a finished job per key as if it had rendered there. Jobs take the options,
+// stats, and outputs of the model record in storage when there is one.
+// Repeating an import changes nothing, since job IDs follow from cache keys.
+func importFileHashes(ctx context.Context, dryRun bool) (migrationResult, error) {
+	var result migrationResult
+	data, err := os.ReadFile(HashesFile)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	var legacy map[string]string
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return result, err
+	}
+
+	keys := make([]string, 0, len(legacy))
+	for key := range legacy {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, ok, err := store.LookupOutput(key); err != nil {
+			return result, err
+		} else if ok {
+			result.Skipped++
+			continue
+		}
+		if dryRun {
+			result.Imported++
+			continue
+		}
+		if err := store.SaveJob(migratedJob(ctx, key, legacy[key])); err != nil {
+			return result, err
+		}
+		if err := store.RecordOutput(key, legacy[key]); err != nil {
+			return result, err
+		}
+		result.Imported++
+	}
+	return result, nil
+}
+
+// Finished job standing in for the render that produced a legacy cache entry
+func migratedJob(ctx context.Context, cacheKey, output string) Job {
+	sum := sha256.Sum256([]byte(MigratedJobPrefix + cacheKey))
+	fileHash, _, _ := strings.Cut(cacheKey, "-")
+	job := Job{
+		ID:         hex.EncodeToString(sum[:16]),
+		OutputPath: output,
+		Outputs:    []string{output},
+		FileHash:   fileHash,
+		CacheKey:   cacheKey,
+		Status:     JobDone,
+	}
+	// Tenants' cache keys don't start with the file hash, so their renders
+	// are imported without a record
+	if record, err := loadModelRecord(ctx, fileHash); err == nil && record != nil {
+		for _, render := range record.Renders {
+			if render.CacheKey == cacheKey {
+				job.Options, job.Outputs, job.MeshFile, job.CreatedAt = render.Options, render.Outputs, render.Mesh, render.RenderedAt
+				stats := render.Stats
+				job.Stats = &stats
+			}
+		}
+	}
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = time.Now()
+		if info, err := storage.Stat(ctx, outputObject(output)); err == nil {
+			job.CreatedAt = info.ModTime
+		}
+	}
+	job.StartedAt, job.UpdatedAt = job.CreatedAt, job.CreatedAt
+	event := statusEvent(&job)
+	job.Message = string(encodeEvent(WSDefaultVersion, event))
+	event.V = WSDefaultVersion
+	job.Events = []jobEvent{{Time: job.UpdatedAt, wsEvent: event}} // Dated like the render, unlike appendJobEvent
+	return job
+}
+
+// Import file_hashes.json into the configured job store ahead of switching to
+// stateless mode, or to check what an upgrade would import
+func runMigrate(args []string) int {
+	flags := flag.NewFlagSet(MigrateSubcommand, flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "count what would be imported without writing anything")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if err := loadConfig(); err != nil {
+		log.Printf("Error loading config: %v", err)
+		return 1
+	}
+	var err error
+	if storage, err = newStorage(config.Storage); err != nil {
+		log.Printf("Error configuring storage: %v", err)
+		return 1
+	}
+	ctx := context.Background()
+	if err := setupEncryption(ctx, config.Encryption); err != nil {
+		log.Printf("Error configuring encryption: %v", err)
+		return 1
+	}
+	if err := connectJobStore(); err != nil {
+		log.Printf("Error connecting to the job store: %v", err)
+		return 1
+	}
+	if err := loadCatalogs(); err != nil {
+		log.Printf("Error loading message catalogs: %v", err)
+		return 1
+	}
+
+	result, err := importFileHashes(ctx, *dryRun)
+	if err != nil {
+		log.Printf("Error importing %s: %v", HashesFile, err)
+		return 1
+	}
+	verb := "Imported"
+	if *dryRun {
+		verb = "Would import"
+	} else if err := os.Rename(HashesFile, HashesFile+MigratedSuffix); err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to rename %s: %v", HashesFile, err)
+	}
+	fmt.Printf("%s %d renders from %s; %d were already in the job store\n", verb, result.Imported, HashesFile, result.Skipped)
+	return 0
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const ModelTemplate = "templates/model.html" // Permalink page for one uploaded model
+
+var (
+	fileHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	modelTmpl       *template.Template
+	modelMu         sync.Mutex // Serializes read-modify-write of model records on this instance
+)
+
+// Everything rendered from one uploaded file. Kept in storage next to the
+// outputs, so permalinks work on any instance and long after the jobs expire.
+type modelRecord struct {
+	FileHash  string           `json:"file_hash"`
+	Renders   []modelRender    `json:"renders"` // Oldest first
+	Bookmarks []CameraBookmark `json:"bookmarks,omitempty"`
+}
+
+// One finished render of a model
+type modelRender struct {
+	CacheKey   string        `json:"cache_key"`
+	Options    RenderOptions `json:"options"`
+	Outputs    []string      `json:"outputs"` // Output file names, primary first
+	Mesh       string        `json:"mesh,omitempty"`
+	Stats      ModelStats    `json:"stats"`
+	RenderedAt time.Time     `json:"rendered_at"`
+}
+
+// Name of a model's record in storage
+func modelObject(fileHash string) string {
+	return "models/" + fileHash + ".json"
+}
+
+// Permalink path of a model
+func modelPermalink(tenant, fileHash string) string {
+	return tenantURL(tenant, "/m/"+fileHash)
+}
+
+// Read a model's record; nil if nothing was rendered from it yet
+func loadModelRecord(ctx context.Context, fileHash string) (*modelRecord, error) {
+	file, err := storage.Open(ctx, modelObject(fileHash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var record modelRecord
+	if err := json.NewDecoder(file).Decode(&record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// Add a finished job to its model's record, replacing an earlier render with
+// the same options
+func recordModelRender(ctx context.Context, job Job, stats ModelStats) error {
+	modelMu.Lock()
+	defer modelMu.Unlock()
+
+	record, err := loadModelRecord(ctx, job.FileHash)
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		record = &modelRecord{FileHash: job.FileHash}
+	}
+	render := modelRender{CacheKey: job.CacheKey, Options: job.Options, Outputs: job.Outputs, Mesh: job.MeshFile, Stats: stats, RenderedAt: time.Now()}
+	for i, existing := range record.Renders {
+		if existing.CacheKey == job.CacheKey {
+			record.Renders = append(record.Renders[:i], record.Renders[i+1:]...)
+			break
+		}
+	}
+	record.Renders = append(record.Renders, render)
+	return saveModelRecord(ctx, record)
+}
+
+// Write a model's record to storage; callers hold modelMu
+func saveModelRecord(ctx context.Context, record *modelRecord) error {
+	tmp, err := os.CreateTemp(config.WorkDir, "model-*.json")
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(tmp).Encode(record)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = storage.Publish(ctx, tmp.Name(), modelObject(record.FileHash))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Render shown on the permalink page: the newest one with an image output
+func (m *modelRecord) featured() *modelRender {
+	for i := len(m.Renders) - 1; i >= 0; i-- {
+		if pushableOutput(m.Renders[i].Outputs[0]) {
+			return &m.Renders[i]
+		}
+	}
+	return &m.Renders[len(m.Renders)-1]
+}
+
+// Everything the model page template can use
+type ModelPageData struct {
+	PageData
+	Hash        string
+	Image       string     // URL of the featured render
+	Stats       ModelStats // Measured by the featured render
+	Downloads   []string   // URLs of every output rendered from this model
+	Description string     // One-line summary for link previews
+	PageURL     string     // Absolute URLs, for OpenGraph tags
+	ImageURL    string     // Social card, see ogImageHandler
+	Bookmarks   []CameraBookmark
+}
+
+// Absolute URL of a path on this server, as the client reached it
+func absoluteURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
+
+// GET /m/{hash}
+func modelPageHandler(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if !fileHashPattern.MatchString(hash) {
+		notFound(w, r)
+		return
+	}
+	record, err := loadModelRecord(r.Context(), hash)
+	if err != nil {
+		log.Printf("Failed to load model %s: %v", hash, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+		return
+	}
+	if record == nil || len(record.Renders) == 0 {
+		notFound(w, r)
+		return
+	}
+
+	csrfToken, err := ensureCSRFToken(w, r)
+	if err != nil {
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Could not create session")
+		return
+	}
+	lang := requestLocale(r)
+	tenant := tenantOf(r.Context())
+	featured := record.featured()
+	data := ModelPageData{
+		PageData:  newPageData(csrfToken, lang, tenant),
+		Hash:      hash,
+		Image:     outputURL(tenant, featured.Outputs[0]),
+		Stats:     featured.Stats,
+		PageURL:   absoluteURL(r, modelPermalink(tenant, hash)),
+		Bookmarks: record.Bookmarks,
+	}
+	data.ImageURL = absoluteURL(r, tenantURL(tenant, "/og/"+hash+".png"))
+	for _, render := range record.Renders {
+		for _, name := range render.Outputs {
+			data.Downloads = append(data.Downloads, outputURL(tenant, name))
+		}
+		if render.Mesh != "" {
+			data.Downloads = append(data.Downloads, outputURL(tenant, render.Mesh))
+		}
+	}
+	d := featured.Stats.Dimensions
+	data.Description = fmt.Sprintf("%.1f × %.1f × %.1f %s · %d %s", d.X, d.Y, d.Z, featured.Stats.Units, featured.Stats.Triangles, translate(lang, "model.triangles"))
+
+	w.Header().Add("Vary", "Accept-Language")
+	if err := modelTmpl.Execute(w, data); err != nil {
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Could not load template")
+		log.Printf("Template execution error: %v", err)
+	}
+}
+
+// POST /m/{hash}/render
+//
+// Render the stored upload again with new options, answering like /upload.
+// bookmark names a saved camera view to render from instead of view_*.
+func modelRenderHandler(w http.ResponseWriter, r *http.Request) {
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+	hash := r.PathValue("hash")
+	if !fileHashPattern.MatchString(hash) {
+		notFound(w, r)
+		return
+	}
+	renderStoredModel(w, r, hash)
+}
+
+// Queue a render of a stored upload with the request's options, answering
+// like /upload
+func renderStoredModel(w http.ResponseWriter, r *http.Request, hash string) {
+	opts, err := parseRenderOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	analysis, err := parseAnalysisOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if _, err := parseGroupID(r); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if name := r.FormValue("bookmark"); name != "" {
+		record, err := loadModelRecord(r.Context(), hash)
+		if err != nil {
+			log.Printf("Failed to load model %s: %v", hash, err)
+			apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+			return
+		}
+		var bookmark CameraBookmark
+		ok := false
+		if record != nil {
+			bookmark, ok = record.bookmark(name)
+		}
+		if !ok {
+			apiError(w, r, http.StatusNotFound, ErrNotFound, "Bookmark not found")
+			return
+		}
+		if opts.Frames > 0 {
+			apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "bookmark can't be combined with frames")
+			return
+		}
+		opts.View = &bookmark.View
+	}
+	if respondCached(w, r, outputCacheKey(tenantOf(r.Context()), hash, opts, analysis)) {
+		return
+	}
+
+	// The stored upload was scanned when it first came in
+	workDir, err := fetchUpload(r.Context(), hash)
+	if errors.Is(err, os.ErrNotExist) {
+		apiError(w, r, http.StatusNotFound, ErrNotFound, "Model not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch upload %s: %v", hash, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+		return
+	}
+	if !submitRender(w, r, workDir, hash, opts, analysis, false) {
+		os.RemoveAll(workDir)
+	}
+}
+
+// One entry of a model's render index, with download URLs
+type modelRenderResponse struct {
+	CacheKey   string        `json:"cache_key"`
+	Options    RenderOptions `json:"options"`
+	Outputs    []string      `json:"outputs"`
+	Mesh       string        `json:"mesh,omitempty"`
+	Stats      ModelStats    `json:"stats"`
+	RenderedAt time.Time     `json:"rendered_at"`
+}
+
+// GET /api/v1/models/{hash}/renders
+//
+// Every render stored for a model, oldest first, so clients can pick an
+// existing output before asking for a new one.
+func modelRendersHandler(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if !fileHashPattern.MatchString(hash) {
+		notFound(w, r)
+		return
+	}
+	record, err := loadModelRecord(r.Context(), hash)
+	if err != nil {
+		log.Printf("Failed to load model %s: %v", hash, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+		return
+	}
+	if record == nil {
+		apiError(w, r, http.StatusNotFound, ErrNotFound, "Model not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, modelRenderResponses(tenantOf(r.Context()), record))
+}
+
+func modelRenderResponses(tenant string, record *modelRecord) []modelRenderResponse {
+	renders := make([]modelRenderResponse, 0, len(record.Renders))
+	for _, render := range record.Renders {
+		resp := modelRenderResponse{CacheKey: render.CacheKey, Options: render.Options, Stats: render.Stats, RenderedAt: render.RenderedAt}
+		for _, name := range render.Outputs {
+			resp.Outputs = append(resp.Outputs, outputURL(tenant, name))
+		}
+		if render.Mesh != "" {
+			resp.Mesh = outputURL(tenant, render.Mesh)
+		}
+		renders = append(renders, resp)
+	}
+	return renders
+}
+
+// What the server already has of a model
+type modelResponse struct {
+	Hash    string                `json:"hash"`
+	Size    int64                 `json:"size"`       // Bytes of the stored upload
+	Render  string                `json:"render_url"` // Where to ask for new renders without uploading again
+	Renders []modelRenderResponse `json:"renders"`
+}
+
+// GET and HEAD /api/v1/models/{hash}
+//
+// Check whether a file is already stored before uploading it: 404 if not,
+// otherwise its stored renders with the options each was made with. The
+// headers carry the gist for HEAD requests, which get no body.
+func modelHandler(w http.ResponseWriter, r *http.Request) {
+	hash := r.PathValue("hash")
+	if !fileHashPattern.MatchString(hash) {
+		notFound(w, r)
+		return
+	}
+	info, err := storage.Stat(r.Context(), uploadObject(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		apiError(w, r, http.StatusNotFound, ErrNotFound, "Model not found")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to look up upload %s: %v", hash, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+		return
+	}
+	record, err := loadModelRecord(r.Context(), hash)
+	if err != nil {
+		log.Printf("Failed to load model %s: %v", hash, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+		return
+	}
+
+	tenant := tenantOf(r.Context())
+	resp := modelResponse{Hash: hash, Size: info.Size, Render: modelPermalink(tenant, hash) + "/render", Renders: []modelRenderResponse{}}
+	if record != nil {
+		resp.Renders = modelRenderResponses(tenant, record)
+	}
+	w.Header().Set("Link", "<"+resp.Render+`>; rel="render"`)
+	w.Header().Set("X-Model-Renders", strconv.Itoa(len(resp.Renders)))
+	w.Header().Set("Access-Control-Expose-Headers", "Link, X-Model-Renders")
+	writeJSON(w, http.StatusOK, resp)
+}
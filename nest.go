@@ -0,0 +1,229 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	MaxNestModels = 20       // Most files accepted by one nesting request
+	NestSpacing   = 5.0      // Gap between models on the plate, in mm
+	MaxNestUpload = 64 << 20 // Multipart memory limit for nesting uploads
+)
+
+// Colors cycled through to tell nested models apart
+var nestPalette = []string{"#4e79a7", "#f28e2b", "#59a14f", "#e15759", "#76b7b2", "#edc948", "#b07aa1", "#ff9da7"}
+
+type nestPlacement struct {
+	File      string  `json:"file"`
+	Placed    bool    `json:"placed"`
+	ErrorCode string  `json:"error_code,omitempty"` // Why the file couldn't be used, when it couldn't
+	Message   string  `json:"message,omitempty"`    // Human-readable reason, in English
+	X         float64 `json:"x"`                    // Front-left corner on the bed, in mm
+	Y         float64 `json:"y"`
+	Width     float64 `json:"width"` // Footprint on the bed, in mm
+	Depth     float64 `json:"depth"`
+	Height    float64 `json:"height"`
+	Rotated   bool    `json:"rotated"` // Turned 90° about Z to fit
+}
+
+type nestResponse struct {
+	Printer    string          `json:"printer"`
+	Fits       bool            `json:"fits"`   // Every model was placed
+	Failed     int             `json:"failed"` // Files that couldn't be used, left off the plate
+	Placements []nestPlacement `json:"placements"`
+	Image      string          `json:"image"` // Top-down render of the plate
+}
+
+// Pack bounding boxes onto the bed in shelves: tallest footprint first, left
+// to right, starting a new row when one fills up. Each box is turned so its
+// long side runs along X.
+func packShelves(items []nestPlacement, bedX, bedY, bedZ float64) {
+	for i := range items {
+		if items[i].Depth > items[i].Width {
+			items[i].Width, items[i].Depth = items[i].Depth, items[i].Width
+			items[i].Rotated = !items[i].Rotated
+		}
+	}
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return items[order[a]].Depth > items[order[b]].Depth })
+
+	var x, y, shelf float64
+	for _, i := range order {
+		it := &items[i]
+		if it.ErrorCode != "" || it.Height > bedZ || it.Width > bedX {
+			continue
+		}
+		if x > 0 && x+it.Width > bedX {
+			x, y, shelf = 0, y+shelf+NestSpacing, 0
+		}
+		if y+it.Depth > bedY {
+			continue
+		}
+		it.Placed, it.X, it.Y = true, x, y
+		x += it.Width + NestSpacing
+		shelf = math.Max(shelf, it.Depth)
+	}
+}
+
+// POST /api/v1/nest with several file fields and a printer name. Lays the
+// models out on that printer's bed and renders the plate from above.
+func nestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, r, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Invalid request method")
+		return
+	}
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+	if err := r.ParseMultipartForm(MaxNestUpload); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Failed to read files")
+		return
+	}
+
+	printer, ok := findPrinter(r.FormValue("printer"))
+	if !ok {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Unknown printer")
+		return
+	}
+	analysis, err := parseAnalysisOptions(r)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	headers := r.MultipartForm.File["file"]
+	if len(headers) == 0 || len(headers) > MaxNestModels {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, fmt.Sprintf("Send between 1 and %d files", MaxNestModels))
+		return
+	}
+
+	workDir, err := newJobWorkDir()
+	if err != nil {
+		log.Printf("Failed to create work dir: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to save files")
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	// Save, scan, and load every model in mm, resting on the plate. Files that
+	// are flagged or unreadable are listed with why, and the rest still nested.
+	key := sha256.New()
+	fmt.Fprintf(key, "%s %g %g %g %s\n", printer.Name, printer.BedX, printer.BedY, printer.BedZ, analysis.Units)
+	meshes := make([]*fauxgl.Mesh, len(headers))
+	items := make([]nestPlacement, len(headers))
+	for i, header := range headers {
+		path := filepath.Join(workDir, fmt.Sprintf("model-%d.stl", i))
+		fileHash, err := saveUploadPart(header, path)
+		if err != nil {
+			apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to save file")
+			return
+		}
+		fmt.Fprintln(key, fileHash)
+		items[i].File = header.Filename
+		switch err := scanFile(r.Context(), path, fileHash); err {
+		case nil:
+		case errScanFailed:
+			items[i].ErrorCode, items[i].Message = ErrScanUnavailable, "Failed to scan file"
+			continue
+		default:
+			items[i].ErrorCode, items[i].Message = errorCode(err, ErrInternal), "File rejected by virus scan"
+			continue
+		}
+
+		mesh, err := loadMesh(path)
+		if err != nil {
+			items[i].ErrorCode, items[i].Message = ErrUnsupportedFormat, fmt.Sprintf("Failed to read %s", header.Filename)
+			continue
+		}
+		size := mesh.BoundingBox().Size()
+		units, _ := resolveUnits(analysis.Units, Dimensions{size.X, size.Y, size.Z})
+		mesh.Transform(fauxgl.Scale(fauxgl.Vector{1, 1, 1}.MulScalar(unitScales[units])))
+		box := mesh.BoundingBox()
+		mesh.Transform(fauxgl.Translate(box.Min.Negate()))
+		size = box.Size()
+
+		meshes[i] = mesh
+		items[i] = nestPlacement{File: header.Filename, Width: size.X, Depth: size.Y, Height: size.Z}
+	}
+
+	packShelves(items, printer.BedX, printer.BedY, printer.BedZ)
+	resp := nestResponse{Printer: printer.Name, Fits: true, Placements: items}
+	for _, it := range items {
+		if !it.Placed {
+			resp.Fits = false
+		}
+		if it.ErrorCode != "" {
+			resp.Failed++
+		}
+	}
+
+	name := fmt.Sprintf("nest-%s.png", hex.EncodeToString(key.Sum(nil)))
+	resp.Image = outputURL(tenantOf(r.Context()), name)
+	exists, err := storage.Exists(r.Context(), outputObject(name))
+	if err != nil {
+		log.Printf("Failed to look up nesting preview: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to render plate")
+		return
+	}
+	if !exists {
+		tmpPath := filepath.Join(workDir, name)
+		if err := saveImage(tmpPath, renderNest(meshes, items, printer), "png"); err != nil {
+			log.Printf("Failed to render nesting preview: %v", err)
+			apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to render plate")
+			return
+		}
+		if err := storage.Publish(r.Context(), tmpPath, outputObject(name)); err != nil {
+			log.Printf("Failed to publish nesting preview: %v", err)
+			apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to render plate")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Top-down view of the packed plate: placed models in distinct colors inside
+// the bed outline
+func renderNest(meshes []*fauxgl.Mesh, items []nestPlacement, printer PrinterProfile) image.Image {
+	// Center the bed on the origin and scale its long side to the bi-unit cube
+	scale := 2 / math.Max(printer.BedX, printer.BedY)
+	plate := fauxgl.NewEmptyMesh()
+	for i, mesh := range meshes {
+		it := items[i]
+		if !it.Placed {
+			continue
+		}
+		if it.Rotated {
+			// Turn 90° about Z, keeping the footprint's corner at the origin
+			mesh.Transform(fauxgl.Rotate(fauxgl.Vector{0, 0, 1}, fauxgl.Radians(90)).Translate(fauxgl.Vector{it.Width, 0, 0}))
+		}
+		mesh.Transform(fauxgl.Translate(fauxgl.Vector{it.X - printer.BedX/2, it.Y - printer.BedY/2, 0}).Scale(fauxgl.Vector{scale, scale, scale}))
+		mesh.SetColor(fauxgl.HexColor(nestPalette[i%len(nestPalette)]))
+		plate.Add(mesh)
+	}
+
+	sc := &scene{mesh: plate, vertexColors: true}
+	outline := bedOutline(fauxgl.Vector{}, printer.BedX*scale, printer.BedY*scale)
+	sc.overlays = append(sc.overlays, overlay{mesh: outline, color: fauxgl.HexColor("#555555"), translucent: true})
+
+	top := camera{
+		eye:    fauxgl.Vector{0, 0, 4},
+		center: fauxgl.Vector{0, 0, 0},
+		up:     fauxgl.Vector{0, 1, 0},
+	}
+	return renderView(sc, top, Width, Height)
+}
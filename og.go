@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/fogleman/fauxgl"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/webp"
+)
+
+// Social card size recommended by OpenGraph and Twitter
+const (
+	OGWidth   = 1200
+	OGHeight  = 630
+	OGPadding = 40
+)
+
+var (
+	ogFontsOnce sync.Once
+	ogTitleFace font.Face // Bold, for the title
+	ogTextFace  font.Face // Regular, for the measurements
+	ogFontsErr  error
+)
+
+// Name of a model's cached social card
+func ogName(fileHash string) string {
+	return fmt.Sprintf("og-%s.png", fileHash)
+}
+
+// GET /og/{hash}.png
+//
+// Social card for a model page: the featured render next to the model's
+// dimensions. Generated on first request and then served like any output.
+func ogImageHandler(w http.ResponseWriter, r *http.Request) {
+	hash, ok := strings.CutSuffix(r.PathValue("file"), ".png")
+	if !ok || !fileHashPattern.MatchString(hash) {
+		notFound(w, r)
+		return
+	}
+	name := ogName(hash)
+	exists, err := storage.Exists(r.Context(), outputObject(name))
+	if err != nil {
+		log.Printf("Failed to look up social card %s: %v", name, err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load card")
+		return
+	}
+	if !exists {
+		record, err := loadModelRecord(r.Context(), hash)
+		if err != nil {
+			log.Printf("Failed to load model %s: %v", hash, err)
+			apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+			return
+		}
+		if record == nil || len(record.Renders) == 0 {
+			notFound(w, r)
+			return
+		}
+		if err := publishOGImage(r.Context(), record, name); err != nil {
+			log.Printf("Failed to create social card %s: %v", name, err)
+			apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to create card")
+			return
+		}
+	}
+	serveOutputFile(w, r, name)
+}
+
+// Compose a model's card and put it into storage
+func publishOGImage(ctx context.Context, record *modelRecord, name string) error {
+	card, err := ogImage(ctx, record.featured())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(config.WorkDir, "og-*.png")
+	if err != nil {
+		return err
+	}
+	err = png.Encode(tmp, card)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = storage.Publish(ctx, tmp.Name(), outputObject(name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Lay out the card: the render on the left, title and measurements on the
+// right, in the page's theme colors
+func ogImage(ctx context.Context, render *modelRender) (image.Image, error) {
+	if err := loadOGFonts(); err != nil {
+		return nil, err
+	}
+	colors := config.UI.Colors
+	card := image.NewNRGBA(image.Rect(0, 0, OGWidth, OGHeight))
+	draw.Draw(card, card.Bounds(), image.NewUniform(fauxgl.HexColor(colors.Background).NRGBA()), image.Point{}, draw.Src)
+
+	// Square render, scaled to the card's height
+	side := OGHeight - 2*OGPadding
+	if im, err := loadRenderImage(ctx, render.Outputs[0]); err != nil {
+		log.Printf("No render for social card: %v", err)
+	} else {
+		dst := image.Rect(OGPadding, OGPadding, OGPadding+side, OGPadding+side)
+		draw.CatmullRom.Scale(card, dst, im, im.Bounds(), draw.Over, nil)
+	}
+
+	x := 2*OGPadding + side
+	maxWidth := OGWidth - OGPadding - x
+	text := fauxgl.HexColor(colors.Text).NRGBA()
+	accent := fauxgl.HexColor(colors.Accent).NRGBA()
+	d := render.Stats.Dimensions
+	lines := []struct {
+		face  font.Face
+		color color.NRGBA
+		text  string
+	}{
+		{ogTitleFace, text, config.UI.Title},
+		{ogTextFace, text, fmt.Sprintf("%.1f × %.1f × %.1f %s", d.X, d.Y, d.Z, render.Stats.Units)},
+		{ogTextFace, accent, fmt.Sprintf("%d triangles", render.Stats.Triangles)},
+	}
+	y := OGHeight/2 - 60
+	for _, line := range lines {
+		drawer := font.Drawer{Dst: card, Src: image.NewUniform(line.color), Face: line.face, Dot: fixed.P(x, y)}
+		drawer.DrawString(fitText(line.face, line.text, maxWidth))
+		y += line.face.Metrics().Height.Ceil() + 16
+	}
+	return card, nil
+}
+
+// Shorten text with an ellipsis until it fits in width pixels
+func fitText(face font.Face, text string, width int) string {
+	if font.MeasureString(face, text).Ceil() <= width {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		if s := string(runes) + "…"; font.MeasureString(face, s).Ceil() <= width {
+			return s
+		}
+	}
+	return ""
+}
+
+// Decode a stored PNG or WebP output
+func loadRenderImage(ctx context.Context, name string) (image.Image, error) {
+	if !pushableOutput(name) {
+		return nil, errors.New("primary output is not an image")
+	}
+	file, err := storage.Open(ctx, outputObject(name))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if path.Ext(name) == ".webp" {
+		return webp.Decode(file)
+	}
+	return png.Decode(file)
+}
+
+// Parse the bundled Go fonts once
+func loadOGFonts() error {
+	ogFontsOnce.Do(func() {
+		var bold, regular *opentype.Font
+		if bold, ogFontsErr = opentype.Parse(gobold.TTF); ogFontsErr != nil {
+			return
+		}
+		if regular, ogFontsErr = opentype.Parse(goregular.TTF); ogFontsErr != nil {
+			return
+		}
+		if ogTitleFace, ogFontsErr = opentype.NewFace(bold, &opentype.FaceOptions{Size: 44, DPI: 72, Hinting: font.HintingFull}); ogFontsErr != nil {
+			return
+		}
+		ogTextFace, ogFontsErr = opentype.NewFace(regular, &opentype.FaceOptions{Size: 36, DPI: 72, Hinting: font.HintingFull})
+	})
+	return ogFontsErr
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultIOD          = 0.15  // Interocular distance in bi-unit model space, roughly human at the default camera distance
+	DefaultCreaseAngle  = 30.0  // Sharpest edge smooth shading blends across, in degrees
+	DefaultMaxHoleEdges = 100   // Largest hole fill_holes closes, in boundary edges
+	MaxHoleEdges        = 10000 // Largest max_hole_edges a job may ask for
+	MaxClipDistance     = 100.0 // Farthest clip plane a job may ask for, in bi-unit model space
+)
+
+// Per-job render settings, sent as form fields alongside the upload. The zero
+// value is the classic single-view thumbnail.
+type RenderOptions struct {
+	Stereo string  `json:"stereo,omitempty"` // "sbs" for a side-by-side pair, "anaglyph" for red-cyan
+	IOD    float64 `json:"iod,omitempty"`    // Eye separation for stereo modes
+
+	Frames    int      `json:"frames,omitempty"`    // Number of 360° spin frames; produces a ZIP instead of a PNG
+	Elevation *float64 `json:"elevation,omitempty"` // Spin camera elevation in degrees
+
+	BuildFrames int `json:"build_frames,omitempty"` // Frames of an animation building the model up from the bed; produces a GIF instead of a PNG
+
+	View *CameraView `json:"view,omitempty"` // Camera for still renders; the standard 3/4 view when nil
+
+	Formats []string `json:"formats,omitempty"` // Encodings produced from the one render: png, webp, depth, backlit, ids, components
+
+	ColorBy     string  `json:"color_by,omitempty"`     // Analysis coloring: "height", "curvature", or "layer"
+	Palette     string  `json:"palette,omitempty"`      // Colors of the analysis coloring; set whenever ColorBy is
+	HideLegend  bool    `json:"hide_legend,omitempty"`  // Leave the analysis coloring's color scale out of the image
+	LayerHeight float64 `json:"layer_height,omitempty"` // Thickness of the bands of the layer coloring, in mm; set whenever ColorBy is "layer"
+	Color       string  `json:"color,omitempty"`        // Model color as "#rrggbb" instead of light gray, without ColorBy
+
+	Annotations *Annotations `json:"annotations,omitempty"` // Labels, callouts, and indicators drawn over the image
+
+	RotateX float64 `json:"rotate_x,omitempty"` // Model rotation in degrees, applied X, then Y, then Z
+	RotateY float64 `json:"rotate_y,omitempty"`
+	RotateZ float64 `json:"rotate_z,omitempty"`
+	Mirror  string  `json:"mirror,omitempty"` // Axis to flip the model across before rotating: "x", "y" or "z"
+
+	ShowCOM    bool `json:"show_com,omitempty"`    // Draw a marker at the center of mass
+	ShowIssues bool `json:"show_issues,omitempty"` // Color degenerate, duplicate, and inverted triangles red
+	ShowEdges  bool `json:"show_edges,omitempty"`  // Highlight non-manifold edges and the rims of holes
+
+	Supports      bool    `json:"supports,omitempty"`       // Draw estimated support pillars under overhangs
+	OverhangAngle float64 `json:"overhang_angle,omitempty"` // Steepest unsupported overhang, in degrees from vertical
+
+	Printer string `json:"printer,omitempty"` // Configured printer whose bed outline is drawn under the model
+
+	Decimate  float64 `json:"decimate,omitempty"`   // Fraction of triangles to keep when simplifying the mesh
+	FillHoles int     `json:"fill_holes,omitempty"` // Close holes of up to this many edges before measuring and rendering
+	Voxels    int     `json:"voxels,omitempty"`     // Render a voxelized version, this many voxels along the longest side
+
+	Lithophane bool `json:"lithophane,omitempty"` // Preview a lithophane lit from behind and offer its STL
+
+	QR *QRCode `json:"qr,omitempty"` // QR code embossed or debossed onto one side of the model
+
+	CreaseAngle float64 `json:"crease_angle,omitempty"` // Smooth shading across edges flatter than this, in degrees; flat-shaded when 0
+
+	Near *float64 `json:"near,omitempty"` // Clip plane distances from the camera in normalized model units; fitted to the model when unset
+	Far  *float64 `json:"far,omitempty"`
+
+	Filters []string `json:"filters,omitempty"` // Post-processing of the rendered image: "fxaa", "sharpen", "gamma", "autoexposure", in order
+	Sharpen float64  `json:"sharpen,omitempty"` // Unsharp mask strength, with "sharpen"
+	Gamma   float64  `json:"gamma,omitempty"`   // Gamma exponent, with "gamma"
+
+	Backdrop string `json:"backdrop,omitempty"` // Digest of the preset's backdrop image the model is composited over
+
+	DOF     *DepthOfField `json:"dof,omitempty"`     // Focal blur from the depth buffer
+	Outline *Outline      `json:"outline,omitempty"` // Accent line around the silhouette, for dark backgrounds
+
+	Quality string `json:"quality,omitempty"` // "raytraced" for a path-traced hero image; rasterized when empty
+	Samples int    `json:"samples,omitempty"` // Path tracing samples per pixel, with raytraced
+	Seed    uint64 `json:"seed,omitempty"`    // Path tracing random seed, with raytraced
+
+	Size int `json:"size,omitempty"` // Width and height of a single view rendered in tiles; Width×Height when 0
+}
+
+var supportedFormats = map[string]bool{"png": true, "webp": true, "depth": true, "backlit": true, "ids": true, "components": true}
+
+// Read render options from the request form
+func parseRenderOptions(r *http.Request) (RenderOptions, error) {
+	var opts RenderOptions
+
+	opts.Stereo = r.FormValue("stereo")
+	switch opts.Stereo {
+	case "":
+	case "sbs", "anaglyph":
+		opts.IOD = DefaultIOD
+		if v := r.FormValue("iod"); v != "" {
+			iod, err := strconv.ParseFloat(v, 64)
+			if err != nil || iod <= 0 || iod > 2 {
+				return opts, fmt.Errorf("iod must be a number in (0, 2]")
+			}
+			opts.IOD = iod
+		}
+	default:
+		return opts, fmt.Errorf("unknown stereo mode %q", opts.Stereo)
+	}
+
+	if v := r.FormValue("frames"); v != "" {
+		frames, err := strconv.Atoi(v)
+		if err != nil || frames < 2 || frames > MaxSpinFrames {
+			return opts, fmt.Errorf("frames must be between 2 and %d", MaxSpinFrames)
+		}
+		if opts.Stereo != "" {
+			return opts, fmt.Errorf("frames can't be combined with stereo")
+		}
+		opts.Frames = frames
+
+		if v := r.FormValue("elevation"); v != "" {
+			elevation, err := strconv.ParseFloat(v, 64)
+			if err != nil || elevation < -89 || elevation > 89 {
+				return opts, fmt.Errorf("elevation must be between -89 and 89 degrees")
+			}
+			opts.Elevation = &elevation
+		}
+	}
+
+	if v := r.FormValue("build_frames"); v != "" {
+		frames, err := strconv.Atoi(v)
+		if err != nil || frames < 2 || frames > MaxBuildFrames {
+			return opts, fmt.Errorf("build_frames must be between 2 and %d", MaxBuildFrames)
+		}
+		if opts.Stereo != "" || opts.Frames > 0 {
+			return opts, fmt.Errorf("build_frames can't be combined with stereo or frames")
+		}
+		opts.BuildFrames = frames
+	}
+
+	view, err := parseCameraView(r)
+	if err != nil {
+		return opts, err
+	}
+	if view != nil && opts.Frames > 0 {
+		return opts, fmt.Errorf("view can't be combined with frames")
+	}
+	opts.View = view
+
+	for _, rot := range []struct {
+		field string
+		value *float64
+	}{{"rotate_x", &opts.RotateX}, {"rotate_y", &opts.RotateY}, {"rotate_z", &opts.RotateZ}} {
+		v := r.FormValue(rot.field)
+		if v == "" {
+			continue
+		}
+		degrees, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(degrees) || math.IsInf(degrees, 0) {
+			return opts, fmt.Errorf("%s must be a number of degrees", rot.field)
+		}
+		// Normalize so equivalent angles share a cache entry
+		degrees = math.Mod(degrees, 360)
+		if degrees < 0 {
+			degrees += 360
+		}
+		*rot.value = degrees
+	}
+
+	opts.Mirror = strings.ToLower(r.FormValue("mirror"))
+	switch opts.Mirror {
+	case "", "x", "y", "z":
+	default:
+		return opts, fmt.Errorf("mirror must be x, y or z")
+	}
+
+	if v := r.FormValue("show_com"); v != "" {
+		show, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("show_com must be true or false")
+		}
+		opts.ShowCOM = show
+	}
+
+	if v := r.FormValue("show_issues"); v != "" {
+		show, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("show_issues must be true or false")
+		}
+		opts.ShowIssues = show
+	}
+
+	if v := r.FormValue("show_edges"); v != "" {
+		show, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("show_edges must be true or false")
+		}
+		opts.ShowEdges = show
+	}
+
+	if v := r.FormValue("supports"); v != "" {
+		supports, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("supports must be true or false")
+		}
+		opts.Supports = supports
+	}
+	if opts.Supports {
+		opts.OverhangAngle = DefaultOverhangAngle
+		if v := r.FormValue("overhang_angle"); v != "" {
+			angle, err := strconv.ParseFloat(v, 64)
+			if err != nil || angle <= 0 || angle >= 90 {
+				return opts, fmt.Errorf("overhang_angle must be between 0 and 90 degrees")
+			}
+			opts.OverhangAngle = angle
+		}
+	}
+
+	if v := r.FormValue("printer"); v != "" {
+		if _, ok := findPrinter(v); !ok {
+			return opts, fmt.Errorf("unknown printer %q", v)
+		}
+		opts.Printer = v
+	}
+
+	if v := r.FormValue("decimate"); v != "" {
+		decimate, err := strconv.ParseFloat(v, 64)
+		if err != nil || decimate <= 0 || decimate >= 1 {
+			return opts, fmt.Errorf("decimate must be a fraction between 0 and 1")
+		}
+		opts.Decimate = decimate
+	}
+
+	for _, plane := range []struct {
+		field string
+		value **float64
+	}{{"near", &opts.Near}, {"far", &opts.Far}} {
+		v := r.FormValue(plane.field)
+		if v == "" {
+			continue
+		}
+		distance, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(distance > 0 && distance <= MaxClipDistance) {
+			return opts, fmt.Errorf("%s must be a distance between 0 and %g", plane.field, MaxClipDistance)
+		}
+		*plane.value = &distance
+	}
+	if opts.Near != nil && opts.Far != nil && *opts.Near >= *opts.Far {
+		return opts, fmt.Errorf("near must be less than far")
+	}
+
+	if v := r.FormValue("smooth"); v != "" {
+		smooth, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("smooth must be true or false")
+		}
+		if smooth {
+			opts.CreaseAngle = DefaultCreaseAngle
+		}
+	}
+	if v := r.FormValue("crease_angle"); v != "" {
+		angle, err := strconv.ParseFloat(v, 64)
+		if err != nil || angle <= 0 || angle > 180 {
+			return opts, fmt.Errorf("crease_angle must be between 0 and 180 degrees")
+		}
+		opts.CreaseAngle = angle
+	}
+
+	if err := parseQROptions(r, &opts); err != nil {
+		return opts, err
+	}
+	if err := parseFilterOptions(r, &opts); err != nil {
+		return opts, err
+	}
+	if err := parseDOFOptions(r, &opts); err != nil {
+		return opts, err
+	}
+	if err := parseOutlineOptions(r, &opts); err != nil {
+		return opts, err
+	}
+	if err := parseQualityOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	if v := r.FormValue("fill_holes"); v != "" {
+		fill, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("fill_holes must be true or false")
+		}
+		if fill {
+			opts.FillHoles = DefaultMaxHoleEdges
+		}
+	}
+	if v := r.FormValue("max_hole_edges"); v != "" && opts.FillHoles > 0 {
+		edges, err := strconv.Atoi(v)
+		if err != nil || edges < 3 || edges > MaxHoleEdges {
+			return opts, fmt.Errorf("max_hole_edges must be between 3 and %d", MaxHoleEdges)
+		}
+		opts.FillHoles = edges
+	}
+
+	if v := r.FormValue("voxels"); v != "" {
+		voxels, err := strconv.Atoi(v)
+		if err != nil || voxels < 2 || voxels > MaxVoxelResolution {
+			return opts, fmt.Errorf("voxels must be between 2 and %d", MaxVoxelResolution)
+		}
+		opts.Voxels = voxels
+	}
+
+	if v := r.FormValue("lithophane"); v != "" {
+		lithophane, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("lithophane must be true or false")
+		}
+		opts.Lithophane = lithophane
+	}
+
+	opts.ColorBy = r.FormValue("color_by")
+	switch opts.ColorBy {
+	case "", "height", "curvature", "layer":
+	default:
+		return opts, fmt.Errorf("unknown color_by mode %q", opts.ColorBy)
+	}
+	if v := r.FormValue("layer_height"); v != "" || opts.ColorBy == "layer" {
+		if opts.ColorBy != "layer" {
+			return opts, fmt.Errorf("layer_height needs color_by=layer")
+		}
+		opts.LayerHeight = DefaultLayerHeight
+		if v != "" {
+			h, err := strconv.ParseFloat(v, 64)
+			if err != nil || !(h >= MinLayerHeight && h <= MaxLayerHeight) {
+				return opts, fmt.Errorf("layer_height must be between %g and %g mm", MinLayerHeight, MaxLayerHeight)
+			}
+			opts.LayerHeight = h
+		}
+	}
+	if c := r.FormValue("color"); c != "" {
+		if !hexColorPattern.MatchString(c) {
+			return opts, fmt.Errorf("color must be a hex color like #333333")
+		}
+		if opts.ColorBy != "" {
+			return opts, fmt.Errorf("color can't be combined with color_by")
+		}
+		opts.Color = strings.ToLower(c)
+	}
+	opts.Palette = r.FormValue("palette")
+	if opts.ColorBy == "" && (opts.Palette != "" || r.FormValue("legend") != "") {
+		return opts, fmt.Errorf("palette and legend need color_by")
+	}
+	if opts.ColorBy != "" {
+		if opts.Palette == "" {
+			opts.Palette = defaultPalettes[opts.ColorBy]
+		}
+		if _, ok := palettes[opts.Palette]; !ok {
+			return opts, fmt.Errorf("unknown palette %q", opts.Palette)
+		}
+		if v := r.FormValue("legend"); v != "" {
+			legend, err := strconv.ParseBool(v)
+			if err != nil {
+				return opts, fmt.Errorf("legend must be true or false")
+			}
+			opts.HideLegend = !legend
+		}
+	}
+
+	if v := r.FormValue("formats"); v != "" {
+		seen := make(map[string]bool)
+		for _, f := range strings.Split(v, ",") {
+			f = strings.ToLower(strings.TrimSpace(f))
+			if !supportedFormats[f] {
+				return opts, fmt.Errorf("unsupported format %q", f)
+			}
+			if !seen[f] {
+				seen[f] = true
+				opts.Formats = append(opts.Formats, f)
+			}
+		}
+		if opts.Frames > 0 || opts.BuildFrames > 0 {
+			return opts, fmt.Errorf("formats can't be combined with frames or build_frames")
+		}
+		if (seen["depth"] || seen["ids"] || seen["components"]) && opts.Stereo != "" {
+			return opts, fmt.Errorf("depth, ids, and components outputs can't be combined with stereo")
+		}
+		// A lone png is the default, keep its cache key unchanged
+		if len(opts.Formats) == 1 && opts.Formats[0] == "png" {
+			opts.Formats = nil
+		}
+	}
+	if err := parseSizeOptions(r, &opts); err != nil {
+		return opts, err
+	}
+	// Lithophanes are judged against the light, with the usual shot second;
+	// a poster is the usual shot alone
+	if opts.Lithophane && opts.Formats == nil && opts.Frames == 0 && opts.BuildFrames == 0 && opts.Size == 0 {
+		opts.Formats = []string{"backlit", "png"}
+	}
+	if err := parseAnnotationOptions(r, &opts); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// Number of views rasterized for these options
+func (o RenderOptions) views() int {
+	switch {
+	case o.Frames > 0:
+		return o.Frames
+	case o.BuildFrames > 0:
+		return o.BuildFrames
+	case o.Stereo != "":
+		return 2
+	default:
+		return 1
+	}
+}
+
+// Pixels in each rasterized view
+func (o RenderOptions) viewPixels() int {
+	if o.Size > 0 {
+		return o.Size * o.Size
+	}
+	return Width * Height
+}
+
+// Output file names for a render with these options, primary output first
+func (o RenderOptions) outputNames(cacheKey string) []string {
+	if o.Frames > 0 {
+		return []string{fmt.Sprintf("output-%s.zip", cacheKey)}
+	}
+	if o.BuildFrames > 0 {
+		return []string{fmt.Sprintf("output-%s.gif", cacheKey)}
+	}
+	if len(o.Formats) == 0 {
+		return []string{fmt.Sprintf("output-%s.png", cacheKey)}
+	}
+	var names []string
+	for _, f := range o.Formats {
+		names = append(names, outputName(cacheKey, f))
+	}
+	return names
+}
+
+// Whether these options change the mesh itself, making the processed mesh
+// worth offering for download
+func (o RenderOptions) processesMesh() bool {
+	return o.Decimate > 0 || o.FillHoles > 0 || o.Voxels > 0 || o.Lithophane || o.QR != nil
+}
+
+// File name of the processed mesh for a cache key
+func meshName(cacheKey string) string {
+	return fmt.Sprintf("mesh-%s.stl", cacheKey)
+}
+
+// Output file name for one encoding of a single-image render
+func outputName(cacheKey, format string) string {
+	switch format {
+	case "depth", "backlit", "ids", "components":
+		return fmt.Sprintf("output-%s-%s.png", cacheKey, format)
+	}
+	return fmt.Sprintf("output-%s.%s", cacheKey, format)
+}
+
+// Analysis settings that change a job's results, in canonical form
+type analysisParams struct {
+	Units      string  `json:"units,omitempty"`
+	HollowWall float64 `json:"hollow_wall,omitempty"`
+}
+
+// Cache key for a model rendered with the given parameters: the file hash
+// (scoped to the tenant, see tenantFileHash), plus a digest of the canonical
+// options and analysis settings when they aren't the defaults. The options
+// are normalized while parsing and encode with fields in a fixed order and
+// zero values left out, so equal renders share a key and new options don't
+// change existing ones. Analysis settings change the stats a job reports, so
+// they are part of the key too, but only when set, so older keys stay valid.
+func outputCacheKey(tenant, fileHash string, opts RenderOptions, analysis AnalysisOptions) string {
+	fileHash = tenantFileHash(tenant, fileHash)
+	data, _ := json.Marshal(opts)
+	if analysis != (AnalysisOptions{}) {
+		params, _ := json.Marshal(analysisParams{Units: analysis.Units, HollowWall: analysis.HollowWall})
+		data = append(append(data, '\n'), params...)
+	}
+	if string(data) == "{}" {
+		return fileHash
+	}
+	sum := sha256.Sum256(data)
+	return fileHash + "-" + hex.EncodeToString(sum[:8])
+}
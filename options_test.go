@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOutputCacheKeySeparatesAnalysisSettings(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	settings := []AnalysisOptions{
+		{},
+		{Units: "mm"},
+		{Units: "in"},
+		{HollowWall: 2},
+		{HollowWall: 2.5},
+		{Units: "in", HollowWall: 2},
+	}
+	seen := make(map[string]AnalysisOptions)
+	for _, analysis := range settings {
+		key := outputCacheKey("", hash, RenderOptions{}, analysis)
+		if other, ok := seen[key]; ok {
+			t.Errorf("%+v and %+v share the cache key %s", analysis, other, key)
+		}
+		seen[key] = analysis
+	}
+	if key := outputCacheKey("", hash, RenderOptions{}, AnalysisOptions{}); key != hash {
+		t.Errorf("default settings got key %s, want the file hash", key)
+	}
+}
+
+func TestParseSizeOptions(t *testing.T) {
+	tests := []struct {
+		form    string
+		size    int
+		formats []string
+		ok      bool
+	}{
+		{"size=512", 512, nil, true},
+		{"size=512&formats=png", 512, nil, true},
+		{"size=512&formats=webp", 512, []string{"webp"}, true},
+		{"size=4096&formats=webp", 4096, []string{"webp"}, true},
+		{"size=8192&formats=webp", 0, nil, false},
+		{"size=8192", 8192, nil, true},
+		{"size=512&formats=png,webp", 0, nil, false},
+		{"size=512&formats=depth", 0, nil, false},
+		{"size=512&frames=8", 0, nil, false},
+		{"size=32", 0, nil, false},
+		{"lithophane=true", 0, []string{"backlit", "png"}, true},
+		{"lithophane=true&size=2048", 2048, nil, true},
+		{"lithophane=true&size=2048&formats=webp", 2048, []string{"webp"}, true},
+		{"lithophane=true&size=2048&formats=backlit,png", 0, nil, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(tt.form))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		opts, err := parseRenderOptions(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok %v", tt.form, err, tt.ok)
+			continue
+		}
+		if tt.ok && (opts.Size != tt.size || !slices.Equal(opts.Formats, tt.formats)) {
+			t.Errorf("%s: got size %d and formats %v, want %d and %v", tt.form, opts.Size, opts.Formats, tt.size, tt.formats)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const OriginRetrySecs = 5 // Retry-After sent when an on-demand render is still running
+
+// Output URLs rendered on demand: the model's hash, then option fields as a
+// query string, e.g. <hash>-color_by=height&view_azimuth=90.png
+var originNamePattern = regexp.MustCompile(`^([0-9a-f]{64})(?:-([^/]*))?\.(png|webp)$`)
+
+// Serve as the origin behind a CDN: unknown output URLs naming a stored model
+// and render options are rendered on first request. The URLs aren't signed,
+// so what they may ask for is limited.
+type OriginConfig struct {
+	Enabled             bool     `json:"enabled"`
+	WaitSecs            int      `json:"wait_secs"`              // Longest a request waits for its render before answering 503
+	MaxAgeSecs          int      `json:"max_age_secs"`           // Cache-Control max-age of outputs served this way
+	Options             []string `json:"options"`                // Option fields the URLs may set; defaultOriginOptions when empty
+	MaxSize             int      `json:"max_size"`               // Largest size the URLs may ask for, in pixels
+	Qualities           []string `json:"qualities"`              // Values of quality the URLs may ask for; rasterized only when empty
+	MaxRendersPerMinute int      `json:"max_renders_per_minute"` // Renders each tenant's URLs may start per minute; no limit when 0
+}
+
+// Option fields origin URLs may set unless configured otherwise: the ones
+// that don't make a render much costlier
+var defaultOriginOptions = []string{
+	"size", "formats", "color", "color_by", "palette", "smooth", "show_edges", "outline", "outline_width", "filters",
+	"view_azimuth", "view_elevation", "view_zoom", "view_target",
+}
+
+// On-demand renders started by origin URLs in the current minute, by tenant
+var (
+	originRendersMu sync.Mutex
+	originRenders   = make(map[string]*renderWindow)
+)
+
+type renderWindow struct {
+	start time.Time
+	count int
+}
+
+// GET /output/<hash>[-<options>].png or .webp, in origin mode
+//
+// The output for the stored model and options, rendered first if it wasn't
+// yet. Options are the fields of /upload, URL-encoded; the extension picks
+// the format, and anything producing other files is refused.
+func serveOriginOutput(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		apiError(w, r, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Method not allowed")
+		return
+	}
+	// Escaped, so values can hold an encoded & or /
+	m := originNamePattern.FindStringSubmatch(path.Base(r.URL.EscapedPath()))
+	if m == nil {
+		notFound(w, r)
+		return
+	}
+	fileHash, params, ext := m[1], m[2], m[3]
+	form, err := url.ParseQuery(params)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid options")
+		return
+	}
+	options := make(map[string]string, len(form))
+	for k := range form {
+		options[k] = form.Get(k)
+	}
+	if err := checkOriginOptions(options); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	serveOnDemand(w, r, fileHash, ext, options, config.Origin.WaitSecs, config.Origin.MaxAgeSecs, true)
+}
+
+// Check the option fields of an origin URL against the configured allowlist
+// and caps
+func checkOriginOptions(options map[string]string) error {
+	allowed := config.Origin.Options
+	if len(allowed) == 0 {
+		allowed = defaultOriginOptions
+	}
+	for _, field := range slices.Sorted(maps.Keys(options)) {
+		if field == "quality" {
+			if v := options[field]; v != "" && !slices.Contains(config.Origin.Qualities, v) {
+				return fmt.Errorf("quality %s isn't rendered on demand", v)
+			}
+			continue
+		}
+		if !slices.Contains(allowed, field) {
+			return fmt.Errorf("%s can't be set on demand", field)
+		}
+	}
+	if v := options["size"]; v != "" {
+		if size, err := strconv.Atoi(v); err == nil && size > config.Origin.MaxSize {
+			return fmt.Errorf("size is at most %d pixels on demand", config.Origin.MaxSize)
+		}
+	}
+	return nil
+}
+
+// Count a render started by an origin URL against its tenant's limit.
+// Returns false, with how long until the limit resets, when it is reached.
+func takeOriginRender(tenant string) (time.Duration, bool) {
+	limit := config.Origin.MaxRendersPerMinute
+	if limit <= 0 {
+		return 0, true
+	}
+	now := time.Now()
+	originRendersMu.Lock()
+	defer originRendersMu.Unlock()
+	window := originRenders[tenant]
+	if window == nil || now.Sub(window.start) >= time.Minute {
+		window = &renderWindow{start: now}
+		originRenders[tenant] = window
+	}
+	if window.count >= limit {
+		return time.Minute - now.Sub(window.start), false
+	}
+	window.count++
+	return 0, true
+}
+
+// Serve the png or webp output of a stored model for option fields, from the
+// cache or rendered now, waiting up to waitSecs for it. The output is cached
+// downstream for maxAgeSecs. With throttled, renders it starts count against
+// the tenant's origin limit.
+func serveOnDemand(w http.ResponseWriter, r *http.Request, fileHash, ext string, options map[string]string, waitSecs, maxAgeSecs int, throttled bool) {
+	if ext == "webp" && options["formats"] == "" {
+		options["formats"] = "webp"
+	}
+	opts, analysis, err := parseOriginOptions(r.Context(), options)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+	if names := opts.outputNames(""); len(names) != 1 || filepath.Ext(names[0]) != "."+ext {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Only single png or webp images are rendered on demand")
+		return
+	}
+
+	tenant := tenantOf(r.Context())
+	cacheKey := outputCacheKey(tenant, fileHash, opts, analysis)
+	if _, ok := lookupOutput(cacheKey); !ok {
+		// Waiting for a render that is already running starts nothing
+		if _, running := findInFlightJob(cacheKey); throttled && !running {
+			if wait, ok := takeOriginRender(tenant); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+				w.Header().Set("Cache-Control", "no-store")
+				apiError(w, r, http.StatusTooManyRequests, ErrLimitReached, "Too many renders on demand, try again later")
+				return
+			}
+		}
+		if !renderOnDemand(w, r, fileHash, opts, analysis, waitSecs) {
+			return
+		}
+	}
+	name, ok := lookupOutput(cacheKey)
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	// The URL names the model and options, so what it shows never changes
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d, immutable", maxAgeSecs))
+	serveOutputFile(w, r, filepath.Base(name))
+}
+
+// Render options and analysis options from option fields
+func parseOriginOptions(ctx context.Context, options map[string]string) (RenderOptions, AnalysisOptions, error) {
+	req, err := optionsRequest(ctx, options)
+	if err != nil {
+		return RenderOptions{}, AnalysisOptions{}, err
+	}
+	opts, err := parseRenderOptions(req)
+	if err != nil {
+		return opts, AnalysisOptions{}, err
+	}
+	analysis, err := parseAnalysisOptions(req)
+	return opts, analysis, err
+}
+
+// Render a stored model as an interactive job and wait up to waitSecs for
+// it. Answers the request and returns false if the output isn't there to
+// serve.
+func renderOnDemand(w http.ResponseWriter, r *http.Request, fileHash string, opts RenderOptions, analysis AnalysisOptions, waitSecs int) bool {
+	exists, err := storage.Exists(r.Context(), uploadObject(fileHash))
+	if err != nil {
+		log.Printf("Failed to look up upload %s: %v", fileHash, err)
+		apiError(w, r, http.StatusBadGateway, ErrStorage, "Failed to read storage")
+		return false
+	}
+	if !exists {
+		notFound(w, r)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(withPriority(r.Context(), PriorityInteractive), time.Duration(waitSecs)*time.Second)
+	defer cancel()
+	workDir, err := fetchUpload(ctx, fileHash)
+	if err == nil {
+		_, err = renderModel(ctx, workDir, fileHash, opts, analysis)
+	}
+	switch {
+	case err == nil:
+		return true
+	case r.Context().Err() != nil:
+		return false // The client went away; the render carries on for the next request
+	case errors.Is(err, context.DeadlineExceeded):
+		w.Header().Set("Retry-After", strconv.Itoa(OriginRetrySecs))
+		w.Header().Set("Cache-Control", "no-store")
+		apiError(w, r, http.StatusServiceUnavailable, ErrJobNotFinished, "Still rendering, try again shortly")
+	case errors.Is(err, os.ErrNotExist):
+		notFound(w, r)
+	default:
+		log.Printf("Failed to render %s on demand: %v", fileHash, err)
+		w.Header().Set("Cache-Control", "no-store")
+		apiError(w, r, http.StatusInternalServerError, ErrRenderFailed, "Failed to render")
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckOriginOptions(t *testing.T) {
+	saved := config.Origin
+	t.Cleanup(func() { config.Origin = saved })
+	config.Origin = OriginConfig{MaxSize: 1024}
+
+	tests := []struct {
+		name    string
+		options map[string]string
+		wantErr bool
+	}{
+		{"none", map[string]string{}, false},
+		{"cheap fields", map[string]string{"color": "#333333", "view_azimuth": "90", "size": "512"}, false},
+		{"size at the cap", map[string]string{"size": "1024"}, false},
+		{"size over the cap", map[string]string{"size": "16384"}, true},
+		{"raytraced", map[string]string{"quality": "raytraced"}, true},
+		{"field outside the allowlist", map[string]string{"frames": "36"}, true},
+		{"costly field", map[string]string{"voxels": "128"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkOriginOptions(tt.options); (err != nil) != tt.wantErr {
+				t.Errorf("checkOriginOptions(%v) = %v, want error %v", tt.options, err, tt.wantErr)
+			}
+		})
+	}
+
+	config.Origin = OriginConfig{MaxSize: 1024, Options: []string{"voxels"}, Qualities: []string{QualityRaytraced}}
+	if err := checkOriginOptions(map[string]string{"voxels": "16", "quality": "raytraced"}); err != nil {
+		t.Errorf("configured fields refused: %v", err)
+	}
+	if err := checkOriginOptions(map[string]string{"color": "#333333"}); err == nil {
+		t.Error("a field left out of the configured allowlist was accepted")
+	}
+}
+
+func TestTakeOriginRender(t *testing.T) {
+	saved := config.Origin
+	t.Cleanup(func() {
+		config.Origin = saved
+		originRendersMu.Lock()
+		clear(originRenders)
+		originRendersMu.Unlock()
+	})
+	config.Origin = OriginConfig{MaxRendersPerMinute: 3}
+
+	for i := 0; i < 3; i++ {
+		if _, ok := takeOriginRender("a"); !ok {
+			t.Fatalf("render %d refused under the limit", i+1)
+		}
+	}
+	wait, ok := takeOriginRender("a")
+	if ok {
+		t.Fatal("render over the limit allowed")
+	}
+	if wait <= 0 || wait > time.Minute {
+		t.Errorf("told to wait %v", wait)
+	}
+	if _, ok := takeOriginRender("b"); !ok {
+		t.Error("another tenant's render was refused")
+	}
+
+	// A window that has run out starts over
+	originRendersMu.Lock()
+	originRenders["a"].start = time.Now().Add(-time.Minute)
+	originRendersMu.Unlock()
+	if _, ok := takeOriginRender("a"); !ok {
+		t.Error("render refused after the minute passed")
+	}
+}
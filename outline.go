@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	DefaultOutlineWidth = 2
+	MaxOutlineWidth     = 8
+	OutlineDepthJump    = 0.05 // Distance step, relative to the farther side, that counts as an edge
+)
+
+// Screen-space outline drawn along the model's silhouette and wherever one
+// part of it stands in front of another
+type Outline struct {
+	Color string `json:"color"` // Hex color, e.g. "#ffffff"
+	Width int    `json:"width"` // In pixels
+}
+
+// Read the outline and outline_width form fields into the options
+func parseOutlineOptions(r *http.Request, opts *RenderOptions) error {
+	c := r.FormValue("outline")
+	if c == "" {
+		return nil
+	}
+	if !hexColorPattern.MatchString(c) {
+		return fmt.Errorf("outline must be a hex color like #ffffff")
+	}
+	outline := Outline{Color: c, Width: DefaultOutlineWidth}
+	if v := r.FormValue("outline_width"); v != "" {
+		width, err := strconv.Atoi(v)
+		if err != nil || width < 1 || width > MaxOutlineWidth {
+			return fmt.Errorf("outline_width must be between 1 and %d pixels", MaxOutlineWidth)
+		}
+		outline.Width = width
+	}
+	opts.Outline = &outline
+	return nil
+}
+
+// Paint the outline onto a rendered view. A pixel is on the outline when a
+// clearly nearer surface is within the outline width of it, so the line
+// sits just outside the silhouette and behind overlapping parts, without
+// covering the model's own shading.
+func drawOutline(im *image.NRGBA, context *fauxgl.Context, near, far float64, outline Outline) {
+	distance := viewDistances(context, near, far)
+	c := fauxgl.HexColor(outline.Color)
+	ink := color.NRGBA{
+		uint8(math.Round(c.R * 255)),
+		uint8(math.Round(c.G * 255)),
+		uint8(math.Round(c.B * 255)),
+		255,
+	}
+
+	// Offsets within a disk of the outline width
+	var disk [][2]int
+	w := outline.Width
+	for dy := -w; dy <= w; dy++ {
+		for dx := -w; dx <= w; dx++ {
+			if (dx != 0 || dy != 0) && dx*dx+dy*dy <= w*w {
+				disk = append(disk, [2]int{dx, dy})
+			}
+		}
+	}
+
+	b := im.Bounds()
+	width, height := context.Width, context.Height
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			d := distance[y*width+x]
+			for _, o := range disk {
+				sx, sy := x+o[0], y+o[1]
+				if sx < 0 || sy < 0 || sx >= width || sy >= height {
+					continue
+				}
+				// Background is infinitely far, so any surface beats it
+				if s := distance[sy*width+sx]; s < d && (math.IsInf(d, 1) || d-s > OutlineDepthJump*d) {
+					im.SetNRGBA(b.Min.X+x, b.Min.Y+y, ink)
+					break
+				}
+			}
+		}
+	}
+}
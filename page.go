@@ -0,0 +1,95 @@
+package main
+
+import "sort"
+
+// Branding and layout settings for the upload page
+type UIConfig struct {
+	Title         string      `json:"title"`          // Browser tab title
+	Headline      string      `json:"headline"`       // Heading above the drop zone
+	Template      string      `json:"template"`       // Page template; point at a copy of templates/index.html to white-label the UI
+	RecentRenders int         `json:"recent_renders"` // How many recent thumbnails to show; 0 hides them
+	Colors        ThemeColors `json:"colors"`
+}
+
+// CSS colors the default template uses
+type ThemeColors struct {
+	Background string `json:"background"`
+	Text       string `json:"text"`
+	Accent     string `json:"accent"`    // Drop zone border and spinner
+	Highlight  string `json:"highlight"` // Drop zone while dragging
+}
+
+// Limits worth telling users about before they upload
+type PageLimits struct {
+	MaxSpinFrames int
+	MaxNestModels int
+	MaxBatchFiles int // Files sent per batch request; the page splits bigger drops
+	Formats       []string
+}
+
+// Everything the page template can use
+type PageData struct {
+	BasePath      string // Prefix of the tenant's URLs, e.g. "/t/design"; empty for the default tenant
+	CSRFToken     string
+	Lang          string
+	T             map[string]string // Messages in Lang, by key
+	Title         string
+	Headline      string
+	Colors        ThemeColors
+	Limits        PageLimits
+	RecentRenders []string // Download URLs of recent image outputs, newest first
+}
+
+// Most recent image outputs of each tenant, oldest first, guarded by mu
+var recentRenders = make(map[string][]string)
+
+// Remember a finished render for the tenant's recent list. Only images are
+// kept, since ZIPs can't be shown as thumbnails.
+func addRecentRender(tenant, name string) {
+	if !pushableOutput(name) || config.UI.RecentRenders <= 0 {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	recent := recentRenders[tenant]
+	for _, existing := range recent {
+		if existing == name {
+			return
+		}
+	}
+	recent = append(recent, name)
+	if extra := len(recent) - config.UI.RecentRenders; extra > 0 {
+		recent = recent[extra:]
+	}
+	recentRenders[tenant] = recent
+}
+
+func newPageData(csrfToken, lang, tenant string) PageData {
+	ui := config.UI
+	data := PageData{
+		BasePath:  tenantURL(tenant, ""),
+		CSRFToken: csrfToken,
+		Lang:      lang,
+		T:         catalogFor(lang),
+		Title:     ui.Title,
+		Headline:  ui.Headline,
+		Colors:    ui.Colors,
+		Limits: PageLimits{
+			MaxSpinFrames: MaxSpinFrames,
+			MaxNestModels: MaxNestModels,
+			MaxBatchFiles: MaxBatchFiles,
+		},
+	}
+	for f := range supportedFormats {
+		data.Limits.Formats = append(data.Limits.Formats, f)
+	}
+	sort.Strings(data.Limits.Formats)
+
+	mu.Lock()
+	recent := recentRenders[tenant]
+	for i := len(recent) - 1; i >= 0; i-- {
+		data.RecentRenders = append(data.RecentRenders, outputURL(tenant, recent[i]))
+	}
+	mu.Unlock()
+	return data
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"image"
+
+	"github.com/fogleman/fauxgl"
+)
+
+// Largest triangle number a picking map holds, in 24 bits of color
+const MaxPickingTriangles = 1<<24 - 1
+
+// Which triangle of the model each pixel of a view shows: triangle i is
+// drawn in the color holding i+1 as a 24-bit big-endian number in red, green
+// and blue, and the background is black. Overlays are left out. Always
+// rasterized on the CPU, without antialiasing, so every pixel is exact.
+func pickingImage(sc *scene, cam camera, width, height int) *image.NRGBA {
+	context := fauxgl.NewContext(width, height)
+	context.ClearColorBufferWith(fauxgl.Black)
+	near, far := clipPlanes(sc, cam)
+	shader := fauxgl.NewSolidColorShader(cam.projection(width, height, near, far), fauxgl.Black)
+	context.Shader = shader
+	for i, t := range sc.mesh.Triangles[:min(len(sc.mesh.Triangles), MaxPickingTriangles)] {
+		shader.Color = pickingColor(i + 1)
+		context.DrawTriangle(t)
+	}
+	return context.ColorBuffer
+}
+
+// Color a number is drawn in. Each channel is nudged above its level so it
+// survives conversion to 8 bits whether that rounds or truncates.
+func pickingColor(n int) fauxgl.Color {
+	channel := func(shift int) float64 {
+		return (float64(n>>shift&0xff) + 0.25) / 255
+	}
+	return fauxgl.Color{R: channel(16), G: channel(8), B: channel(0), A: 1}
+}
+
+// Number a picking map pixel holds
+func pickingNumber(im *image.NRGBA, i int) int {
+	return int(im.Pix[i])<<16 | int(im.Pix[i+1])<<8 | int(im.Pix[i+2])
+}
+
+// The picking map with each triangle's number replaced by the number of the
+// connected part it belongs to, counting from 1 in triangle order
+func componentImage(triangles *image.NRGBA, mesh *fauxgl.Mesh) *image.NRGBA {
+	components := meshComponents(mesh)
+	im := image.NewNRGBA(triangles.Bounds())
+	for i := 0; i < len(im.Pix); i += 4 {
+		n := pickingNumber(triangles, i)
+		if n > 0 {
+			n = components[n-1] + 1
+		}
+		im.Pix[i], im.Pix[i+1], im.Pix[i+2], im.Pix[i+3] = uint8(n>>16), uint8(n>>8), uint8(n), 255
+	}
+	return im
+}
+
+// Connected part of each triangle, numbered from 0 in order of each part's
+// first triangle. Triangles are connected through corners at the same
+// position.
+func meshComponents(mesh *fauxgl.Mesh) []int {
+	parent := make([]int, len(mesh.Triangles))
+	find := func(i int) int {
+		for parent[i] != i {
+			parent[i] = parent[parent[i]]
+			i = parent[i]
+		}
+		return i
+	}
+	byCorner := make(map[fauxgl.Vector]int)
+	for i, t := range mesh.Triangles {
+		parent[i] = i
+		for _, p := range []fauxgl.Vector{t.V1.Position, t.V2.Position, t.V3.Position} {
+			if j, ok := byCorner[p]; ok {
+				a, b := find(i), find(j)
+				parent[max(a, b)] = min(a, b)
+			} else {
+				byCorner[p] = i
+			}
+		}
+	}
+
+	components := make([]int, len(mesh.Triangles))
+	numbers := make(map[int]int)
+	for i := range mesh.Triangles {
+		root := find(i)
+		n, ok := numbers[root]
+		if !ok {
+			n = len(numbers)
+			numbers[root] = n
+		}
+		components[i] = n
+	}
+	return components
+}
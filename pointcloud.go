@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	MaxSplatPoints = 250000  // Larger clouds are thinned evenly to this many splats
+	SplatScale     = 0.6     // Splat radius relative to the estimated point spacing
+	MaxPCDRowSize  = 1 << 16 // Largest point of a binary PCD file, in bytes
+)
+
+// Point cloud formats accepted by the upload form, by file extension
+var pointCloudFormats = map[string]bool{"xyz": true, "pcd": true}
+
+// Point cloud format of an uploaded file name, or "" for meshes
+func pointCloudFormat(filename string) string {
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(filename), "."))
+	if pointCloudFormats[ext] {
+		return ext
+	}
+	return ""
+}
+
+// Turn an uploaded point cloud into an STL of splats, so the rest of the
+// pipeline can treat it like any other model
+func convertPointCloud(path, format, stlPath string) error {
+	var points []fauxgl.Vector
+	var err error
+	switch format {
+	case "xyz":
+		points, err = loadXYZ(path)
+	case "pcd":
+		points, err = loadPCD(path)
+	default:
+		err = fmt.Errorf("unsupported point cloud format %q", format)
+	}
+	if err != nil {
+		return err
+	}
+	if len(points) == 0 {
+		return fmt.Errorf("point cloud has no points")
+	}
+	return splatMesh(points).SaveSTL(stlPath)
+}
+
+// Read whitespace-separated "x y z" lines; further columns (normals, colors)
+// are ignored, as are blank lines and # comments
+func loadXYZ(path string) ([]fauxgl.Vector, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var points []fauxgl.Vector
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		p, err := parsePoint(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		points = append(points, p)
+	}
+	return points, scanner.Err()
+}
+
+func parsePoint(fields []string) (fauxgl.Vector, error) {
+	if len(fields) < 3 {
+		return fauxgl.Vector{}, fmt.Errorf("expected x y z")
+	}
+	var xyz [3]float64
+	for i := range xyz {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return fauxgl.Vector{}, fmt.Errorf("invalid coordinate %q", fields[i])
+		}
+		xyz[i] = v
+	}
+	return fauxgl.Vector{xyz[0], xyz[1], xyz[2]}, nil
+}
+
+// Read a PCL point cloud with ASCII or uncompressed binary data. Only the x,
+// y, and z fields are used. Points with NaN coordinates, which PCL uses for
+// missing measurements, are skipped.
+func loadPCD(path string) ([]fauxgl.Vector, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	var fields, types []string
+	var sizes, counts []int
+	points := -1
+	data := ""
+	for data == "" {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("incomplete PCD header")
+		}
+		words := strings.Fields(line)
+		if len(words) == 0 || strings.HasPrefix(words[0], "#") {
+			continue
+		}
+		switch strings.ToUpper(words[0]) {
+		case "FIELDS":
+			fields = words[1:]
+		case "SIZE":
+			sizes, err = atoiAll(words[1:])
+		case "TYPE":
+			types = words[1:]
+		case "COUNT":
+			counts, err = atoiAll(words[1:])
+		case "POINTS":
+			if len(words) > 1 {
+				points, err = strconv.Atoi(words[1])
+			}
+		case "DATA":
+			if len(words) > 1 {
+				data = strings.ToLower(words[1])
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid PCD header line %q", strings.TrimSpace(line))
+		}
+	}
+	if counts == nil {
+		counts = make([]int, len(fields))
+		for i := range counts {
+			counts[i] = 1
+		}
+	}
+	if len(sizes) != len(fields) || len(types) != len(fields) || len(counts) != len(fields) || points < 0 {
+		return nil, fmt.Errorf("inconsistent PCD header")
+	}
+
+	// Position of x, y, and z among the values of one point, in bytes, and
+	// their float sizes
+	column := [3]int{-1, -1, -1}
+	var offset, size [3]int
+	values, rowSize := 0, 0
+	for i, name := range fields {
+		if sizes[i] != 1 && sizes[i] != 2 && sizes[i] != 4 && sizes[i] != 8 {
+			return nil, fmt.Errorf("PCD field %s has invalid size %d", name, sizes[i])
+		}
+		if counts[i] < 1 || counts[i] > MaxPCDRowSize {
+			return nil, fmt.Errorf("PCD field %s has invalid count %d", name, counts[i])
+		}
+		if axis := strings.Index("xyz", name); len(name) == 1 && axis >= 0 {
+			if types[i] != "F" || (sizes[i] != 4 && sizes[i] != 8) {
+				return nil, fmt.Errorf("PCD field %s must be a float", name)
+			}
+			column[axis], offset[axis], size[axis] = values, rowSize, sizes[i]
+		}
+		values += counts[i]
+		rowSize += sizes[i] * counts[i]
+		if rowSize > MaxPCDRowSize {
+			return nil, fmt.Errorf("PCD points are over %d bytes", MaxPCDRowSize)
+		}
+	}
+	if column[0] < 0 || column[1] < 0 || column[2] < 0 {
+		return nil, fmt.Errorf("PCD file has no x, y, z fields")
+	}
+	for axis := range column {
+		if column[axis] >= values || offset[axis]+size[axis] > rowSize {
+			return nil, fmt.Errorf("PCD field %c lies outside the point", "xyz"[axis])
+		}
+	}
+
+	var cloud []fauxgl.Vector
+	add := func(p fauxgl.Vector) {
+		if !math.IsNaN(p.X+p.Y+p.Z) && !math.IsInf(p.X+p.Y+p.Z, 0) {
+			cloud = append(cloud, p)
+		}
+	}
+	switch data {
+	case "ascii":
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			words := strings.Fields(scanner.Text())
+			if len(words) == 0 {
+				continue
+			}
+			if len(words) < values {
+				return nil, fmt.Errorf("short PCD point %q", scanner.Text())
+			}
+			var xyz [3]float64
+			for axis := range xyz {
+				v, err := strconv.ParseFloat(words[column[axis]], 64)
+				if err != nil {
+					return nil, fmt.Errorf("invalid coordinate %q", words[column[axis]])
+				}
+				xyz[axis] = v
+			}
+			add(fauxgl.Vector{xyz[0], xyz[1], xyz[2]})
+		}
+		return cloud, scanner.Err()
+	case "binary":
+		row := make([]byte, rowSize)
+		read := func(axis int) float64 {
+			if size[axis] == 8 {
+				return math.Float64frombits(binary.LittleEndian.Uint64(row[offset[axis]:]))
+			}
+			return float64(math.Float32frombits(binary.LittleEndian.Uint32(row[offset[axis]:])))
+		}
+		for i := 0; i < points; i++ {
+			if _, err := io.ReadFull(reader, row); err != nil {
+				return nil, fmt.Errorf("truncated PCD data: %w", err)
+			}
+			add(fauxgl.Vector{read(0), read(1), read(2)})
+		}
+		return cloud, nil
+	default:
+		return nil, fmt.Errorf("unsupported PCD data encoding %q", data)
+	}
+}
+
+func atoiAll(words []string) ([]int, error) {
+	ints := make([]int, len(words))
+	for i, w := range words {
+		n, err := strconv.Atoi(w)
+		if err != nil {
+			return nil, err
+		}
+		ints[i] = n
+	}
+	return ints, nil
+}
+
+// Mesh with a small octahedron at every point, sized from the average point
+// spacing so neighboring splats just touch. Shaded like any mesh, they read
+// as a continuous surface on dense scans.
+func splatMesh(points []fauxgl.Vector) *fauxgl.Mesh {
+	stride := 1
+	if len(points) > MaxSplatPoints {
+		stride = (len(points) + MaxSplatPoints - 1) / MaxSplatPoints
+	}
+
+	// Scans sample surfaces, so the spacing goes with the square root of the
+	// area per point; the bounding box's surface stands in for the scan's
+	box := fauxgl.Box{Min: points[0], Max: points[0]}
+	for _, p := range points {
+		box = box.Extend(fauxgl.Box{Min: p, Max: p})
+	}
+	size := box.Size()
+	area := 2 * (size.X*size.Y + size.Y*size.Z + size.X*size.Z)
+	radius := SplatScale * math.Sqrt(area/float64((len(points)+stride-1)/stride))
+	if radius == 0 || math.IsNaN(radius) {
+		radius = 1
+	}
+
+	axes := []fauxgl.Vector{{radius, 0, 0}, {0, radius, 0}, {0, 0, radius}}
+	mesh := fauxgl.NewEmptyMesh()
+	for i := 0; i < len(points); i += stride {
+		p := points[i]
+		// Eight faces, one per octant, wound outward
+		for _, sx := range []float64{1, -1} {
+			for _, sy := range []float64{1, -1} {
+				for _, sz := range []float64{1, -1} {
+					a := p.Add(axes[0].MulScalar(sx))
+					b := p.Add(axes[1].MulScalar(sy))
+					c := p.Add(axes[2].MulScalar(sz))
+					if sx*sy*sz < 0 {
+						a, b = b, a
+					}
+					mesh.Triangles = append(mesh.Triangles, fauxgl.NewTriangleForPoints(a, b, c))
+				}
+			}
+		}
+	}
+	return mesh
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writePCD(t *testing.T, header string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "cloud.pcd")
+	content := append([]byte(strings.TrimSpace(header)+"\n"), data...)
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func float32s(values ...float32) []byte {
+	var buf bytes.Buffer
+	for _, v := range values {
+		binary.Write(&buf, binary.LittleEndian, math.Float32bits(v))
+	}
+	return buf.Bytes()
+}
+
+func TestLoadPCDRejectsMalformedHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		data   []byte
+	}{
+		{
+			name:   "zero count on a coordinate, binary",
+			header: "FIELDS y z x\nSIZE 4 4 4\nTYPE F F F\nCOUNT 1 1 0\nPOINTS 1\nDATA binary",
+			data:   float32s(1, 2),
+		},
+		{
+			name:   "zero count on a coordinate, ascii",
+			header: "FIELDS y z x\nSIZE 4 4 4\nTYPE F F F\nCOUNT 1 1 0\nPOINTS 1\nDATA ascii",
+			data:   []byte("1 2\n"),
+		},
+		{
+			name:   "negative count",
+			header: "FIELDS x y z\nSIZE 4 4 4\nTYPE F F F\nCOUNT 1 1 -1\nPOINTS 1\nDATA binary",
+			data:   float32s(1, 2, 3),
+		},
+		{
+			name:   "negative size",
+			header: "FIELDS x y z rgb\nSIZE 4 4 4 -8\nTYPE F F F U\nCOUNT 1 1 1 1\nPOINTS 1\nDATA binary",
+			data:   float32s(1, 2, 3),
+		},
+		{
+			name:   "zero size",
+			header: "FIELDS x y z rgb\nSIZE 4 4 4 0\nTYPE F F F U\nCOUNT 1 1 1 1\nPOINTS 1\nDATA binary",
+			data:   float32s(1, 2, 3),
+		},
+		{
+			name:   "odd size",
+			header: "FIELDS x y z rgb\nSIZE 4 4 4 3\nTYPE F F F U\nCOUNT 1 1 1 1\nPOINTS 1\nDATA binary",
+			data:   float32s(1, 2, 3, 4),
+		},
+		{
+			name:   "point larger than the limit",
+			header: "FIELDS x y z extra\nSIZE 4 4 4 8\nTYPE F F F F\nCOUNT 1 1 1 100000\nPOINTS 1\nDATA binary",
+			data:   float32s(1, 2, 3),
+		},
+		{
+			name:   "coordinate that isn't a float",
+			header: "FIELDS x y z\nSIZE 4 4 2\nTYPE F F F\nCOUNT 1 1 1\nPOINTS 1\nDATA binary",
+			data:   float32s(1, 2, 3),
+		},
+		{
+			name:   "missing coordinate",
+			header: "FIELDS x y\nSIZE 4 4\nTYPE F F\nCOUNT 1 1\nPOINTS 1\nDATA binary",
+			data:   float32s(1, 2),
+		},
+		{
+			name:   "sizes don't match fields",
+			header: "FIELDS x y z\nSIZE 4 4\nTYPE F F F\nCOUNT 1 1 1\nPOINTS 1\nDATA binary",
+			data:   float32s(1, 2, 3),
+		},
+		{
+			name:   "short ascii point",
+			header: "FIELDS x y z\nSIZE 4 4 4\nTYPE F F F\nCOUNT 1 1 1\nPOINTS 1\nDATA ascii",
+			data:   []byte("1 2\n"),
+		},
+		{
+			name:   "truncated binary data",
+			header: "FIELDS x y z\nSIZE 4 4 4\nTYPE F F F\nCOUNT 1 1 1\nPOINTS 2\nDATA binary",
+			data:   float32s(1, 2, 3),
+		},
+		{
+			name:   "compressed data",
+			header: "FIELDS x y z\nSIZE 4 4 4\nTYPE F F F\nCOUNT 1 1 1\nPOINTS 1\nDATA binary_compressed",
+			data:   float32s(1, 2, 3),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, err := loadPCD(writePCD(t, tt.header, tt.data))
+			if err == nil {
+				t.Fatalf("loadPCD accepted the file, got %d points", len(points))
+			}
+		})
+	}
+}
+
+func TestLoadPCDReadsPoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		data   []byte
+	}{
+		{
+			name:   "binary with extra fields",
+			header: "FIELDS z rgb x y\nSIZE 4 4 4 4\nTYPE F U F F\nCOUNT 1 1 1 1\nPOINTS 2\nDATA binary",
+			data:   append(float32s(3, 0, 1, 2), float32s(6, 0, 4, 5)...),
+		},
+		{
+			name:   "ascii with a NaN point",
+			header: "FIELDS x y z\nSIZE 4 4 4\nTYPE F F F\nCOUNT 1 1 1\nPOINTS 3\nDATA ascii",
+			data:   []byte("1 2 3\nnan nan nan\n4 5 6\n"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			points, err := loadPCD(writePCD(t, tt.header, tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(points) != 2 {
+				t.Fatalf("got %d points, want 2", len(points))
+			}
+			if p := points[1]; p.X != 4 || p.Y != 5 || p.Z != 6 {
+				t.Errorf("second point is %v, want (4, 5, 6)", p)
+			}
+		})
+	}
+}
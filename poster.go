@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	MinImageSize      = 64
+	MaxImageSize      = 16384 // Largest side of a poster render
+	MaxWebPPosterSize = 4096  // WebP posters are encoded whole, so they stay smaller
+	TileSize          = 1024  // Side of the tiles larger images are rendered in
+	pngChunkSize      = 64 << 10
+)
+
+// Read the size form field into the options
+func parseSizeOptions(r *http.Request, opts *RenderOptions) error {
+	v := r.FormValue("size")
+	if v == "" {
+		return nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size < MinImageSize || size > MaxImageSize {
+		return fmt.Errorf("size must be between %d and %d pixels", MinImageSize, MaxImageSize)
+	}
+	// The standard size keeps its cache key
+	if size == Width {
+		return nil
+	}
+	if opts.Frames > 0 || opts.BuildFrames > 0 || opts.Stereo != "" {
+		return fmt.Errorf("size can't be combined with frames, build_frames, or stereo")
+	}
+	// A lone png is already cleared from the formats, so only webp is left
+	if opts.Formats != nil && !slices.Equal(opts.Formats, []string{"webp"}) {
+		return fmt.Errorf("size only works with a single png or webp format")
+	}
+	if slices.Equal(opts.Formats, []string{"webp"}) && size > MaxWebPPosterSize {
+		return fmt.Errorf("size must be at most %d pixels for webp", MaxWebPPosterSize)
+	}
+	opts.Size = size
+	return nil
+}
+
+// Pixels around each tile rendered and thrown away, so outlines, blur, and
+// filters near tile edges see the same neighbors as in one big image
+func (sc *scene) tileMargin() int {
+	margin := len(sc.filters)
+	if sc.outline != nil {
+		margin += sc.outline.Width
+	}
+	if sc.dof != nil {
+		margin += int(math.Ceil(sc.dof.Aperture))
+	}
+	return margin
+}
+
+// Render a size×size view as a PNG, one row of tiles at a time, so memory
+// stays bounded by a row of tiles however large the image is. A .webp
+// output is assembled whole and encoded at the end instead. onTile is called
+// after each tile with the number done and the total.
+func renderPoster(ctx context.Context, sc *scene, cam camera, size int, outputPath string, onTile func(done, total int)) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	out := bufio.NewWriter(file)
+	if filepath.Ext(outputPath) == ".webp" {
+		im := image.NewNRGBA(image.Rect(0, 0, size, size))
+		err := renderPosterRows(ctx, sc, cam, size, onTile, func(rows *image.NRGBA, y0 int) error {
+			draw.Draw(im, rows.Bounds().Add(image.Pt(0, y0)), rows, rows.Bounds().Min, draw.Src)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := encodeWebP(out, im); err != nil {
+			return err
+		}
+	} else {
+		png, err := newPNGStream(out, size, size)
+		if err != nil {
+			return err
+		}
+		err = renderPosterRows(ctx, sc, cam, size, onTile, func(rows *image.NRGBA, y0 int) error {
+			return png.writeRows(rows)
+		})
+		if err != nil {
+			return err
+		}
+		if err := png.close(); err != nil {
+			return err
+		}
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Render the view a row of tiles at a time, handing each finished band of
+// rows, annotated and branded, to emit along with its top row
+func renderPosterRows(ctx context.Context, sc *scene, cam camera, size int, onTile func(done, total int), emit func(rows *image.NRGBA, y0 int) error) error {
+	// Tiles are too small to meter on their own
+	if slices.Contains(sc.filters, "autoexposure") {
+		renderView(sc, cam, ExposureMeterSize, ExposureMeterSize)
+	}
+
+	margin := sc.tileMargin()
+	tiles := (size + TileSize - 1) / TileSize
+	strip := image.NewNRGBA(image.Rect(0, 0, size, TileSize))
+	s := float64(size)
+	for ty := 0; ty < tiles; ty++ {
+		y0 := ty * TileSize
+		h := min(TileSize, size-y0)
+		for tx := 0; tx < tiles; tx++ {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			x0 := tx * TileSize
+			w := min(TileSize, size-x0)
+			tile := cam
+			tile.window = &viewWindow{
+				left:   float64(x0-margin) / s,
+				top:    float64(y0-margin) / s,
+				right:  float64(x0+w+margin) / s,
+				bottom: float64(y0+h+margin) / s,
+			}
+			im := renderView(sc, tile, w+2*margin, h+2*margin)
+			draw.Draw(strip, image.Rect(x0, 0, x0+w, h), im, im.Bounds().Min.Add(image.Pt(margin, margin)), draw.Src)
+			onTile(ty*tiles+tx+1, tiles*tiles)
+		}
+		rows := strip.SubImage(image.Rect(0, 0, size, h)).(*image.NRGBA)
+		sc.drawAnnotationStrip(rows, y0, image.Pt(size, size), cam)
+		applyBrandingStrip(rows, y0, image.Pt(size, size))
+		if err := emit(rows, y0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PNG encoder that takes the image a band of rows at a time, for images too
+// large to hold in memory at once. Rows use the Up filter, which suits
+// renders with large flat areas.
+type pngStream struct {
+	w       io.Writer
+	idat    *bufio.Writer // Chunks compressed data into IDAT chunks
+	zw      *zlib.Writer
+	prev    []byte
+	row     []byte
+	written int
+	height  int
+}
+
+func newPNGStream(w io.Writer, width, height int) (*pngStream, error) {
+	if _, err := io.WriteString(w, "\x89PNG\r\n\x1a\n"); err != nil {
+		return nil, err
+	}
+	var header [13]byte
+	binary.BigEndian.PutUint32(header[0:], uint32(width))
+	binary.BigEndian.PutUint32(header[4:], uint32(height))
+	header[8] = 8 // Bits per channel
+	header[9] = 6 // RGBA, not premultiplied
+	if err := writePNGChunk(w, "IHDR", header[:]); err != nil {
+		return nil, err
+	}
+	p := &pngStream{w: w, prev: make([]byte, 4*width), row: make([]byte, 1+4*width), height: height}
+	p.idat = bufio.NewWriterSize(idatWriter{w}, pngChunkSize)
+	p.zw = zlib.NewWriter(p.idat)
+	return p, nil
+}
+
+// Add the next rows of the image
+func (p *pngStream) writeRows(im *image.NRGBA) error {
+	b := im.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		pix := im.Pix[im.PixOffset(b.Min.X, y):][:len(p.prev)]
+		p.row[0] = 2 // Up filter
+		for i, v := range pix {
+			p.row[1+i] = v - p.prev[i]
+		}
+		copy(p.prev, pix)
+		if _, err := p.zw.Write(p.row); err != nil {
+			return err
+		}
+		p.written++
+	}
+	return nil
+}
+
+// Finish the image once every row is written
+func (p *pngStream) close() error {
+	if p.written != p.height {
+		return fmt.Errorf("png has %d of %d rows", p.written, p.height)
+	}
+	if err := p.zw.Close(); err != nil {
+		return err
+	}
+	if err := p.idat.Flush(); err != nil {
+		return err
+	}
+	return writePNGChunk(p.w, "IEND", nil)
+}
+
+// Writes everything it's given as one IDAT chunk
+type idatWriter struct {
+	w io.Writer
+}
+
+func (w idatWriter) Write(data []byte) (int, error) {
+	if err := writePNGChunk(w.w, "IDAT", data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func writePNGChunk(w io.Writer, kind string, data []byte) error {
+	var length, sum [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(data)
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	for _, part := range [][]byte{length[:], []byte(kind), data, sum[:]} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Report a finished tile of a poster render to the job's subscribers
+func pushTileProgress(jobID string, tile, total int) {
+	// A sandboxed render hands its progress to the server process
+	if sandboxOutput != nil {
+		writeSandboxMessage(sandboxMessage{Tile: &sandboxTile{Tile: tile, Total: total}})
+		return
+	}
+
+	mu.Lock()
+	if job, ok := jobs[jobID]; ok {
+		appendJobEvent(job, wsEvent{Type: "tile", JobID: jobID, Frame: tile, Total: total})
+	}
+	mu.Unlock()
+	if store != nil {
+		publishTileProgress(jobID, tile, total)
+		return
+	}
+	sendTileProgress(jobID, tile, total)
+}
+
+// Send a tile event to this instance's subscribers of a job
+func sendTileProgress(jobID string, tile, total int) {
+	mu.Lock()
+	conns := append([]*websocket.Conn(nil), jobConnections[jobID]...)
+	mu.Unlock()
+	event := wsEvent{Type: "tile", JobID: jobID, Frame: tile, Total: total}
+	for _, conn := range conns {
+		if err := conn.WriteMessage(websocket.TextMessage, encodeEvent(wsVersion(conn), event)); err != nil {
+			log.Printf("Failed to send tile progress to job ID %s: %v\n", jobID, err)
+			conn.Close()
+			removeConnection(jobID, conn)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Connection to a Postgres database used as the job store in stateless mode
+type PostgresConfig struct {
+	DSN string `json:"dsn"` // e.g. postgres://render:secret@db/render?sslmode=require
+}
+
+// Schema changes, applied in order and recorded in schema_migrations. Only
+// ever append.
+var postgresMigrations = []string{
+	`CREATE TABLE jobs (
+		id         text PRIMARY KEY,
+		status     text NOT NULL,
+		file_hash  text NOT NULL,
+		cache_key  text NOT NULL,
+		options    jsonb NOT NULL,
+		stats      jsonb,
+		created_at timestamptz NOT NULL,
+		started_at timestamptz,
+		updated_at timestamptz NOT NULL,
+		record     jsonb NOT NULL
+	);
+	CREATE INDEX jobs_file_hash ON jobs (file_hash);
+	CREATE INDEX jobs_created_at ON jobs (created_at);
+	CREATE TABLE in_flight (
+		cache_key  text PRIMARY KEY,
+		job_id     text NOT NULL,
+		claimed_at timestamptz NOT NULL DEFAULT now()
+	);
+	CREATE TABLE outputs (
+		cache_key  text PRIMARY KEY,
+		name       text NOT NULL,
+		created_at timestamptz NOT NULL DEFAULT now()
+	);`,
+	`CREATE TABLE output_accesses (
+		key      text NOT NULL,
+		kind     text NOT NULL,
+		referrer text,
+		at       timestamptz NOT NULL
+	);
+	CREATE INDEX output_accesses_key_at ON output_accesses (key, at);`,
+}
+
+const postgresMigrationLock int64 = 0x72656e646572 // Advisory lock key, so concurrently starting instances migrate one at a time
+
+// Job and hash store kept in Postgres. Jobs are never deleted, so the table
+// doubles as a render log for reporting; finished jobs just stop being served
+// after JobRetention.
+type postgresStore struct {
+	db *sql.DB
+}
+
+func newPostgresStore(cfg PostgresConfig) (*postgresStore, error) {
+	if cfg.DSN == "" {
+		return nil, fmt.Errorf("postgres needs a dsn")
+	}
+	db, err := sql.Open("postgres", cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if err := migratePostgres(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate postgres: %w", err)
+	}
+	return &postgresStore{db: db}, nil
+}
+
+// Bring the schema up to date
+func migratePostgres(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+		return err
+	}
+	var version int
+	if err := tx.QueryRow(`SELECT coalesce(max(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(postgresMigrations); i++ {
+		if _, err := tx.Exec(postgresMigrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// JSON goes in as text; lib/pq would send []byte as bytea
+func (s *postgresStore) SaveJob(job Job) error {
+	record, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	options, err := json.Marshal(job.Options)
+	if err != nil {
+		return err
+	}
+	var stats *string // NULL until rendered
+	if job.Stats != nil {
+		data, err := json.Marshal(job.Stats)
+		if err != nil {
+			return err
+		}
+		text := string(data)
+		stats = &text
+	}
+	var startedAt *time.Time
+	if !job.StartedAt.IsZero() {
+		startedAt = &job.StartedAt
+	}
+
+	_, err = s.db.Exec(`INSERT INTO jobs (id, status, file_hash, cache_key, options, stats, created_at, started_at, updated_at, record)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT (id) DO UPDATE SET status = $2, stats = $6, started_at = $8, updated_at = $9, record = $10`,
+		job.ID, job.Status, job.FileHash, job.CacheKey, string(options), stats, job.CreatedAt, startedAt, job.UpdatedAt, string(record))
+	return err
+}
+
+func (s *postgresStore) LoadJob(id string) (*Job, error) {
+	var record []byte
+	err := s.db.QueryRow(`SELECT record FROM jobs
+		WHERE id = $1 AND (status NOT IN ($2, $3) OR updated_at > $4)`,
+		id, JobDone, JobFailed, time.Now().Add(-JobRetention)).Scan(&record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(record, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *postgresStore) ClaimCacheKey(cacheKey, id string) (string, error) {
+	// Claims older than JobPendingTTL belong to jobs lost in a crash
+	var owner string
+	err := s.db.QueryRow(`INSERT INTO in_flight (cache_key, job_id) VALUES ($1, $2)
+		ON CONFLICT (cache_key) DO UPDATE SET job_id = excluded.job_id, claimed_at = now()
+		WHERE in_flight.claimed_at < $3
+		RETURNING job_id`, cacheKey, id, time.Now().Add(-JobPendingTTL)).Scan(&owner)
+	if err == nil {
+		return "", nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return "", err
+	}
+	existing, err := s.FindCacheKey(cacheKey)
+	if err == nil && existing == "" {
+		return s.ClaimCacheKey(cacheKey, id) // Released in between, try again
+	}
+	return existing, err
+}
+
+func (s *postgresStore) FindCacheKey(cacheKey string) (string, error) {
+	var id string
+	err := s.db.QueryRow(`SELECT job_id FROM in_flight WHERE cache_key = $1 AND claimed_at >= $2`,
+		cacheKey, time.Now().Add(-JobPendingTTL)).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
+
+func (s *postgresStore) ReleaseCacheKey(cacheKey, id string) error {
+	_, err := s.db.Exec(`DELETE FROM in_flight WHERE cache_key = $1 AND job_id = $2`, cacheKey, id)
+	return err
+}
+
+func (s *postgresStore) LookupOutput(cacheKey string) (string, bool, error) {
+	var name string
+	err := s.db.QueryRow(`SELECT name FROM outputs WHERE cache_key = $1`, cacheKey).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return name, err == nil, err
+}
+
+func (s *postgresStore) StaleJobs(before time.Time) ([]string, error) {
+	rows, err := s.db.Query(`SELECT id FROM jobs WHERE status IN ($1, $2) AND updated_at < $3`, JobQueued, JobProcessing, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var stale []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return stale, err
+		}
+		stale = append(stale, id)
+	}
+	return stale, rows.Err()
+}
+
+func (s *postgresStore) RecordOutput(cacheKey, name string) error {
+	_, err := s.db.Exec(`INSERT INTO outputs (cache_key, name) VALUES ($1, $2)
+		ON CONFLICT (cache_key) DO UPDATE SET name = excluded.name`, cacheKey, name)
+	return err
+}
+
+// Every access is a row, so the table doubles as an access log
+func (s *postgresStore) RecordAccess(key string, access OutputAccess) error {
+	var referrer *string // NULL for direct requests
+	if access.Referrer != "" {
+		referrer = &access.Referrer
+	}
+	_, err := s.db.Exec(`INSERT INTO output_accesses (key, kind, referrer, at) VALUES ($1, $2, $3, $4)`,
+		key, access.Kind, referrer, access.Time)
+	return err
+}
+
+func (s *postgresStore) LoadAnalytics(key string) (OutputAnalytics, error) {
+	var a OutputAnalytics
+	var firstAt, lastAt sql.NullTime
+	err := s.db.QueryRow(`SELECT count(*) FILTER (WHERE kind = $2), count(*) FILTER (WHERE kind = $3), min(at), max(at)
+		FROM output_accesses WHERE key = $1`, key, AccessView, AccessDownload).Scan(&a.Views, &a.Downloads, &firstAt, &lastAt)
+	if err != nil || !firstAt.Valid {
+		return a, err
+	}
+	a.FirstAt, a.LastAt = &firstAt.Time, &lastAt.Time
+
+	if a.Referrers, err = s.referrerCounts(key); err != nil {
+		return a, err
+	}
+	rows, err := s.db.Query(`SELECT at, kind, coalesce(referrer, '') FROM output_accesses
+		WHERE key = $1 ORDER BY at DESC LIMIT $2`, key, MaxRecentAccesses)
+	if err != nil {
+		return a, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var access OutputAccess
+		if err := rows.Scan(&access.Time, &access.Kind, &access.Referrer); err != nil {
+			return a, err
+		}
+		a.Recent = append(a.Recent, access)
+	}
+	return a, rows.Err()
+}
+
+func (s *postgresStore) AnalyticsSummary(top int) (AnalyticsSummary, error) {
+	var summary AnalyticsSummary
+	err := s.db.QueryRow(`SELECT count(*) FILTER (WHERE kind = $1), count(*) FILTER (WHERE kind = $2), count(DISTINCT key)
+		FROM output_accesses`, AccessView, AccessDownload).Scan(&summary.Views, &summary.Downloads, &summary.Outputs)
+	if err != nil {
+		return summary, err
+	}
+	if summary.Referrers, err = s.referrerCounts(""); err != nil {
+		return summary, err
+	}
+
+	rows, err := s.db.Query(`SELECT key, count(*) FILTER (WHERE kind = $1), count(*) FILTER (WHERE kind = $2)
+		FROM output_accesses GROUP BY key ORDER BY count(*) DESC, key LIMIT $3`, AccessView, AccessDownload, top)
+	if err != nil {
+		return summary, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key string
+		var usage OutputUsage
+		if err := rows.Scan(&key, &usage.Views, &usage.Downloads); err != nil {
+			return summary, err
+		}
+		usage.Tenant, usage.Name = splitAnalyticsKey(key)
+		summary.Top = append(summary.Top, usage)
+	}
+	return summary, rows.Err()
+}
+
+// The MaxReferrers most common referring hosts of an output, or of all
+// outputs when key is empty
+func (s *postgresStore) referrerCounts(key string) (map[string]int64, error) {
+	rows, err := s.db.Query(`SELECT referrer, count(*) FROM output_accesses
+		WHERE ($1 = '' OR key = $1) AND referrer IS NOT NULL
+		GROUP BY referrer ORDER BY count(*) DESC LIMIT $2`, key, MaxReferrers)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var host string
+		var n int64
+		if err := rows.Scan(&host, &n); err != nil {
+			return counts, err
+		}
+		counts[host] = n
+	}
+	return counts, rows.Err()
+}
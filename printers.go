@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+
+	"github.com/fogleman/fauxgl"
+)
+
+// A printer's build volume, configured by the operator
+type PrinterProfile struct {
+	Name string  `json:"name"`
+	BedX float64 `json:"bed_x"` // Build volume in mm
+	BedY float64 `json:"bed_y"`
+	BedZ float64 `json:"bed_z"`
+}
+
+// Whether a model fits a printer, and how it has to be placed
+type PrinterFit struct {
+	Printer  string  `json:"printer"`
+	Fits     bool    `json:"fits"`
+	Up       string  `json:"up,omitempty"`       // Model axis pointing up: "z" as uploaded (after any rotation), or "x"/"y" when laid on its side
+	Rotation float64 `json:"rotation,omitempty"` // Turn about the up axis in degrees needed to fit the bed
+}
+
+// Look up a configured printer by name
+func findPrinter(name string) (PrinterProfile, bool) {
+	for _, p := range config.Printers {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return PrinterProfile{}, false
+}
+
+// Check the model against every configured printer. Each of the three axes is
+// tried as up, preferring the current orientation, and the footprint is turned
+// in 1° steps to find one that fits the bed.
+func checkPrinterFits(mesh *fauxgl.Mesh, mmPerUnit float64) []PrinterFit {
+	if len(config.Printers) == 0 {
+		return nil
+	}
+
+	// Footprint hull and height for each candidate up axis, in mm
+	type pose struct {
+		up     string
+		hull   []fauxgl.Vector
+		height float64
+	}
+	var poses []pose
+	for _, up := range []string{"z", "x", "y"} {
+		var points []fauxgl.Vector
+		lo, hi := math.Inf(1), math.Inf(-1)
+		for _, t := range mesh.Triangles {
+			for _, v := range []fauxgl.Vector{t.V1.Position, t.V2.Position, t.V3.Position} {
+				v = v.MulScalar(mmPerUnit)
+				var p fauxgl.Vector
+				var h float64
+				switch up {
+				case "z":
+					p, h = fauxgl.Vector{v.X, v.Y, 0}, v.Z
+				case "x":
+					p, h = fauxgl.Vector{v.Y, v.Z, 0}, v.X
+				case "y":
+					p, h = fauxgl.Vector{v.Z, v.X, 0}, v.Y
+				}
+				points = append(points, p)
+				lo, hi = math.Min(lo, h), math.Max(hi, h)
+			}
+		}
+		poses = append(poses, pose{up, convexHull2D(points), hi - lo})
+	}
+
+	var fits []PrinterFit
+	for _, printer := range config.Printers {
+		fit := PrinterFit{Printer: printer.Name}
+	search:
+		for _, p := range poses {
+			if p.height > printer.BedZ {
+				continue
+			}
+			for deg := 0; deg < 180; deg++ {
+				w, d := footprint(p.hull, fauxgl.Radians(float64(deg)))
+				if (w <= printer.BedX && d <= printer.BedY) || (w <= printer.BedY && d <= printer.BedX) {
+					fit.Fits, fit.Up, fit.Rotation = true, p.up, float64(deg)
+					break search
+				}
+			}
+		}
+		fits = append(fits, fit)
+	}
+	return fits
+}
+
+// Width and depth of a 2D hull's bounding rectangle after turning it by angle
+func footprint(hull []fauxgl.Vector, angle float64) (float64, float64) {
+	sin, cos := math.Sincos(angle)
+	minX, maxX := math.Inf(1), math.Inf(-1)
+	minY, maxY := math.Inf(1), math.Inf(-1)
+	for _, p := range hull {
+		x := p.X*cos - p.Y*sin
+		y := p.X*sin + p.Y*cos
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	return maxX - minX, maxY - minY
+}
+
+// Outline of a w×d bed lying just under the plate point center
+func bedOutline(center fauxgl.Vector, w, d float64) *fauxgl.Mesh {
+	bar := 0.01
+	z := center.Z - bar/2
+
+	outline := fauxgl.NewEmptyMesh()
+	for _, edge := range []struct{ center, size fauxgl.Vector }{
+		{fauxgl.Vector{center.X, center.Y - d/2, z}, fauxgl.Vector{w + bar, bar, bar}},
+		{fauxgl.Vector{center.X, center.Y + d/2, z}, fauxgl.Vector{w + bar, bar, bar}},
+		{fauxgl.Vector{center.X - w/2, center.Y, z}, fauxgl.Vector{bar, d + bar, bar}},
+		{fauxgl.Vector{center.X + w/2, center.Y, z}, fauxgl.Vector{bar, d + bar, bar}},
+	} {
+		side := fauxgl.NewCube() // Unit cube centered on the origin
+		side.Transform(fauxgl.Scale(edge.size).Translate(edge.center))
+		outline.Add(side)
+	}
+	return outline
+}
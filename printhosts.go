@@ -0,0 +1,513 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// Print hosts whose stored G-code gets thumbnails
+const (
+	PrintHostOctoPrint = "octoprint"
+	PrintHostPrusaLink = "prusalink"
+)
+
+const (
+	DefaultPrintHostPoll = 60 * time.Second
+	DefaultThumbnailSize = "220x124"
+	MaxPrintFileMB       = 512 // Largest G-code file downloaded from a print host
+)
+
+// Slicer thumbnail blocks open with this comment; files that have one are left alone
+const thumbnailBlockStart = "; thumbnail begin "
+
+// A printer's OctoPrint or PrusaLink instance. Every G-code file it stores
+// that has no thumbnail is rendered, queued or not, and the render is written
+// into the file as the slicer thumbnail comment block PrusaSlicer writes,
+// which is what printer dashboards show. STLs have nowhere to carry one.
+type PrintHostConfig struct {
+	Type           string            `json:"type"`            // "octoprint" or "prusalink"
+	URL            string            `json:"url"`             // Base URL, e.g. http://octopi.local
+	APIKey         string            `json:"api_key"`         // Sent as X-Api-Key
+	Storage        string            `json:"storage"`         // PrusaLink storage to look at; "usb" when empty
+	PollSecs       int               `json:"poll_secs"`       // How often to look for new files; every 60 seconds when 0
+	ThumbnailSizes []string          `json:"thumbnail_sizes"` // WxH of each thumbnail written; 220x124 when empty
+	Options        map[string]string `json:"options"`         // Render option fields, as sent to /upload; must render a PNG
+}
+
+// A G-code file on a print host
+type printFile struct {
+	path     string // Path on the host, slash-separated, without a leading slash
+	download string // URL to download it from
+	version  string // Changes whenever the file does
+}
+
+type printHost interface {
+	list(ctx context.Context) ([]printFile, error)
+	// Save a file at localPath
+	download(ctx context.Context, file printFile, localPath string) error
+	// Replace a file with the local file at localPath
+	upload(ctx context.Context, file printFile, localPath string) error
+}
+
+// Returned by upload when the host won't replace the file now, e.g. while
+// it's printing
+var errPrintHostBusy = errors.New("print host is using the file")
+
+// Check a print host's settings and connect its API
+func newPrintHost(cfg PrintHostConfig) (printHost, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.New("print host url must be http or https")
+	}
+	for _, size := range cfg.ThumbnailSizes {
+		if _, _, err := parseThumbnailSize(size); err != nil {
+			return nil, err
+		}
+	}
+	r, err := optionsRequest(context.Background(), cfg.Options)
+	if err != nil {
+		return nil, err
+	}
+	opts, err := parseRenderOptions(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(opts.outputNames("")[0], ".png") {
+		return nil, errors.New("print host options must render a PNG")
+	}
+	api := printHostAPI{baseURL: strings.TrimSuffix(cfg.URL, "/"), apiKey: cfg.APIKey, client: &http.Client{Timeout: 5 * time.Minute}}
+	switch cfg.Type {
+	case PrintHostOctoPrint:
+		return &octoPrintHost{api}, nil
+	case PrintHostPrusaLink:
+		storage := cfg.Storage
+		if storage == "" {
+			storage = "usb"
+		}
+		return &prusaLinkHost{api, storage}, nil
+	}
+	return nil, fmt.Errorf("unknown print host type %q", cfg.Type)
+}
+
+func parseThumbnailSize(size string) (int, int, error) {
+	w, h, ok := strings.Cut(size, "x")
+	width, err1 := strconv.Atoi(w)
+	height, err2 := strconv.Atoi(h)
+	if !ok || err1 != nil || err2 != nil || width < 1 || height < 1 || width > Width || height > Height {
+		return 0, 0, fmt.Errorf("thumbnail size %q must be WxH, up to %dx%d", size, Width, Height)
+	}
+	return width, height, nil
+}
+
+// Look for new G-code files on a print host until shutdown, giving each one
+// without a thumbnail the render of its toolpaths
+func watchPrintHost(host printHost, cfg PrintHostConfig) {
+	poll := DefaultPrintHostPoll
+	if cfg.PollSecs > 0 {
+		poll = time.Duration(cfg.PollSecs) * time.Second
+	}
+	ctx := workerCtx
+	seen := make(map[string]string) // Version of each file already handled, by path
+	for {
+		files, err := host.list(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to list files on %s: %v", cfg.URL, err)
+		}
+		for _, file := range files {
+			if seen[file.path] == file.version {
+				continue
+			}
+			err := addPrintThumbnail(ctx, host, cfg, file)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, errPrintHostBusy) {
+				continue // Try again next time
+			}
+			if err != nil {
+				log.Printf("Failed to add a thumbnail to %s on %s: %v", file.path, cfg.URL, err)
+			}
+			seen[file.path] = file.version
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(poll):
+		}
+	}
+}
+
+// Render a G-code file's toolpaths and upload the file again with the render
+// as its thumbnails, unless it already has any
+func addPrintThumbnail(ctx context.Context, host printHost, cfg PrintHostConfig, file printFile) error {
+	dir, err := newJobWorkDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	local := filepath.Join(dir, path.Base(file.path))
+	if err := host.download(ctx, file, local); err != nil {
+		return err
+	}
+	if has, err := hasThumbnail(local); has || err != nil {
+		return err
+	}
+
+	r, err := optionsRequest(ctx, cfg.Options)
+	if err != nil {
+		return err
+	}
+	opts, err := parseRenderOptions(r)
+	if err != nil {
+		return err
+	}
+	analysis, err := parseAnalysisOptions(r)
+	if err != nil {
+		return err
+	}
+	src, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	workDir, fileHash, err := readModel(ctx, r, path.Base(file.path), src, MaxPrintFileMB)
+	src.Close()
+	if err != nil {
+		return err
+	}
+	cacheKey, err := renderModel(ctx, workDir, fileHash, opts, analysis)
+	if err != nil {
+		return err
+	}
+	blocks, err := thumbnailBlocks(ctx, outputObject(opts.outputNames(cacheKey)[0]), cfg.ThumbnailSizes)
+	if err != nil {
+		return err
+	}
+
+	withThumbnails := filepath.Join(dir, "thumbnailed-"+path.Base(file.path))
+	if err := prependToFile(local, withThumbnails, blocks); err != nil {
+		return err
+	}
+	if err := host.upload(ctx, file, withThumbnails); err != nil {
+		return err
+	}
+	log.Printf("Added a thumbnail to %s on %s", file.path, cfg.URL)
+	return nil
+}
+
+// Whether G-code already carries a slicer thumbnail, ours or the slicer's
+func hasThumbnail(local string) (bool, error) {
+	file, err := os.Open(local)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), thumbnailBlockStart) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// Slicer thumbnail comment blocks of a stored PNG, one per size, each scaled
+// to fit and centered
+func thumbnailBlocks(ctx context.Context, name string, sizes []string) (string, error) {
+	rc, err := storage.Open(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	im, err := png.Decode(rc)
+	rc.Close()
+	if err != nil {
+		return "", err
+	}
+	if len(sizes) == 0 {
+		sizes = []string{DefaultThumbnailSize}
+	}
+	var blocks strings.Builder
+	for _, size := range sizes {
+		width, height, err := parseThumbnailSize(size)
+		if err != nil {
+			return "", err
+		}
+		b := im.Bounds()
+		scale := min(float64(width)/float64(b.Dx()), float64(height)/float64(b.Dy()))
+		w, h := int(float64(b.Dx())*scale), int(float64(b.Dy())*scale)
+		x, y := (width-w)/2, (height-h)/2
+		thumb := image.NewNRGBA(image.Rect(0, 0, width, height))
+		draw.CatmullRom.Scale(thumb, image.Rect(x, y, x+w, y+h), im, b, draw.Src, nil)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, thumb); err != nil {
+			return "", err
+		}
+		data := base64.StdEncoding.EncodeToString(buf.Bytes())
+		fmt.Fprintf(&blocks, ";\n%s%dx%d %d\n", thumbnailBlockStart, width, height, len(data))
+		for len(data) > 0 {
+			n := min(len(data), 78)
+			fmt.Fprintf(&blocks, "; %s\n", data[:n])
+			data = data[n:]
+		}
+		blocks.WriteString("; thumbnail end\n;\n")
+	}
+	return blocks.String(), nil
+}
+
+// Write text followed by the contents of src to dst
+func prependToFile(src, dst, text string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, text)
+	if err == nil {
+		_, err = io.Copy(out, in)
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// What OctoPrint and PrusaLink have in common: a base URL and an API key
+// sent as X-Api-Key
+type printHostAPI struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func (a printHostAPI) do(req *http.Request) (*http.Response, error) {
+	req.Header.Set("X-Api-Key", a.apiKey)
+	return a.client.Do(req)
+}
+
+// Download a file, up to MaxPrintFileMB. Both hosts ask for the API key here
+// too.
+func (a printHostAPI) download(ctx context.Context, file printFile, local string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, file.download, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download answered %s", resp.Status)
+	}
+	dst, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	limit := int64(MaxPrintFileMB) << 20
+	n, err := io.Copy(dst, io.LimitReader(resp.Body, limit+1))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > limit {
+		err = fmt.Errorf("file is larger than %d MB", MaxPrintFileMB)
+	}
+	return err
+}
+
+func (a printHostAPI) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// OctoPrint's REST API, files on its local storage
+type octoPrintHost struct {
+	printHostAPI
+}
+
+type octoPrintFile struct {
+	Name     string          `json:"name"`
+	Path     string          `json:"path"`
+	Type     string          `json:"type"` // "machinecode" for G-code, "model", or "folder"
+	Size     int64           `json:"size"`
+	Date     int64           `json:"date"`
+	Refs     printFileRefs   `json:"refs"`
+	Children []octoPrintFile `json:"children"`
+}
+
+type printFileRefs struct {
+	Download string `json:"download"`
+}
+
+func (h *octoPrintHost) list(ctx context.Context) ([]printFile, error) {
+	var resp struct {
+		Files []octoPrintFile `json:"files"`
+	}
+	if err := h.getJSON(ctx, h.baseURL+"/api/files/local?recursive=true", &resp); err != nil {
+		return nil, err
+	}
+	var files []printFile
+	var walk func([]octoPrintFile)
+	walk = func(entries []octoPrintFile) {
+		for _, f := range entries {
+			switch {
+			case f.Type == "folder":
+				walk(f.Children)
+			case f.Type == "machinecode" && gcodeFormat(f.Name) != "" && f.Refs.Download != "":
+				files = append(files, printFile{path: f.Path, download: f.Refs.Download, version: fmt.Sprintf("%d/%d", f.Size, f.Date)})
+			}
+		}
+	}
+	walk(resp.Files)
+	return files, nil
+}
+
+// Upload the file again under its name and folder, which replaces it
+func (h *octoPrintHost) upload(ctx context.Context, file printFile, localPath string) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	body, form := io.Pipe()
+	mw := multipart.NewWriter(form)
+	go func() {
+		folder := path.Dir(file.path)
+		if folder == "." {
+			folder = ""
+		}
+		err := mw.WriteField("path", folder)
+		if err == nil {
+			var part io.Writer
+			if part, err = mw.CreateFormFile("file", path.Base(file.path)); err == nil {
+				_, err = io.Copy(part, src)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		form.CloseWithError(err)
+	}()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.baseURL+"/api/files/local", body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := h.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errPrintHostBusy
+	}
+	return fmt.Errorf("upload answered %s", resp.Status)
+}
+
+// PrusaLink's v1 API, files on one storage
+type prusaLinkHost struct {
+	printHostAPI
+	storage string
+}
+
+type prusaLinkFile struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"` // "PRINT_FILE", "FOLDER", or "FILE"
+	Size     int64           `json:"size"`
+	Modified int64           `json:"m_timestamp"`
+	Refs     printFileRefs   `json:"refs"`
+	Children []prusaLinkFile `json:"children"`
+}
+
+func (h *prusaLinkHost) list(ctx context.Context) ([]printFile, error) {
+	var files []printFile
+	var walk func(folder string) error
+	walk = func(folder string) error {
+		var resp prusaLinkFile
+		if err := h.getJSON(ctx, h.baseURL+"/api/v1/files/"+url.PathEscape(h.storage)+escapeBlobName("/"+folder), &resp); err != nil {
+			return err
+		}
+		for _, f := range resp.Children {
+			p := strings.TrimPrefix(folder+"/"+f.Name, "/")
+			switch {
+			case f.Type == "FOLDER":
+				if err := walk(p); err != nil {
+					return err
+				}
+			case f.Type == "PRINT_FILE" && gcodeFormat(f.Name) != "" && f.Refs.Download != "":
+				files = append(files, printFile{path: p, download: h.baseURL + f.Refs.Download, version: fmt.Sprintf("%d/%d", f.Size, f.Modified)})
+			}
+		}
+		return nil
+	}
+	return files, walk("")
+}
+
+func (h *prusaLinkHost) upload(ctx context.Context, file printFile, localPath string) error {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	u := h.baseURL + "/api/v1/files/" + url.PathEscape(h.storage) + "/" + escapeBlobName(file.path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, src)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "text/x.gcode")
+	req.Header.Set("Overwrite", "?1")
+	resp, err := h.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated, http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return errPrintHostBusy
+	}
+	return fmt.Errorf("upload answered %s", resp.Status)
+}
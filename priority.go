@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+)
+
+// Queue lanes. Interactive jobs are always taken first, and workers reserved
+// by config.InteractiveShare take nothing else, so a person waiting on a
+// render isn't stuck behind a large batch.
+const (
+	PriorityInteractive = "interactive" // Someone is waiting for it: web UI uploads, by default
+	PriorityBatch       = "batch"       // API clients, batches, and warmup, by default
+)
+
+type priorityContextKey struct{}
+
+// Attach the lane a context's jobs are queued in
+func withPriority(ctx context.Context, priority string) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, priority)
+}
+
+// Lane a context's jobs are queued in; batch unless set
+func priorityOf(ctx context.Context) string {
+	if priority, ok := ctx.Value(priorityContextKey{}).(string); ok {
+		return priority
+	}
+	return PriorityBatch
+}
+
+// Lane a render request asks for in its priority field. Without one, the web
+// UI, which doesn't ask for JSON, is interactive and API clients are batch.
+func requestPriority(r *http.Request) (string, error) {
+	switch priority := r.FormValue("priority"); priority {
+	case PriorityInteractive, PriorityBatch:
+		return priority, nil
+	case "":
+		if wantsJSON(r) {
+			return PriorityBatch, nil
+		}
+		return PriorityInteractive, nil
+	default:
+		return "", fmt.Errorf("priority must be %q or %q", PriorityInteractive, PriorityBatch)
+	}
+}
+
+// Workers that only take interactive jobs: config.InteractiveShare of them,
+// rounded up, always leaving one for batch jobs
+func reservedWorkers() int {
+	n := workerCount()
+	if config.InteractiveShare <= 0 {
+		return 0
+	}
+	return min(int(math.Ceil(config.InteractiveShare*float64(n))), n-1)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Identifying metadata taken out of an upload before it was stored. Only
+// the kind and size are kept, never the content.
+type MetadataRemoval struct {
+	Field string `json:"field"` // "stl_header", "solid_name", or "extra_lines"
+	Bytes int    `json:"bytes"`
+}
+
+// Lines an ASCII STL is made of; anything else is tool or user text
+var stlKeywords = []string{"solid", "facet", "outer", "vertex", "endloop", "endfacet", "endsolid"}
+
+// Remove what exporters write into an STL besides the geometry: the 80-byte
+// header of binary files (often the program, user, or part number), and the
+// solid name and any stray lines of ASCII files. The file is rewritten in
+// place; what was removed is returned.
+func stripSTLMetadata(path string) ([]MetadataRemoval, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 84)
+	if _, err := io.ReadFull(file, header); err == nil {
+		count := int64(binary.LittleEndian.Uint32(header[80:]))
+		if 84+50*count == info.Size() {
+			used := len(bytes.TrimRight(header[:80], "\x00 "))
+			if used == 0 {
+				return nil, nil
+			}
+			if _, err := file.WriteAt(make([]byte, 80), 0); err != nil {
+				return nil, err
+			}
+			return []MetadataRemoval{{Field: "stl_header", Bytes: used}}, file.Close()
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return stripASCIISTL(file, path)
+}
+
+// Rewrite an ASCII STL with bare solid and endsolid lines and nothing but
+// geometry in between
+func stripASCIISTL(file *os.File, path string) ([]MetadataRemoval, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".strip-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	var names, extra int
+	out := bufio.NewWriter(tmp)
+	lines := bufio.NewScanner(file)
+	lines.Buffer(make([]byte, 64<<10), 1<<20)
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		keyword, rest, _ := strings.Cut(line, " ")
+		switch {
+		case line == "":
+			continue
+		case keyword == "solid" || keyword == "endsolid":
+			names += len(strings.TrimSpace(rest))
+			line = keyword
+		case !isSTLKeyword(keyword):
+			extra += len(line)
+			continue
+		}
+		out.WriteString(line)
+		out.WriteByte('\n')
+	}
+	if err := lines.Err(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := out.Flush(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+
+	var removed []MetadataRemoval
+	if names > 0 {
+		removed = append(removed, MetadataRemoval{Field: "solid_name", Bytes: names})
+	}
+	if extra > 0 {
+		removed = append(removed, MetadataRemoval{Field: "extra_lines", Bytes: extra})
+	}
+	if removed == nil {
+		return nil, nil
+	}
+	file.Close()
+	return removed, os.Rename(tmp.Name(), path)
+}
+
+func isSTLKeyword(word string) bool {
+	for _, k := range stlKeywords {
+		if word == k {
+			return true
+		}
+	}
+	return false
+}
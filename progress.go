@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	UploadIDHeader          = "X-Upload-ID"          // Client-chosen ID for following an upload's progress
+	UploadProgressInterval  = 250 * time.Millisecond // How often progress is pushed over the WebSocket
+	UploadProgressWait      = 10 * time.Second       // How long a progress socket waits for its upload to start
+	UploadProgressRetention = time.Minute            // Finished uploads stay queryable this long
+)
+
+var uploadIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]{8,64}$`)
+
+// Server-side receive progress of one upload, as clients see it
+type uploadProgress struct {
+	Received int64 `json:"received"`
+	Total    int64 `json:"total"` // Content-Length, or -1 when the client didn't send one
+	Done     bool  `json:"done"`
+}
+
+// An upload being received. The byte count changes on every read of the
+// body, so it is counted atomically instead of under mu; done is guarded by
+// mu.
+type trackedUpload struct {
+	received atomic.Int64
+	total    int64
+	done     bool
+}
+
+var uploadProgresses = make(map[string]*trackedUpload) // Upload ID -> progress
+
+// Request body that counts the bytes read from it
+type progressReader struct {
+	io.ReadCloser
+	upload *trackedUpload
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.upload.received.Add(int64(n))
+	return n, err
+}
+
+// Count the request body as it is received, if the client sent an upload ID.
+// Must be called before anything reads the body. Returns a function that
+// marks the upload as finished.
+func trackUploadProgress(r *http.Request) func() {
+	id := r.Header.Get(UploadIDHeader)
+	if !uploadIDPattern.MatchString(id) {
+		return func() {}
+	}
+
+	upload := &trackedUpload{total: r.ContentLength}
+	mu.Lock()
+	uploadProgresses[id] = upload
+	mu.Unlock()
+	r.Body = &progressReader{ReadCloser: r.Body, upload: upload}
+
+	return func() {
+		mu.Lock()
+		upload.done = true
+		mu.Unlock()
+		time.AfterFunc(UploadProgressRetention, func() {
+			mu.Lock()
+			if uploadProgresses[id] == upload {
+				delete(uploadProgresses, id)
+			}
+			mu.Unlock()
+		})
+	}
+}
+
+// Snapshot of an upload's progress
+func getUploadProgress(id string) (uploadProgress, bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	upload, ok := uploadProgresses[id]
+	if !ok {
+		return uploadProgress{}, false
+	}
+	return uploadProgress{Received: upload.received.Load(), Total: upload.total, Done: upload.done}, true
+}
+
+// GET /api/v1/uploads/{id}
+func uploadProgressHandler(w http.ResponseWriter, r *http.Request) {
+	progress, ok := getUploadProgress(r.PathValue("id"))
+	if !ok {
+		apiError(w, r, http.StatusNotFound, ErrNotFound, "Upload not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, progress)
+}
+
+// GET /ws/uploads/{id}
+//
+// Pushes an upload_progress event whenever more bytes have arrived, and
+// closes after the one with done set. The socket may be opened before the
+// upload starts.
+func uploadProgressWSHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !uploadIDPattern.MatchString(id) {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid upload ID")
+		return
+	}
+	conn, err := upgradeWS(w, r)
+	if err != nil {
+		log.Println("WebSocket upgrade failed:", err)
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(UploadProgressInterval)
+	defer ticker.Stop()
+	deadline := time.Now().Add(UploadProgressWait)
+	var last uploadProgress
+	for range ticker.C {
+		progress, ok := getUploadProgress(id)
+		if !ok {
+			if time.Now().After(deadline) {
+				return
+			}
+			continue
+		}
+		if progress == last {
+			continue
+		}
+		last = progress
+
+		event := wsEvent{Type: "upload_progress", UploadID: id, Received: progress.Received, Total: int(progress.Total), Done: progress.Done}
+		if err := conn.WriteMessage(websocket.TextMessage, encodeEvent(wsVersion(conn), event)); err != nil || progress.Done {
+			return
+		}
+	}
+}
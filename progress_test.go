@@ -0,0 +1,33 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTrackUploadProgress(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	r := httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader(body))
+	r.Header.Set(UploadIDHeader, "test-upload-1")
+	finish := trackUploadProgress(r)
+
+	if _, err := io.CopyN(io.Discard, r.Body, 400); err != nil {
+		t.Fatal(err)
+	}
+	progress, ok := getUploadProgress("test-upload-1")
+	if !ok || progress != (uploadProgress{Received: 400, Total: 1000}) {
+		t.Fatalf("mid-upload progress is %+v, %v", progress, ok)
+	}
+
+	if _, err := io.Copy(io.Discard, r.Body); err != nil {
+		t.Fatal(err)
+	}
+	finish()
+	progress, _ = getUploadProgress("test-upload-1")
+	if progress != (uploadProgress{Received: 1000, Total: 1000, Done: true}) {
+		t.Fatalf("final progress is %+v", progress)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/fogleman/fauxgl"
+	"rsc.io/qr"
+)
+
+const (
+	MaxQRText        = 512  // Longest text or URL accepted for a QR code
+	DefaultQRDepth   = 0.6  // Module height in mm, about three layers on common printers
+	DefaultQRFill    = 0.6  // Code size relative to the shorter side of its face, when not given
+	MaxQRSize        = 1000 // Largest accepted size or depth, in mm
+	QRDebossPadWidth = 1    // Modules of raised border around a debossed code
+)
+
+// A QR code added to one side of the model before measuring and rendering
+type QRCode struct {
+	Text  string  `json:"text"`
+	Face  string  `json:"face"`           // Bounding box side the code faces out of: "+x", "-x", "+y", "-y", "+z", "-z"
+	Size  float64 `json:"size,omitempty"` // Side length in mm, without quiet zone; DefaultQRFill of the face when 0
+	Depth float64 `json:"depth"`          // Relief in mm
+	Mode  string  `json:"mode"`           // "emboss" raises the dark modules; "deboss" sinks them into a raised pad
+}
+
+// Axes of each face, seen from outside: right, up, and out of the face
+var qrFaces = map[string][3]fauxgl.Vector{
+	"+x": {{0, 1, 0}, {0, 0, 1}, {1, 0, 0}},
+	"-x": {{0, -1, 0}, {0, 0, 1}, {-1, 0, 0}},
+	"+y": {{-1, 0, 0}, {0, 0, 1}, {0, 1, 0}},
+	"-y": {{1, 0, 0}, {0, 0, 1}, {0, -1, 0}},
+	"+z": {{1, 0, 0}, {0, 1, 0}, {0, 0, 1}},
+	"-z": {{-1, 0, 0}, {0, 1, 0}, {0, 0, -1}},
+}
+
+// Read the qr form fields into the options
+func parseQROptions(r *http.Request, opts *RenderOptions) error {
+	text := r.FormValue("qr")
+	if text == "" {
+		return nil
+	}
+	if len(text) > MaxQRText {
+		return fmt.Errorf("qr must be at most %d bytes", MaxQRText)
+	}
+	code := QRCode{Text: text, Face: "+z", Depth: DefaultQRDepth, Mode: "emboss"}
+	if v := r.FormValue("qr_face"); v != "" {
+		if _, ok := qrFaces[v]; !ok {
+			return fmt.Errorf("qr_face must be one of +x, -x, +y, -y, +z, -z")
+		}
+		code.Face = v
+	}
+	if v := r.FormValue("qr_mode"); v != "" {
+		if v != "emboss" && v != "deboss" {
+			return fmt.Errorf("qr_mode must be emboss or deboss")
+		}
+		code.Mode = v
+	}
+	for _, field := range []struct {
+		name  string
+		value *float64
+	}{{"qr_size", &code.Size}, {"qr_depth", &code.Depth}} {
+		v := r.FormValue(field.name)
+		if v == "" {
+			continue
+		}
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil || !(x > 0 && x <= MaxQRSize) {
+			return fmt.Errorf("%s must be a length in mm between 0 and %d", field.name, MaxQRSize)
+		}
+		*field.value = x
+	}
+	if _, err := qr.Encode(code.Text, qr.M); err != nil {
+		return fmt.Errorf("qr: %w", err)
+	}
+	opts.QR = &code
+	return nil
+}
+
+// Add the code to the mesh as blocks standing out of the chosen face. The
+// blocks follow the outermost surface under the code: they reach down into
+// it and share a flat top the code's depth above its highest point, so
+// scanners see one plane even on uneven faces.
+func embossQR(mesh *fauxgl.Mesh, settings QRCode, mmPerUnit float64) error {
+	code, err := qr.Encode(settings.Text, qr.M)
+	if err != nil {
+		return err
+	}
+	axes := qrFaces[settings.Face]
+	u, v, n := axes[0], axes[1], axes[2]
+
+	// Face extents in its own axes; the axes are signed unit vectors, so the
+	// box's corners bound them
+	box := mesh.BoundingBox()
+	span := func(a fauxgl.Vector) (float64, float64) {
+		p, q := box.Min.Dot(a), box.Max.Dot(a)
+		return math.Min(p, q), math.Max(p, q)
+	}
+	uMin, uMax := span(u)
+	vMin, vMax := span(v)
+	size := settings.Size / mmPerUnit
+	if size == 0 {
+		size = DefaultQRFill * math.Min(uMax-uMin, vMax-vMin)
+	}
+	module := size / float64(code.Size)
+	pad := 0
+	if settings.Mode == "deboss" {
+		pad = QRDebossPadWidth
+	}
+	cells := code.Size + 2*pad
+	left := (uMin+uMax)/2 - float64(cells)*module/2
+	top := (vMin+vMax)/2 + float64(cells)*module/2
+
+	// Outermost surface height at every module corner
+	corners := cells + 1
+	heights := make([]float64, corners*corners)
+	for i := range heights {
+		heights[i] = math.Inf(-1)
+	}
+	toGrid := func(p fauxgl.Vector) fauxgl.Vector {
+		return fauxgl.Vector{(p.Dot(u) - left) / module, (top - p.Dot(v)) / module, p.Dot(n)}
+	}
+	for _, t := range mesh.Triangles {
+		a, b, c := toGrid(t.V1.Position), toGrid(t.V2.Position), toGrid(t.V3.Position)
+		x0 := max(0, int(math.Ceil(min(a.X, b.X, c.X))))
+		x1 := min(corners-1, int(math.Floor(max(a.X, b.X, c.X))))
+		y0 := max(0, int(math.Ceil(min(a.Y, b.Y, c.Y))))
+		y1 := min(corners-1, int(math.Floor(max(a.Y, b.Y, c.Y))))
+		for y := y0; y <= y1; y++ {
+			for x := x0; x <= x1; x++ {
+				if h, ok := verticalHit(a, b, c, float64(x), float64(y)); ok && h > heights[y*corners+x] {
+					heights[y*corners+x] = h
+				}
+			}
+		}
+	}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, h := range heights {
+		if !math.IsInf(h, -1) {
+			lo, hi = math.Min(lo, h), math.Max(hi, h)
+		}
+	}
+	if math.IsInf(lo, 1) {
+		return fmt.Errorf("QR code area doesn't overlap the model")
+	}
+	depth := settings.Depth / mmPerUnit
+	bottom, surface := lo-depth, hi+depth
+
+	// One block per run of raised modules along each row
+	world := func(x, y, h float64) fauxgl.Vector {
+		return u.MulScalar(left + x*module).Add(v.MulScalar(top - y*module)).Add(n.MulScalar(h))
+	}
+	raised := func(x, y int) bool {
+		return code.Black(x-pad, y-pad) != (settings.Mode == "deboss")
+	}
+	for y := 0; y < cells; y++ {
+		for x := 0; x < cells; {
+			if !raised(x, y) {
+				x++
+				continue
+			}
+			end := x
+			for end < cells && raised(end, y) {
+				end++
+			}
+			// Rows count down from the top, so row y spans y+1 (bottom) to y
+			mesh.Triangles = append(mesh.Triangles, boxTriangles(
+				world(float64(x), float64(y+1), bottom),
+				world(float64(end), float64(y+1), bottom),
+				world(float64(x), float64(y), bottom),
+				n.MulScalar(surface-bottom))...)
+			x = end
+		}
+	}
+	return nil
+}
+
+// Twelve outward-facing triangles of a box with corner o, base edges o→x and
+// o→y, and height h, which must point along (x-o)×(y-o)
+func boxTriangles(o, x, y, h fauxgl.Vector) []*fauxgl.Triangle {
+	dx, dy := x.Sub(o), y.Sub(o)
+	var c [8]fauxgl.Vector
+	for i := range c {
+		c[i] = o
+		if i&1 != 0 {
+			c[i] = c[i].Add(dx)
+		}
+		if i&2 != 0 {
+			c[i] = c[i].Add(dy)
+		}
+		if i&4 != 0 {
+			c[i] = c[i].Add(h)
+		}
+	}
+	var tris []*fauxgl.Triangle
+	for _, f := range [][4]int{{0, 4, 6, 2}, {1, 3, 7, 5}, {0, 1, 5, 4}, {2, 6, 7, 3}, {0, 2, 3, 1}, {4, 5, 7, 6}} {
+		tris = append(tris,
+			fauxgl.NewTriangleForPoints(c[f[0]], c[f[1]], c[f[2]]),
+			fauxgl.NewTriangleForPoints(c[f[0]], c[f[2]], c[f[3]]))
+	}
+	return tris
+}
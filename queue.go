@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const DrainTimeout = 25 * time.Second // How long shutdown waits for the running render, within the usual 30s grace period
+
+// What uploads do when the queue is full
+const (
+	QueueFullReject = "reject" // Answer 503 right away
+	QueueFullWait   = "wait"   // Hold the upload until a slot frees up, for up to config.QueueWaitSecs
+)
+
+// Returned by enqueueJob when the queue has no room for the job; the job
+// fails with ErrQueueFull
+var errQueueFull = withErrorCode(ErrQueueFull, errors.New("render queue is full"))
+
+var queueRejections atomic.Int64 // Jobs turned away because the queue was full
+
+const QueueFullRetrySecs = 30 // Retry-After sent with queue full replies
+
+// Upload response when the queue has no room
+type queueFullResponse struct {
+	Code     string `json:"code"`  // Always ErrQueueFull
+	Error    string `json:"error"` // Always "queue_full", from before error codes
+	Queued   int    `json:"queued"`
+	Capacity int    `json:"capacity"`
+}
+
+// Pause state for the render queue. While paused, workers finish their
+// current job but don't take new ones; queued jobs stay in the queue.
+var (
+	pauseMu     sync.Mutex
+	pauseCond   = sync.NewCond(&pauseMu)
+	queuePaused bool
+	rendering   = make(map[string]Job) // Jobs being rendered by ID, handed back to the queue if shutdown can't wait for them
+)
+
+// Root context of the render workers, cancelled when shutdown gives up on the
+// running render
+var workerCtx, stopWorkers = context.WithCancel(context.Background())
+
+// Hand a registered job to the workers: this process's channel, or the shared
+// queue in stateless mode. Fails with errQueueFull when config.QueueCapacity
+// jobs are already waiting, right away or after config.QueueWaitSecs.
+func enqueueJob(ctx context.Context, job Job) error {
+	var deadline <-chan time.Time
+	if config.QueueFull == QueueFullWait {
+		timer := time.NewTimer(time.Duration(config.QueueWaitSecs) * time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	if store == nil {
+		lane := queue
+		if job.Priority == PriorityInteractive {
+			lane = interactiveQueue
+		}
+		select {
+		case lane.slots <- struct{}{}:
+			lane.push(job)
+			return nil
+		default:
+		}
+		if deadline != nil {
+			select {
+			case lane.slots <- struct{}{}:
+				lane.push(job)
+				return nil
+			case <-deadline:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		queueRejections.Add(1)
+		return errQueueFull
+	}
+
+	// The shared queue has no bound of its own; poll its length
+	for redisQueueLength(ctx, job.Priority) >= config.QueueCapacity {
+		if deadline == nil {
+			queueRejections.Add(1)
+			return errQueueFull
+		}
+		select {
+		case <-deadline:
+			queueRejections.Add(1)
+			return errQueueFull
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(RedisPollPeriod):
+		}
+	}
+
+	// Whichever instance renders it can't see this one's work dir
+	name := uploadObject(job.FileHash)
+	exists, err := storage.Exists(ctx, name)
+	if err == nil && !exists {
+		err = storage.Publish(ctx, job.STLPath, name)
+	}
+	if err != nil {
+		return err
+	}
+	os.RemoveAll(job.WorkDir)
+	job.STLPath, job.WorkDir = "", ""
+	return redisEnqueue(ctx, job)
+}
+
+// Turn an upload away because the queue is full, telling the client how
+// deep it is and when to try again
+func respondQueueFull(w http.ResponseWriter, r *http.Request) {
+	queued := queuedJobs(r.Context())
+	w.Header().Set("Retry-After", strconv.Itoa(QueueFullRetrySecs))
+	if wantsJSON(r) {
+		w.Header().Set(ErrorCodeHeader, ErrQueueFull)
+		writeJSON(w, http.StatusServiceUnavailable, queueFullResponse{Code: ErrQueueFull, Error: "queue_full", Queued: queued, Capacity: config.QueueCapacity})
+		return
+	}
+	apiError(w, r, http.StatusServiceUnavailable, ErrQueueFull, fmt.Sprintf("The render queue is full (%d jobs waiting), try again later", queued))
+}
+
+// Take the next job to render, interactive jobs first, with tenants taking
+// turns within a lane. The job returned already counts as rendering. Returns
+// false when there was nothing to take yet, or when the queue was paused
+// while waiting for a job, so the caller can check the pause state again.
+func dequeueJob(ctx context.Context, interactiveOnly bool) (Job, bool) {
+	if store == nil {
+		select {
+		case <-interactiveQueue.ready:
+			return takeFromLane(interactiveQueue)
+		default:
+		}
+		var batchReady chan struct{} // Never ready for interactiveOnly
+		if !interactiveOnly {
+			batchReady = queue.ready
+		}
+		select {
+		case <-interactiveQueue.ready:
+			return takeFromLane(interactiveQueue)
+		case <-batchReady:
+			return takeFromLane(queue)
+		case <-ctx.Done():
+			return Job{}, false
+		}
+	}
+
+	job, ok, err := redisDequeue(ctx, interactiveOnly)
+	if ctx.Err() != nil {
+		return Job{}, false
+	}
+	if err != nil {
+		log.Printf("Failed to read from queue: %v", err)
+		time.Sleep(RedisPollPeriod)
+		return Job{}, false
+	}
+	if !ok {
+		return Job{}, false
+	}
+	if !startRendering(job) {
+		if err := redisReturn(context.Background(), job); err != nil {
+			log.Printf("Failed to return job ID %s to the queue: %v\n", job.ID, err)
+		}
+		return Job{}, false
+	}
+	loadSharedJob(job.ID)
+	if err := fetchJobInput(withTenant(ctx, job.Tenant), &job); err != nil {
+		log.Printf("Failed to fetch upload for job ID %s: %v\n", job.ID, err)
+		finishRendering(job)
+		failJob(job.ID, ErrInputUnavailable)
+		return Job{}, false
+	}
+	return job, true
+}
+
+// Take a job from a lane whose ready signal was received, counting it as
+// rendering. If the queue was paused meanwhile the signal goes back and the
+// job stays where it was in its line.
+func takeFromLane(lane *fairQueue) (Job, bool) {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	if queuePaused {
+		lane.ready <- struct{}{}
+		return Job{}, false
+	}
+	job := lane.pop()
+	rendering[job.ID] = job
+	return job, true
+}
+
+// Number of jobs waiting to be rendered, in both lanes
+func queuedJobs(ctx context.Context) int {
+	return queuedInLane(ctx, PriorityInteractive) + queuedInLane(ctx, PriorityBatch)
+}
+
+func queuedInLane(ctx context.Context, priority string) int {
+	if store != nil {
+		return redisQueueLength(ctx, priority)
+	}
+	if priority == PriorityInteractive {
+		return interactiveQueue.len()
+	}
+	return queue.len()
+}
+
+// Jobs waiting in a lane by tenant, leaving out tenants with none
+func queueDepths(ctx context.Context, priority string) map[string]int {
+	if store != nil {
+		return redisQueueDepths(ctx, priority)
+	}
+	if priority == PriorityInteractive {
+		return interactiveQueue.depths()
+	}
+	return queue.depths()
+}
+
+// Block until the queue is not paused
+func waitWhilePaused() {
+	pauseMu.Lock()
+	for queuePaused {
+		pauseCond.Wait()
+	}
+	pauseMu.Unlock()
+}
+
+func setQueuePaused(paused bool) {
+	pauseMu.Lock()
+	queuePaused = paused
+	pauseMu.Unlock()
+	pauseCond.Broadcast()
+}
+
+// Count a render as started, unless the queue was paused since the job was
+// taken. Both happen under pauseMu, so a pause either sees the render or
+// keeps it from starting.
+func startRendering(job Job) bool {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	if queuePaused {
+		return false
+	}
+	rendering[job.ID] = job
+	return true
+}
+
+// Count a render as finished
+func finishRendering(job Job) {
+	pauseMu.Lock()
+	delete(rendering, job.ID)
+	pauseMu.Unlock()
+}
+
+type QueueStatus struct {
+	Paused   bool `json:"paused"`
+	Queued   int  `json:"queued"`
+	Capacity int  `json:"capacity"` // Of each lane
+
+	Interactive     int                 `json:"interactive"`      // Of Queued, in the interactive lane
+	ReservedWorkers int                 `json:"reserved_workers"` // Workers of this instance that only take interactive jobs
+	Tenants         []TenantQueueStatus `json:"tenants"`          // Queued jobs of each tenant that has any
+	InFlight        int                 `json:"in_flight"`
+	Rejected        int64               `json:"rejected"` // Uploads turned away with a full queue since startup
+
+	MemoryReservedMB int64 `json:"memory_reserved_mb"` // Estimated memory of the renders in progress
+	MemoryBudgetMB   int   `json:"memory_budget_mb"`
+}
+
+// A tenant's share of the queue
+type TenantQueueStatus struct {
+	Tenant      string `json:"tenant"` // Empty for the default tenant
+	Queued      int    `json:"queued"`
+	Interactive int    `json:"interactive"` // Of Queued, in the interactive lane
+}
+
+func queueStatus(ctx context.Context) QueueStatus {
+	interactive := queuedInLane(ctx, PriorityInteractive)
+	queued := interactive + queuedInLane(ctx, PriorityBatch)
+	interactiveDepths, batchDepths := queueDepths(ctx, PriorityInteractive), queueDepths(ctx, PriorityBatch)
+	tenants := []TenantQueueStatus{}
+	for _, tenant := range queueTenants() {
+		status := TenantQueueStatus{Tenant: tenant, Interactive: interactiveDepths[tenant]}
+		status.Queued = status.Interactive + batchDepths[tenant]
+		if status.Queued > 0 {
+			tenants = append(tenants, status)
+		}
+	}
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	return QueueStatus{
+		Paused:           queuePaused,
+		Queued:           queued,
+		Capacity:         config.QueueCapacity,
+		Interactive:      interactive,
+		ReservedWorkers:  reservedWorkers(),
+		Tenants:          tenants,
+		InFlight:         len(rendering),
+		Rejected:         queueRejections.Load(),
+		MemoryReservedMB: reservedMemory() >> 20,
+		MemoryBudgetMB:   config.MemoryBudgetMB,
+	}
+}
+
+// Shut down on SIGINT or SIGTERM: stop accepting requests and taking jobs,
+// then give the running renders up to DrainTimeout to finish. In stateless
+// mode renders that don't finish in time go back on the shared queue for
+// another instance, so rolling deploys don't lose jobs.
+func drainOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Println("Shutting down, draining the render queue")
+
+	setQueuePaused(true)
+	ctx, cancel := context.WithTimeout(context.Background(), DrainTimeout)
+	defer cancel()
+	server.Shutdown(ctx)
+	if err := saveAnalytics(); err != nil {
+		log.Printf("Failed to save analytics: %v", err)
+	}
+
+	for {
+		pauseMu.Lock()
+		left := make([]Job, 0, len(rendering))
+		for _, job := range rendering {
+			left = append(left, job)
+		}
+		pauseMu.Unlock()
+		if len(left) == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			if store != nil {
+				for _, job := range left {
+					requeueJob(job)
+				}
+			}
+			stopWorkers()
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Put an interrupted job back on the shared queue
+func requeueJob(job Job) {
+	updateJob(job.ID, JobQueued)
+	job.STLPath, job.WorkDir = "", "" // The upload is already in storage
+	if err := redisEnqueue(context.Background(), job); err != nil {
+		log.Printf("Failed to requeue job ID %s: %v\n", job.ID, err)
+		return
+	}
+	log.Printf("Requeued job ID %s\n", job.ID)
+}
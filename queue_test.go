@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// Give this process fresh lanes, restored when the test ends
+func useLocalQueue(t *testing.T) {
+	t.Helper()
+	savedStore, savedQueue, savedInteractive := store, queue, interactiveQueue
+	store, queue, interactiveQueue = nil, newFairQueue(4), newFairQueue(4)
+	t.Cleanup(func() {
+		store, queue, interactiveQueue = savedStore, savedQueue, savedInteractive
+		setQueuePaused(false)
+		pauseMu.Lock()
+		clear(rendering)
+		pauseMu.Unlock()
+	})
+}
+
+func TestPauseStopsWaitingWorker(t *testing.T) {
+	useLocalQueue(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type taken struct {
+		job Job
+		ok  bool
+	}
+	result := make(chan taken, 1)
+	go func() {
+		job, ok := dequeueJob(ctx, false)
+		result <- taken{job, ok}
+	}()
+	time.Sleep(50 * time.Millisecond) // Let the worker block waiting for a job
+
+	setQueuePaused(true)
+	if err := enqueueJob(ctx, Job{ID: "paused", Priority: PriorityBatch}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-result:
+		if r.ok {
+			t.Fatalf("worker took job %s while the queue was paused", r.job.ID)
+		}
+	case <-ctx.Done():
+		t.Fatal("worker didn't give up the job")
+	}
+	if n := queue.len(); n != 1 {
+		t.Fatalf("%d jobs queued while paused, want 1", n)
+	}
+	pauseMu.Lock()
+	started := len(rendering)
+	pauseMu.Unlock()
+	if started != 0 {
+		t.Fatalf("%d renders started while paused", started)
+	}
+
+	setQueuePaused(false)
+	job, ok := dequeueJob(ctx, false)
+	if !ok || job.ID != "paused" {
+		t.Fatalf("after resuming got job %q, %v, want the queued one", job.ID, ok)
+	}
+	pauseMu.Lock()
+	_, counted := rendering[job.ID]
+	pauseMu.Unlock()
+	if !counted {
+		t.Error("job taken after resuming doesn't count as rendering")
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	QualityRaytraced       = "raytraced"
+	DefaultRaytraceSamples = 64   // Samples per pixel when the request doesn't say
+	MaxRaytraceSamples     = 4096 // Most samples per pixel a job may ask for
+	MaxBounces             = 3    // Diffuse bounces after the first hit
+	BVHLeafSize            = 4
+
+	// Disk light in the direction of the raster key light, bright enough that
+	// an unshadowed surface gets the same 0.8 diffuse the rasterizer gives it
+	lightDistance = 8.0
+	lightRadius   = 2.0
+	lightRadiance = 0.8 * lightDistance * lightDistance / (lightRadius * lightRadius)
+	skyRadiance   = 0.2 // Matches the rasterizer's ambient term where nothing occludes the sky
+	rayEpsilon    = 1e-6
+)
+
+// Path tracing settings for a raytraced render
+type RaytraceSettings struct {
+	Samples int           // Samples per pixel
+	Budget  time.Duration // Stop adding samples after this long; no limit when 0
+	Seed    uint64        // Seeds the random numbers, so a view renders the same given the same samples
+}
+
+// Read the quality and samples form fields into the options
+func parseQualityOptions(r *http.Request, opts *RenderOptions) error {
+	switch q := r.FormValue("quality"); q {
+	case "":
+		for _, field := range []string{"samples", "seed"} {
+			if r.FormValue(field) != "" {
+				return fmt.Errorf("%s needs quality=raytraced", field)
+			}
+		}
+		return nil
+	case QualityRaytraced:
+		opts.Quality = q
+	default:
+		return fmt.Errorf("unknown quality %q", q)
+	}
+	if opts.Frames > 0 || opts.BuildFrames > 0 || opts.Stereo != "" {
+		return fmt.Errorf("quality=raytraced is only available for single views")
+	}
+	opts.Samples = DefaultRaytraceSamples
+	if v := r.FormValue("samples"); v != "" {
+		samples, err := strconv.Atoi(v)
+		if err != nil || samples < 1 || samples > MaxRaytraceSamples {
+			return fmt.Errorf("samples must be between 1 and %d", MaxRaytraceSamples)
+		}
+		opts.Samples = samples
+	}
+	if v := r.FormValue("seed"); v != "" {
+		seed, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("seed must be a whole number from 0 to %d", uint64(math.MaxUint64))
+		}
+		opts.Seed = seed
+	}
+	return nil
+}
+
+// Surface the path tracer can hit: one triangle with its shading normals and
+// colors
+type rtTriangle struct {
+	v0, e1, e2 fauxgl.Vector
+	normals    [3]fauxgl.Vector
+	colors     [3]fauxgl.Color
+	centroid   fauxgl.Vector
+	box        fauxgl.Box
+}
+
+// Bounding volume hierarchy node. Leaves hold count triangles from first;
+// inner nodes have their left child right after them and the right one at
+// right.
+type bvhNode struct {
+	box          fauxgl.Box
+	first, count int
+	right        int
+}
+
+type rtScene struct {
+	triangles []rtTriangle
+	nodes     []bvhNode
+}
+
+// Collect the scene's model and overlays into a BVH. Overlays are hit like
+// the model, in their own colors; translucent ones let light through in
+// proportion to their transparency and cast no shadows.
+func newRTScene(sc *scene) *rtScene {
+	rt := &rtScene{}
+	add := func(mesh *fauxgl.Mesh, c fauxgl.Color, vertexColors bool) {
+		for _, t := range mesh.Triangles {
+			tri := rtTriangle{
+				v0:      t.V1.Position,
+				e1:      t.V2.Position.Sub(t.V1.Position),
+				e2:      t.V3.Position.Sub(t.V1.Position),
+				normals: [3]fauxgl.Vector{t.V1.Normal, t.V2.Normal, t.V3.Normal},
+				colors:  [3]fauxgl.Color{c, c, c},
+			}
+			if vertexColors {
+				tri.colors = [3]fauxgl.Color{t.V1.Color, t.V2.Color, t.V3.Color}
+			}
+			tri.box = fauxgl.Box{
+				Min: t.V1.Position.Min(t.V2.Position).Min(t.V3.Position),
+				Max: t.V1.Position.Max(t.V2.Position).Max(t.V3.Position),
+			}
+			tri.centroid = t.V1.Position.Add(t.V2.Position).Add(t.V3.Position).DivScalar(3)
+			rt.triangles = append(rt.triangles, tri)
+		}
+	}
+	add(sc.mesh, sc.modelColor(), sc.vertexColors)
+	for _, o := range sc.overlays {
+		c := o.color
+		if !o.translucent {
+			c.A = 1
+		}
+		add(o.mesh, c, false)
+	}
+	if len(rt.triangles) > 0 {
+		rt.build(0, len(rt.triangles))
+	}
+	return rt
+}
+
+// Build the subtree over triangles[first:first+count], splitting at the
+// median centroid along the longest axis. Returns the node's index.
+func (rt *rtScene) build(first, count int) int {
+	box := rt.triangles[first].box
+	for _, t := range rt.triangles[first+1 : first+count] {
+		box = fauxgl.Box{Min: box.Min.Min(t.box.Min), Max: box.Max.Max(t.box.Max)}
+	}
+	index := len(rt.nodes)
+	rt.nodes = append(rt.nodes, bvhNode{box: box, first: first, count: count})
+	if count <= BVHLeafSize {
+		return index
+	}
+
+	size := box.Max.Sub(box.Min)
+	axis := func(v fauxgl.Vector) float64 { return v.X }
+	if size.Y > size.X && size.Y >= size.Z {
+		axis = func(v fauxgl.Vector) float64 { return v.Y }
+	} else if size.Z > size.X && size.Z > size.Y {
+		axis = func(v fauxgl.Vector) float64 { return v.Z }
+	}
+	slices.SortFunc(rt.triangles[first:first+count], func(a, b rtTriangle) int {
+		ca, cb := axis(a.centroid), axis(b.centroid)
+		switch {
+		case ca < cb:
+			return -1
+		case ca > cb:
+			return 1
+		}
+		return 0
+	})
+
+	half := count / 2
+	rt.build(first, half)
+	right := rt.build(first+half, count-half)
+	rt.nodes[index].count = 0
+	rt.nodes[index].right = right
+	return index
+}
+
+type rtHit struct {
+	t, u, v float64
+	tri     *rtTriangle
+}
+
+// Nearest triangle along a ray within maxT. With shadow set, translucent
+// surfaces are skipped and any opaque hit is enough.
+func (rt *rtScene) intersect(origin, dir fauxgl.Vector, maxT float64, shadow bool) (rtHit, bool) {
+	hit := rtHit{t: maxT}
+	if len(rt.nodes) == 0 {
+		return hit, false
+	}
+	inv := fauxgl.Vector{1 / dir.X, 1 / dir.Y, 1 / dir.Z}
+	stack := make([]int, 1, 64)
+	for len(stack) > 0 {
+		index := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		node := &rt.nodes[index]
+		if !rayHitsBox(origin, inv, node.box, hit.t) {
+			continue
+		}
+		if node.count == 0 {
+			stack = append(stack, node.right, index+1)
+			continue
+		}
+		for i := node.first; i < node.first+node.count; i++ {
+			tri := &rt.triangles[i]
+			if shadow && tri.colors[0].A < 1 {
+				continue
+			}
+			if t, u, v, ok := tri.intersect(origin, dir); ok && t < hit.t {
+				hit = rtHit{t: t, u: u, v: v, tri: tri}
+				if shadow {
+					return hit, true
+				}
+			}
+		}
+	}
+	return hit, hit.tri != nil
+}
+
+// Slab test of a ray against a box, for hits nearer than maxT
+func rayHitsBox(origin, inv fauxgl.Vector, box fauxgl.Box, maxT float64) bool {
+	lo, hi := 0.0, maxT
+	for _, axis := range [3][4]float64{
+		{origin.X, inv.X, box.Min.X, box.Max.X},
+		{origin.Y, inv.Y, box.Min.Y, box.Max.Y},
+		{origin.Z, inv.Z, box.Min.Z, box.Max.Z},
+	} {
+		t0 := (axis[2] - axis[0]) * axis[1]
+		t1 := (axis[3] - axis[0]) * axis[1]
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		lo = math.Max(lo, t0)
+		hi = math.Min(hi, t1)
+		if lo > hi {
+			return false
+		}
+	}
+	return true
+}
+
+// Möller–Trumbore intersection. Both sides of a triangle are hit.
+func (tri *rtTriangle) intersect(origin, dir fauxgl.Vector) (t, u, v float64, ok bool) {
+	p := dir.Cross(tri.e2)
+	det := tri.e1.Dot(p)
+	if math.Abs(det) < 1e-12 {
+		return 0, 0, 0, false
+	}
+	s := origin.Sub(tri.v0)
+	u = s.Dot(p) / det
+	if u < 0 || u > 1 {
+		return 0, 0, 0, false
+	}
+	q := s.Cross(tri.e1)
+	v = dir.Dot(q) / det
+	if v < 0 || u+v > 1 {
+		return 0, 0, 0, false
+	}
+	t = tri.e2.Dot(q) / det
+	return t, u, v, t > rayEpsilon
+}
+
+// Shading normal and color at a hit, interpolated from the vertices
+func (h rtHit) surface() (fauxgl.Vector, fauxgl.Color) {
+	w := 1 - h.u - h.v
+	n := h.tri.normals
+	c := h.tri.colors
+	normal := n[0].MulScalar(w).Add(n[1].MulScalar(h.u)).Add(n[2].MulScalar(h.v)).Normalize()
+	col := c[0].MulScalar(w).Add(c[1].MulScalar(h.u)).Add(c[2].MulScalar(h.v))
+	return normal, col
+}
+
+// Path trace a view: diffuse surfaces lit by a disk light, which gives soft
+// shadows, and a dim sky, which gives ambient occlusion, with up to
+// MaxBounces of light between surfaces. Passes of one sample per pixel run
+// until settings.Samples or settings.Budget is reached, whichever is first;
+// the first pass always completes. Returns the image and the samples per
+// pixel taken. Each row of each pass draws its random numbers from its own
+// stream of settings.Seed, so the result doesn't depend on the number of
+// CPUs.
+func raytrace(sc *scene, cam camera, width, height int, settings RaytraceSettings) (image.Image, int) {
+	rt := newRTScene(sc)
+	forward := cam.center.Sub(cam.eye).Normalize()
+	right := forward.Cross(cam.up).Normalize()
+	up := right.Cross(forward)
+	scale := math.Tan(fauxgl.Radians(FOV) / 2)
+	aspect := cam.aspect(width, height)
+	window := viewWindow{0, 0, 1, 1}
+	if cam.window != nil {
+		window = *cam.window
+	}
+
+	key := fauxgl.Vector{1, 1, 1}.Normalize()
+	lightU := key.Perpendicular().Normalize()
+	lightV := key.Cross(lightU)
+	light := key.MulScalar(lightDistance)
+
+	// Light reaching a surface point straight from the disk, for a white
+	// diffuse surface
+	direct := func(rng *rand.Rand, p, n fauxgl.Vector) float64 {
+		r, a := lightRadius*math.Sqrt(rng.Float64()), 2*math.Pi*rng.Float64()
+		q := light.Add(lightU.MulScalar(r * math.Cos(a))).Add(lightV.MulScalar(r * math.Sin(a)))
+		w := q.Sub(p)
+		dist := w.Length()
+		w = w.DivScalar(dist)
+		cosSurface, cosLight := n.Dot(w), w.Dot(key)
+		if cosSurface <= 0 || cosLight <= 0 {
+			return 0
+		}
+		if _, blocked := rt.intersect(p, w, dist, true); blocked {
+			return 0
+		}
+		area := math.Pi * lightRadius * lightRadius
+		return lightRadiance * cosSurface * cosLight * area / (math.Pi * dist * dist)
+	}
+
+	// Light coming back along one camera ray; the white background where it
+	// misses the scene
+	trace := func(rng *rand.Rand, origin, dir fauxgl.Vector) fauxgl.Color {
+		radiance := fauxgl.Black
+		throughput := fauxgl.White
+		for bounce := 0; bounce <= MaxBounces; {
+			hit, ok := rt.intersect(origin, dir, math.MaxFloat64, false)
+			if !ok {
+				if bounce == 0 {
+					return fauxgl.White
+				}
+				return radiance.Add(throughput.MulScalar(skyRadiance))
+			}
+			p := origin.Add(dir.MulScalar(hit.t))
+			n, albedo := hit.surface()
+			// Translucent surfaces let part of the light straight through
+			if albedo.A < 1 && rng.Float64() > albedo.A {
+				origin = p.Add(dir.MulScalar(rayEpsilon))
+				continue
+			}
+			if n.Dot(dir) > 0 {
+				n = n.Negate()
+			}
+			albedo.A = 1
+			origin = p.Add(n.MulScalar(rayEpsilon))
+			radiance = radiance.Add(throughput.Mul(albedo).MulScalar(direct(rng, origin, n)))
+			throughput = throughput.Mul(albedo)
+			dir = cosineDirection(rng, n)
+			bounce++
+		}
+		return radiance
+	}
+
+	sum := make([]fauxgl.Color, width*height)
+	deadline := time.Now().Add(settings.Budget)
+	workers := runtime.NumCPU()
+	samples := 0
+	for samples < settings.Samples {
+		if samples > 0 && settings.Budget > 0 && time.Now().After(deadline) {
+			break
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for y := w; y < height; y += workers {
+					rng := rand.New(rand.NewPCG(settings.Seed, uint64(samples)<<32|uint64(y)))
+					for x := 0; x < width; x++ {
+						fx := window.left + (float64(x)+rng.Float64())/float64(width)*(window.right-window.left)
+						fy := window.top + (float64(y)+rng.Float64())/float64(height)*(window.bottom-window.top)
+						px := (2*fx - 1) * scale * aspect
+						py := (1 - 2*fy) * scale
+						dir := forward.Add(right.MulScalar(px)).Add(up.MulScalar(py)).Normalize()
+						i := y*width + x
+						sum[i] = sum[i].Add(trace(rng, cam.eye, dir))
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		samples++
+	}
+
+	im := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i, c := range sum {
+		c = c.DivScalar(float64(samples)).Min(fauxgl.White)
+		im.Pix[4*i] = uint8(math.Round(c.R * 255))
+		im.Pix[4*i+1] = uint8(math.Round(c.G * 255))
+		im.Pix[4*i+2] = uint8(math.Round(c.B * 255))
+		im.Pix[4*i+3] = 255
+	}
+	return im, samples
+}
+
+// Random direction around n, more likely the closer to n, as diffuse
+// surfaces scatter light
+func cosineDirection(rng *rand.Rand, n fauxgl.Vector) fauxgl.Vector {
+	r, a := math.Sqrt(rng.Float64()), 2*math.Pi*rng.Float64()
+	u := n.Perpendicular().Normalize()
+	v := n.Cross(u)
+	return u.MulScalar(r * math.Cos(a)).Add(v.MulScalar(r * math.Sin(a))).Add(n.MulScalar(math.Sqrt(1 - r*r)))
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	JobPendingTTL   = 24 * time.Hour  // How long queued and running jobs are kept in shared state
+	RedisPollPeriod = 5 * time.Second // BRPOP timeout, so paused workers notice promptly
+)
+
+// Connection to the Redis server shared by every instance in stateless mode
+type RedisConfig struct {
+	Address  string `json:"address"` // host:port
+	Password string `json:"password"`
+	DB       int    `json:"db"`
+	Prefix   string `json:"prefix"` // Prepended to every key and channel, e.g. "render:"
+}
+
+var rdb *redis.Client
+
+func connectRedis(cfg RedisConfig) error {
+	if cfg.Address == "" {
+		return fmt.Errorf("redis needs an address")
+	}
+	rdb = redis.NewClient(&redis.Options{Addr: cfg.Address, Password: cfg.Password, DB: cfg.DB})
+	return rdb.Ping(context.Background()).Err()
+}
+
+func redisKey(name string) string {
+	return config.Redis.Prefix + name
+}
+
+// Push a job onto the shared queue; workers pop from the other end
+func redisEnqueue(ctx context.Context, job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return rdb.LPush(ctx, redisQueueKey(job.Priority, job.Tenant), data).Err()
+}
+
+// Put a job taken from the shared queue back at the head of its line
+func redisReturn(ctx context.Context, job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return rdb.RPush(ctx, redisQueueKey(job.Priority, job.Tenant), data).Err()
+}
+
+// List holding a tenant's jobs in a lane of the shared queue. The default
+// tenant's batch jobs, and jobs queued before there were lanes, share the
+// original list.
+func redisQueueKey(priority, tenant string) string {
+	name := "queue"
+	if priority == PriorityInteractive {
+		name += ":interactive"
+	}
+	if tenant != "" {
+		name += ":tenant:" + tenant
+	}
+	return redisKey(name)
+}
+
+// This instance's turns among tenants in each lane of the shared queue
+var (
+	redisTurnsMu sync.Mutex
+	redisTurns   = make(map[string]*fairTurns)
+)
+
+func redisLaneTurns(priority string) *fairTurns {
+	if redisTurns[priority] == nil {
+		redisTurns[priority] = newFairTurns(queueTenants()...)
+	}
+	return redisTurns[priority]
+}
+
+// Pop the oldest job from the shared queue, waiting up to RedisPollPeriod.
+// Interactive jobs are taken first, interactiveOnly takes nothing else, and
+// within a lane tenants take turns as in a fairQueue.
+func redisDequeue(ctx context.Context, interactiveOnly bool) (Job, bool, error) {
+	lanes := []string{PriorityInteractive}
+	if !interactiveOnly {
+		lanes = append(lanes, PriorityBatch)
+	}
+	type line struct{ priority, tenant string }
+	var keys []string
+	lines := make(map[string]line)
+	redisTurnsMu.Lock()
+	for _, priority := range lanes {
+		for _, tenant := range redisLaneTurns(priority).rotation() {
+			key := redisQueueKey(priority, tenant)
+			keys = append(keys, key)
+			lines[key] = line{priority, tenant}
+		}
+	}
+	redisTurnsMu.Unlock()
+
+	result, err := rdb.BRPop(ctx, RedisPollPeriod, keys...).Result()
+	if errors.Is(err, redis.Nil) {
+		return Job{}, false, nil
+	}
+	if err != nil {
+		return Job{}, false, err
+	}
+	var job Job
+	if err := json.Unmarshal([]byte(result[1]), &job); err != nil {
+		return Job{}, false, err
+	}
+	from := lines[result[0]]
+	redisTurnsMu.Lock()
+	redisLaneTurns(from.priority).took(from.tenant, job.Estimate)
+	redisTurnsMu.Unlock()
+	return job, true, nil
+}
+
+// IDs of the jobs on every line of the shared queue
+func redisQueuedJobIDs(ctx context.Context) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	for _, priority := range []string{PriorityInteractive, PriorityBatch} {
+		for _, tenant := range queueTenants() {
+			entries, err := rdb.LRange(ctx, redisQueueKey(priority, tenant), 0, -1).Result()
+			if err != nil {
+				return nil, err
+			}
+			for _, data := range entries {
+				var job struct{ ID string }
+				if json.Unmarshal([]byte(data), &job) == nil {
+					ids[job.ID] = true
+				}
+			}
+		}
+	}
+	return ids, nil
+}
+
+// Jobs waiting in a lane of the shared queue, across tenants
+func redisQueueLength(ctx context.Context, priority string) int {
+	n := 0
+	for _, depth := range redisQueueDepths(ctx, priority) {
+		n += depth
+	}
+	return n
+}
+
+// Jobs waiting in a lane of the shared queue by tenant, leaving out tenants
+// with none
+func redisQueueDepths(ctx context.Context, priority string) map[string]int {
+	depths := make(map[string]int)
+	for _, tenant := range queueTenants() {
+		n, err := rdb.LLen(ctx, redisQueueKey(priority, tenant)).Result()
+		if err != nil {
+			log.Printf("Failed to read queue length: %v", err)
+		}
+		if n > 0 {
+			depths[tenant] = int(n)
+		}
+	}
+	return depths
+}
+
+// Broadcast a message to every instance, this one included
+func redisPublish(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return rdb.Publish(context.Background(), redisKey("events"), data).Err()
+}
+
+// Deliver broadcast messages until the connection is closed
+func redisSubscribe(handle func(payload []byte)) {
+	sub := rdb.Subscribe(context.Background(), redisKey("events"))
+	for msg := range sub.Channel() {
+		handle([]byte(msg.Payload))
+	}
+}
+
+// Job and hash store kept in Redis
+type redisStore struct{}
+
+func (redisStore) SaveJob(job Job) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	ttl := JobPendingTTL
+	if job.finished() {
+		ttl = JobRetention
+	}
+	return rdb.Set(context.Background(), redisKey("job:"+job.ID), data, ttl).Err()
+}
+
+func (redisStore) LoadJob(id string) (*Job, error) {
+	data, err := rdb.Get(context.Background(), redisKey("job:"+id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (redisStore) ClaimCacheKey(cacheKey, id string) (string, error) {
+	ctx := context.Background()
+	key := redisKey("inflight:" + cacheKey)
+	for {
+		ok, err := rdb.SetNX(ctx, key, id, JobPendingTTL).Result()
+		if err != nil || ok {
+			return "", err
+		}
+		existing, err := rdb.Get(ctx, key).Result()
+		if errors.Is(err, redis.Nil) {
+			continue // Released in between, try again
+		}
+		return existing, err
+	}
+}
+
+func (redisStore) FindCacheKey(cacheKey string) (string, error) {
+	id, err := rdb.Get(context.Background(), redisKey("inflight:"+cacheKey)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	return id, err
+}
+
+// Delete only if the key still belongs to the job
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+func (redisStore) ReleaseCacheKey(cacheKey, id string) error {
+	return releaseScript.Run(context.Background(), rdb, []string{redisKey("inflight:" + cacheKey)}, id).Err()
+}
+
+func (redisStore) LookupOutput(cacheKey string) (string, bool, error) {
+	name, err := rdb.HGet(context.Background(), redisKey("outputs"), cacheKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", false, nil
+	}
+	return name, err == nil, err
+}
+
+func (redisStore) RecordOutput(cacheKey, name string) error {
+	return rdb.HSet(context.Background(), redisKey("outputs"), cacheKey, name).Err()
+}
+
+func (s redisStore) StaleJobs(before time.Time) ([]string, error) {
+	ctx := context.Background()
+	var stale []string
+	iter := rdb.Scan(ctx, 0, redisKey("job:*"), 100).Iterator()
+	for iter.Next(ctx) {
+		job, err := s.LoadJob(strings.TrimPrefix(iter.Val(), redisKey("job:")))
+		if err != nil {
+			return stale, err
+		}
+		if job != nil && !job.finished() && job.UpdatedAt.Before(before) {
+			stale = append(stale, job.ID)
+		}
+	}
+	return stale, iter.Err()
+}
+
+// Counter field an access increments
+func accessField(access OutputAccess) string {
+	if access.Kind == AccessView {
+		return "views"
+	}
+	return "downloads"
+}
+
+func (redisStore) RecordAccess(key string, access OutputAccess) error {
+	ctx := context.Background()
+	referrers := redisKey("analytics-referrers:" + key)
+	if host := access.Referrer; host != "" {
+		// Racy between instances, which only lets a few more hosts in
+		known, err := rdb.HExists(ctx, referrers, host).Result()
+		if err != nil {
+			return err
+		}
+		if !known && rdb.HLen(ctx, referrers).Val() >= MaxReferrers {
+			access.Referrer = OtherReferrer
+		}
+	}
+	recent, err := json.Marshal(access)
+	if err != nil {
+		return err
+	}
+
+	counts := redisKey("analytics:" + key)
+	field := accessField(access)
+	pipe := rdb.TxPipeline()
+	pipe.HIncrBy(ctx, counts, field, 1)
+	pipe.HSetNX(ctx, counts, "first_at", access.Time.Format(time.RFC3339Nano))
+	pipe.HSet(ctx, counts, "last_at", access.Time.Format(time.RFC3339Nano))
+	pipe.LPush(ctx, redisKey("analytics-recent:"+key), recent)
+	pipe.LTrim(ctx, redisKey("analytics-recent:"+key), 0, MaxRecentAccesses-1)
+	pipe.ZIncrBy(ctx, redisKey("analytics-top"), 1, key)
+	pipe.HIncrBy(ctx, redisKey("analytics-totals"), field, 1)
+	if access.Referrer != "" {
+		pipe.HIncrBy(ctx, referrers, access.Referrer, 1)
+		pipe.HIncrBy(ctx, redisKey("analytics-referrers"), access.Referrer, 1)
+	}
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+func (redisStore) LoadAnalytics(key string) (OutputAnalytics, error) {
+	ctx := context.Background()
+	var a OutputAnalytics
+	counts, err := rdb.HGetAll(ctx, redisKey("analytics:"+key)).Result()
+	if err != nil || len(counts) == 0 {
+		return a, err
+	}
+	a.Views, _ = strconv.ParseInt(counts["views"], 10, 64)
+	a.Downloads, _ = strconv.ParseInt(counts["downloads"], 10, 64)
+	if t, err := time.Parse(time.RFC3339Nano, counts["first_at"]); err == nil {
+		a.FirstAt = &t
+	}
+	if t, err := time.Parse(time.RFC3339Nano, counts["last_at"]); err == nil {
+		a.LastAt = &t
+	}
+
+	if a.Referrers, err = redisCounts(ctx, redisKey("analytics-referrers:"+key)); err != nil {
+		return a, err
+	}
+	recent, err := rdb.LRange(ctx, redisKey("analytics-recent:"+key), 0, -1).Result()
+	if err != nil {
+		return a, err
+	}
+	for _, data := range recent {
+		var access OutputAccess
+		if err := json.Unmarshal([]byte(data), &access); err == nil {
+			a.Recent = append(a.Recent, access)
+		}
+	}
+	return a, nil
+}
+
+func (redisStore) AnalyticsSummary(top int) (AnalyticsSummary, error) {
+	ctx := context.Background()
+	var summary AnalyticsSummary
+	totals, err := redisCounts(ctx, redisKey("analytics-totals"))
+	if err != nil {
+		return summary, err
+	}
+	summary.Views, summary.Downloads = totals["views"], totals["downloads"]
+	outputs, err := rdb.ZCard(ctx, redisKey("analytics-top")).Result()
+	if err != nil {
+		return summary, err
+	}
+	summary.Outputs = int(outputs)
+	if summary.Referrers, err = redisCounts(ctx, redisKey("analytics-referrers")); err != nil {
+		return summary, err
+	}
+
+	keys, err := rdb.ZRevRange(ctx, redisKey("analytics-top"), 0, int64(top-1)).Result()
+	if err != nil {
+		return summary, err
+	}
+	for _, key := range keys {
+		counts, err := redisCounts(ctx, redisKey("analytics:"+key))
+		if err != nil {
+			return summary, err
+		}
+		tenant, name := splitAnalyticsKey(key)
+		summary.Top = append(summary.Top, OutputUsage{Tenant: tenant, Name: name, Views: counts["views"], Downloads: counts["downloads"]})
+	}
+	sortOutputUsage(summary.Top)
+	return summary, nil
+}
+
+// A hash of counters, skipping fields that aren't numbers
+func redisCounts(ctx context.Context, key string) (map[string]int64, error) {
+	fields, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int64, len(fields))
+	for field, value := range fields {
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			counts[field] = n
+		}
+	}
+	return counts, nil
+}
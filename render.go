@@ -0,0 +1,598 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fogleman/fauxgl"
+	"github.com/hschendel/stl"
+)
+
+const MinNearRatio = 0.001 // Smallest automatic near plane as a fraction of the far plane, to keep depth precision
+
+// Camera placement for a single view
+type camera struct {
+	eye, center, up fauxgl.Vector
+	window          *viewWindow // Part of the view to render, for tiles; all of it when nil
+}
+
+// Rectangle of a view as fractions of its width and height from the top
+// left. It may reach outside 0–1, for tiles with margins.
+type viewWindow struct {
+	left, top, right, bottom float64
+}
+
+// Projection onto a width×height image of the camera's window
+func (cam camera) projection(width, height int, near, far float64) fauxgl.Matrix {
+	look := fauxgl.LookAt(cam.eye, cam.center, cam.up)
+	w := cam.window
+	if w == nil {
+		return look.Perspective(FOV, float64(width)/float64(height), near, far)
+	}
+	ymax := near * math.Tan(fauxgl.Radians(FOV)/2)
+	xmax := ymax * cam.aspect(width, height)
+	return look.Frustum(-xmax+2*xmax*w.left, -xmax+2*xmax*w.right, ymax-2*ymax*w.bottom, ymax-2*ymax*w.top, near, far)
+}
+
+// Aspect ratio of the whole view when width×height pixels show the window
+func (cam camera) aspect(width, height int) float64 {
+	if cam.window == nil {
+		return float64(width) / float64(height)
+	}
+	w := cam.window
+	return (float64(width) / (w.right - w.left)) / (float64(height) / (w.bottom - w.top))
+}
+
+// A loaded model plus everything that affects how it is shaded
+type scene struct {
+	mesh         *fauxgl.Mesh
+	vertexColors bool         // Shade with per-vertex colors from the mesh instead of color
+	color        fauxgl.Color // Of the whole model; light gray when unset, see modelColor
+	stats        ModelStats   // Measured in model units, before normalization
+	overlays     []overlay
+	near, far    float64 // Clip plane overrides; 0 fits the plane to the scene's bounds
+	fitScale     float64 // Bi-unit cube units per model unit
+
+	filters        []string // Post-processing applied to each rendered view
+	sharpen, gamma float64
+	dof            *DepthOfField
+	outline        *Outline
+	backdrop       image.Image // Composited behind the model instead of the white background
+	backdropDigest string
+	exposure       *toneCurve        // Metered on the first view, with the autoexposure filter
+	annotations    *annotationLayer  // Legend, labels, and indicators drawn into finished images
+	raytrace       *RaytraceSettings // Path trace views instead of using the rasterized colors
+}
+
+// Color the model is shaded with when it has no vertex colors; light gray
+// unless the job asked for another
+func (sc *scene) modelColor() fauxgl.Color {
+	if sc.color == (fauxgl.Color{}) {
+		return fauxgl.Gray(0.75)
+	}
+	return sc.color
+}
+
+// Extra geometry drawn over the model. Markers stay visible even where the
+// model hides them; translucent overlays blend in front of the model but are
+// hidden behind it.
+type overlay struct {
+	mesh        *fauxgl.Mesh
+	color       fauxgl.Color
+	translucent bool
+}
+
+var defaultCamera = camera{
+	eye:    fauxgl.Vector{3, 3, 3},
+	center: fauxgl.Vector{0, 0, 0},
+	up:     fauxgl.Vector{0, 0, 1},
+}
+
+// Load an STL file into a mesh, in the file's own coordinates
+func loadMesh(path string) (*fauxgl.Mesh, error) {
+	reader, err := stl.ReadFile(path)
+	if err != nil {
+		return nil, withErrorCode(ErrUnsupportedFormat, fmt.Errorf("failed to read STL file: %w", err))
+	}
+
+	mesh := fauxgl.NewEmptyMesh()
+	for _, triangle := range reader.Triangles {
+		v1 := fauxgl.Vector{float64(triangle.Vertices[0][0]), float64(triangle.Vertices[0][1]), float64(triangle.Vertices[0][2])}
+		v2 := fauxgl.Vector{float64(triangle.Vertices[1][0]), float64(triangle.Vertices[1][1]), float64(triangle.Vertices[1][2])}
+		v3 := fauxgl.Vector{float64(triangle.Vertices[2][0]), float64(triangle.Vertices[2][1]), float64(triangle.Vertices[2][2])}
+		mesh.Triangles = append(mesh.Triangles, fauxgl.NewTriangleForPoints(v1, v2, v3))
+	}
+	return mesh, nil
+}
+
+// Apply the requested mirror and rotations
+func orientMesh(mesh *fauxgl.Mesh, opts RenderOptions) {
+	if opts.Mirror == "" && opts.RotateX == 0 && opts.RotateY == 0 && opts.RotateZ == 0 {
+		return
+	}
+	mesh.Transform(orientation(opts))
+	if opts.Mirror != "" {
+		mesh.ReverseWinding() // A reflection turns the faces inside out
+	}
+}
+
+// The requested mirror followed by the rotations, as one transform
+func orientation(opts RenderOptions) fauxgl.Matrix {
+	m := fauxgl.Identity()
+	switch opts.Mirror {
+	case "x":
+		m = m.Scale(fauxgl.Vector{-1, 1, 1})
+	case "y":
+		m = m.Scale(fauxgl.Vector{1, -1, 1})
+	case "z":
+		m = m.Scale(fauxgl.Vector{1, 1, -1})
+	}
+	if opts.RotateX != 0 {
+		m = m.Rotate(fauxgl.Vector{1, 0, 0}, fauxgl.Radians(opts.RotateX))
+	}
+	if opts.RotateY != 0 {
+		m = m.Rotate(fauxgl.Vector{0, 1, 0}, fauxgl.Radians(opts.RotateY))
+	}
+	if opts.RotateZ != 0 {
+		m = m.Rotate(fauxgl.Vector{0, 0, 1}, fauxgl.Radians(opts.RotateZ))
+	}
+	return m
+}
+
+// Rasterize the scene as seen from one camera, keeping the depth buffer
+func renderContext(sc *scene, cam camera, width, height int) *fauxgl.Context {
+	return renderer.Render(sc, cam, width, height)
+}
+
+func (cpuRenderer) Render(sc *scene, cam camera, width, height int) *fauxgl.Context {
+	context := fauxgl.NewContext(width, height)
+	context.ClearColorBufferWith(fauxgl.HexColor("#ffffff"))
+
+	near, far := clipPlanes(sc, cam)
+	matrix := cam.projection(width, height, near, far)
+	light := fauxgl.Vector{1, 1, 1}.Normalize()
+	if sc.vertexColors {
+		context.Shader = newVertexColorShader(matrix, light, cam.eye)
+	} else {
+		shader := fauxgl.NewPhongShader(matrix, light, cam.eye)
+		shader.ObjectColor = sc.modelColor()
+		shader.SpecularPower = 100
+		context.Shader = shader
+	}
+	context.DrawMesh(sc.mesh)
+
+	if len(sc.overlays) > 0 {
+		// Keep the model's depth so depth maps aren't affected by overlays
+		depth := append([]float64(nil), context.DepthBuffer...)
+		drawOverlay := func(o overlay) {
+			shader := fauxgl.NewPhongShader(matrix, light, cam.eye)
+			shader.ObjectColor = o.color
+			context.Shader = shader
+			context.DrawMesh(o.mesh)
+		}
+
+		context.AlphaBlend = true
+		context.WriteDepth = false
+		for _, o := range sc.overlays {
+			if o.translucent {
+				drawOverlay(o)
+			}
+		}
+		context.AlphaBlend = false
+		context.WriteDepth = true
+
+		context.ClearDepthBuffer()
+		for _, o := range sc.overlays {
+			if !o.translucent {
+				drawOverlay(o)
+			}
+		}
+		copy(context.DepthBuffer, depth)
+	}
+
+	return context
+}
+
+// Near and far clip plane distances that just enclose the scene, model and
+// overlays, as seen from cam. Fixed planes clip models whose normalized box
+// still reaches past them, e.g. long thin parts seen end-on, and waste depth
+// precision on small ones.
+func clipPlanes(sc *scene, cam camera) (float64, float64) {
+	box := sc.mesh.BoundingBox()
+	for _, o := range sc.overlays {
+		box = box.Extend(o.mesh.BoundingBox())
+	}
+
+	// Depth of each box corner along the view direction
+	forward := cam.center.Sub(cam.eye).Normalize()
+	lo, hi := math.MaxFloat64, -math.MaxFloat64
+	for i := 0; i < 8; i++ {
+		corner := box.Min
+		if i&1 != 0 {
+			corner.X = box.Max.X
+		}
+		if i&2 != 0 {
+			corner.Y = box.Max.Y
+		}
+		if i&4 != 0 {
+			corner.Z = box.Max.Z
+		}
+		d := corner.Sub(cam.eye).Dot(forward)
+		lo = math.Min(lo, d)
+		hi = math.Max(hi, d)
+	}
+
+	// Leave some slack, and keep the near plane in front of the camera even
+	// when the camera is inside the box
+	margin := 0.05*(hi-lo) + 0.01
+	far := math.Max(hi+margin, 0.1)
+	near := math.Max(lo-margin, far*MinNearRatio)
+	if sc.near > 0 {
+		near = sc.near
+	}
+	if sc.far > 0 {
+		far = sc.far
+	}
+	return near, far
+}
+
+// Check that the clip planes are in order for every camera. A near or far
+// override is only checked against the other when both are set; with one,
+// the other is fitted to the scene and may end up on the wrong side of it.
+func checkClipPlanes(sc *scene, cams ...camera) error {
+	for _, cam := range cams {
+		if near, far := clipPlanes(sc, cam); near >= far {
+			return withErrorCode(ErrInvalidRequest, fmt.Errorf("near (%g) must be less than far (%g)", near, far))
+		}
+	}
+	return nil
+}
+
+// Rasterize the scene as seen from one camera
+func renderView(sc *scene, cam camera, width, height int) image.Image {
+	return sc.finishView(renderContext(sc, cam, width, height), cam)
+}
+
+// Rendered image of a view with its outline, focal blur, and filters applied.
+// Raytraced scenes replace the rasterized colors but keep its depth buffer
+// for those.
+func (sc *scene) finishView(context *fauxgl.Context, cam camera) image.Image {
+	im := context.Image()
+	if sc.raytrace != nil {
+		var samples int
+		im, samples = raytrace(sc, cam, context.Width, context.Height, *sc.raytrace)
+		// Tiles may each run out of time at a different pass
+		if sc.stats.Samples == 0 || samples < sc.stats.Samples {
+			sc.stats.Samples = samples
+		}
+	}
+	if cam.window == nil {
+		sc.meterExposure(im, context.DepthBuffer)
+	}
+	if sc.outline == nil && sc.dof == nil && sc.backdrop == nil {
+		return sc.postProcess(im)
+	}
+	dst, ok := im.(*image.NRGBA)
+	if !ok {
+		dst = image.NewNRGBA(im.Bounds())
+		draw.Draw(dst, dst.Bounds(), im, im.Bounds().Min, draw.Src)
+	}
+	if sc.backdrop != nil {
+		sc.applyBackdrop(dst, context.DepthBuffer, cam)
+	}
+	near, far := clipPlanes(sc, cam)
+	if sc.outline != nil {
+		drawOutline(dst, context, near, far, *sc.outline)
+	}
+	if sc.dof != nil {
+		dst = focalBlur(dst, context, cam, near, far, *sc.dof)
+	}
+	return sc.postProcess(dst)
+}
+
+// Load the job's model and apply its shading options
+func loadScene(ctx context.Context, job Job) (*scene, error) {
+	mesh, err := loadMesh(job.STLPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	orientMesh(mesh, job.Options)
+	if job.Options.Decimate > 0 {
+		mesh.Simplify(job.Options.Decimate)
+	}
+	filled := 0
+	if job.Options.FillHoles > 0 {
+		filled = fillHoles(mesh, job.Options.FillHoles)
+	}
+	if job.Options.QR != nil {
+		size := mesh.BoundingBox().Size()
+		units, _ := resolveUnits(job.Analysis.Units, Dimensions{size.X, size.Y, size.Z})
+		if err := embossQR(mesh, *job.Options.QR, unitScales[units]); err != nil {
+			return nil, err
+		}
+	}
+	sc := &scene{mesh: mesh, stats: measureMesh(mesh, job.Analysis)}
+	sc.stats.Issues.HolesFilled = filled
+	if job.Options.Color != "" {
+		sc.color = fauxgl.HexColor(job.Options.Color)
+	}
+	if job.Options.Voxels > 0 {
+		// Measured as uploaded, shown as blocks
+		blocks, voxels := voxelMesh(mesh, job.Options.Voxels, unitScales[sc.stats.Units])
+		if len(blocks.Triangles) == 0 {
+			return nil, errors.New("model encloses no volume to voxelize")
+		}
+		mesh, sc.mesh, sc.stats.Voxels = blocks, blocks, &voxels
+	}
+	if job.Options.Near != nil {
+		sc.near = *job.Options.Near
+	}
+	if job.Options.Far != nil {
+		sc.far = *job.Options.Far
+	}
+	sc.filters, sc.sharpen, sc.gamma = job.Options.Filters, job.Options.Sharpen, job.Options.Gamma
+	sc.dof, sc.outline = job.Options.DOF, job.Options.Outline
+	if sc.backdrop, err = findBackdrop(job.Options.Backdrop); err != nil {
+		return nil, err
+	}
+	sc.backdropDigest = job.Options.Backdrop
+	if job.Options.Quality == QualityRaytraced {
+		sc.raytrace = &RaytraceSettings{Samples: job.Options.Samples, Budget: time.Duration(config.RaytraceSecs) * time.Second, Seed: job.Options.Seed}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Keep the processed mesh, in the model's own units, for download
+	if job.MeshFile != "" {
+		if err := mesh.SaveSTL(filepath.Join(job.WorkDir, job.MeshFile)); err != nil {
+			return nil, fmt.Errorf("failed to save processed mesh: %w", err)
+		}
+	}
+
+	// Fit the model to the bi-unit cube so the camera framing is the same for every model
+	fit := mesh.BiUnitCube()
+	// The fit is a uniform scale plus a translation
+	sc.fitScale = fit.MulPosition(fauxgl.Vector{1, 0, 0}).Sub(fit.MulPosition(fauxgl.Vector{})).X
+
+	if job.Options.ShowCOM && sc.stats.CenterOfMass != nil {
+		com := sc.stats.CenterOfMass
+		center := fit.MulPosition(fauxgl.Vector{com.X, com.Y, com.Z})
+		sc.overlays = append(sc.overlays, overlay{mesh: centerOfMassMarker(center), color: fauxgl.HexColor("#e74c3c")})
+	}
+
+	if job.Options.ShowEdges {
+		sc.overlays = append(sc.overlays, edgeMarkers(mesh)...)
+	}
+
+	if printer, ok := findPrinter(job.Options.Printer); ok {
+		scale := sc.fitScale / unitScales[sc.stats.Units]
+		box := mesh.BoundingBox()
+		center := fauxgl.Vector{(box.Min.X + box.Max.X) / 2, (box.Min.Y + box.Max.Y) / 2, box.Min.Z}
+		outline := bedOutline(center, printer.BedX*scale, printer.BedY*scale)
+		sc.overlays = append(sc.overlays, overlay{mesh: outline, color: fauxgl.HexColor("#555555"), translucent: true})
+	}
+
+	if job.Options.Supports {
+		if pillars := supportPillars(mesh, job.Options.OverhangAngle); pillars != nil {
+			sc.overlays = append(sc.overlays, overlay{mesh: pillars, color: fauxgl.HexColor("#3498db").Alpha(0.45), translucent: true})
+		}
+	}
+
+	// Average vertex normals across shallow edges so scans and organic shapes
+	// don't look faceted; sharper edges keep their crease
+	if job.Options.CreaseAngle > 0 {
+		mesh.SmoothNormalsThreshold(fauxgl.Radians(job.Options.CreaseAngle))
+	}
+
+	var lg *legend
+	palette := palettes[job.Options.Palette]
+	switch job.Options.ColorBy {
+	case "height":
+		height := colorByHeight(mesh, palette) / sc.fitScale
+		lg = heightLegend(palette, height, sc.stats.Units)
+		sc.vertexColors = true
+	case "curvature":
+		curvature := colorByCurvature(mesh, palette) * sc.fitScale
+		lg = curvatureLegend(palette, curvature, sc.stats.Units)
+		sc.vertexColors = true
+	case "layer":
+		layers := colorByLayer(mesh, palette, job.Options.LayerHeight*sc.fitScale/unitScales[sc.stats.Units])
+		lg = layerLegend(palette, layers)
+		sc.vertexColors = true
+	}
+	if job.Options.HideLegend {
+		lg = nil
+	}
+	sc.annotations = newAnnotationLayer(lg, job.Options.Annotations, fit.Mul(orientation(job.Options)))
+	if job.Options.ShowIssues {
+		_, problems := findMeshIssues(mesh)
+		colorProblemTriangles(mesh, problems, sc.vertexColors, sc.modelColor())
+		sc.vertexColors = true
+	}
+	return sc, nil
+}
+
+// 16-bit depth map of a rendered view: near surfaces are bright, the
+// background is black
+func depthImage(context *fauxgl.Context) image.Image {
+	lo, hi := math.MaxFloat64, -math.MaxFloat64
+	for _, d := range context.DepthBuffer {
+		if d == math.MaxFloat64 {
+			continue
+		}
+		lo = math.Min(lo, d)
+		hi = math.Max(hi, d)
+	}
+
+	im := image.NewGray16(image.Rect(0, 0, context.Width, context.Height))
+	for i, d := range context.DepthBuffer {
+		if d == math.MaxFloat64 {
+			continue
+		}
+		t := 1.0
+		if hi > lo {
+			t = 1 - (d-lo)/(hi-lo)
+		}
+		// Keep the farthest surface distinguishable from the background
+		v := 0x0100 + uint16(t*0xfeff)
+		im.SetGray16(i%context.Width, i/context.Width, color.Gray16{v})
+	}
+	return im
+}
+
+// Camera distance of every pixel of a rendered view, +Inf for the
+// background. The depth buffer holds screen depth, 0 at the near plane and 1
+// at the far plane, which isn't linear in distance.
+func viewDistances(context *fauxgl.Context, near, far float64) []float64 {
+	distance := make([]float64, len(context.DepthBuffer))
+	for i, z := range context.DepthBuffer {
+		if z == math.MaxFloat64 {
+			distance[i] = math.Inf(1)
+			continue
+		}
+		ndc := 2*z - 1
+		distance[i] = 2 * far * near / (far + near - ndc*(far-near))
+	}
+	return distance
+}
+
+// Encode an image to a file in the given format
+func saveImage(path string, im image.Image, format string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	switch format {
+	case "webp":
+		err = encodeWebP(file, im)
+	default:
+		err = png.Encode(file, im)
+	}
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Render STL to PNG (or a ZIP of PNG frames, a build animation GIF, or
+// several encodings of one image) using fauxgl. Results are written into the
+// job's work dir under the job's output names. Returns the model's
+// measurements. Gives up between steps once ctx is done.
+func renderSTLToPNG(ctx context.Context, job Job) (ModelStats, error) {
+	sc, err := loadScene(ctx, job)
+	if err != nil {
+		return ModelStats{}, err
+	}
+
+	if job.Options.Frames > 0 {
+		outputPath := filepath.Join(job.WorkDir, job.OutputPath)
+		elevation := DefaultElevation
+		if job.Options.Elevation != nil {
+			elevation = *job.Options.Elevation
+		}
+		cams := make([]camera, job.Options.Frames)
+		for i := range cams {
+			cams[i] = spinCamera(i, job.Options.Frames, elevation)
+		}
+		if err := checkClipPlanes(sc, cams...); err != nil {
+			return ModelStats{}, err
+		}
+		preview := func(i int, im image.Image) {
+			pushPreviewFrame(job.ID, i+1, job.Options.Frames, im)
+		}
+		if err := renderSpinZIP(ctx, sc, job.Options.Frames, elevation, outputPath, preview); err != nil {
+			return ModelStats{}, fmt.Errorf("failed to save ZIP file: %w", err)
+		}
+		return sc.stats, nil
+	}
+
+	cam := defaultCamera
+	if job.Options.View != nil {
+		cam = job.Options.View.camera()
+	}
+	if err := checkClipPlanes(sc, cam); err != nil {
+		return ModelStats{}, err
+	}
+	if job.Options.BuildFrames > 0 {
+		outputPath := filepath.Join(job.WorkDir, job.OutputPath)
+		preview := func(i int, im image.Image) {
+			pushPreviewFrame(job.ID, i+1, job.Options.BuildFrames, im)
+		}
+		if err := renderBuildGIF(ctx, sc, cam, job.Options.BuildFrames, outputPath, preview); err != nil {
+			return ModelStats{}, fmt.Errorf("failed to save GIF file: %w", err)
+		}
+		return sc.stats, nil
+	}
+	if job.Options.Size > 0 {
+		outputPath := filepath.Join(job.WorkDir, job.OutputPath)
+		progress := func(done, total int) {
+			pushTileProgress(job.ID, done, total)
+		}
+		if err := renderPoster(ctx, sc, cam, job.Options.Size, outputPath, progress); err != nil {
+			return ModelStats{}, fmt.Errorf("failed to save poster: %w", err)
+		}
+		return sc.stats, nil
+	}
+
+	// Rasterize once, then encode every requested format from the same frame
+	var im image.Image
+	var context *fauxgl.Context
+	switch job.Options.Stereo {
+	case "sbs":
+		im = renderStereoPair(sc, cam, job.Options.IOD) // Annotated eye by eye
+	case "anaglyph":
+		im = sc.withAnnotations(renderAnaglyph(sc, cam, job.Options.IOD), cam)
+	default:
+		context = renderContext(sc, cam, Width, Height)
+		im = sc.withAnnotations(sc.finishView(context, cam), cam)
+	}
+	im = applyBrandingFrame(im)
+
+	formats := job.Options.Formats
+	if len(formats) == 0 {
+		formats = []string{"png"}
+	}
+	var picking *image.NRGBA // Shared by the ids and components maps
+	for i, format := range formats {
+		if err := ctx.Err(); err != nil {
+			return ModelStats{}, err
+		}
+		outputPath := filepath.Join(job.WorkDir, job.Outputs[i])
+		if (format == "ids" || format == "components") && picking == nil {
+			picking = pickingImage(sc, cam, Width, Height)
+		}
+		var err error
+		switch format {
+		case "depth":
+			err = saveImage(outputPath, depthImage(context), "png")
+		case "backlit":
+			err = saveImage(outputPath, backlitImage(sc, Width, Height), "png")
+		case "ids":
+			err = saveImage(outputPath, picking, "png")
+		case "components":
+			err = saveImage(outputPath, componentImage(picking, sc.mesh), "png")
+		default:
+			err = saveImage(outputPath, im, format)
+		}
+		if err != nil {
+			return ModelStats{}, fmt.Errorf("failed to save %s file: %w", format, err)
+		}
+	}
+
+	return sc.stats, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/fogleman/fauxgl"
+)
+
+func TestCheckClipPlanes(t *testing.T) {
+	tests := []struct {
+		name      string
+		near, far float64
+		wantErr   bool
+	}{
+		{"fitted", 0, 0, false},
+		{"near in front of the model", 1, 0, false},
+		{"near past the fitted far plane", 50, 0, true},
+		{"far behind the model", 0, 20, false},
+		{"far before the fitted near plane", 0, 0.001, true},
+		{"both in order", 1, 20, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := &scene{mesh: fauxgl.NewCube(), near: tt.near, far: tt.far}
+			err := checkClipPlanes(sc, defaultCamera, spinCamera(3, 8, DefaultElevation))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkClipPlanes = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && errorCode(err, "") != ErrInvalidRequest {
+				t.Errorf("error code is %q, want %s", errorCode(err, ""), ErrInvalidRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	RendererCPU = "cpu" // fauxgl, in this process
+	RendererGPU = "gpu" // OpenGL through headless EGL; needs a build with -tags egl
+)
+
+// Rasterizes a scene into color and depth buffers. Outlines, focal blur,
+// filters, and encoding work on those buffers the same way whichever
+// renderer drew them.
+type Renderer interface {
+	Render(sc *scene, cam camera, width, height int) *fauxgl.Context
+}
+
+type cpuRenderer struct{}
+
+// Renderer that draws model views, selected by config.Renderer
+var renderer Renderer = cpuRenderer{}
+
+// Name of the configured renderer
+func rendererName() string {
+	if config.Renderer == "" {
+		return RendererCPU
+	}
+	return config.Renderer
+}
+
+// Set up the renderer selected in the config
+func setupRenderer() error {
+	switch config.Renderer {
+	case "", RendererCPU:
+		renderer = cpuRenderer{}
+	case RendererGPU:
+		gpu, err := newGPURenderer()
+		if err != nil {
+			return err
+		}
+		renderer = gpu
+	default:
+		return fmt.Errorf("unknown renderer %q", config.Renderer)
+	}
+	return nil
+}
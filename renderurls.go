@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File names of render URLs: the model's hash and the format
+var renderURLPattern = regexp.MustCompile(`^([0-9a-f]{64})\.(png|webp)$`)
+
+// Short query parameters of render URLs, by the option field they set
+var renderURLAliases = map[string]string{
+	"angle": "view_azimuth",
+}
+
+var shortHexColorPattern = regexp.MustCompile(`^#?([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Signed render URLs, which frontends build to ask for image variants of a
+// stored model like from an image CDN. Enabled when a key is set.
+type RenderURLConfig struct {
+	Key        string `json:"key"`          // Secret the URLs are signed with
+	KeyEnv     string `json:"key_env"`      // Environment variable holding the key instead
+	WaitSecs   int    `json:"wait_secs"`    // Longest a request waits for its render before answering 503
+	MaxAgeSecs int    `json:"max_age_secs"` // Cache-Control max-age of the images
+}
+
+// Key render URLs are signed with; "" when they are off
+func renderURLKey() string {
+	if config.RenderURLs.Key != "" {
+		return config.RenderURLs.Key
+	}
+	if config.RenderURLs.KeyEnv != "" {
+		return os.Getenv(config.RenderURLs.KeyEnv)
+	}
+	return ""
+}
+
+// GET /render/<hash>.png or .webp?size=512&angle=45&color=333&sig=…
+//
+// The stored model rendered with the options in the query, from the cache or
+// on the fly. Query parameters are the option fields of /upload, plus angle
+// for view_azimuth and color without its #. sig is the hex HMAC-SHA256, with
+// the configured key, of the path and the other parameters sorted by name,
+// form-encoded, e.g. /render/<hash>.png?angle=45&color=333&size=512, under
+// /t/<tenant> for a tenant's models. An expires parameter, in Unix seconds,
+// is signed along and ends the URL's validity.
+func renderURLHandler(w http.ResponseWriter, r *http.Request) {
+	key := renderURLKey()
+	m := renderURLPattern.FindStringSubmatch(r.PathValue("file"))
+	if key == "" || m == nil {
+		notFound(w, r)
+		return
+	}
+	query, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid query")
+		return
+	}
+	sig := query.Get("sig")
+	query.Del("sig")
+	// A tenant's URLs are signed with its path prefix, however it was named
+	signed := tenantURL(tenantOf(r.Context()), "/render/"+m[0])
+	if !validRenderURLSignature(key, signed, query, sig) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidSignature, "Invalid or missing signature")
+		return
+	}
+	if v := query.Get("expires"); v != "" {
+		expires, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || time.Now().Unix() > expires {
+			apiError(w, r, http.StatusForbidden, ErrInvalidSignature, "The URL has expired")
+			return
+		}
+		query.Del("expires")
+	}
+
+	options := make(map[string]string, len(query))
+	for k := range query {
+		field := k
+		if alias, ok := renderURLAliases[k]; ok {
+			field = alias
+		}
+		options[field] = query.Get(k)
+	}
+	if c := options["color"]; c != "" {
+		if !shortHexColorPattern.MatchString(c) {
+			apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "color must be a hex color like 333 or 333333")
+			return
+		}
+		c = strings.TrimPrefix(c, "#")
+		if len(c) == 3 {
+			c = string([]byte{c[0], c[0], c[1], c[1], c[2], c[2]})
+		}
+		options["color"] = "#" + c
+	}
+	serveOnDemand(w, r, m[1], m[2], options, config.RenderURLs.WaitSecs, config.RenderURLs.MaxAgeSecs, false)
+}
+
+// Whether sig signs the path and query with key
+func validRenderURLSignature(key, path string, query url.Values, sig string) bool {
+	got, err := hex.DecodeString(sig)
+	if err != nil || len(got) != sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(path + "?" + query.Encode()))
+	return hmac.Equal(got, mac.Sum(nil))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func signRenderURL(key, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(path + "?" + query.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestRenderURLSignatures(t *testing.T) {
+	const key = "render-key"
+	savedConfig, savedStorage := config.RenderURLs, storage
+	config.RenderURLs = RenderURLConfig{Key: key, WaitSecs: 1}
+	storage = &recordingStorage{}
+	t.Cleanup(func() { config.RenderURLs, storage = savedConfig, savedStorage })
+
+	file := outputHash + ".png"
+	path := "/render/" + file
+	query := url.Values{"size": {"512"}, "angle": {"45"}, "color": {"333"}}
+	sig := signRenderURL(key, path, query)
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	expiring := url.Values{"size": {"512"}, "expires": {future}}
+	expired := url.Values{"size": {"512"}, "expires": {past}}
+
+	tests := []struct {
+		name     string
+		rawQuery string
+		valid    bool
+	}{
+		{"signed", query.Encode() + "&sig=" + sig, true},
+		{"reordered parameters", "size=512&sig=" + sig + "&color=333&angle=45", true},
+		{"no signature", query.Encode(), false},
+		{"signature of other parameters", "size=1024&angle=45&color=333&sig=" + sig, false},
+		{"extra parameter", query.Encode() + "&formats=webp&sig=" + sig, false},
+		{"wrong key", query.Encode() + "&sig=" + signRenderURL("other-key", path, query), false},
+		{"other path", query.Encode() + "&sig=" + signRenderURL(key, "/render/"+outputHash+".webp", query), false},
+		{"not hex", query.Encode() + "&sig=zz", false},
+		{"not expired", expiring.Encode() + "&sig=" + signRenderURL(key, path, expiring), true},
+		{"expired", expired.Encode() + "&sig=" + signRenderURL(key, path, expired), false},
+		{"expiry moved", "size=512&expires=" + future + "&sig=" + signRenderURL(key, path, expired), false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, path+"?"+tt.rawQuery, nil)
+		r.SetPathValue("file", file)
+		w := httptest.NewRecorder()
+		renderURLHandler(w, r)
+		// Past the signature check, the model isn't stored
+		want := http.StatusForbidden
+		if tt.valid {
+			want = http.StatusNotFound
+		}
+		if w.Code != want {
+			t.Errorf("%s: got status %d %s, want %d", tt.name, w.Code, w.Header().Get("X-Error-Code"), want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+)
+
+const RenderSubcommand = "render" // First argument that runs the binary as a sandboxed render
+
+// Settings for running each queued render in a child process. The child is
+// this binary started with RenderSubcommand.
+type SandboxConfig struct {
+	Enabled  bool `json:"enabled"`
+	MemoryMB int  `json:"memory_mb"` // Address space limit of the child; none when 0
+	CPUSecs  int  `json:"cpu_secs"`  // CPU time limit of the child; none when 0
+}
+
+// One line the render subprocess writes to its parent. Exactly one of the
+// fields is set, apart from Code, which comes with Error.
+type sandboxMessage struct {
+	Preview *sandboxPreview `json:"preview,omitempty"`
+	Tile    *sandboxTile    `json:"tile,omitempty"`
+	Stats   *ModelStats     `json:"stats,omitempty"`
+	Error   string          `json:"error,omitempty"`
+	Code    string          `json:"code,omitempty"` // Error code the job fails with
+}
+
+// A live preview frame, encoded as PNG, for the parent to pass on
+type sandboxPreview struct {
+	Frame int    `json:"frame"`
+	Total int    `json:"total"`
+	PNG   []byte `json:"png"`
+}
+
+// A finished tile of a poster render
+type sandboxTile struct {
+	Tile  int `json:"tile"`
+	Total int `json:"total"`
+}
+
+// Where the render subprocess reports to its parent; nil in the server
+var (
+	sandboxMu     sync.Mutex
+	sandboxOutput *json.Encoder
+)
+
+func writeSandboxMessage(msg sandboxMessage) {
+	sandboxMu.Lock()
+	defer sandboxMu.Unlock()
+	if err := sandboxOutput.Encode(msg); err != nil {
+		log.Printf("Failed to report to parent: %v", err)
+	}
+}
+
+// Render a job in a child process confined by config.Sandbox, so a crash or
+// runaway allocation while loading the mesh fails only this job. The job goes
+// to the child's stdin; previews and the stats come back on its stdout, and
+// its log lines are passed through on stderr. The child is killed when ctx
+// ends.
+func renderSandboxed(ctx context.Context, job Job) (ModelStats, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return ModelStats{}, err
+	}
+	input, err := json.Marshal(job)
+	if err != nil {
+		return ModelStats{}, err
+	}
+	cmd := exec.CommandContext(ctx, self, RenderSubcommand)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return ModelStats{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return ModelStats{}, err
+	}
+
+	var stats *ModelStats
+	var renderErr, renderCode string
+	decoder := json.NewDecoder(stdout)
+	for {
+		var msg sandboxMessage
+		if err := decoder.Decode(&msg); err != nil {
+			// Let a child that wrote garbage run to its end
+			io.Copy(io.Discard, stdout)
+			break
+		}
+		switch {
+		case msg.Preview != nil:
+			recordPreviewEvent(job.ID, msg.Preview.Frame, msg.Preview.Total)
+			deliverPreviewFrame(job.ID, msg.Preview.Frame, msg.Preview.Total, msg.Preview.PNG)
+		case msg.Tile != nil:
+			pushTileProgress(job.ID, msg.Tile.Tile, msg.Tile.Total)
+		case msg.Stats != nil:
+			stats = msg.Stats
+		case msg.Error != "":
+			renderErr, renderCode = msg.Error, msg.Code
+		}
+	}
+	err = cmd.Wait()
+
+	if ctx.Err() != nil {
+		return ModelStats{}, ctx.Err()
+	}
+	if renderErr != "" {
+		return ModelStats{}, withErrorCode(renderCode, errors.New(renderErr))
+	}
+	if err != nil {
+		return ModelStats{}, fmt.Errorf("render process: %w", err)
+	}
+	if stats == nil {
+		return ModelStats{}, errors.New("render process reported no stats")
+	}
+	return *stats, nil
+}
+
+// Entry point of the render subcommand: confine this process, read a job
+// from stdin, render it into its work dir, and report on stdout. Returns the
+// exit code.
+func runRenderSubprocess() int {
+	log.SetPrefix("render: ")
+	if err := loadConfig(); err != nil {
+		log.Printf("Error loading config: %v", err)
+		return 1
+	}
+	if err := loadBrandingFrame(); err != nil {
+		log.Printf("Error loading branding frame: %v", err)
+		return 1
+	}
+	if err := loadBackdrops(); err != nil {
+		log.Printf("Error loading backdrops: %v", err)
+		return 1
+	}
+	if err := setupRenderer(); err != nil {
+		log.Printf("Error setting up renderer: %v", err)
+		return 1
+	}
+	var job Job
+	if err := json.NewDecoder(os.Stdin).Decode(&job); err != nil {
+		log.Printf("Error reading job: %v", err)
+		return 1
+	}
+	if err := confineRender(config.Sandbox); err != nil {
+		log.Printf("Error confining render: %v", err)
+		return 1
+	}
+
+	sandboxOutput = json.NewEncoder(os.Stdout)
+	stats, err := renderSTLToPNG(context.Background(), job)
+	if err != nil {
+		writeSandboxMessage(sandboxMessage{Error: err.Error(), Code: renderErrorCode(err)})
+		return 1
+	}
+	writeSandboxMessage(sandboxMessage{Stats: &stats})
+	return 0
+}
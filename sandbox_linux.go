@@ -0,0 +1,111 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs        = 38
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetKillProcess  = 0x80000000
+	seccompRetErrno        = 0x00050000
+	seccompRetAllow        = 0x7fff0000
+	x32SyscallBit          = 0x40000000
+
+	bpfLdWAbs = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK   = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgeK   = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRetK   = 0x06 // BPF_RET | BPF_K
+)
+
+// Instruction and program layouts of the kernel's classic BPF
+type sockFilter struct {
+	code   uint16
+	jt, jf uint8
+	k      uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// Numbers the syscall package doesn't have, per architecture
+var seccompArchs = map[string]struct {
+	audit             uint32 // AUDIT_ARCH_* value in seccomp_data.arch
+	seccomp, execveat uintptr
+}{
+	"amd64": {0xc000003e, 317, 322},
+	"arm64": {0xc00000b7, 277, 281},
+}
+
+// Apply the resource limits, then a seccomp filter that refuses networking,
+// starting programs, and tracing. Everything a render needs, reading the
+// mesh and writing into the work dir, stays allowed.
+func confineRender(cfg SandboxConfig) error {
+	for _, limit := range []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_AS, uint64(cfg.MemoryMB) << 20},
+		{syscall.RLIMIT_CPU, uint64(cfg.CPUSecs)},
+	} {
+		if limit.value == 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(limit.resource, &syscall.Rlimit{Cur: limit.value, Max: limit.value}); err != nil {
+			return fmt.Errorf("setrlimit: %w", err)
+		}
+	}
+
+	arch, ok := seccompArchs[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("no seccomp filter for %s", runtime.GOARCH)
+	}
+	denied := []uintptr{
+		syscall.SYS_SOCKET, syscall.SYS_SOCKETPAIR, syscall.SYS_CONNECT, syscall.SYS_BIND,
+		syscall.SYS_LISTEN, syscall.SYS_ACCEPT, syscall.SYS_ACCEPT4,
+		syscall.SYS_EXECVE, arch.execveat, syscall.SYS_PTRACE,
+		syscall.SYS_MOUNT, syscall.SYS_UMOUNT2, syscall.SYS_CHROOT,
+	}
+	filter := []sockFilter{
+		{bpfLdWAbs, 0, 0, 4}, // seccomp_data.arch
+		{bpfJeqK, 1, 0, arch.audit},
+		{bpfRetK, 0, 0, seccompRetKillProcess},
+		{bpfLdWAbs, 0, 0, 0}, // seccomp_data.nr
+		// x32 calls on amd64 carry the same arch but other numbers
+		{bpfJgeK, 0, 1, x32SyscallBit},
+		{bpfRetK, 0, 0, seccompRetKillProcess},
+	}
+	for _, nr := range denied {
+		filter = append(filter,
+			sockFilter{bpfJeqK, 0, 1, uint32(nr)},
+			sockFilter{bpfRetK, 0, 0, seccompRetErrno | uint32(syscall.EPERM)},
+		)
+	}
+	filter = append(filter, sockFilter{bpfRetK, 0, 0, seccompRetAllow})
+	prog := sockFprog{len: uint16(len(filter)), filter: &filter[0]}
+
+	// Both calls act on the calling thread; TSYNC extends the filter and
+	// no_new_privs to the runtime's other threads
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %w", errno)
+	}
+	r, _, errno := syscall.RawSyscall(arch.seccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+	if r != 0 {
+		return fmt.Errorf("seccomp: thread %d could not be synchronized", r)
+	}
+	runtime.KeepAlive(filter)
+	return nil
+}
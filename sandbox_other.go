@@ -0,0 +1,11 @@
+//go:build !linux || !(amd64 || arm64)
+
+package main
+
+import "errors"
+
+// Resource limits and seccomp are Linux only, and the filter knows the
+// syscall numbers of amd64 and arm64 only
+func confineRender(cfg SandboxConfig) error {
+	return errors.New("sandboxed renders need Linux on amd64 or arm64")
+}
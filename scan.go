@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	ScanActionReject     = "reject"     // Delete flagged uploads
+	ScanActionQuarantine = "quarantine" // Move flagged uploads to the quarantine directory
+)
+
+// Upload scanning settings. Scanning is disabled when Type is empty.
+type ScannerConfig struct {
+	Type          string `json:"type"`           // "clamd" or "icap"
+	Address       string `json:"address"`        // clamd: unix socket path or host:port, icap: host:port
+	Service       string `json:"service"`        // ICAP service name, e.g. "avscan"
+	Action        string `json:"action"`         // What to do with flagged files: "reject" or "quarantine"
+	QuarantineDir string `json:"quarantine_dir"` // Where quarantined files are moved
+	TimeoutSecs   int    `json:"timeout_secs"`   // Per-scan network timeout
+}
+
+type ScanResult struct {
+	Infected  bool
+	Signature string // Name of the detected threat, if reported by the scanner
+}
+
+// Scanner checks an uploaded file before it is queued for rendering
+type Scanner interface {
+	Scan(ctx context.Context, path string) (ScanResult, error)
+}
+
+// Build the scanner selected in the config, or nil if scanning is disabled
+func newScanner(cfg ScannerConfig) (Scanner, error) {
+	if cfg.Action != ScanActionReject && cfg.Action != ScanActionQuarantine {
+		return nil, fmt.Errorf("unknown scanner action %q", cfg.Action)
+	}
+
+	timeout := time.Duration(cfg.TimeoutSecs) * time.Second
+	switch cfg.Type {
+	case "":
+		return nil, nil
+	case "clamd":
+		return &clamdScanner{address: cfg.Address, timeout: timeout}, nil
+	case "icap":
+		return &icapScanner{address: cfg.Address, service: cfg.Service, timeout: timeout}, nil
+	default:
+		return nil, fmt.Errorf("unknown scanner type %q", cfg.Type)
+	}
+}
+
+// Move a flagged upload out of the way according to the configured action.
+// Quarantined files are stored under the given name.
+func handleFlaggedUpload(path, name string, cfg ScannerConfig) error {
+	if cfg.Action != ScanActionQuarantine {
+		return os.Remove(path)
+	}
+	if err := os.MkdirAll(cfg.QuarantineDir, 0700); err != nil {
+		return err
+	}
+	return moveFile(path, filepath.Join(cfg.QuarantineDir, name))
+}
+
+// Connect to the scanner. The connection gives up after timeout, or as soon
+// as ctx is done, e.g. when the uploading client goes away.
+func dialScanner(ctx context.Context, address string, timeout time.Duration) (net.Conn, error) {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	dialer := net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	return conn, nil
+}
+
+// clamd scanner using the INSTREAM command, so the daemon doesn't need
+// access to our uploads directory
+type clamdScanner struct {
+	address string
+	timeout time.Duration
+}
+
+func (s *clamdScanner) Scan(ctx context.Context, path string) (ScanResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer file.Close()
+
+	conn, err := dialScanner(ctx, s.address, s.timeout)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, err
+	}
+
+	// Stream the file as length-prefixed chunks, terminated by a zero-length chunk
+	buf := make([]byte, 32*1024)
+	size := make([]byte, 4)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return ScanResult{}, err
+			}
+			if _, err := conn.Write(buf[:n]); err != nil {
+				return ScanResult{}, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return ScanResult{}, err
+	}
+
+	// Reply looks like "stream: OK" or "stream: Eicar-Signature FOUND"
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && err != io.EOF {
+		return ScanResult{}, err
+	}
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("clamd error: %s", reply)
+	}
+}
+
+// ICAP scanner sending the file as an encapsulated HTTP response (RESPMOD).
+// A 204 reply means the content is clean.
+type icapScanner struct {
+	address string
+	service string
+	timeout time.Duration
+}
+
+func (s *icapScanner) Scan(ctx context.Context, path string) (ScanResult, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return ScanResult{}, err
+	}
+
+	conn, err := dialScanner(ctx, s.address, s.timeout)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("failed to connect to ICAP server: %w", err)
+	}
+	defer conn.Close()
+
+	resHeader := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\nContent-Length: %d\r\n\r\n", info.Size())
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "RESPMOD icap://%s/%s ICAP/1.0\r\n", s.address, s.service)
+	fmt.Fprintf(w, "Host: %s\r\n", s.address)
+	fmt.Fprintf(w, "Allow: 204\r\n")
+	fmt.Fprintf(w, "Encapsulated: res-hdr=0, res-body=%d\r\n\r\n", len(resHeader))
+	w.WriteString(resHeader)
+
+	// Body is sent with HTTP chunked encoding
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			fmt.Fprintf(w, "%x\r\n", n)
+			w.Write(buf[:n])
+			w.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ScanResult{}, err
+		}
+	}
+	w.WriteString("0\r\n\r\n")
+	if err := w.Flush(); err != nil {
+		return ScanResult{}, err
+	}
+
+	reader := textproto.NewReader(bufio.NewReader(conn))
+	status, err := reader.ReadLine()
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("failed to read ICAP response: %w", err)
+	}
+	header, err := reader.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return ScanResult{}, fmt.Errorf("failed to read ICAP headers: %w", err)
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) < 2 {
+		return ScanResult{}, fmt.Errorf("malformed ICAP status line: %q", status)
+	}
+	switch fields[1] {
+	case "204":
+		return ScanResult{}, nil
+	case "200", "403":
+		// The server modified or blocked the content, so treat it as flagged
+		signature := header.Get("X-Virus-ID")
+		if signature == "" {
+			signature = header.Get("X-Infection-Found")
+		}
+		return ScanResult{Infected: true, Signature: signature}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("ICAP server returned %q", status)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	MaxSceneBody   = 1 << 20 // Largest accepted scene description, in bytes
+	MaxSceneModels = 20      // Most models in one scene
+	MaxSceneLights = 8
+	MaxSceneSize   = 4096 // Largest image side, in pixels
+)
+
+var hexColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Full description of a render, for clients that want control over more
+// than the render options offer. Positions are in mm.
+type SceneSpec struct {
+	Models     []SceneModel `json:"models"`
+	Camera     SceneCamera  `json:"camera"`
+	Lights     []SceneLight `json:"lights,omitempty"`     // Directional; one white light from +X +Y +Z when empty
+	Ambient    *float64     `json:"ambient,omitempty"`    // Light reaching every surface, 0–1; 0.2 by default
+	Background string       `json:"background,omitempty"` // "#rrggbb" or "transparent"; white by default
+	Width      int          `json:"width,omitempty"`      // Image size in pixels; the standard render size by default
+	Height     int          `json:"height,omitempty"`
+}
+
+// A stored upload placed in the scene
+type SceneModel struct {
+	Hash  string `json:"hash"`
+	Units string `json:"units,omitempty"` // Units the model is in; guessed like uploads when empty
+	PartTransform
+	Material SceneMaterial `json:"material"`
+}
+
+type SceneMaterial struct {
+	Color     string   `json:"color,omitempty"`     // "#rrggbb"; light gray by default
+	Specular  *float64 `json:"specular,omitempty"`  // Strength of highlights, 0–1; 0.3 by default
+	Shininess float64  `json:"shininess,omitempty"` // Highlight sharpness, as a Phong exponent; 100 by default
+}
+
+// Camera placement in mm; unset fields frame the whole scene from the
+// standard thumbnail direction
+type SceneCamera struct {
+	Eye    *[3]float64 `json:"eye,omitempty"`
+	Center *[3]float64 `json:"center,omitempty"`
+	Up     *[3]float64 `json:"up,omitempty"`  // +Z by default
+	FOV    float64     `json:"fov,omitempty"` // Vertical field of view in degrees
+}
+
+type SceneLight struct {
+	Direction [3]float64 `json:"direction"`           // Toward the light
+	Color     string     `json:"color,omitempty"`     // White by default
+	Intensity float64    `json:"intensity,omitempty"` // 1 by default
+}
+
+type sceneResponse struct {
+	Image string `json:"image"`
+}
+
+// Check a scene description and fill in its defaults
+func (s *SceneSpec) validate() error {
+	if len(s.Models) == 0 || len(s.Models) > MaxSceneModels {
+		return fmt.Errorf("models must list between 1 and %d models", MaxSceneModels)
+	}
+	if len(s.Lights) > MaxSceneLights {
+		return fmt.Errorf("lights must list at most %d lights", MaxSceneLights)
+	}
+	checkColor := func(field, c string) error {
+		if c != "" && !hexColorPattern.MatchString(c) {
+			return fmt.Errorf("%s must be a #rrggbb color", field)
+		}
+		return nil
+	}
+	for i := range s.Models {
+		m := &s.Models[i]
+		if !fileHashPattern.MatchString(m.Hash) {
+			return fmt.Errorf("models[%d].hash must be a model's SHA-256", i)
+		}
+		if _, ok := unitScales[m.Units]; m.Units != "" && !ok {
+			return fmt.Errorf("models[%d].units must be mm or in", i)
+		}
+		if m.Scale < 0 {
+			return fmt.Errorf("models[%d].scale must be positive", i)
+		}
+		if err := checkColor(fmt.Sprintf("models[%d].material.color", i), m.Material.Color); err != nil {
+			return err
+		}
+		if sp := m.Material.Specular; sp != nil && (*sp < 0 || *sp > 1) {
+			return fmt.Errorf("models[%d].material.specular must be between 0 and 1", i)
+		}
+		if m.Material.Shininess < 0 {
+			return fmt.Errorf("models[%d].material.shininess must be positive", i)
+		}
+	}
+	for i, l := range s.Lights {
+		if l.Direction == [3]float64{} {
+			return fmt.Errorf("lights[%d].direction must not be zero", i)
+		}
+		if err := checkColor(fmt.Sprintf("lights[%d].color", i), l.Color); err != nil {
+			return err
+		}
+		if l.Intensity < 0 {
+			return fmt.Errorf("lights[%d].intensity must be positive", i)
+		}
+	}
+	if s.Ambient != nil && (*s.Ambient < 0 || *s.Ambient > 1) {
+		return fmt.Errorf("ambient must be between 0 and 1")
+	}
+	if s.Background != "transparent" {
+		if err := checkColor("background", s.Background); err != nil {
+			return err
+		}
+	}
+	if s.Camera.FOV != 0 && (s.Camera.FOV < 1 || s.Camera.FOV > 120) {
+		return fmt.Errorf("camera.fov must be between 1 and 120 degrees")
+	}
+	if s.Width == 0 {
+		s.Width = Width
+	}
+	if s.Height == 0 {
+		s.Height = Height
+	}
+	if s.Width < 16 || s.Width > MaxSceneSize || s.Height < 16 || s.Height > MaxSceneSize {
+		return fmt.Errorf("width and height must be between 16 and %d pixels", MaxSceneSize)
+	}
+	return nil
+}
+
+// POST /api/v1/scenes with a JSON SceneSpec. Renders the stored models as
+// described and responds with the image URL. Identical descriptions share
+// one image.
+func sceneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiError(w, r, http.StatusMethodNotAllowed, ErrMethodNotAllowed, "Invalid request method")
+		return
+	}
+	if !corsOriginTrusted(r.Header.Get("Origin")) && !validCSRFToken(r) {
+		apiError(w, r, http.StatusForbidden, ErrInvalidCSRF, "Invalid CSRF token")
+		return
+	}
+
+	var spec SceneSpec
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MaxSceneBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&spec); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			apiError(w, r, http.StatusRequestEntityTooLarge, ErrTooLarge, fmt.Sprintf("Scene must be at most %d bytes", MaxSceneBody))
+			return
+		}
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, "Invalid scene: "+err.Error())
+		return
+	}
+	if err := spec.validate(); err != nil {
+		apiError(w, r, http.StatusBadRequest, ErrInvalidRequest, err.Error())
+		return
+	}
+
+	canonical, _ := json.Marshal(spec)
+	sum := sha256.Sum256(canonical)
+	name := fmt.Sprintf("scene-%s.png", hex.EncodeToString(sum[:]))
+	resp := sceneResponse{Image: outputURL(tenantOf(r.Context()), name)}
+	exists, err := storage.Exists(r.Context(), outputObject(name))
+	if err != nil {
+		log.Printf("Failed to look up scene render: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to render scene")
+		return
+	}
+	if exists {
+		writeJSON(w, http.StatusOK, resp)
+		return
+	}
+
+	workDir, err := newJobWorkDir()
+	if err != nil {
+		log.Printf("Failed to create work dir: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to render scene")
+		return
+	}
+	defer os.RemoveAll(workDir)
+
+	// Scenes render right here, so they share the memory budget with the
+	// queue. Sizes come from storage before anything is loaded.
+	sample := RenderSample{Views: 1, Pixels: spec.Width * spec.Height}
+	for _, m := range spec.Models {
+		if info, err := storage.Stat(r.Context(), uploadObject(m.Hash)); err == nil {
+			sample.FileSize += info.Size
+			sample.Triangles += int(info.Size / 50) // Binary STL facet size
+		}
+	}
+	release, err := reserveMemory(r.Context(), estimateRenderMemory(sample))
+	if err != nil {
+		return // Client gone
+	}
+	defer release()
+
+	meshes := make([]*fauxgl.Mesh, len(spec.Models))
+	for i, m := range spec.Models {
+		modelDir, err := fetchUpload(r.Context(), m.Hash)
+		if errors.Is(err, os.ErrNotExist) {
+			apiError(w, r, http.StatusNotFound, ErrNotFound, fmt.Sprintf("Model %s not found", m.Hash))
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to fetch upload %s: %v", m.Hash, err)
+			apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+			return
+		}
+		mesh, err := loadMesh(filepath.Join(modelDir, "input.stl"))
+		os.RemoveAll(modelDir)
+		if err != nil {
+			log.Printf("Failed to load upload %s: %v", m.Hash, err)
+			apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to load model")
+			return
+		}
+		size := mesh.BoundingBox().Size()
+		units, _ := resolveUnits(m.Units, Dimensions{size.X, size.Y, size.Z})
+		mesh.Transform(fauxgl.Scale(fauxgl.Vector{1, 1, 1}.MulScalar(unitScales[units])))
+		mesh.Transform(m.matrix())
+		meshes[i] = mesh
+	}
+
+	tmpPath := filepath.Join(workDir, name)
+	if err := saveImage(tmpPath, renderSceneSpec(spec, meshes).Image(), "png"); err != nil {
+		log.Printf("Failed to render scene: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to render scene")
+		return
+	}
+	if err := storage.Publish(r.Context(), tmpPath, outputObject(name)); err != nil {
+		log.Printf("Failed to publish scene render: %v", err)
+		apiError(w, r, http.StatusInternalServerError, ErrInternal, "Failed to render scene")
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// Rasterize placed models as the scene describes
+func renderSceneSpec(spec SceneSpec, meshes []*fauxgl.Mesh) *fauxgl.Context {
+	context := fauxgl.NewContext(spec.Width, spec.Height)
+	switch spec.Background {
+	case "transparent":
+		context.ClearColorBufferWith(fauxgl.Transparent)
+	case "":
+		context.ClearColorBufferWith(fauxgl.White)
+	default:
+		context.ClearColorBufferWith(fauxgl.HexColor(spec.Background))
+	}
+
+	all := fauxgl.NewEmptyMesh()
+	for _, mesh := range meshes {
+		all.Add(mesh)
+	}
+	cam := sceneCamera(spec.Camera, all.BoundingBox())
+	fov := spec.Camera.FOV
+	if fov == 0 {
+		fov = FOV
+	}
+	near, far := clipPlanes(&scene{mesh: all}, cam)
+	matrix := fauxgl.LookAt(cam.eye, cam.center, cam.up).Perspective(fov, float64(spec.Width)/float64(spec.Height), near, far)
+
+	ambient := 0.2
+	if spec.Ambient != nil {
+		ambient = *spec.Ambient
+	}
+	lights := []sceneLightSource{{direction: fauxgl.Vector{1, 1, 1}.Normalize(), color: fauxgl.Gray(0.8)}}
+	if len(spec.Lights) > 0 {
+		lights = nil
+		for _, l := range spec.Lights {
+			color := fauxgl.White
+			if l.Color != "" {
+				color = fauxgl.HexColor(l.Color)
+			}
+			intensity := l.Intensity
+			if intensity == 0 {
+				intensity = 1
+			}
+			d := l.Direction
+			lights = append(lights, sceneLightSource{fauxgl.Vector{d[0], d[1], d[2]}.Normalize(), color.MulScalar(intensity)})
+		}
+	}
+
+	for i, mesh := range meshes {
+		material := spec.Models[i].Material
+		color := fauxgl.Gray(0.75)
+		if material.Color != "" {
+			color = fauxgl.HexColor(material.Color)
+		}
+		specular := 0.3
+		if material.Specular != nil {
+			specular = *material.Specular
+		}
+		shininess := material.Shininess
+		if shininess == 0 {
+			shininess = 100
+		}
+		context.Shader = &sceneShader{matrix, cam.eye, color, fauxgl.Gray(ambient), lights, specular, shininess}
+		context.DrawMesh(mesh)
+	}
+	return context
+}
+
+// The described camera, with unset fields filled in to frame box from the
+// standard thumbnail direction
+func sceneCamera(c SceneCamera, box fauxgl.Box) camera {
+	vector := func(v *[3]float64, fallback fauxgl.Vector) fauxgl.Vector {
+		if v == nil {
+			return fallback
+		}
+		return fauxgl.Vector{v[0], v[1], v[2]}
+	}
+	fov := c.FOV
+	if fov == 0 {
+		fov = FOV
+	}
+	center := vector(c.Center, box.Min.Add(box.Max).DivScalar(2))
+	radius := box.Max.Sub(box.Min).Length() / 2
+	distance := math.Max(radius, 1e-3) / math.Sin(fauxgl.Radians(fov)/2)
+	eye := vector(c.Eye, center.Add(defaultCamera.eye.Normalize().MulScalar(distance)))
+	return camera{eye: eye, center: center, up: vector(c.Up, defaultCamera.up)}
+}
+
+type sceneLightSource struct {
+	direction fauxgl.Vector // Toward the light
+	color     fauxgl.Color  // Scaled by intensity
+}
+
+// Phong shading with any number of colored directional lights
+type sceneShader struct {
+	matrix    fauxgl.Matrix
+	eye       fauxgl.Vector
+	color     fauxgl.Color
+	ambient   fauxgl.Color
+	lights    []sceneLightSource
+	specular  float64
+	shininess float64
+}
+
+func (s *sceneShader) Vertex(v fauxgl.Vertex) fauxgl.Vertex {
+	v.Output = s.matrix.MulPositionW(v.Position)
+	return v
+}
+
+func (s *sceneShader) Fragment(v fauxgl.Vertex) fauxgl.Color {
+	light := s.ambient
+	var highlight fauxgl.Color
+	view := s.eye.Sub(v.Position).Normalize()
+	for _, l := range s.lights {
+		diffuse := math.Max(v.Normal.Dot(l.direction), 0)
+		if diffuse == 0 {
+			continue
+		}
+		light = light.Add(l.color.MulScalar(diffuse))
+		if s.specular > 0 {
+			reflected := l.direction.Negate().Reflect(v.Normal)
+			if specular := math.Max(view.Dot(reflected), 0); specular > 0 {
+				highlight = highlight.Add(l.color.MulScalar(math.Pow(specular, s.shininess) * s.specular))
+			}
+		}
+	}
+	return s.color.Mul(light).Add(highlight).Min(fauxgl.White).Alpha(1)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	CSRFCookieName = "csrf_token"
+	CSRFHeaderName = "X-CSRF-Token"
+	CSRFFormField  = "csrf_token"
+)
+
+// Only files named after a content hash are ever served from the output directory
+var outputNamePattern = regexp.MustCompile(`^(output-[0-9a-f]{64}(-[0-9a-f]{16})?(-depth|-backlit|-ids|-components)?\.(png|webp|zip|gif)|nest-[0-9a-f]{64}\.png|scene-[0-9a-f]{64}\.png|og-[0-9a-f]{64}\.png|mesh-[0-9a-f]{64}(-[0-9a-f]{16})?\.stl)$`)
+
+// Generate a random hex token
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Return the visitor's CSRF token, issuing a new cookie if they don't have one yet
+func ensureCSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(CSRFCookieName); err == nil && len(cookie.Value) == 64 {
+		return cookie.Value, nil
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// Check that the request carries the same CSRF token as its cookie, either in
+// the X-CSRF-Token header or the csrf_token form field
+func validCSRFToken(r *http.Request) bool {
+	cookie, err := r.Cookie(CSRFCookieName)
+	if err != nil || cookie.Value == "" {
+		return false
+	}
+	token := r.Header.Get(CSRFHeaderName)
+	if token == "" {
+		token = r.FormValue(CSRFFormField)
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) == 1
+}
+
+// Check that a requested output name is one we could have generated
+func validOutputName(name string) bool {
+	return outputNamePattern.MatchString(name)
+}
+
+// Serve a file from the output directory by name, refusing anything that
+// isn't a hash-named regular file (no traversal, no symlinks, no listings).
+// Every view and download is counted.
+func serveOutputFile(w http.ResponseWriter, r *http.Request, name string) {
+	if !validOutputName(name) {
+		notFound(w, r)
+		return
+	}
+	recorder := &statusRecorder{ResponseWriter: w}
+	serveStoredFile(recorder, r, outputObject(name))
+	recordOutputAccess(r, name, recorder.status)
+}
+
+// Handler for /output/<name>
+func outputHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/output/")
+	if config.Origin.Enabled && originNamePattern.MatchString(path.Base(r.URL.EscapedPath())) {
+		serveOriginOutput(w, r)
+		return
+	}
+	serveOutputFile(w, r, name)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Storage that records every name it is asked about and has no files
+type recordingStorage struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (s *recordingStorage) record(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.names = append(s.names, name)
+}
+
+func (s *recordingStorage) Publish(ctx context.Context, localPath, name string) error {
+	s.record(name)
+	return nil
+}
+
+func (s *recordingStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	s.record(name)
+	return nil, os.ErrNotExist
+}
+
+func (s *recordingStorage) OpenAt(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	s.record(name)
+	return nil, os.ErrNotExist
+}
+
+func (s *recordingStorage) Stat(ctx context.Context, name string) (StoredFileInfo, error) {
+	s.record(name)
+	return StoredFileInfo{}, os.ErrNotExist
+}
+
+func (s *recordingStorage) Exists(ctx context.Context, name string) (bool, error) {
+	s.record(name)
+	return false, nil
+}
+
+var outputHash = strings.Repeat("ab", 32)
+
+// Requests for files outside the output directory, or for names no render
+// produces
+var traversalPaths = []string{
+	"/output/../secret.txt",
+	"/output/../../etc/passwd",
+	"/output/%2e%2e%2fsecret.txt",
+	"/output/%2e%2e/%2e%2e/etc/passwd",
+	"/output/..%2f..%2fetc%2fpasswd",
+	"/output//etc/passwd",
+	"/output/%2fetc%2fpasswd",
+	"/output/..\\secret.txt",
+	"/output/..%5c..%5csecret.txt",
+	"/output/output-" + outputHash + ".png%00.txt",
+	"/output/secret.txt%00",
+	"/output/secret.txt",
+	"/output/uploads/input-" + outputHash + ".stl",
+	"/output/output-" + outputHash + ".png/../../secret.txt",
+	"/output/output-" + outputHash + ".exe",
+}
+
+func TestValidOutputName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"output-" + outputHash + ".png", true},
+		{"output-" + outputHash + "-0123456789abcdef-depth.webp", true},
+		{"mesh-" + outputHash + ".stl", true},
+		{"../output-" + outputHash + ".png", false},
+		{"../../etc/passwd", false},
+		{"%2e%2e%2foutput-" + outputHash + ".png", false},
+		{"/output-" + outputHash + ".png", false},
+		{"/etc/passwd", false},
+		{"..\\output-" + outputHash + ".png", false},
+		{"output-" + outputHash + ".png\\..\\secret.txt", false},
+		{"output-" + outputHash + ".png\x00", false},
+		{"output-" + outputHash + "\x00.png", false},
+		{"output-" + outputHash + ".png\n", false},
+		{"uploads/input-" + outputHash + ".stl", false},
+		{"sub/output-" + outputHash + ".png", false},
+		{"output-" + strings.ToUpper(outputHash) + ".png", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := validOutputName(tt.name); got != tt.want {
+			t.Errorf("validOutputName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOutputHandlerRefusesTraversal(t *testing.T) {
+	recorder := &recordingStorage{}
+	saved := storage
+	storage = recorder
+	t.Cleanup(func() { storage = saved })
+
+	for _, target := range traversalPaths {
+		t.Run(target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			outputHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if w.Code != http.StatusNotFound && w.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want 404 or 400", w.Code)
+			}
+		})
+	}
+	for _, name := range recorder.names {
+		t.Errorf("storage was asked for %q", name)
+	}
+}
+
+// With local storage, files next to the output directory must stay out of
+// reach even though they exist
+func TestOutputHandlerRefusesTraversalOnDisk(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	saved := storage
+	storage = localStorage{}
+	t.Cleanup(func() { storage = saved })
+
+	const secret = "not for download"
+	if err := os.Mkdir("output", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("secret.txt", []byte(secret), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("output/output-"+outputHash+".png", []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range traversalPaths {
+		t.Run(target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			outputHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+			if w.Code != http.StatusNotFound && w.Code != http.StatusBadRequest {
+				t.Errorf("got status %d, want 404 or 400", w.Code)
+			}
+			if strings.Contains(w.Body.String(), secret) {
+				t.Errorf("response contains the secret file")
+			}
+		})
+	}
+
+	// The file that is in the output directory is still served
+	w := httptest.NewRecorder()
+	outputHandler(w, httptest.NewRequest(http.MethodGet, "/output/output-"+outputHash+".png", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "png" {
+		t.Errorf("got status %d and body %q for a valid output", w.Code, w.Body.String())
+	}
+}
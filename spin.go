@@ -0,0 +1,76 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"os"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	MaxSpinFrames    = 360
+	DefaultElevation = 35.26 // Elevation of the default (3, 3, 3) camera, in degrees
+)
+
+// Camera orbiting the model's vertical axis at the default camera distance.
+// Azimuth 45° matches the default thumbnail view.
+func orbitCamera(azimuth, elevation float64) camera {
+	distance := defaultCamera.eye.Length()
+	az, el := fauxgl.Radians(azimuth), fauxgl.Radians(elevation)
+	eye := fauxgl.Vector{
+		distance * math.Cos(el) * math.Cos(az),
+		distance * math.Cos(el) * math.Sin(az),
+		distance * math.Sin(el),
+	}
+	return camera{eye: eye, center: defaultCamera.center, up: defaultCamera.up}
+}
+
+// Camera of frame i of a spin of frames, starting at the default view
+func spinCamera(i, frames int, elevation float64) camera {
+	return orbitCamera(45+float64(i)*360/float64(frames), elevation)
+}
+
+// Render evenly spaced frames around the model into a ZIP of numbered PNGs
+// (frame-001.png, frame-002.png, ...) as expected by 360° spin viewers
+// onFrame, if set, is called with each frame as soon as it's rendered. Stops
+// between frames once ctx is done.
+func renderSpinZIP(ctx context.Context, sc *scene, frames int, elevation float64, outputPath string, onFrame func(i int, im image.Image)) error {
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	archive := zip.NewWriter(file)
+	for i := 0; i < frames; i++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		cam := spinCamera(i, frames, elevation)
+		im := applyBrandingFrame(sc.withAnnotations(renderView(sc, cam, Width, Height), cam))
+
+		// PNGs are already compressed, so store them as-is
+		entry, err := archive.CreateHeader(&zip.FileHeader{
+			Name:   fmt.Sprintf("frame-%03d.png", i+1),
+			Method: zip.Store,
+		})
+		if err != nil {
+			return err
+		}
+		if err := png.Encode(entry, im); err != nil {
+			return err
+		}
+		if onFrame != nil {
+			onFrame(i, im)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Job records, in-flight claims, and the rendered-output index, shared by
+// every instance in stateless mode
+type jobStore interface {
+	SaveJob(job Job) error
+	LoadJob(id string) (*Job, error) // nil when unknown or expired
+	// Mark a job as producing a cache key. Returns the ID of the job that
+	// already is, if any, in which case nothing changes.
+	ClaimCacheKey(cacheKey, id string) (string, error)
+	FindCacheKey(cacheKey string) (string, error) // ID of the job producing a cache key, or empty
+	ReleaseCacheKey(cacheKey, id string) error
+	LookupOutput(cacheKey string) (string, bool, error)
+	RecordOutput(cacheKey, name string) error
+	StaleJobs(before time.Time) ([]string, error) // IDs of jobs queued or processing without an update since before
+	RecordAccess(key string, access OutputAccess) error
+	LoadAnalytics(key string) (OutputAnalytics, error)
+	AnalyticsSummary(top int) (AnalyticsSummary, error)
+}
+
+// Shared state in stateless mode; nil when everything lives in this process
+var store jobStore
+
+// Move queue, jobs, and events out of the process so any instance can serve
+// any request. Outputs and uploads must already be in object storage. The
+// queue and events always go through Redis; job records can go to Postgres
+// instead.
+func setupStateless() error {
+	if config.Storage.Type == "" || config.Storage.Type == StorageLocal {
+		return fmt.Errorf("stateless mode needs gcs, azure, or ipfs storage")
+	}
+	if err := connectJobStore(); err != nil {
+		return err
+	}
+	go redisSubscribe(handleClusterMessage)
+	return nil
+}
+
+// Connect to Redis and the configured job store
+func connectJobStore() error {
+	if err := connectRedis(config.Redis); err != nil {
+		return fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	switch config.JobStore {
+	case "", "redis":
+		store = redisStore{}
+	case "postgres":
+		pg, err := newPostgresStore(config.Postgres)
+		if err != nil {
+			return err
+		}
+		store = pg
+	default:
+		return fmt.Errorf("unknown job store %q", config.JobStore)
+	}
+	return nil
+}
+
+// Broadcast between instances in stateless mode
+type clusterMessage struct {
+	Job     *Job            `json:"job,omitempty"` // Job record after a status change
+	Preview *clusterPreview `json:"preview,omitempty"`
+	Tile    *clusterTile    `json:"tile,omitempty"`
+}
+
+// Spin preview frame, for subscribers connected to other instances
+type clusterPreview struct {
+	JobID string `json:"job_id"`
+	Frame int    `json:"frame"`
+	Total int    `json:"total"`
+	PNG   []byte `json:"png"`
+}
+
+// Poster tile progress, for subscribers connected to other instances
+type clusterTile struct {
+	JobID string `json:"job_id"`
+	Tile  int    `json:"tile"`
+	Total int    `json:"total"`
+}
+
+func handleClusterMessage(payload []byte) {
+	var msg clusterMessage
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		log.Printf("Ignoring malformed cluster message: %v", err)
+		return
+	}
+	switch {
+	case msg.Job != nil:
+		applyJobUpdate(*msg.Job)
+	case msg.Preview != nil:
+		sendPreviewFrame(msg.Preview.JobID, msg.Preview.Frame, msg.Preview.Total, msg.Preview.PNG)
+	case msg.Tile != nil:
+		sendTileProgress(msg.Tile.JobID, msg.Tile.Tile, msg.Tile.Total)
+	}
+}
+
+// Claim the cache key, store the new job, and announce it so every instance
+// counts it in ETAs
+func registerSharedJob(job *Job) (string, bool, error) {
+	existing, err := store.ClaimCacheKey(job.CacheKey, job.ID)
+	if err != nil {
+		return "", false, err
+	}
+	if existing != "" {
+		return existing, true, nil
+	}
+	if err := store.SaveJob(*job); err != nil {
+		store.ReleaseCacheKey(job.CacheKey, job.ID)
+		return "", false, err
+	}
+
+	mu.Lock()
+	job.changed = make(chan struct{})
+	jobs[job.ID] = job
+	mu.Unlock()
+	if err := redisPublish(clusterMessage{Job: job}); err != nil {
+		log.Printf("Failed to announce job ID %s: %v\n", job.ID, err)
+	}
+	return job.ID, false, nil
+}
+
+// Persist a status change and broadcast it; every instance, this one
+// included, applies it when the broadcast arrives
+func publishJobUpdate(job Job) {
+	if err := store.SaveJob(job); err != nil {
+		log.Printf("Failed to save job ID %s: %v\n", job.ID, err)
+	}
+	if job.finished() {
+		if err := store.ReleaseCacheKey(job.CacheKey, job.ID); err != nil {
+			log.Printf("Failed to release cache key of job ID %s: %v\n", job.ID, err)
+		}
+	}
+	if err := redisPublish(clusterMessage{Job: &job}); err != nil {
+		log.Printf("Failed to broadcast job ID %s: %v\n", job.ID, err)
+		applyJobUpdate(job) // At least reach the subscribers on this instance
+	}
+}
+
+func publishPreviewFrame(jobID string, frame, total int, data []byte) {
+	msg := clusterMessage{Preview: &clusterPreview{JobID: jobID, Frame: frame, Total: total, PNG: data}}
+	if err := redisPublish(msg); err != nil {
+		log.Printf("Failed to broadcast preview for job ID %s: %v\n", jobID, err)
+	}
+}
+
+func publishTileProgress(jobID string, tile, total int) {
+	msg := clusterMessage{Tile: &clusterTile{JobID: jobID, Tile: tile, Total: total}}
+	if err := redisPublish(msg); err != nil {
+		log.Printf("Failed to broadcast tile progress for job ID %s: %v\n", jobID, err)
+	}
+}
+
+// Make a job registered on another instance known to this one
+func loadSharedJob(id string) {
+	if store == nil {
+		return
+	}
+	mu.Lock()
+	_, known := jobs[id]
+	mu.Unlock()
+	if known {
+		return
+	}
+
+	job, err := store.LoadJob(id)
+	if err != nil {
+		log.Printf("Failed to load job ID %s: %v\n", id, err)
+	}
+	if job == nil {
+		return
+	}
+	mu.Lock()
+	if _, known := jobs[id]; !known {
+		job.changed = make(chan struct{})
+		jobs[id] = job
+	}
+	mu.Unlock()
+}
@@ -0,0 +1,242 @@
+// Upload page: sends dropped or picked files to /api/v1/batches, at most
+// maxBatchFiles per request, and follows their jobs on one multiplexed
+// socket, showing each file's upload progress, place in the queue, and
+// thumbnail once rendered. Expects the page to define messages, the
+// translated UI strings, basePath, the prefix of the tenant's URLs, and
+// maxBatchFiles.
+
+// WebSocket protocol version this page understands
+const WS_VERSION = 1;
+const WS_PROTOCOL = `render.v${WS_VERSION}`;
+
+// Rows of the upload list by job ID, while their jobs are followed
+const rowsByJob = new Map();
+let jobsSocket = null;
+
+// Upload files a batch at a time, so the first ones start rendering while
+// the rest are still being sent
+function handleFiles(files) {
+    document.getElementById("output").textContent = "";
+    files = Array.from(files);
+    const rows = files.map(addRow);
+    let sending = Promise.resolve();
+    for (let i = 0; i < files.length; i += maxBatchFiles) {
+        const batch = files.slice(i, i + maxBatchFiles);
+        const batchRows = rows.slice(i, i + maxBatchFiles);
+        sending = sending.then(() => uploadBatch(batch, batchRows));
+    }
+}
+
+// Add a file to the upload list: its thumbnail once rendered, its name, a
+// progress bar while it's sent, and its status
+function addRow(file) {
+    const element = document.createElement("li");
+    element.className = "upload-row";
+    const thumb = document.createElement("div");
+    thumb.className = "upload-thumb";
+    const name = document.createElement("div");
+    name.className = "upload-name";
+    name.textContent = file.name;
+    const progress = document.createElement("progress");
+    progress.max = 1;
+    progress.value = 0;
+    const status = document.createElement("div");
+    status.className = "upload-status";
+    status.textContent = messages["page.waiting"];
+
+    const details = document.createElement("div");
+    details.className = "upload-details";
+    details.append(name, progress, status);
+    element.append(thumb, details);
+    document.getElementById("uploads").appendChild(element);
+    return { element, thumb, progress, status };
+}
+
+// Send one batch, resolving once the server has answered for every file
+function uploadBatch(files, rows) {
+    return new Promise(resolve => {
+        const formData = new FormData();
+        files.forEach(file => formData.append("file", file));
+        const csrfToken = document.querySelector('meta[name="csrf-token"]').content;
+
+        const xhr = new XMLHttpRequest();
+        xhr.open("POST", `${basePath}/api/v1/batches`);
+        xhr.setRequestHeader("X-CSRF-Token", csrfToken);
+        xhr.setRequestHeader("Accept", "application/json");
+        xhr.responseType = "json";
+        rows.forEach(row => row.status.textContent = messages["page.uploading"]);
+
+        // Files are sent in order, so the bytes sent so far fill them up one
+        // after another
+        const sizes = files.map(file => file.size);
+        const total = sizes.reduce((sum, size) => sum + size, 0);
+        xhr.upload.onprogress = event => {
+            if (!event.lengthComputable) {
+                return;
+            }
+            let sent = event.loaded / event.total * total;
+            sizes.forEach((size, i) => {
+                rows[i].progress.value = size > 0 ? Math.min(Math.max(sent / size, 0), 1) : 1;
+                sent -= size;
+            });
+        };
+
+        xhr.onload = () => {
+            const data = xhr.response;
+            if (!data || !Array.isArray(data.items)) {
+                console.error("Batch upload failed:", xhr.status, data);
+                rows.forEach(row => showFailed(row, (data && data.message) || messages["page.upload_failed"]));
+            } else {
+                data.items.forEach((item, i) => showItem(rows[i], item));
+            }
+            resolve();
+        };
+        xhr.onerror = () => {
+            rows.forEach(row => showFailed(row, messages["page.upload_failed"]));
+            resolve();
+        };
+        xhr.send(formData);
+    });
+}
+
+// Show what the batch did with a file: rendered before, failed, or queued
+function showItem(row, item) {
+    row.progress.value = 1;
+    row.progress.style.display = "none";
+    switch (item.status) {
+    case "exists":
+        showDone(row, item.output);
+        break;
+    case "failed":
+        showFailed(row, item.message);
+        break;
+    default:
+        row.status.textContent = "";
+        followJob(item.job_id, row);
+    }
+}
+
+// Follow a job on the multiplexed socket, opening it if needed
+function followJob(jobID, row) {
+    rowsByJob.set(jobID, row);
+    if (!jobsSocket) {
+        openJobsSocket();
+    } else if (jobsSocket.readyState === WebSocket.OPEN) {
+        jobsSocket.send(JSON.stringify({ subscribe: [jobID] }));
+    }
+    // A socket still connecting subscribes to every followed job once open
+}
+
+function openJobsSocket() {
+    const socket = new WebSocket(`ws://${window.location.hostname}:8080/ws/jobs`, WS_PROTOCOL);
+    jobsSocket = socket;
+
+    socket.onopen = () => {
+        socket.send(JSON.stringify({ subscribe: Array.from(rowsByJob.keys()) }));
+    };
+
+    socket.onmessage = event => {
+        const message = JSON.parse(event.data);
+        const row = rowsByJob.get(message.job_id);
+        if (message.v !== WS_VERSION || !row) {
+            return;
+        }
+        if (message.type === "queue") {
+            row.status.textContent = messages["page.queued"].replace("%d", message.position);
+        } else if (message.type === "status") {
+            if (message.status === "done") {
+                rowsByJob.delete(message.job_id);
+                showDone(row, message.output, message.permalink);
+            } else if (message.status === "failed") {
+                rowsByJob.delete(message.job_id);
+                showFailed(row, message.message);
+            } else {
+                row.status.textContent = message.message;
+            }
+        }
+    };
+
+    // Reconnect while jobs are followed; subscribing again replays their
+    // current status
+    socket.onclose = event => {
+        console.log("WebSocket connection closed. Code:", event.code, "Reason:", event.reason);
+        jobsSocket = null;
+        if (rowsByJob.size > 0) {
+            setTimeout(() => {
+                if (!jobsSocket && rowsByJob.size > 0) {
+                    openJobsSocket();
+                }
+            }, 1000);
+        }
+    };
+
+    socket.onerror = error => {
+        console.error("WebSocket error:", error);
+    };
+}
+
+// Show a finished file: its image as a thumbnail, linked to the model page
+// when there is one, or a download link for outputs that aren't images
+function showDone(row, output, permalink) {
+    row.status.textContent = "";
+    row.element.classList.add("done");
+    if (!output) {
+        return;
+    }
+    const link = document.createElement("a");
+    link.href = permalink || output;
+    if (/\.(png|webp|gif)$/.test(output)) {
+        const img = document.createElement("img");
+        img.src = output;
+        img.alt = messages["page.rendered_alt"];
+        link.appendChild(img);
+        row.thumb.appendChild(link);
+    } else {
+        link.href = output;
+        link.textContent = messages["page.download"];
+        row.status.appendChild(link);
+    }
+}
+
+function showFailed(row, text) {
+    row.progress.style.display = "none";
+    row.element.classList.add("failed");
+    row.status.textContent = text || messages["page.error"];
+}
+
+// Drag-and-drop and click-to-upload functionality
+const dropZone = document.getElementById("drop-zone");
+const fileInput = document.getElementById("file-input");
+
+// Trigger file input click on drop zone click
+dropZone.addEventListener("click", (event) => {
+    event.stopPropagation();
+    fileInput.click();
+});
+
+// Handle file selection from file input
+fileInput.addEventListener("change", (event) => {
+    if (event.target.files.length > 0) {
+        handleFiles(event.target.files);
+    }
+    fileInput.value = ""; // Picking the same files again uploads them again
+});
+
+// Drag-and-drop event listeners
+dropZone.addEventListener("dragover", (event) => {
+    event.preventDefault();
+    dropZone.classList.add("dragover");
+});
+
+dropZone.addEventListener("dragleave", () => {
+    dropZone.classList.remove("dragover");
+});
+
+dropZone.addEventListener("drop", (event) => {
+    event.preventDefault();
+    dropZone.classList.remove("dragover");
+
+    if (event.dataTransfer.files.length > 0) {
+        handleFiles(event.dataTransfer.files);
+    }
+});
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const DefaultUnits = "mm" // STL files carry no units; most slicers and CAD exports use millimeters
+
+// Millimeters per model unit
+var unitScales = map[string]float64{"mm": 1, "in": 25.4}
+
+// Largest extent, in millimeters, below which a model without explicit units
+// is guessed to be in inches. Real parts that small are rare, while inch models
+// of a few units across are common.
+const inchGuessMaxExtent = 12
+
+// Bounding box size along each axis
+type Dimensions struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+func (d Dimensions) scaled(s float64) Dimensions {
+	return Dimensions{d.X * s, d.Y * s, d.Z * s}
+}
+
+// Position in model units
+type Point struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+// Measurements of an uploaded model
+type ModelStats struct {
+	Units        string     `json:"units"`         // "mm" or "in"
+	UnitsAssumed bool       `json:"units_assumed"` // Units weren't given and were guessed from the model size
+	Dimensions   Dimensions `json:"dimensions"`    // Bounding box in Units
+	DimensionsMM Dimensions `json:"dimensions_mm"` // Bounding box in millimeters
+	Triangles    int        `json:"triangles"`
+	Issues       MeshIssues `json:"issues"` // Broken triangles found in the upload
+
+	CenterOfMass *Point       `json:"center_of_mass,omitempty"` // Assuming uniform density; omitted for open meshes
+	Stability    *Stability   `json:"stability,omitempty"`      // Standing on the lowest face, as oriented
+	Hollowing    *Hollowing   `json:"hollowing,omitempty"`      // Material estimate when hollow_wall is given
+	Voxels       *VoxelStats  `json:"voxels,omitempty"`         // Grid of the voxel preview, when voxels is given
+	PrinterFits  []PrinterFit `json:"printer_fits,omitempty"`   // One entry per configured printer
+
+	Samples int `json:"samples,omitempty"` // Path tracing samples per pixel taken, fewer than asked for when raytrace_secs ran out
+}
+
+// Per-job analysis settings. Unlike RenderOptions these don't change the
+// rendered image, only the reported stats.
+type AnalysisOptions struct {
+	Units      string  // Units the client says the model is in, or "" to guess
+	HollowWall float64 // Wall thickness in mm for the hollowing estimate, 0 to skip it
+}
+
+// Read the optional analysis form fields
+func parseAnalysisOptions(r *http.Request) (AnalysisOptions, error) {
+	var opts AnalysisOptions
+
+	opts.Units = strings.ToLower(strings.TrimSpace(r.FormValue("units")))
+	if _, ok := unitScales[opts.Units]; opts.Units != "" && !ok {
+		return opts, fmt.Errorf("units must be mm or in")
+	}
+
+	if v := r.FormValue("hollow_wall"); v != "" {
+		wall, err := strconv.ParseFloat(v, 64)
+		if err != nil || wall <= 0 || wall > MaxHollowWall {
+			return opts, fmt.Errorf("hollow_wall must be a thickness in mm between 0 and %g", float64(MaxHollowWall))
+		}
+		opts.HollowWall = wall
+	}
+
+	return opts, nil
+}
+
+// Measure a mesh in its file coordinates. With no units given, a model too
+// small to plausibly be millimeters is taken to be in inches.
+func measureMesh(mesh *fauxgl.Mesh, analysis AnalysisOptions) ModelStats {
+	size := mesh.BoundingBox().Size()
+	dims := Dimensions{size.X, size.Y, size.Z}
+
+	stats := ModelStats{Dimensions: dims, Triangles: len(mesh.Triangles)}
+	stats.Issues, _ = findMeshIssues(mesh)
+	stats.Units, stats.UnitsAssumed = resolveUnits(analysis.Units, dims)
+	stats.DimensionsMM = dims.scaled(unitScales[stats.Units])
+
+	if com, ok := centerOfMass(mesh); ok {
+		stats.CenterOfMass = &Point{com.X, com.Y, com.Z}
+		stability := analyzeStability(mesh, com)
+		stats.Stability = &stability
+	}
+
+	if analysis.HollowWall > 0 {
+		stats.Hollowing = estimateHollowing(mesh, analysis.HollowWall, unitScales[stats.Units])
+	}
+	stats.PrinterFits = checkPrinterFits(mesh, unitScales[stats.Units])
+	return stats
+}
+
+// Units for a model: the ones given, or a guess from its size
+func resolveUnits(units string, dims Dimensions) (string, bool) {
+	if units != "" {
+		return units, false
+	}
+	if extent := math.Max(dims.X, math.Max(dims.Y, dims.Z)); extent > 0 && extent < inchGuessMaxExtent {
+		return "in", true
+	}
+	return DefaultUnits, true
+}
+
+// Attach measurements to a job once its model has been loaded, with the
+// renderer that drew it
+func setJobStats(id string, stats ModelStats) {
+	mu.Lock()
+	defer mu.Unlock()
+	if job, ok := jobs[id]; ok {
+		job.Stats = &stats
+		job.Renderer = rendererName()
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Split a camera into left and right eyes separated by iod, both converging
+// on the original target
+func stereoCameras(cam camera, iod float64) (camera, camera) {
+	forward := cam.center.Sub(cam.eye).Normalize()
+	right := forward.Cross(cam.up).Normalize().MulScalar(iod / 2)
+
+	left := cam
+	left.eye = cam.eye.Sub(right)
+	rightCam := cam
+	rightCam.eye = cam.eye.Add(right)
+	return left, rightCam
+}
+
+// Render left and right views next to each other (parallel-viewing order)
+func renderStereoPair(sc *scene, cam camera, iod float64) image.Image {
+	leftCam, rightCam := stereoCameras(cam, iod)
+	left := sc.withAnnotations(renderView(sc, leftCam, Width, Height), leftCam)
+	right := sc.withAnnotations(renderView(sc, rightCam, Width, Height), rightCam)
+
+	pair := image.NewNRGBA(image.Rect(0, 0, 2*Width, Height))
+	draw.Draw(pair, image.Rect(0, 0, Width, Height), left, left.Bounds().Min, draw.Src)
+	draw.Draw(pair, image.Rect(Width, 0, 2*Width, Height), right, right.Bounds().Min, draw.Src)
+	return pair
+}
+
+// Render a red-cyan anaglyph: red from the left eye, green and blue from the right
+func renderAnaglyph(sc *scene, cam camera, iod float64) image.Image {
+	leftCam, rightCam := stereoCameras(cam, iod)
+	left := renderView(sc, leftCam, Width, Height)
+	right := renderView(sc, rightCam, Width, Height)
+
+	out := image.NewNRGBA(image.Rect(0, 0, Width, Height))
+	lb, rb := left.Bounds(), right.Bounds()
+	for y := 0; y < Height; y++ {
+		for x := 0; x < Width; x++ {
+			l := color.NRGBAModel.Convert(left.At(lb.Min.X+x, lb.Min.Y+y)).(color.NRGBA)
+			r := color.NRGBAModel.Convert(right.At(rb.Min.X+x, rb.Min.Y+y)).(color.NRGBA)
+			out.SetNRGBA(x, y, color.NRGBA{l.R, r.G, r.B, 255})
+		}
+	}
+	return out
+}
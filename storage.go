@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Storage backend types
+const (
+	StorageLocal = "local"
+	StorageGCS   = "gcs"
+	StorageAzure = "azure"
+	StorageIPFS  = "ipfs"
+)
+
+// Where published uploads and outputs live
+type StorageConfig struct {
+	Type      string `json:"type"`      // local (default), gcs, azure, or ipfs
+	Bucket    string `json:"bucket"`    // GCS bucket
+	Account   string `json:"account"`   // Azure storage account; AZURE_STORAGE_ACCOUNT when empty
+	Container string `json:"container"` // Azure blob container
+	Prefix    string `json:"prefix"`    // Prepended to every object name, e.g. "render/"
+	API       string `json:"api"`       // Kubo RPC API URL for ipfs; DefaultIPFSAPI when empty
+}
+
+// Published files, addressed by slash-separated names such as
+// "output/output-<hash>.png" or "uploads/input-<hash>.stl"
+type Storage interface {
+	// Store a finished local file under name. The local file is consumed.
+	Publish(ctx context.Context, localPath, name string) error
+	// Open a stored file for reading; fails with os.ErrNotExist if missing
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Open a stored file for reading from offset to the end
+	OpenAt(ctx context.Context, name string, offset int64) (io.ReadCloser, error)
+	// Size and modification time of a stored file; fails with os.ErrNotExist
+	// if missing
+	Stat(ctx context.Context, name string) (StoredFileInfo, error)
+	Exists(ctx context.Context, name string) (bool, error)
+}
+
+type StoredFileInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+var storage Storage = localStorage{}
+
+// Output types missing from Go's built-in table, which is all there is on
+// slim container images without /etc/mime.types
+func init() {
+	mime.AddExtensionType(".zip", "application/zip")
+	mime.AddExtensionType(".stl", "model/stl")
+}
+
+func newStorage(cfg StorageConfig) (Storage, error) {
+	switch cfg.Type {
+	case "", StorageLocal:
+		return localStorage{}, nil
+	case StorageGCS:
+		if cfg.Bucket == "" {
+			return nil, fmt.Errorf("gcs storage needs a bucket")
+		}
+		return &gcsStorage{bucket: cfg.Bucket, prefix: cfg.Prefix, client: &http.Client{}, tokens: newGoogleTokenSource(gcsScope)}, nil
+	case StorageAzure:
+		return newAzureStorage(cfg)
+	case StorageIPFS:
+		return newIPFSStorage(cfg)
+	}
+	return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+}
+
+// Files in uploads/ and output/ under the working directory
+type localStorage struct{}
+
+func (localStorage) Publish(ctx context.Context, localPath, name string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return moveFile(localPath, filepath.FromSlash(name))
+}
+
+func (localStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.FromSlash(name))
+}
+
+func (localStorage) OpenAt(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filepath.FromSlash(name))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (localStorage) Stat(ctx context.Context, name string) (StoredFileInfo, error) {
+	info, err := os.Stat(filepath.FromSlash(name))
+	if err != nil {
+		return StoredFileInfo{}, err
+	}
+	return StoredFileInfo{Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (localStorage) Exists(ctx context.Context, name string) (bool, error) {
+	_, err := os.Stat(filepath.FromSlash(name))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Name of a published output
+func outputObject(name string) string {
+	return path.Join("output", name)
+}
+
+// Stream a stored file to the client
+func serveStoredFile(w http.ResponseWriter, r *http.Request, name string) {
+	// Local files get http.ServeFile's range and caching support; symlinks
+	// and anything but regular files are refused
+	if local, ok := localStoragePath(r.Context(), name); ok {
+		info, err := os.Lstat(local)
+		if err != nil || !info.Mode().IsRegular() {
+			notFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, local)
+		return
+	}
+
+	// Cloud objects get the same through ranged reads, so interrupted
+	// downloads of large spins and bundles can resume
+	info, err := storage.Stat(r.Context(), name)
+	if errors.Is(err, os.ErrNotExist) {
+		notFound(w, r)
+		return
+	}
+	if err != nil {
+		apiError(w, r, http.StatusBadGateway, ErrStorage, "Failed to read file")
+		return
+	}
+	if w.Header().Get("Content-Type") == "" {
+		if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+	}
+	file := &storedFileReader{ctx: r.Context(), name: name, size: info.Size}
+	defer file.Close()
+	http.ServeContent(w, r, path.Base(name), info.ModTime, file)
+}
+
+// Seekable view of a stored file that opens a ranged read at the current
+// position on the first Read after a seek
+type storedFileReader struct {
+	ctx    context.Context
+	name   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *storedFileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	if offset != f.offset {
+		f.Close()
+		f.offset = offset
+	}
+	return offset, nil
+}
+
+func (f *storedFileReader) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+	if f.body == nil {
+		body, err := storage.OpenAt(f.ctx, f.name, f.offset)
+		if err != nil {
+			return 0, err
+		}
+		f.body = body
+	}
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *storedFileReader) Close() error {
+	if f.body == nil {
+		return nil
+	}
+	err := f.body.Close()
+	f.body = nil
+	return err
+}
+
+// Object name with the configured prefix, for the cloud backends
+func prefixedName(prefix, name string) string {
+	return strings.TrimPrefix(prefix+name, "/")
+}
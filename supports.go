@@ -0,0 +1,88 @@
+package main
+
+import (
+	"math"
+	"sort"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const (
+	DefaultOverhangAngle = 45.0 // Typical FDM limit, in degrees from vertical
+	SupportGridSize      = 48   // Pillar grid cells along the bi-unit cube's side
+)
+
+// Rough support structures for a model already fitted to the bi-unit cube,
+// resting on its lowest Z. Overhanging faces are sampled on a coarse XY grid
+// and each sample gets a square pillar down to the build plate, or to the top
+// of the model surface beneath it. Returns nil if nothing needs support.
+func supportPillars(mesh *fauxgl.Mesh, overhangAngle float64) *fauxgl.Mesh {
+	// Faces tilted further from vertical than the threshold, facing down
+	limit := -math.Sin(fauxgl.Radians(overhangAngle))
+
+	box := mesh.BoundingBox()
+	plate := box.Min.Z
+	cell := 2.0 / SupportGridSize
+	nx := int(math.Ceil((box.Max.X-box.Min.X)/cell)) + 1
+	ny := int(math.Ceil((box.Max.Y-box.Min.Y)/cell)) + 1
+
+	// Every surface crossing of each cell's vertical line, with whether that
+	// surface overhangs
+	type hit struct {
+		z        float64
+		overhang bool
+	}
+	columns := make([][]hit, nx*ny)
+	for _, t := range mesh.Triangles {
+		a, b, c := t.V1.Position, t.V2.Position, t.V3.Position
+		n := b.Sub(a).Cross(c.Sub(a))
+		if n.Length() == 0 {
+			continue
+		}
+		overhang := n.Normalize().Z < limit
+
+		x0 := int(math.Max(0, math.Ceil((math.Min(a.X, math.Min(b.X, c.X))-box.Min.X)/cell-0.5)))
+		x1 := int(math.Min(float64(nx-1), math.Floor((math.Max(a.X, math.Max(b.X, c.X))-box.Min.X)/cell-0.5)))
+		y0 := int(math.Max(0, math.Ceil((math.Min(a.Y, math.Min(b.Y, c.Y))-box.Min.Y)/cell-0.5)))
+		y1 := int(math.Min(float64(ny-1), math.Floor((math.Max(a.Y, math.Max(b.Y, c.Y))-box.Min.Y)/cell-0.5)))
+		for ix := x0; ix <= x1; ix++ {
+			px := box.Min.X + (float64(ix)+0.5)*cell
+			for iy := y0; iy <= y1; iy++ {
+				py := box.Min.Y + (float64(iy)+0.5)*cell
+				if z, ok := verticalHit(a, b, c, px, py); ok {
+					columns[ix*ny+iy] = append(columns[ix*ny+iy], hit{z, overhang})
+				}
+			}
+		}
+	}
+
+	pillars := fauxgl.NewEmptyMesh()
+	width := cell * 0.6
+	for ix := 0; ix < nx; ix++ {
+		for iy := 0; iy < ny; iy++ {
+			hits := columns[ix*ny+iy]
+			sort.Slice(hits, func(i, j int) bool { return hits[i].z < hits[j].z })
+			for i, h := range hits {
+				if !h.overhang || h.z-plate < cell/2 {
+					continue
+				}
+				bottom := plate
+				if i > 0 {
+					bottom = hits[i-1].z
+				}
+				if h.z-bottom < cell/4 {
+					continue // Too short to matter
+				}
+				center := fauxgl.Vector{box.Min.X + (float64(ix)+0.5)*cell, box.Min.Y + (float64(iy)+0.5)*cell, (bottom + h.z) / 2}
+				pillar := fauxgl.NewCube() // Unit cube centered on the origin
+				pillar.Transform(fauxgl.Scale(fauxgl.Vector{width, width, h.z - bottom}).Translate(center))
+				pillars.Add(pillar)
+			}
+		}
+	}
+
+	if len(pillars.Triangles) == 0 {
+		return nil
+	}
+	return pillars
+}
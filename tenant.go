@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	TenantHeader      = "X-Tenant"       // Request header naming the tenant
+	TenantTokenHeader = "X-Tenant-Token" // Request header carrying the tenant's token
+	TenantPathPrefix  = "/t/"            // Path prefix naming the tenant, as in /t/{name}/upload
+)
+
+// A team served by this deployment. Each tenant has its own output cache,
+// recent renders, quota, and storage prefix, so teams never see or reuse each
+// other's models.
+type TenantConfig struct {
+	Name          string `json:"name"`
+	StoragePrefix string `json:"storage_prefix"` // Prepended to the tenant's object names; "tenants/<name>/" when empty
+	MaxJobs       int    `json:"max_jobs"`       // Jobs the tenant may have queued or rendering at once on an instance; no limit when 0
+	Token         string `json:"token"`          // Secret requests naming the tenant must send in TenantTokenHeader; anyone may act as the tenant when empty
+}
+
+var (
+	tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+	errTenantQuota    = errors.New("tenant has too many jobs in progress")
+)
+
+type tenantContextKey struct{}
+
+// Check the configured tenants on startup
+func validateTenants() error {
+	seen := make(map[string]bool)
+	for _, t := range config.Tenants {
+		if !tenantNamePattern.MatchString(t.Name) {
+			return fmt.Errorf("tenant name %q must be 1-32 lowercase letters, digits, or dashes", t.Name)
+		}
+		if seen[t.Name] {
+			return fmt.Errorf("tenant %q is configured twice", t.Name)
+		}
+		seen[t.Name] = true
+	}
+	return nil
+}
+
+func findTenant(name string) (TenantConfig, bool) {
+	for _, t := range config.Tenants {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return TenantConfig{}, false
+}
+
+// Attach a tenant to a context; the empty name is the default tenant
+func withTenant(ctx context.Context, tenant string) context.Context {
+	if tenant == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tenantContextKey{}, tenant)
+}
+
+// Tenant a request or job context belongs to; empty for the default tenant
+func tenantOf(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantContextKey{}).(string)
+	return tenant
+}
+
+// Wrap the server's handler so requests carry their tenant, taken from a
+// /t/{name} path prefix, which is stripped, or from TenantHeader. Unknown
+// tenants get a 404, and requests for a tenant with a token that don't carry
+// it a 401, unless they only fetch shared pages and files. Without configured
+// tenants, requests are passed on as they are.
+func withTenants(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(config.Tenants) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := r.Header.Get(TenantHeader)
+		if rest, ok := strings.CutPrefix(r.URL.Path, TenantPathPrefix); ok {
+			var path string
+			name, path, _ = strings.Cut(rest, "/")
+			u := *r.URL
+			u.Path, u.RawPath = "/"+path, ""
+			r = r.Clone(r.Context())
+			r.URL = &u
+		}
+		if name == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t, ok := findTenant(name)
+		if !ok {
+			notFound(w, r)
+			return
+		}
+		if t.Token != "" && !sharedTenantRequest(r) {
+			token := r.Header.Get(TenantTokenHeader)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) != 1 {
+				apiError(w, r, http.StatusUnauthorized, ErrUnauthorized, "Unauthorized")
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), name)))
+	})
+}
+
+// Whether a request only fetches what a tenant's links are handed out for:
+// outputs, render URLs, model pages and their previews, and static files.
+// These are named by hashes or signed, and are opened by browsers and link
+// previews that can't send a token.
+func sharedTenantRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	for _, prefix := range []string{"/output/", "/render/", "/og/", "/static/"} {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return true
+		}
+	}
+	if hash, ok := strings.CutPrefix(r.URL.Path, "/m/"); ok && !strings.Contains(hash, "/") {
+		return true
+	}
+	return r.URL.Path == "/favicon.ico"
+}
+
+// Path of a page or file as the tenant's clients reach it
+func tenantURL(tenant, path string) string {
+	if tenant == "" {
+		return path
+	}
+	return TenantPathPrefix + tenant + path
+}
+
+// Download URL of a stored output
+func outputURL(tenant, name string) string {
+	return tenantURL(tenant, "/output/"+name)
+}
+
+// Hash a tenant's file is cached under, so the same file uploaded by two
+// tenants gets separate outputs. The default tenant keeps the file's hash.
+func tenantFileHash(tenant, fileHash string) string {
+	if tenant == "" {
+		return fileHash
+	}
+	sum := sha256.Sum256([]byte("tenant|" + tenant + "|" + fileHash))
+	return hex.EncodeToString(sum[:])
+}
+
+// Prefix of a tenant's object names in storage
+func tenantStoragePrefix(tenant string) string {
+	t, _ := findTenant(tenant)
+	if t.StoragePrefix != "" {
+		return t.StoragePrefix
+	}
+	return "tenants/" + tenant + "/"
+}
+
+// Count a tenant's queued and rendering jobs against its quota
+func checkTenantQuota(tenant string) error {
+	t, ok := findTenant(tenant)
+	if !ok || t.MaxJobs <= 0 {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	pending := 0
+	for _, job := range jobs {
+		if job.Tenant == tenant && !job.finished() {
+			pending++
+		}
+	}
+	if pending >= t.MaxJobs {
+		return errTenantQuota
+	}
+	return nil
+}
+
+// Storage that files every object of a tenant under the tenant's prefix,
+// taking the tenant from the context
+type tenantStorage struct {
+	Storage
+}
+
+func (s tenantStorage) name(ctx context.Context, name string) string {
+	if tenant := tenantOf(ctx); tenant != "" {
+		return tenantStoragePrefix(tenant) + name
+	}
+	return name
+}
+
+// Path of a stored file when storage is local files, under the tenant's prefix
+func localStoragePath(ctx context.Context, name string) (string, bool) {
+	s := storage
+	if t, ok := s.(tenantStorage); ok {
+		name, s = t.name(ctx, name), t.Storage
+	}
+	if _, ok := s.(localStorage); !ok {
+		return "", false
+	}
+	return filepath.FromSlash(name), true
+}
+
+func (s tenantStorage) Publish(ctx context.Context, localPath, name string) error {
+	return s.Storage.Publish(ctx, localPath, s.name(ctx, name))
+}
+
+func (s tenantStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	return s.Storage.Open(ctx, s.name(ctx, name))
+}
+
+func (s tenantStorage) OpenAt(ctx context.Context, name string, offset int64) (io.ReadCloser, error) {
+	return s.Storage.OpenAt(ctx, s.name(ctx, name), offset)
+}
+
+func (s tenantStorage) Stat(ctx context.Context, name string) (StoredFileInfo, error) {
+	return s.Storage.Stat(ctx, s.name(ctx, name))
+}
+
+func (s tenantStorage) Exists(ctx context.Context, name string) (bool, error) {
+	return s.Storage.Exists(ctx, s.name(ctx, name))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantToken(t *testing.T) {
+	saved := config.Tenants
+	config.Tenants = []TenantConfig{{Name: "design", Token: "s3cret"}, {Name: "open"}}
+	t.Cleanup(func() { config.Tenants = saved })
+
+	var tenant string
+	handler := withTenants(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant = tenantOf(r.Context())
+	}))
+	tests := []struct {
+		method, target string
+		header, token  string
+		status         int
+		tenant         string
+	}{
+		{http.MethodPost, "/t/design/upload", "", "", http.StatusUnauthorized, ""},
+		{http.MethodPost, "/t/design/upload", "", "wrong", http.StatusUnauthorized, ""},
+		{http.MethodPost, "/t/design/upload", "", "s3cret", http.StatusOK, "design"},
+		{http.MethodPost, "/upload", "design", "", http.StatusUnauthorized, ""},
+		{http.MethodPost, "/upload", "design", "s3cret", http.StatusOK, "design"},
+		{http.MethodGet, "/t/design/", "", "", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/t/design/api/v1/models/" + outputHash, "", "", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/t/design/m/" + outputHash + "/bookmarks", "", "", http.StatusUnauthorized, ""},
+		{http.MethodGet, "/t/design/output/output-" + outputHash + ".png", "", "", http.StatusOK, "design"},
+		{http.MethodHead, "/t/design/output/output-" + outputHash + ".png", "", "", http.StatusOK, "design"},
+		{http.MethodGet, "/t/design/render/" + outputHash + ".png", "", "", http.StatusOK, "design"},
+		{http.MethodGet, "/t/design/m/" + outputHash, "", "", http.StatusOK, "design"},
+		{http.MethodGet, "/t/design/og/" + outputHash + ".png", "", "", http.StatusOK, "design"},
+		{http.MethodPost, "/t/open/upload", "", "", http.StatusOK, "open"},
+		{http.MethodPost, "/upload", "", "", http.StatusOK, ""},
+		{http.MethodPost, "/t/other/upload", "", "s3cret", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		tenant = ""
+		r := httptest.NewRequest(tt.method, tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set(TenantHeader, tt.header)
+		}
+		if tt.token != "" {
+			r.Header.Set(TenantTokenHeader, tt.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status || tenant != tt.tenant {
+			t.Errorf("%s %s with tenant %q and token %q: got status %d and tenant %q, want %d and %q",
+				tt.method, tt.target, tt.header, tt.token, w.Code, tenant, tt.status, tt.tenant)
+		}
+	}
+}
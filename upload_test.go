@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// A multipart upload with a valid CSRF token and the given fields and files
+func uploadRequest(t *testing.T, target string, fields map[string]string, files map[string][]byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		mw.WriteField(name, value)
+	}
+	for name, data := range files {
+		part, err := mw.CreateFormFile(name, "model.stl")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(data)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	token := strings.Repeat("cd", 32)
+	r.AddCookie(&http.Cookie{Name: CSRFCookieName, Value: token})
+	r.Header.Set(CSRFHeaderName, token)
+	return r
+}
+
+func TestUploadRequestErrors(t *testing.T) {
+	saved := config.MaxUploadMB
+	config.MaxUploadMB = 1
+	t.Cleanup(func() { config.MaxUploadMB = saved })
+
+	large := map[string][]byte{"file": bytes.Repeat([]byte("x"), 2<<20)}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		r       *http.Request
+		status  int
+		code    string
+	}{
+		{"upload without file", uploadHandler, uploadRequest(t, "/upload", nil, nil), http.StatusBadRequest, ErrInvalidRequest},
+		{"upload too large", uploadHandler, uploadRequest(t, "/upload", nil, large), http.StatusRequestEntityTooLarge, ErrTooLarge},
+		{"convert without file", convertHandler, uploadRequest(t, "/api/v1/convert", map[string]string{"to": "obj"}, nil), http.StatusBadRequest, ErrInvalidRequest},
+		{"convert too large", convertHandler, uploadRequest(t, "/api/v1/convert", map[string]string{"to": "obj"}, large), http.StatusRequestEntityTooLarge, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		tt.handler(w, tt.r)
+		if w.Code != tt.status || w.Header().Get("X-Error-Code") != tt.code {
+			t.Errorf("%s: got %d %s, want %d %s", tt.name, w.Code, w.Header().Get("X-Error-Code"), tt.status, tt.code)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+
+	"github.com/fogleman/fauxgl"
+)
+
+const MaxVoxelResolution = 128 // Largest voxels option, in voxels along the model's longest side
+
+// Size of the grid a voxel preview was built on
+type VoxelStats struct {
+	Resolution  int     `json:"resolution"` // Voxels along the longest side
+	Filled      int     `json:"filled"`     // Voxels inside the model
+	VoxelSizeMM float64 `json:"voxel_size_mm"`
+}
+
+// Faces of a voxel: outward direction, and two edges whose cross product
+// points the same way so the faces wind counterclockwise from outside
+var voxelFaces = []struct {
+	d    [3]int
+	u, v fauxgl.Vector
+}{
+	{[3]int{1, 0, 0}, fauxgl.Vector{0, 1, 0}, fauxgl.Vector{0, 0, 1}},
+	{[3]int{-1, 0, 0}, fauxgl.Vector{0, 0, 1}, fauxgl.Vector{0, 1, 0}},
+	{[3]int{0, 1, 0}, fauxgl.Vector{0, 0, 1}, fauxgl.Vector{1, 0, 0}},
+	{[3]int{0, -1, 0}, fauxgl.Vector{1, 0, 0}, fauxgl.Vector{0, 0, 1}},
+	{[3]int{0, 0, 1}, fauxgl.Vector{1, 0, 0}, fauxgl.Vector{0, 1, 0}},
+	{[3]int{0, 0, -1}, fauxgl.Vector{0, 1, 0}, fauxgl.Vector{1, 0, 0}},
+}
+
+// Rebuild a closed mesh from cubic voxels, resolution of them along its
+// longest side. Only faces between a filled and an empty voxel are kept, so
+// the result is a watertight blocky shell. mmPerUnit is used for the stats.
+func voxelMesh(mesh *fauxgl.Mesh, resolution int, mmPerUnit float64) (*fauxgl.Mesh, VoxelStats) {
+	origin, voxel, nx, ny, nz := voxelGrid(mesh, resolution)
+	inside := voxelize(mesh, origin, voxel, nx, ny, nz)
+	filled := func(ix, iy, iz int) bool {
+		if ix < 0 || iy < 0 || iz < 0 || ix >= nx || iy >= ny || iz >= nz {
+			return false
+		}
+		return inside[(ix*ny+iy)*nz+iz]
+	}
+
+	stats := VoxelStats{Resolution: resolution, VoxelSizeMM: math.Round(voxel*mmPerUnit*1000) / 1000}
+	blocks := fauxgl.NewEmptyMesh()
+	for ix := 0; ix < nx; ix++ {
+		for iy := 0; iy < ny; iy++ {
+			for iz := 0; iz < nz; iz++ {
+				if !filled(ix, iy, iz) {
+					continue
+				}
+				stats.Filled++
+				corner := origin.Add(fauxgl.Vector{float64(ix), float64(iy), float64(iz)}.MulScalar(voxel))
+				for _, f := range voxelFaces {
+					if filled(ix+f.d[0], iy+f.d[1], iz+f.d[2]) {
+						continue
+					}
+					// Faces on the positive side sit one voxel further out
+					base := corner.Add(fauxgl.Vector{float64(max(f.d[0], 0)), float64(max(f.d[1], 0)), float64(max(f.d[2], 0))}.MulScalar(voxel))
+					u, v := f.u.MulScalar(voxel), f.v.MulScalar(voxel)
+					blocks.Triangles = append(blocks.Triangles,
+						fauxgl.NewTriangleForPoints(base, base.Add(u), base.Add(u).Add(v)),
+						fauxgl.NewTriangleForPoints(base, base.Add(u).Add(v), base.Add(v)))
+				}
+			}
+		}
+	}
+	return blocks, stats
+}
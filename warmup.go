@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Models to render right after startup, so the outputs customers ask for
+// first are already cached after a deploy
+type WarmupConfig struct {
+	Manifest string `json:"manifest"` // JSON file listing the models; no warmup when empty
+	MaxMB    int    `json:"max_mb"`   // Largest model downloaded from a manifest URL
+}
+
+// One model in the warmup manifest: a stored upload by hash, or a file to
+// download. Options are render and analysis form fields, as sent to /upload.
+type warmupEntry struct {
+	Tenant  string            `json:"tenant,omitempty"`
+	Hash    string            `json:"hash,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// Render every model in the warmup manifest that isn't cached yet. Entries
+// are queued one at a time, each after the last finished, so uploads arriving
+// meanwhile aren't stuck behind the whole manifest.
+func warmCache() {
+	if config.Warmup.Manifest == "" {
+		return
+	}
+	data, err := os.ReadFile(config.Warmup.Manifest)
+	if err != nil {
+		log.Printf("Failed to read warmup manifest: %v", err)
+		return
+	}
+	var entries []warmupEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		log.Printf("Failed to parse warmup manifest: %v", err)
+		return
+	}
+
+	log.Printf("Warming the cache with %d models", len(entries))
+	rendered := 0
+	for i, entry := range entries {
+		if workerCtx.Err() != nil {
+			return
+		}
+		ok, err := warmEntry(workerCtx, entry)
+		if err != nil {
+			log.Printf("Failed to warm manifest entry %d: %v", i+1, err)
+			continue
+		}
+		if ok {
+			rendered++
+		}
+	}
+	log.Printf("Cache warmed: rendered %d of %d models", rendered, len(entries))
+}
+
+// Render one manifest entry and wait for it. Returns false if its output was
+// already cached.
+func warmEntry(ctx context.Context, entry warmupEntry) (bool, error) {
+	if (entry.Hash == "") == (entry.URL == "") {
+		return false, errors.New("needs exactly one of hash and url")
+	}
+	if entry.Tenant != "" {
+		if _, ok := findTenant(entry.Tenant); !ok {
+			return false, fmt.Errorf("unknown tenant %q", entry.Tenant)
+		}
+		ctx = withTenant(ctx, entry.Tenant)
+	}
+	r, err := optionsRequest(ctx, entry.Options)
+	if err != nil {
+		return false, err
+	}
+	opts, err := parseRenderOptions(r)
+	if err != nil {
+		return false, err
+	}
+	analysis, err := parseAnalysisOptions(r)
+	if err != nil {
+		return false, err
+	}
+
+	var workDir, fileHash string
+	if entry.Hash != "" {
+		if !fileHashPattern.MatchString(entry.Hash) {
+			return false, errors.New("hash must be a SHA-256")
+		}
+		fileHash = entry.Hash
+		if warmCached(outputCacheKey(entry.Tenant, fileHash, opts, analysis)) {
+			return false, nil
+		}
+		if workDir, err = fetchUpload(ctx, fileHash); err != nil {
+			return false, err
+		}
+	} else {
+		if workDir, fileHash, err = downloadModel(ctx, r, entry.URL); err != nil {
+			return false, err
+		}
+		if warmCached(outputCacheKey(entry.Tenant, fileHash, opts, analysis)) {
+			os.RemoveAll(workDir)
+			return false, nil
+		}
+	}
+
+	id, err := queueRenderPatiently(ctx, workDir, fileHash, opts, analysis)
+	if err != nil {
+		return false, err
+	}
+	job, err := awaitJob(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if job.Status == JobFailed {
+		return false, fmt.Errorf("job ID %s failed", id)
+	}
+	return true, nil
+}
+
+// Request carrying render and analysis form fields, as sent to /upload, to
+// parse them from
+func optionsRequest(ctx context.Context, options map[string]string) (*http.Request, error) {
+	form := url.Values{}
+	for k, v := range options {
+		form.Set(k, v)
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r, nil
+}
+
+// Queue a render of the model in workDir, waiting while the queue or the
+// tenant's quota is full rather than giving up. workDir is taken over.
+func queueRenderPatiently(ctx context.Context, workDir, fileHash string, opts RenderOptions, analysis AnalysisOptions) (string, error) {
+	for {
+		id, coalesced, err := queueRender(ctx, workDir, fileHash, opts, analysis, false, negotiateLocale(""))
+		if coalesced {
+			os.RemoveAll(workDir)
+		}
+		if !errors.Is(err, errQueueFull) && !errors.Is(err, errTenantQuota) {
+			if err != nil {
+				os.RemoveAll(workDir)
+			}
+			return id, err
+		}
+		select {
+		case <-ctx.Done():
+			os.RemoveAll(workDir)
+			return "", ctx.Err()
+		case <-time.After(QueueFullRetrySecs * time.Second):
+		}
+	}
+}
+
+// Render the model in workDir for the context's tenant unless its output is
+// already stored, and wait for it. workDir is taken over. Returns the cache
+// key the outputs are named after.
+func renderModel(ctx context.Context, workDir, fileHash string, opts RenderOptions, analysis AnalysisOptions) (string, error) {
+	cacheKey := outputCacheKey(tenantOf(ctx), fileHash, opts, analysis)
+	if _, ok := lookupOutput(cacheKey); ok {
+		os.RemoveAll(workDir)
+		return cacheKey, nil
+	}
+	id, err := queueRenderPatiently(ctx, workDir, fileHash, opts, analysis)
+	if err != nil {
+		return "", err
+	}
+	job, err := awaitJob(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if job.Status == JobFailed {
+		return "", fmt.Errorf("job ID %s failed with %s", id, job.ErrorCode)
+	}
+	return cacheKey, nil
+}
+
+// Wait for a job to finish. A job that expired meanwhile comes back empty.
+func awaitJob(ctx context.Context, id string) (Job, error) {
+	for {
+		job, changed, ok := getJob(id)
+		if !ok || job.finished() {
+			return job, nil
+		}
+		select {
+		case <-ctx.Done():
+			return Job{}, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// Whether an output is stored or on its way
+func warmCached(cacheKey string) bool {
+	if _, ok := lookupOutput(cacheKey); ok {
+		return true
+	}
+	_, ok := findInFlightJob(cacheKey)
+	return ok
+}
+
+// Download a model into a new work dir as input.stl, scanning and converting
+// it like an upload. r carries the entry's options for the conversion.
+// Returns the work dir and the file hash.
+func downloadModel(ctx context.Context, r *http.Request, rawURL string) (string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", "", errors.New("url must be http or https")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("download answered %s", resp.Status)
+	}
+	return readModel(ctx, r, path.Base(u.Path), resp.Body, config.Warmup.MaxMB)
+}
+
+// Save a model named filename from body into a new work dir as input.stl,
+// scanning and converting it like an upload, up to maxMB. r carries the
+// options for the conversion. Returns the work dir and the file hash. Errors
+// carry the code an upload failing the same way would answer with.
+func readModel(ctx context.Context, r *http.Request, filename string, body io.Reader, maxMB int) (string, string, error) {
+	conv, err := uploadConverter(r, filename)
+	if err != nil {
+		return "", "", withErrorCode(ErrInvalidRequest, err)
+	}
+	workDir, err := newJobWorkDir()
+	if err != nil {
+		return "", "", err
+	}
+	fail := func(err error) (string, string, error) {
+		os.RemoveAll(workDir)
+		return "", "", err
+	}
+	stlPath := filepath.Join(workDir, "input.stl")
+	inputPath := stlPath
+	if conv != nil {
+		inputPath = filepath.Join(workDir, "input."+conv.ext)
+	}
+	file, err := os.Create(inputPath)
+	if err != nil {
+		return fail(err)
+	}
+	limit := int64(maxMB) << 20
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(body, limit+1))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fail(err)
+	}
+	if n > limit {
+		return fail(withErrorCode(ErrTooLarge, fmt.Errorf("model is larger than %d MB", maxMB)))
+	}
+	fileHash := convertedFileHash(hex.EncodeToString(hash.Sum(nil)), conv)
+
+	if scanner != nil {
+		result, err := scanner.Scan(ctx, inputPath)
+		if err != nil {
+			return fail(withErrorCode(ErrScanUnavailable, fmt.Errorf("failed to scan model: %w", err)))
+		}
+		if result.Infected {
+			if err := handleFlaggedUpload(inputPath, fmt.Sprintf("input-%s.stl", fileHash), config.Scanner); err != nil {
+				log.Printf("Failed to %s flagged download %s: %v", config.Scanner.Action, inputPath, err)
+			}
+			return fail(withErrorCode(ErrVirusDetected, fmt.Errorf("model flagged by scanner (%s)", result.Signature)))
+		}
+	}
+	if conv != nil {
+		if err := conv.convert(inputPath, stlPath); err != nil {
+			return fail(withErrorCode(ErrUnsupportedFormat, fmt.Errorf("failed to convert model: %w", err)))
+		}
+		os.Remove(inputPath)
+	}
+	return workDir, fileHash, nil
+}
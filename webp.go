@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+	"sort"
+)
+
+// Minimal lossless WebP (VP8L) encoder. It uses no transforms and a single
+// set of prefix codes, and codes runs of repeated pixels (or matches with the
+// row above) as backward references, which is what makes flat render
+// backgrounds cheap.
+
+const (
+	vp8lMaxRun         = 4096
+	vp8lMinRun         = 3
+	vp8lNumLengthCodes = 24
+	vp8lNumDistCodes   = 40
+	vp8lMaxCodeLength  = 15
+)
+
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// One token of the entropy-coded pixel stream: a literal pixel or a backward
+// reference (distance code + run length)
+type vp8lToken struct {
+	literal  color.NRGBA
+	isCopy   bool
+	distCode int // 1 = pixel above, 2 = pixel to the left
+	length   int
+}
+
+type vp8lBitWriter struct {
+	w     *bufio.Writer
+	acc   uint64
+	nbits uint
+}
+
+func (b *vp8lBitWriter) writeBits(value uint32, n uint) {
+	b.acc |= uint64(value) << b.nbits
+	b.nbits += n
+	for b.nbits >= 8 {
+		b.w.WriteByte(byte(b.acc))
+		b.acc >>= 8
+		b.nbits -= 8
+	}
+}
+
+func (b *vp8lBitWriter) flush() {
+	if b.nbits > 0 {
+		b.w.WriteByte(byte(b.acc))
+		b.acc, b.nbits = 0, 0
+	}
+}
+
+// Canonical prefix code for one alphabet
+type prefixCode struct {
+	lengths []int
+	codes   []uint32 // Bit-reversed, ready to be written LSB first
+	single  int      // Index of the only used symbol, or -1
+}
+
+func (c *prefixCode) write(b *vp8lBitWriter, symbol int) {
+	if c.single >= 0 {
+		return // Single-symbol codes take no bits
+	}
+	b.writeBits(c.codes[symbol], uint(c.lengths[symbol]))
+}
+
+// Build a length-limited Huffman code from symbol frequencies
+func newPrefixCode(freqs []int, maxLength int) *prefixCode {
+	code := &prefixCode{lengths: make([]int, len(freqs)), codes: make([]uint32, len(freqs)), single: -1}
+
+	var used []int
+	for s, f := range freqs {
+		if f > 0 {
+			used = append(used, s)
+		}
+	}
+	switch len(used) {
+	case 0:
+		code.single = 0
+		code.lengths[0] = 1
+		return code
+	case 1:
+		code.single = used[0]
+		code.lengths[used[0]] = 1
+		return code
+	}
+
+	// Flatten the distribution until the tree fits the length limit
+	counts := append([]int(nil), freqs...)
+	for {
+		lengths := huffmanLengths(counts)
+		max := 0
+		for _, l := range lengths {
+			if l > max {
+				max = l
+			}
+		}
+		if max <= maxLength {
+			code.lengths = lengths
+			break
+		}
+		for s := range counts {
+			if counts[s] > 0 {
+				counts[s] = (counts[s] + 1) / 2
+			}
+		}
+	}
+
+	// Assign canonical codes: shorter first, then by symbol
+	var blCount [vp8lMaxCodeLength + 2]int
+	for _, l := range code.lengths {
+		if l > 0 {
+			blCount[l]++
+		}
+	}
+	var next [vp8lMaxCodeLength + 2]uint32
+	var c uint32
+	for bits := 1; bits <= vp8lMaxCodeLength+1; bits++ {
+		c = (c + uint32(blCount[bits-1])) << 1
+		next[bits] = c
+	}
+	for s, l := range code.lengths {
+		if l == 0 {
+			continue
+		}
+		code.codes[s] = reverseBits(next[l], l)
+		next[l]++
+	}
+	return code
+}
+
+func reverseBits(v uint32, n int) uint32 {
+	var r uint32
+	for i := 0; i < n; i++ {
+		r = r<<1 | v&1
+		v >>= 1
+	}
+	return r
+}
+
+// Plain Huffman code lengths for the symbols with nonzero counts
+func huffmanLengths(counts []int) []int {
+	type node struct {
+		weight      int
+		symbol      int
+		left, right int
+	}
+	var nodes []node
+	var active []int
+	for s, c := range counts {
+		if c > 0 {
+			nodes = append(nodes, node{weight: c, symbol: s, left: -1, right: -1})
+			active = append(active, len(nodes)-1)
+		}
+	}
+	for len(active) > 1 {
+		sort.SliceStable(active, func(i, j int) bool { return nodes[active[i]].weight < nodes[active[j]].weight })
+		a, b := active[0], active[1]
+		nodes = append(nodes, node{weight: nodes[a].weight + nodes[b].weight, symbol: -1, left: a, right: b})
+		active = append(active[2:], len(nodes)-1)
+	}
+
+	lengths := make([]int, len(counts))
+	var walk func(i, depth int)
+	walk = func(i, depth int) {
+		if nodes[i].symbol >= 0 {
+			lengths[nodes[i].symbol] = depth
+			return
+		}
+		walk(nodes[i].left, depth+1)
+		walk(nodes[i].right, depth+1)
+	}
+	walk(active[0], 0)
+	return lengths
+}
+
+// Write a prefix code's lengths into the bitstream
+func writePrefixCode(b *vp8lBitWriter, code *prefixCode) {
+	// Codes with a single 8-bit symbol use the compact "simple" form
+	if code.single >= 0 && code.single < 256 {
+		b.writeBits(1, 1) // Simple code
+		b.writeBits(0, 1) // One symbol
+		b.writeBits(1, 1) // 8-bit symbol
+		b.writeBits(uint32(code.single), 8)
+		return
+	}
+
+	// Normal code: lengths are themselves coded with a code-length code
+	var freqs [19]int
+	for _, l := range code.lengths {
+		freqs[l]++
+	}
+	lengthCode := newPrefixCode(freqs[:], 7)
+
+	numCodes := 19
+	for numCodes > 4 && lengthCode.lengths[vp8lCodeLengthOrder[numCodes-1]] == 0 {
+		numCodes--
+	}
+
+	b.writeBits(0, 1) // Normal code
+	b.writeBits(uint32(numCodes-4), 4)
+	for i := 0; i < numCodes; i++ {
+		b.writeBits(uint32(lengthCode.lengths[vp8lCodeLengthOrder[i]]), 3)
+	}
+	b.writeBits(0, 1) // Code lengths for the whole alphabet follow
+	for _, l := range code.lengths {
+		lengthCode.write(b, l)
+	}
+}
+
+// Split a run length or distance into its prefix symbol and extra bits
+func vp8lPrefix(value int) (symbol int, extraBits uint, extra uint32) {
+	d := value - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	h := 0
+	for (d >> uint(h+1)) > 0 {
+		h++
+	}
+	second := (d >> uint(h-1)) & 1
+	extraBits = uint(h - 1)
+	return 2*h + second, extraBits, uint32(d & (1<<extraBits - 1))
+}
+
+// Turn the image into literals and backward references
+func vp8lTokens(pixels []color.NRGBA, width int) []vp8lToken {
+	var tokens []vp8lToken
+	for i := 0; i < len(pixels); {
+		// Longest match with the previous pixel or the pixel above
+		best, bestCode := 0, 0
+		for _, cand := range []struct{ dist, code int }{{1, 2}, {width, 1}} {
+			if i < cand.dist {
+				continue
+			}
+			n := 0
+			for i+n < len(pixels) && n < vp8lMaxRun && pixels[i+n] == pixels[i+n-cand.dist] {
+				n++
+			}
+			if n > best {
+				best, bestCode = n, cand.code
+			}
+		}
+		if best >= vp8lMinRun {
+			tokens = append(tokens, vp8lToken{isCopy: true, distCode: bestCode, length: best})
+			i += best
+			continue
+		}
+		tokens = append(tokens, vp8lToken{literal: pixels[i]})
+		i++
+	}
+	return tokens
+}
+
+// Encode an image as lossless WebP
+func encodeWebP(w io.Writer, im image.Image) error {
+	bounds := im.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	pixels := make([]color.NRGBA, 0, width*height)
+	hasAlpha := false
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(im.At(x, y)).(color.NRGBA)
+			if c.A != 255 {
+				hasAlpha = true
+			}
+			pixels = append(pixels, c)
+		}
+	}
+	tokens := vp8lTokens(pixels, width)
+
+	// Symbol statistics for the five prefix codes
+	green := make([]int, 256+vp8lNumLengthCodes)
+	red, blue, alpha := make([]int, 256), make([]int, 256), make([]int, 256)
+	dist := make([]int, vp8lNumDistCodes)
+	for _, t := range tokens {
+		if t.isCopy {
+			ls, _, _ := vp8lPrefix(t.length)
+			ds, _, _ := vp8lPrefix(t.distCode)
+			green[256+ls]++
+			dist[ds]++
+			continue
+		}
+		green[t.literal.G]++
+		red[t.literal.R]++
+		blue[t.literal.B]++
+		alpha[t.literal.A]++
+	}
+	codes := []*prefixCode{
+		newPrefixCode(green, vp8lMaxCodeLength),
+		newPrefixCode(red, vp8lMaxCodeLength),
+		newPrefixCode(blue, vp8lMaxCodeLength),
+		newPrefixCode(alpha, vp8lMaxCodeLength),
+		newPrefixCode(dist, vp8lMaxCodeLength),
+	}
+
+	// Build the VP8L bitstream in memory so the RIFF sizes are known
+	var payload bytes.Buffer
+	bw := &vp8lBitWriter{w: bufio.NewWriter(&payload)}
+	bw.writeBits(0x2f, 8) // Signature
+	bw.writeBits(uint32(width-1), 14)
+	bw.writeBits(uint32(height-1), 14)
+	if hasAlpha {
+		bw.writeBits(1, 1)
+	} else {
+		bw.writeBits(0, 1)
+	}
+	bw.writeBits(0, 3) // Version
+	bw.writeBits(0, 1) // No transforms
+	bw.writeBits(0, 1) // No color cache
+	bw.writeBits(0, 1) // No meta prefix codes
+	for _, code := range codes {
+		writePrefixCode(bw, code)
+	}
+	for _, t := range tokens {
+		if t.isCopy {
+			ls, lbits, lextra := vp8lPrefix(t.length)
+			codes[0].write(bw, 256+ls)
+			bw.writeBits(lextra, lbits)
+			ds, dbits, dextra := vp8lPrefix(t.distCode)
+			codes[4].write(bw, ds)
+			bw.writeBits(dextra, dbits)
+			continue
+		}
+		codes[0].write(bw, int(t.literal.G))
+		codes[1].write(bw, int(t.literal.R))
+		codes[2].write(bw, int(t.literal.B))
+		codes[3].write(bw, int(t.literal.A))
+	}
+	bw.flush()
+	if err := bw.w.Flush(); err != nil {
+		return err
+	}
+
+	chunk := payload.Bytes()
+	padded := len(chunk) + len(chunk)%2
+	header := make([]byte, 20)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+8+padded))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(chunk)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(chunk); err != nil {
+		return err
+	}
+	if padded != len(chunk) {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebPRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name          string
+		width, height int
+		pixel         func(x, y int) color.NRGBA
+	}{
+		{"single pixel", 1, 1, func(x, y int) color.NRGBA {
+			return color.NRGBA{10, 20, 30, 255}
+		}},
+		{"flat background with a square", 64, 48, func(x, y int) color.NRGBA {
+			if x >= 20 && x < 40 && y >= 10 && y < 30 {
+				return color.NRGBA{200, 40, 40, 255}
+			}
+			return color.NRGBA{255, 255, 255, 255}
+		}},
+		{"gradient", 37, 19, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x * 7), uint8(y * 13), uint8(x + y), 255}
+		}},
+		{"noise", 23, 17, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255}
+		}},
+		{"transparent background", 32, 32, func(x, y int) color.NRGBA {
+			if (x-16)*(x-16)+(y-16)*(y-16) < 100 {
+				return color.NRGBA{0, 128, 255, 200}
+			}
+			return color.NRGBA{}
+		}},
+		{"single row", 300, 1, func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(x / 50), 0, 0, 255}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := image.NewNRGBA(image.Rect(0, 0, tt.width, tt.height))
+			for y := 0; y < tt.height; y++ {
+				for x := 0; x < tt.width; x++ {
+					src.SetNRGBA(x, y, tt.pixel(x, y))
+				}
+			}
+			var buf bytes.Buffer
+			if err := encodeWebP(&buf, src); err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := webp.Decode(&buf)
+			if err != nil {
+				t.Fatalf("decoding the encoded image: %v", err)
+			}
+			if got := decoded.Bounds(); got != src.Bounds() {
+				t.Fatalf("decoded bounds %v, want %v", got, src.Bounds())
+			}
+			for y := 0; y < tt.height; y++ {
+				for x := 0; x < tt.width; x++ {
+					want := src.NRGBAAt(x, y)
+					got := color.NRGBAModel.Convert(decoded.At(x, y)).(color.NRGBA)
+					if want.A == 0 { // The color of fully transparent pixels doesn't matter
+						got, want = color.NRGBA{A: got.A}, color.NRGBA{}
+					}
+					if got != want {
+						t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, got, want)
+					}
+				}
+			}
+		})
+	}
+}
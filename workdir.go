@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+const (
+	WorkDirPrefix   = "render-job-"  // Name prefix of per-job scratch directories
+	StaleWorkDirAge = 24 * time.Hour // Leftover scratch directories older than this are removed on startup
+)
+
+// Create an isolated scratch directory for one job. Uploads are written,
+// scanned, and rendered there, and only finished files are moved out.
+func newJobWorkDir() (string, error) {
+	if config.WorkDir != "" {
+		if err := os.MkdirAll(config.WorkDir, 0700); err != nil {
+			return "", err
+		}
+	}
+	return os.MkdirTemp(config.WorkDir, WorkDirPrefix)
+}
+
+// Remove scratch directories left behind by a crash or restart
+func cleanStaleWorkDirs() {
+	base := config.WorkDir
+	if base == "" {
+		base = os.TempDir()
+	}
+	dirs, _ := filepath.Glob(filepath.Join(base, WorkDirPrefix+"*"))
+	for _, dir := range dirs {
+		info, err := os.Stat(dir)
+		if err != nil || !info.IsDir() || time.Since(info.ModTime()) < StaleWorkDirAge {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Failed to remove stale work dir %s: %v", dir, err)
+		}
+	}
+}
+
+// Move a file into place. Falls back to copy-then-rename when the work dir is
+// on another filesystem (e.g. tmpfs), so dst never appears half-written.
+func moveFile(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-"+filepath.Base(dst))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Remove(src)
+}
+
+// Move a job's results out of its scratch directory into storage: the
+// rendered outputs under output/ and the input under uploads/ (unless an
+// identical copy is already there). Returns the name of the primary output.
+func publishJobFiles(ctx context.Context, job Job) (string, error) {
+	for _, name := range job.Outputs {
+		if err := storage.Publish(ctx, filepath.Join(job.WorkDir, name), outputObject(name)); err != nil {
+			return "", err
+		}
+	}
+	if job.MeshFile != "" {
+		if err := storage.Publish(ctx, filepath.Join(job.WorkDir, job.MeshFile), outputObject(job.MeshFile)); err != nil {
+			return "", err
+		}
+	}
+
+	uploadName := uploadObject(job.FileHash)
+	exists, err := storage.Exists(ctx, uploadName)
+	if err == nil && !exists {
+		err = storage.Publish(ctx, job.STLPath, uploadName)
+	}
+	if err != nil {
+		log.Printf("Failed to store upload %s: %v", uploadName, err)
+	}
+	return outputObject(job.OutputPath), nil
+}
+
+// Name of a stored upload
+func uploadObject(fileHash string) string {
+	return "uploads/input-" + fileHash + ".stl"
+}
+
+// Download a job's upload from storage into a new work dir, for jobs queued
+// by another instance
+func fetchJobInput(ctx context.Context, job *Job) error {
+	workDir, err := fetchUpload(ctx, job.FileHash)
+	if err != nil {
+		return err
+	}
+	job.WorkDir, job.STLPath = workDir, filepath.Join(workDir, "input.stl")
+	return nil
+}
+
+// Copy a stored upload into a new work dir as input.stl. Returns the work dir.
+func fetchUpload(ctx context.Context, fileHash string) (string, error) {
+	src, err := storage.Open(ctx, uploadObject(fileHash))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	workDir, err := newJobWorkDir()
+	if err != nil {
+		return "", err
+	}
+	dst, err := os.Create(filepath.Join(workDir, "input.stl"))
+	if err == nil {
+		_, err = io.Copy(dst, src)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.RemoveAll(workDir)
+		return "", err
+	}
+	return workDir, nil
+}
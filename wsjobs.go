@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	MaxWSJobs             = 200             // Most jobs one multiplexed socket follows at once
+	QueuePositionInterval = 2 * time.Second // How often a multiplexed socket rechecks queue positions, which move as other jobs do
+)
+
+// Message a client sends on a multiplexed socket to follow more jobs
+type wsSubscription struct {
+	Subscribe []string `json:"subscribe"`
+}
+
+// A job followed by a multiplexed socket, with what the client was last told
+type followedJob struct {
+	message  string // Last status event sent
+	position int    // Last queue position sent; 0 when none was
+}
+
+// GET /ws/jobs
+//
+// One socket for the jobs of many uploads, e.g. every file of a batch. Send
+// {"subscribe": ["<job id>", …]} text frames, as many as needed; each job's
+// status events, including its current status, and a queue event whenever
+// its place in line changes come on this socket, told apart by job_id. A job
+// is dropped once it has finished; unknown jobs get a failed status event
+// with ERR_NOT_FOUND. Events come from one writer, so jobs finishing at once
+// never write to the socket concurrently.
+func jobsWSHandler(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWS(w, r)
+	if err != nil {
+		log.Println("WebSocket upgrade failed:", err)
+		return
+	}
+	defer conn.Close()
+
+	// Subscriptions are read here and picked up by the loop below
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var subscribedMu sync.Mutex
+	var subscribed []string
+	wake := make(chan struct{}, 1)
+	go func() {
+		defer cancel()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var sub wsSubscription
+			if err := json.Unmarshal(data, &sub); err != nil {
+				continue
+			}
+			subscribedMu.Lock()
+			subscribed = append(subscribed, sub.Subscribe...)
+			subscribedMu.Unlock()
+			select {
+			case wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	following := make(map[string]*followedJob)
+	version := wsVersion(conn)
+	send := func(message []byte) bool {
+		return conn.WriteMessage(websocket.TextMessage, message) == nil
+	}
+	for {
+		subscribedMu.Lock()
+		ids := subscribed
+		subscribed = nil
+		subscribedMu.Unlock()
+		for _, id := range ids {
+			if _, ok := following[id]; ok {
+				continue
+			}
+			if len(following) == MaxWSJobs {
+				event := wsEvent{Type: "status", JobID: id, Status: JobFailed, ErrorCode: ErrLimitReached, Message: "Too many jobs on one socket"}
+				if !send(encodeEvent(version, event)) {
+					return
+				}
+				continue
+			}
+			following[id] = &followedJob{}
+		}
+
+		var changes []<-chan struct{}
+		for id, f := range following {
+			job, changed, ok := getJob(id)
+			if !ok {
+				delete(following, id)
+				event := wsEvent{Type: "status", JobID: id, Status: JobFailed, ErrorCode: ErrNotFound, Message: "Job not found"}
+				if !send(encodeEvent(version, event)) {
+					return
+				}
+				continue
+			}
+			if position, _ := queuePosition(id); position != f.position {
+				f.position = position
+				if position > 0 && !send(encodeEvent(version, wsEvent{Type: "queue", JobID: id, Position: position})) {
+					return
+				}
+			}
+			if job.Message != "" && job.Message != f.message {
+				f.message = job.Message
+				if !send(reencodeEvent(version, job.Message)) {
+					return
+				}
+			}
+			if job.finished() {
+				delete(following, id)
+			} else {
+				changes = append(changes, changed)
+			}
+		}
+		if !waitForChange(ctx, append(changes, wake), QueuePositionInterval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"path/filepath"
+
+	"github.com/gorilla/websocket"
+)
+
+const ImagePushChunk = 64 << 10 // Bytes per binary WebSocket frame when pushing images
+
+// WebSockets that asked for the finished image to be pushed over the socket
+var imagePushConns = make(map[*websocket.Conn]bool)
+
+// Write a finished image to one WebSocket:
+//
+//	image_start event with the content type and size
+//	binary frames of up to ImagePushChunk bytes
+//	image_end event with the SHA-256 of the bytes
+func writeImagePush(ctx context.Context, conn *websocket.Conn, jobID, name string) error {
+	file, err := storage.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	start := wsEvent{Type: "image_start", JobID: jobID, ContentType: contentType, Size: len(data)}
+	if err := conn.WriteMessage(websocket.TextMessage, encodeEvent(wsVersion(conn), start)); err != nil {
+		return err
+	}
+	for start := 0; start < len(data); start += ImagePushChunk {
+		end := min(start+ImagePushChunk, len(data))
+		if err := conn.WriteMessage(websocket.BinaryMessage, data[start:end]); err != nil {
+			return err
+		}
+	}
+	sum := sha256.Sum256(data)
+	end := wsEvent{Type: "image_end", JobID: jobID, SHA256: hex.EncodeToString(sum[:])}
+	return conn.WriteMessage(websocket.TextMessage, encodeEvent(wsVersion(conn), end))
+}
+
+// Whether a job's primary output can be pushed as an image
+func pushableOutput(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".png" || ext == ".webp"
+}
+
+// Subscribers of a job that asked for its image. Callers hold mu.
+func imagePushSubscribers(jobID string) []*websocket.Conn {
+	var conns []*websocket.Conn
+	for _, conn := range jobConnections[jobID] {
+		if imagePushConns[conn] {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// Push a finished job's image to subscribers that asked for it. Called
+// before the completion message so clients have the bytes when it arrives.
+func pushJobImage(conns []*websocket.Conn, jobID, tenant, name string) {
+	for _, conn := range conns {
+		if err := writeImagePush(withTenant(context.Background(), tenant), conn, jobID, name); err != nil {
+			log.Printf("Failed to push image to job ID %s: %v\n", jobID, err)
+			conn.Close()
+			removeConnection(jobID, conn)
+		}
+	}
+}
+
+const PreviewSize = 256 // Width and height of live preview frames
+
+// WebSockets that asked for live preview frames
+var previewConns = make(map[*websocket.Conn]bool)
+
+// Push a low-resolution preview of one finished frame to every subscriber
+// that asked for previews: a preview event followed by the PNG as one binary
+// frame.
+func pushPreviewFrame(jobID string, frame, total int, im image.Image) {
+	// A sandboxed render hands its frames to the server process
+	if sandboxOutput != nil {
+		if data, ok := encodePreview(jobID, im); ok {
+			writeSandboxMessage(sandboxMessage{Preview: &sandboxPreview{Frame: frame, Total: total, PNG: data}})
+		}
+		return
+	}
+
+	recordPreviewEvent(jobID, frame, total)
+	// In stateless mode the subscribers may be connected to other instances
+	if store == nil && len(previewSubscribers(jobID)) == 0 {
+		return
+	}
+	if data, ok := encodePreview(jobID, im); ok {
+		deliverPreviewFrame(jobID, frame, total, data)
+	}
+}
+
+// Downsample and encode a preview frame
+func encodePreview(jobID string, im image.Image) ([]byte, bool) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, downsample(im, PreviewSize)); err != nil {
+		log.Printf("Failed to encode preview for job ID %s: %v\n", jobID, err)
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// Add a preview to the job's event history
+func recordPreviewEvent(jobID string, frame, total int) {
+	mu.Lock()
+	defer mu.Unlock()
+	if job, ok := jobs[jobID]; ok {
+		appendJobEvent(job, wsEvent{Type: "preview", JobID: jobID, ContentType: "image/png", Frame: frame, Total: total})
+	}
+}
+
+// Send an encoded preview frame to its subscribers, wherever they're connected
+func deliverPreviewFrame(jobID string, frame, total int, data []byte) {
+	if store != nil {
+		publishPreviewFrame(jobID, frame, total, data)
+		return
+	}
+	sendPreviewFrame(jobID, frame, total, data)
+}
+
+// WebSockets following a job that asked for previews
+func previewSubscribers(jobID string) []*websocket.Conn {
+	mu.Lock()
+	defer mu.Unlock()
+	var conns []*websocket.Conn
+	for _, conn := range jobConnections[jobID] {
+		if previewConns[conn] {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// Send an encoded preview frame to this instance's preview subscribers
+func sendPreviewFrame(jobID string, frame, total int, data []byte) {
+	for _, conn := range previewSubscribers(jobID) {
+		event := wsEvent{Type: "preview", JobID: jobID, ContentType: "image/png", Size: len(data), Frame: frame, Total: total}
+		err := conn.WriteMessage(websocket.TextMessage, encodeEvent(wsVersion(conn), event))
+		if err == nil {
+			err = conn.WriteMessage(websocket.BinaryMessage, data)
+		}
+		if err != nil {
+			log.Printf("Failed to send preview to job ID %s: %v\n", jobID, err)
+			conn.Close()
+			removeConnection(jobID, conn)
+		}
+	}
+}
+
+// Box-filter an image down so its longer side is at most size pixels
+func downsample(im image.Image, size int) image.Image {
+	bounds := im.Bounds()
+	factor := (max(bounds.Dx(), bounds.Dy()) + size - 1) / size
+	if factor <= 1 {
+		return im
+	}
+
+	w, h := bounds.Dx()/factor, bounds.Dy()/factor
+	out := image.NewNRGBA(image.Rect(0, 0, w, h))
+	n := uint32(factor * factor)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var r, g, b, a uint32
+			for dy := 0; dy < factor; dy++ {
+				for dx := 0; dx < factor; dx++ {
+					cr, cg, cb, ca := im.At(bounds.Min.X+x*factor+dx, bounds.Min.Y+y*factor+dy).RGBA()
+					r, g, b, a = r+cr, g+cg, b+cb, a+ca
+				}
+			}
+			out.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return out
+}